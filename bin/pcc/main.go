@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -11,6 +12,8 @@ import (
 	"net"
 	"os"
 	"path"
+	"path/filepath"
+	"time"
 
 	"github.com/filmil/private-code-comments/pkg"
 	"github.com/golang/glog"
@@ -33,6 +36,37 @@ func main() {
 		// The communication socket filename.
 		socketFile string
 		version    bool
+		// The default delete policy.
+		deletePolicy string
+		// The default author of new notes.
+		author string
+		// If set, export all notes to this file and exit.
+		exportFile string
+		// How long deleted notes are kept in the trash.
+		trashRetention time.Duration
+		// If set, list the trash and exit.
+		listTrash bool
+		// If set, restore this note from the trash and exit.
+		restoreID int64
+		// Where the notes are kept while serving.
+		storeKind string
+		// The file with the key of the encrypted contents.
+		keyFile string
+		// If set, rekey the database and exit.
+		rekey bool
+		// The file with the new key, for --rekey.
+		newKeyFile string
+		// The directory of the databases of the workspaces.
+		shardDir string
+		// If set, snapshots of the databases are made in this directory
+		// while serving.
+		backupDir string
+		// How often snapshots are made.
+		backupInterval time.Duration
+		// How many snapshots of each database are kept.
+		backupKeep int
+		// If set, restore the database from this snapshot and exit.
+		restoreSnapshot string
 	)
 
 	// Set up flags
@@ -42,6 +76,40 @@ func main() {
 		"socket-file", pkg.DefaultSocket,
 		"The socket to use for communication")
 	flag.BoolVar(&version, "version", false, "print version and exit")
+	flag.StringVar(&deletePolicy, "delete_policy", string(pkg.DefaultDeletePolicy),
+		"What happens to the notes on deleted lines, unless a workspace config says otherwise: merge, drop, next or orphan")
+	flag.StringVar(&author, "author", os.Getenv("USER"),
+		"The author recorded for new notes, unless a workspace config says otherwise")
+	flag.StringVar(&exportFile, "export", "",
+		"If set, export all notes as JSON to this file, or to stdout if \"-\", and exit")
+	flag.DurationVar(&trashRetention, "trash_retention", 30*24*time.Hour,
+		"How long deleted notes are kept in the trash before they are purged. 0 keeps them forever")
+	flag.BoolVar(&listTrash, "trash", false,
+		"If set, list the deleted notes in the trash as JSON to stdout, and exit")
+	flag.Int64Var(&restoreID, "restore", 0,
+		"If set, restore the deleted note with this ID from the trash, and exit")
+	flag.StringVar(&storeKind, "store", StoreSQLite,
+		"Where the notes are kept while serving: sqlite, in the --db database, sharded, in a database for each workspace, "+
+			"in --shard_dir or as the workspace config says, or memory, where they are lost on exit")
+	flag.StringVar(&shardDir, "shard_dir", "",
+		"The directory of the databases of the workspaces, for --store=sharded")
+	flag.StringVar(&backupDir, "backup_dir", "",
+		"If set, make snapshots of the databases in this directory while serving, at start and every --backup_interval")
+	flag.DurationVar(&backupInterval, "backup_interval", time.Hour,
+		"How often to make snapshots of the databases, for --backup_dir")
+	flag.IntVar(&backupKeep, "backup_keep", 24,
+		"How many of the newest snapshots of each database to keep in --backup_dir")
+	flag.StringVar(&restoreSnapshot, "restore_snapshot", "",
+		"If set, replace the --db database with this snapshot file, or with its newest snapshot in --backup_dir if `latest`, and exit. "+
+			"The database is first backed up to --backup_dir, or next to it")
+	flag.StringVar(&keyFile, "key_file", "",
+		"The file with the hex encoded key of the encrypted note contents. Else the key is in $"+pkg.KeyEnv+
+			", or derived from the passphrase in $"+pkg.PassphraseEnv+". Without a key, new contents are not encrypted")
+	flag.BoolVar(&rekey, "rekey", false,
+		"If set, encrypt the note contents with the new key, from --new_key_file, $"+NewKeyEnv+" or $"+NewPassphraseEnv+
+			", or decrypt them if there is no new key, and exit")
+	flag.StringVar(&newKeyFile, "new_key_file", "",
+		"The file with the new hex encoded key, for --rekey")
 	flag.Parse()
 
 	if version {
@@ -49,6 +117,24 @@ func main() {
 		os.Exit(0)
 	}
 
+	var opts pkg.ServerOpts
+	var err error
+	opts.DeletePolicy, err = pkg.ParseDeletePolicy(deletePolicy)
+	if err != nil {
+		glog.Fatalf("invalid --delete_policy: %v", err)
+	}
+	opts.Author = author
+	opts.TrashRetention = trashRetention
+	if storeKind != StoreSQLite && storeKind != StoreMemory && storeKind != StoreSharded {
+		glog.Fatalf("invalid --store: %q", storeKind)
+	}
+	if storeKind == StoreSharded && shardDir == "" {
+		glog.Fatalf("--store=%v needs a --shard_dir", StoreSharded)
+	}
+	if backupDir != "" && backupInterval <= 0 {
+		glog.Fatalf("invalid --backup_interval: %v", backupInterval)
+	}
+
 	// Allow net.Listen to create the comms socket - remove it if it exists.
 	if err := os.Remove(socketFile); err != nil {
 		if !errors.Is(err, fs.ErrNotExist) {
@@ -71,7 +157,7 @@ func main() {
 	}
 
 	// connect and schedule cleanup
-	db, err := sql.Open(pkg.SqliteDriver, dbFilename)
+	db, err := pkg.OpenDB(dbFilename)
 	if err != nil {
 		glog.Fatalf("could not open database: %v: %v", dbFilename, err)
 	}
@@ -81,20 +167,281 @@ func main() {
 		}
 	}()
 
+	ctx := context.Background()
+	if restoreSnapshot != "" {
+		if dbFilename == pkg.DefaultFilename {
+			glog.Fatalf("an in-memory database can not be restored")
+		}
+		// The snapshots of a workspace database are named as ShardedStore
+		// names them.
+		prefix := pkg.SnapshotPrefix(dbFilename)
+		if storeKind == StoreSharded {
+			prefix = pkg.ShardSnapshotPrefix(shardDir, dbFilename)
+		}
+		if err := Restore(ctx, db, dbFilename, !needsInit, restoreSnapshot, backupDir, prefix); err != nil {
+			glog.Fatalf("could not restore: %v", err)
+		}
+		return
+	}
 	// Create the data schema if it has not been created before.
 	glog.Infof("creating a new database: %s", dbFilename)
 	if needsInit {
-		if err := pkg.CreateDBSchema(db); err != nil {
+		if err := pkg.CreateDBSchema(ctx, db); err != nil {
 			glog.Fatalf("could not create: %v: %v", dbFilename, err)
 		}
 	}
+	// Bring the schema of an older database up to date.  In-memory
+	// databases are not backed up.
+	backup := dbFilename
+	if dbFilename == pkg.DefaultFilename {
+		backup = ""
+	}
+	if err := pkg.Migrate(ctx, db, backup); err != nil {
+		glog.Fatalf("could not migrate: %v: %v", dbFilename, err)
+	}
+	if n, err := pkg.CollectGarbage(ctx, db); err != nil {
+		glog.Errorf("could not collect garbage: %v: %v", dbFilename, err)
+	} else if n > 0 {
+		glog.Infof("collected %v unreachable annotation contents", n)
+	}
 
-	if err := Serve(socketFile, db); err != nil {
+	key, err := loadKey(keyFile, pkg.KeyEnv, pkg.PassphraseEnv, func() ([]byte, error) {
+		return pkg.GetSalt(ctx, db)
+	})
+	if err != nil {
+		glog.Fatalf("could not load the key: %v", err)
+	}
+	var newKey *pkg.Key
+	if rekey {
+		newKey, err = loadKey(newKeyFile, NewKeyEnv, NewPassphraseEnv, func() ([]byte, error) {
+			return pkg.NewSalt(), nil
+		})
+		if err != nil {
+			glog.Fatalf("could not load the new key: %v", err)
+		}
+	}
+	if key != nil {
+		if dbFilename == pkg.DefaultFilename {
+			glog.Fatalf("an in-memory database can not be encrypted")
+		}
+		db.Close()
+		if db, err = pkg.OpenEncryptedDB(dbFilename, key); err != nil {
+			glog.Fatalf("could not open database: %v: %v", dbFilename, err)
+		}
+	}
+	if err := pkg.CheckKey(ctx, db, key); err != nil {
+		glog.Fatalf("could not open database: %v: %v", dbFilename, err)
+	}
+	if rekey {
+		n, err := pkg.Rekey(ctx, db, newKey)
+		if err != nil {
+			glog.Fatalf("could not rekey: %v", err)
+		}
+		if newKey == nil {
+			fmt.Printf("decrypted %v contents\n", n)
+		} else {
+			fmt.Printf("encrypted %v contents with the new key\n", n)
+		}
+		return
+	}
+
+	if listTrash {
+		if err := ListTrash(ctx, db); err != nil {
+			glog.Fatalf("could not list the trash: %v", err)
+		}
+		return
+	}
+	if restoreID != 0 {
+		n, err := pkg.RestoreTrash(ctx, db, restoreID)
+		if err != nil {
+			glog.Fatalf("could not restore: %v", err)
+		}
+		fmt.Printf("restored note %v to %v%v, line %v\n", n.Id, n.Workspace, n.Path, n.Line+1)
+		return
+	}
+	if exportFile != "" {
+		if err := Export(ctx, db, exportFile); err != nil {
+			glog.Fatalf("could not export: %v", err)
+		}
+		return
+	}
+
+	var store pkg.Store = pkg.NewSQLStore(db)
+	switch storeKind {
+	case StoreMemory:
+		glog.Infof("keeping the notes in memory only")
+		store = pkg.NewMemStore()
+	case StoreSharded:
+		glog.Infof("keeping the notes of each workspace in a database of its own, in: %v", shardDir)
+		s := pkg.NewShardedStore(shardDir, key)
+		defer s.Close()
+		store = s
+	}
+	if backupDir != "" {
+		switch {
+		case storeKind == StoreMemory || (storeKind == StoreSQLite && dbFilename == pkg.DefaultFilename):
+			glog.Warningf("not backing up the notes, which are in memory only")
+		case storeKind == StoreSharded:
+			go BackupFn(ctx, backupInterval, func(minAge time.Duration) ([]pkg.Snapshot, error) {
+				return store.(*pkg.ShardedStore).Backup(ctx, backupDir, backupKeep, minAge)
+			})
+		default:
+			go BackupFn(ctx, backupInterval, func(minAge time.Duration) ([]pkg.Snapshot, error) {
+				s, err := pkg.BackupDB(ctx, db, backupDir, pkg.SnapshotPrefix(dbFilename), backupKeep, minAge)
+				if s.Filename == "" {
+					return nil, err
+				}
+				return []pkg.Snapshot{s}, err
+			})
+		}
+	}
+	if err := Serve(socketFile, store, opts); err != nil {
 		glog.Errorf("error while serving: %v", err)
 	}
 	glog.Infof("exiting program")
 }
 
+// The environment variables with the new key, for --rekey, see pkg.KeyEnv and
+// pkg.PassphraseEnv.
+const (
+	NewKeyEnv        = `PCC_NEW_KEY`
+	NewPassphraseEnv = `PCC_NEW_PASSPHRASE`
+)
+
+// loadKey returns the key in the file keyFile, or else the hex encoded key in
+// the environment variable keyEnv, or else the key derived from the
+// passphrase in the environment variable passphraseEnv, with the salt that
+// salt returns.  Returns nil if there is no key.
+func loadKey(keyFile, keyEnv, passphraseEnv string, salt func() ([]byte, error)) (*pkg.Key, error) {
+	if keyFile != "" {
+		return pkg.ReadKeyFile(keyFile)
+	}
+	if k := os.Getenv(keyEnv); k != "" {
+		key, err := pkg.ParseKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("$%v: %w", keyEnv, err)
+		}
+		return key, nil
+	}
+	if p := os.Getenv(passphraseEnv); p != "" {
+		s, err := salt()
+		if err != nil {
+			return nil, err
+		}
+		return pkg.KeyFromPassphrase(p, s)
+	}
+	return nil, nil
+}
+
+// BackupFn makes snapshots with backup at start, unless the newest snapshot is
+// more recent than interval, and then every interval, until ctx is done.
+func BackupFn(ctx context.Context, interval time.Duration, backup func(minAge time.Duration) ([]pkg.Snapshot, error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	minAge := interval
+	for {
+		snapshots, err := backup(minAge)
+		if err != nil {
+			glog.Errorf("could not back up: %v", err)
+		}
+		for _, s := range snapshots {
+			glog.Infof("backed up to: %v", s.Filename)
+		}
+		minAge = 0
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Restore replaces the database db, in the file dbFilename, with the snapshot
+// file snapshot, or with its newest snapshot in backupDir if snapshot is
+// "latest".  The snapshots of db are named after prefix.  The database is first backed up to backupDir, or to the
+// directory of dbFilename, if it exists.
+func Restore(ctx context.Context, db *sql.DB, dbFilename string, exists bool, snapshot, backupDir, prefix string) error {
+	if snapshot == "latest" {
+		if backupDir == "" {
+			return fmt.Errorf("restoring the latest snapshot needs a --backup_dir")
+		}
+		snapshots, err := pkg.ListSnapshots(backupDir, prefix)
+		if err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			return fmt.Errorf("no snapshots of: %v, in --backup_dir: %q", dbFilename, backupDir)
+		}
+		snapshot = snapshots[len(snapshots)-1].Filename
+	}
+	if exists {
+		dir := backupDir
+		if dir == "" {
+			dir = filepath.Dir(dbFilename)
+		}
+		s, err := pkg.MakeSnapshot(ctx, db, dir, prefix, time.Now())
+		if err != nil {
+			return fmt.Errorf("could not back up before restoring: %w", err)
+		}
+		fmt.Printf("backed up %v to %v\n", dbFilename, s.Filename)
+	}
+	if err := pkg.RestoreSnapshot(ctx, db, snapshot); err != nil {
+		return err
+	}
+	fmt.Printf("restored %v from %v\n", dbFilename, snapshot)
+	return nil
+}
+
+// The values of the --store flag.
+const (
+	StoreSQLite  = `sqlite`
+	StoreMemory  = `memory`
+	StoreSharded = `sharded`
+)
+
+// Export writes all notes in db as a JSON array to the file filename, or to
+// stdout if filename is "-".
+func Export(ctx context.Context, db *sql.DB, filename string) error {
+	notes, err := pkg.ListAnns(ctx, db, pkg.ListFilter{})
+	if err != nil {
+		return fmt.Errorf("could not list notes: %w", err)
+	}
+	out := []pkg.PccNote{}
+	for _, n := range notes {
+		out = append(out, pkg.NewPccNote(nil, n))
+	}
+	w := os.Stdout
+	if filename != "-" {
+		f, err := os.Create(filename)
+		if err != nil {
+			return fmt.Errorf("could not create: %v: %w", filename, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	if err := e.Encode(out); err != nil {
+		return fmt.Errorf("could not write: %v: %w", filename, err)
+	}
+	return nil
+}
+
+// ListTrash writes the notes in the trash of db as a JSON array to stdout.
+func ListTrash(ctx context.Context, db *sql.DB) error {
+	trash, err := pkg.ListTrash(ctx, db, "", "")
+	if err != nil {
+		return fmt.Errorf("could not list the trash: %w", err)
+	}
+	out := []pkg.PccTrashed{}
+	for _, t := range trash {
+		out = append(out, pkg.NewPccTrashed(nil, t))
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(out)
+}
+
 // StdioConn is a connection that uses stdin for input, and stdout for output.
 type StdioConn struct{}
 
@@ -115,18 +462,19 @@ func (*StdioConn) Write(p []byte) (n int, err error) {
 	return os.Stdout.Write(p)
 }
 
-// Serve serves LSP on socketName, using the database `db`.
+// Serve serves LSP on socketName, using the annotations in `store` and the
+// server settings `opts`.
 //
 // If socketName is the special constant `pkg.DefaultSocket`, then LSP is
 // served on a socket created by joining stdin/stdout, as LSP servers usually
 // do.
-func Serve(socketName string, db *sql.DB) error {
+func Serve(socketName string, store pkg.Store, opts pkg.ServerOpts) error {
 	glog.Infof("listening for a connection at: %v", socketName)
 
 	if socketName == pkg.DefaultSocket {
 		// Use a ReadWriteCloser from stdin and stdout.
 		stream := jsonrpc2.NewStream(&StdioConn{})
-		if err := ServeSingleConn(db, stream); err != nil {
+		if err := ServeSingleConn(store, stream, opts); err != nil {
 			glog.Infof("error while serving a signle request: %v", err)
 		}
 	} else {
@@ -143,7 +491,7 @@ func Serve(socketName string, db *sql.DB) error {
 
 			// Create a json connection
 			stream := jsonrpc2.NewStream(c)
-			if err := ServeSingleConn(db, stream); err != nil {
+			if err := ServeSingleConn(store, stream, opts); err != nil {
 				if !errors.Is(err, pkg.ExitError) {
 					glog.Infof("error: %v", err)
 				} else {
@@ -156,15 +504,15 @@ func Serve(socketName string, db *sql.DB) error {
 	return nil
 }
 
-// ServeSingleConn serves a single JSON-RPC2 connection on `stream`, using `db`
-// as the source of annotations.
+// ServeSingleConn serves a single JSON-RPC2 connection on `stream`, using
+// `store` as the source of annotations, and `opts` as the server settings.
 //
 // A special error `pkg.ExitError` means that an exit is requested.  `nil` means
 // no error, and the caller may try to repeat serving.
-func ServeSingleConn(db *sql.DB, stream jsonrpc2.Stream) error {
+func ServeSingleConn(store pkg.Store, stream jsonrpc2.Stream, opts pkg.ServerOpts) error {
 	jc := jsonrpc2.NewConn(stream)
 	ctx := context.Background()
-	s, err := pkg.NewServer(ctx, db, jc)
+	s, err := pkg.NewServer(ctx, store, jc, opts)
 	if err != nil {
 		return fmt.Errorf("could not create server: %w", err)
 	}
@@ -57,6 +57,12 @@ func BazelTmpDir(t *testing.T) string {
 //
 // The created Neovim is a hermetic instance.
 func NewNeovim(dbfile string, args ...string) (*nvim.Nvim, error) {
+	return NewNeovimWithEnv(dbfile, nil, args...)
+}
+
+// NewNeovimWithEnv is like NewNeovim, but adds env, a list of "NAME=value"
+// settings, to the environment of the Neovim child process.
+func NewNeovimWithEnv(dbfile string, env []string, args ...string) (*nvim.Nvim, error) {
 	outDir := NotEmpty(BazelTmpDir(nil))
 	i := getInstance()
 	pccLogDir, err := os.MkdirTemp(outDir, fmt.Sprintf("%03d-log.dir", i))
@@ -71,7 +77,7 @@ func NewNeovim(dbfile string, args ...string) (*nvim.Nvim, error) {
 		return nil, fmt.Errorf("could not create temp dir: %w", err)
 	}
 	return nvim.NewChildProcess(nvim.ChildProcessEnv(
-		[]string{
+		append([]string{
 			// Set up a hermetic environment, with local dirs.
 			"USERNAME=unknown",
 			"LOGNAME=unknown",
@@ -85,7 +91,7 @@ func NewNeovim(dbfile string, args ...string) (*nvim.Nvim, error) {
 				NotEmpty(*nvimLuaDir), NotEmpty(*pluginVimDir)),
 			fmt.Sprintf("VIMRUNTIME=%v", NotEmpty(*nvimShareDir)),
 			fmt.Sprintf("LD_PRELOAD_PATH=%v", NotEmpty(*nvimLibDir)),
-		}),
+		}, env...)),
 		// Use our own Neovim executable.
 		nvim.ChildProcessCommand(NotEmpty(*nvimBinary)),
 		// And pass some args in.
@@ -131,7 +137,7 @@ func WaitForAnns(ctx context.Context, db *sql.DB, ws lsp.URI, file string, anns
 
 	var i int
 	for {
-		actual, err := pkg.GetAnns(db, string(ws), file)
+		actual, err := pkg.GetAnns(ctx, db, string(ws), file)
 		if err != nil {
 			return fmt.Errorf("could not get anns: %w", err)
 		}
@@ -156,6 +162,19 @@ func InsertText(cl *nvim.Nvim, buf nvim.Buffer, line int, text string) error {
 	return cl.SetBufferText(buf, line, 0, line, 0, bytes)
 }
 
+// JoinLines joins the line `line` with the line below it, separating them with
+// a space, like the `J` command does.
+func JoinLines(cl *nvim.Nvim, buf nvim.Buffer, line int) error {
+	lines, err := GetAllLines(cl, buf)
+	if err != nil {
+		return fmt.Errorf("could not join: %w", err)
+	}
+	if line+1 >= len(lines) {
+		return fmt.Errorf("no line below line %v to join", line)
+	}
+	return cl.SetBufferText(buf, line, len(lines[line]), line+1, 0, [][]byte{[]byte(" ")})
+}
+
 func RemoveTextLines(cl *nvim.Nvim, buf nvim.Buffer, begin, count int) error {
 	ret := cl.SetBufferText(buf, begin, 0, begin+count, 0, [][]byte{{}})
 	return ret
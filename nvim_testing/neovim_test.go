@@ -5,6 +5,8 @@ import (
 	"flag"
 	"fmt"
 	"path"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,8 +18,9 @@ import (
 )
 
 var (
-	editFile = flag.String("edit-file", "", "")
-	ws       lsp.URI
+	editFile   = flag.String("edit-file", "", "")
+	policyFile = flag.String("policy-file", "", "")
+	ws         lsp.URI
 )
 
 func init() {
@@ -50,7 +53,7 @@ const testFilename = "/nvim_testing/content/textfile.txt"
 
 func dbName(t *testing.T) string {
 	t.Helper()
-	return fmt.Sprintf("%v.db.sqlite", t.Name())
+	return fmt.Sprintf("%v.db.sqlite", strings.ReplaceAll(t.Name(), "/", "_"))
 }
 
 func TestInsertLine(t *testing.T) {
@@ -63,7 +66,7 @@ func TestInsertLine(t *testing.T) {
 	db, closeFn := tc.Must3(RunDBQuery(dbFile, ``))
 	defer closeFn()
 
-	tc.Must1(pkg.InsertAnn(db, string(ws), testFilename, 10, "hello!"))
+	tc.Must1(pkg.InsertAnn(ctx, db, string(ws), testFilename, 10, "hello!"))
 	n := tc.Must(NewNeovim(dbFile))
 
 	c := tc.Must(GetLspAttachEvent(n, "*"))
@@ -76,7 +79,7 @@ func TestInsertLine(t *testing.T) {
 
 	// Not sure why this must be done. But if it isn't, then the write won't
 	// get seen by nvim.
-	tc.Must(pkg.GetAnns(db, string(ws), testFilename))
+	tc.Must(pkg.GetAnns(ctx, db, string(ws), testFilename))
 
 	tc.Must1(WaitForAnns(ctx, db, ws, testFilename, []pkg.Ann{
 		{Line: 10, Content: "hello!"},
@@ -101,7 +104,7 @@ func TestDeleteLine(t *testing.T) {
 	db, closeFn := tc.Must3(RunDBQuery(dbFile, ``))
 	defer closeFn()
 
-	tc.Must1(pkg.InsertAnn(db, string(ws), testFilename, 10, "hello!"))
+	tc.Must1(pkg.InsertAnn(ctx, db, string(ws), testFilename, 10, "hello!"))
 	n := tc.Must(NewNeovim(dbFile))
 
 	c := tc.Must(GetLspAttachEvent(n, "*"))
@@ -132,12 +135,13 @@ func TestDeleteLine(t *testing.T) {
 }
 
 func TestGetLine(t *testing.T) {
+	ctx := context.Background()
 	tmpDir := BazelTmpDir(t)
 	dbFile := path.Join(tmpDir, dbName(t))
 
 	db, closeFn := tc.Must3(RunDBQuery(dbFile, ``))
 	defer closeFn()
-	tc.Must1(pkg.InsertAnn(db, string(ws), testFilename, 10, "hello!"))
+	tc.Must1(pkg.InsertAnn(ctx, db, string(ws), testFilename, 10, "hello!"))
 	n := tc.Must(NewNeovim(dbFile))
 
 	e := tc.Must(GetLspAttachEvent(n, "*"))
@@ -165,7 +169,7 @@ func TestDeleteSingletonLine(t *testing.T) {
 	db, closeFn := tc.Must3(RunDBQuery(dbFile, ``))
 	defer closeFn()
 
-	tc.Must1(pkg.InsertAnn(db, string(ws), testFilename, 10, "hello!"))
+	tc.Must1(pkg.InsertAnn(ctx, db, string(ws), testFilename, 10, "hello!"))
 	n := tc.Must(NewNeovim(dbFile))
 
 	c := tc.Must(GetLspAttachEvent(n, "*"))
@@ -194,3 +198,130 @@ func TestDeleteSingletonLine(t *testing.T) {
 		t.Errorf("expected no note, but found: %q", note)
 	}
 }
+
+const policyFilename = "/nvim_testing/content/policy.txt"
+
+func TestDeletePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy pkg.DeletePolicy
+		// If set, joins line 1 and 2, else deletes line 1.
+		join     bool
+		expected []pkg.Ann
+		orphans  []pkg.Ann
+	}{
+		{
+			name:     "merge",
+			policy:   pkg.DeletePolicyMerge,
+			expected: []pkg.Ann{{Line: 1, Content: "b note\n--\nc note"}, {Line: 2, Content: "d note"}},
+		},
+		{
+			name:     "drop",
+			policy:   pkg.DeletePolicyDrop,
+			expected: []pkg.Ann{{Line: 1, Content: "c note"}, {Line: 2, Content: "d note"}},
+		},
+		{
+			name:     "next",
+			policy:   pkg.DeletePolicyNext,
+			expected: []pkg.Ann{{Line: 1, Content: "b note\n--\nc note"}, {Line: 2, Content: "d note"}},
+		},
+		{
+			name:     "next_join",
+			policy:   pkg.DeletePolicyNext,
+			join:     true,
+			expected: []pkg.Ann{{Line: 1, Content: "b note"}, {Line: 2, Content: "c note\n--\nd note"}},
+		},
+		{
+			name:     "orphan",
+			policy:   pkg.DeletePolicyOrphan,
+			expected: []pkg.Ann{{Line: 1, Content: "c note"}, {Line: 2, Content: "d note"}},
+			orphans:  []pkg.Ann{{Line: 1, Content: "b note"}},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+
+			tmpDir := BazelTmpDir(t)
+			dbFile := path.Join(tmpDir, dbName(t))
+
+			db, closeFn := tc.Must3(RunDBQuery(dbFile, ``))
+			defer closeFn()
+
+			tc.Must1(pkg.InsertAnn(ctx, db, string(ws), policyFilename, 1, "b note"))
+			tc.Must1(pkg.InsertAnn(ctx, db, string(ws), policyFilename, 2, "c note"))
+			tc.Must1(pkg.InsertAnn(ctx, db, string(ws), policyFilename, 3, "d note"))
+			n := tc.Must(NewNeovimWithEnv(dbFile, []string{
+				fmt.Sprintf("PCC_DELETE_POLICY=%v", test.policy),
+			}))
+			defer n.Command("quit")
+
+			c := tc.Must(GetLspAttachEvent(n, "*"))
+			tc.Must1(EditFile(n, NotEmpty(*policyFile)))
+			<-c
+
+			buf := tc.Must(n.CurrentBuffer())
+			tc.Must1(WaitForLine(ctx, n, buf, 0, "alpha"))
+
+			if test.join {
+				tc.Must1(JoinLines(n, buf, 1))
+				tc.Must1(WaitForLine(ctx, n, buf, 1, "bravo charlie"))
+			} else {
+				tc.Must1(RemoveTextLines(n, buf, 1, 1))
+				tc.Must1(WaitForLine(ctx, n, buf, 1, "charlie"))
+			}
+			LogAllLines(t, tc.Must(GetAllLines(n, buf)))
+
+			tc.Must1(WaitForAnns(ctx, db, ws, policyFilename, test.expected))
+			orphans := []pkg.Ann{}
+			for _, o := range tc.Must(pkg.GetOrphanedAnns(ctx, db, string(ws), policyFilename)) {
+				orphans = append(orphans, o.Ann)
+			}
+			if test.orphans == nil {
+				test.orphans = []pkg.Ann{}
+			}
+			if !reflect.DeepEqual(orphans, test.orphans) {
+				t.Errorf("orphans:\n\twant: %+v\n\tgot : %+v", test.orphans, orphans)
+			}
+		})
+	}
+}
+
+func TestUndoDeleteLine(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tmpDir := BazelTmpDir(t)
+	dbFile := path.Join(tmpDir, dbName(t))
+
+	db, closeFn := tc.Must3(RunDBQuery(dbFile, ``))
+	defer closeFn()
+
+	tc.Must1(pkg.InsertAnn(ctx, db, string(ws), policyFilename, 1, "b note"))
+	tc.Must1(pkg.InsertAnn(ctx, db, string(ws), policyFilename, 2, "c note"))
+	n := tc.Must(NewNeovim(dbFile))
+	defer n.Command("quit")
+
+	c := tc.Must(GetLspAttachEvent(n, "*"))
+	tc.Must1(EditFile(n, NotEmpty(*policyFile)))
+	<-c
+
+	buf := tc.Must(n.CurrentBuffer())
+	tc.Must1(WaitForLine(ctx, n, buf, 0, "alpha"))
+
+	tc.Must1(RemoveTextLines(n, buf, 1, 1))
+	tc.Must1(WaitForLine(ctx, n, buf, 1, "charlie"))
+	tc.Must1(WaitForAnns(ctx, db, ws, policyFilename, []pkg.Ann{
+		{Line: 1, Content: "b note\n--\nc note"},
+	}))
+
+	tc.Must1(n.Command("undo"))
+	tc.Must1(WaitForLine(ctx, n, buf, 1, "bravo"))
+	LogAllLines(t, tc.Must(GetAllLines(n, buf)))
+	tc.Must1(WaitForAnns(ctx, db, ws, policyFilename, []pkg.Ann{
+		{Line: 1, Content: "b note"},
+		{Line: 2, Content: "c note"},
+	}))
+}
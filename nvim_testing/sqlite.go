@@ -1,6 +1,7 @@
 package nvim_testing
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -17,11 +18,11 @@ func RunDBQuery(dbFilename, query string) (*sql.DB, func(), error) {
 		return nil, nil, fmt.Errorf("could not create db file: %v: %v", dbFilename, err)
 	}
 
-	db, err := sql.Open(pkg.SqliteDriver, dbFilename)
+	db, err := pkg.OpenDB(dbFilename)
 	if err != nil {
 		return nil, nil, fmt.Errorf("could not open database: %v: %v", dbFilename, err)
 	}
-	if err := pkg.CreateDBSchema(db); err != nil {
+	if err := pkg.CreateDBSchema(context.Background(), db); err != nil {
 		return nil, nil, fmt.Errorf("could not create: %v: %v", dbFilename, err)
 	}
 
@@ -0,0 +1,222 @@
+// Online backups of the databases
+package pkg
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// SnapshotExt is the extension of the snapshot files.
+	SnapshotExt = `.sqlite`
+	// snapshotTime is the layout of the time of a snapshot in its file name.
+	snapshotTime = `20060102T150405.000Z`
+)
+
+// Snapshot is a copy of a database, as it was at Time.
+type Snapshot struct {
+	Filename string
+	Time     time.Time
+}
+
+// SnapshotPrefix returns the prefix of the names of the snapshots of the
+// database file filename: its name without the extension.
+func SnapshotPrefix(filename string) string {
+	base := filepath.Base(filename)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// snapshotFilename returns the name of the snapshot of prefix made at t, in
+// the directory dir.
+func snapshotFilename(dir, prefix string, t time.Time) string {
+	return filepath.Join(dir, prefix+"-"+t.UTC().Format(snapshotTime)+SnapshotExt)
+}
+
+// MakeSnapshot writes a copy of db to a new snapshot file in the directory
+// dir, named after prefix and t.  The copy is consistent, and db stays in use
+// while it is made.  The snapshot file appears only once it is complete.
+func MakeSnapshot(ctx context.Context, db *sql.DB, dir, prefix string, t time.Time) (Snapshot, error) {
+	s := Snapshot{Filename: snapshotFilename(dir, prefix, t), Time: t.UTC().Truncate(time.Millisecond)}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return Snapshot{}, opError("MakeSnapshot", fmt.Errorf("could not make directory: %w", err))
+	}
+	tmp := s.Filename + ".tmp"
+	os.Remove(tmp)
+	if _, err := db.ExecContext(ctx, `VACUUM INTO ?;`, tmp); err != nil {
+		os.Remove(tmp)
+		return Snapshot{}, opError("MakeSnapshot", fmt.Errorf("could not copy to: %v: %w", tmp, err))
+	}
+	if err := os.Rename(tmp, s.Filename); err != nil {
+		os.Remove(tmp)
+		return Snapshot{}, opError("MakeSnapshot", fmt.Errorf("could not rename: %w", err))
+	}
+	return s, nil
+}
+
+// ListSnapshots returns the snapshots of prefix in the directory dir, oldest
+// first.
+func ListSnapshots(dir, prefix string) ([]Snapshot, error) {
+	names, err := filepath.Glob(filepath.Join(dir, prefix+"-*"+SnapshotExt))
+	if err != nil {
+		return nil, opError("ListSnapshots", err)
+	}
+	ret := []Snapshot{}
+	for _, name := range names {
+		ts := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), prefix+"-"), SnapshotExt)
+		// Skips the snapshots of longer prefixes.
+		t, err := time.Parse(snapshotTime, ts)
+		if err != nil {
+			continue
+		}
+		ret = append(ret, Snapshot{Filename: name, Time: t})
+	}
+	slices.SortFunc(ret, func(a, b Snapshot) int {
+		return cmp.Or(a.Time.Compare(b.Time), cmp.Compare(a.Filename, b.Filename))
+	})
+	return ret, nil
+}
+
+// RotateSnapshots deletes all but the keep newest snapshots of prefix in the
+// directory dir.  Returns the number of snapshots deleted.
+func RotateSnapshots(dir, prefix string, keep int) (int, error) {
+	snapshots, err := ListSnapshots(dir, prefix)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for len(snapshots) > max(keep, 0) {
+		// Another process may have deleted it first.
+		if err := os.Remove(snapshots[0].Filename); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return n, opError("RotateSnapshots", fmt.Errorf("could not delete: %w", err))
+		}
+		snapshots = snapshots[1:]
+		n++
+	}
+	return n, nil
+}
+
+// BackupDB makes a snapshot of db in the directory dir, unless the newest
+// snapshot of prefix is more recent than minAge, and then deletes all but the
+// keep newest snapshots.  Returns the new snapshot, or a zero Snapshot if
+// none was due.
+func BackupDB(ctx context.Context, db *sql.DB, dir, prefix string, keep int, minAge time.Duration) (Snapshot, error) {
+	snapshots, err := ListSnapshots(dir, prefix)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	now := time.Now()
+	if len(snapshots) > 0 && now.Sub(snapshots[len(snapshots)-1].Time) < minAge {
+		return Snapshot{}, nil
+	}
+	s, err := MakeSnapshot(ctx, db, dir, prefix, now)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if n, err := RotateSnapshots(dir, prefix, keep); err != nil {
+		glog.Warningf("BackupDB: %v", err)
+	} else if n > 0 {
+		glog.V(1).Infof("BackupDB: deleted %v old snapshots of: %v", n, prefix)
+	}
+	return s, nil
+}
+
+// checkSnapshot checks that the snapshot file filename is a whole database.
+func checkSnapshot(ctx context.Context, filename string) error {
+	if _, err := os.Stat(filename); err != nil {
+		return fmt.Errorf("could not find snapshot: %w", err)
+	}
+	db, err := sql.Open(SqliteDriver, "file:"+filename+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("could not open snapshot: %w", err)
+	}
+	defer db.Close()
+	var result string
+	if err := db.QueryRowContext(ctx, `PRAGMA integrity_check(1);`).Scan(&result); err != nil {
+		return fmt.Errorf("could not check snapshot: %v: %w", filename, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("snapshot is corrupt: %v: %v", filename, result)
+	}
+	var tables int
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'AnnotationLocations'
+	;`).Scan(&tables); err != nil {
+		return fmt.Errorf("could not check snapshot: %v: %w", filename, err)
+	}
+	if tables == 0 {
+		return fmt.Errorf("not a snapshot of annotations: %v", filename)
+	}
+	return nil
+}
+
+// RestoreSnapshot replaces all of db with the snapshot file filename, with
+// the SQLite backup API, so that the other connections to db see either the
+// old or the restored contents.  The schema of the snapshot is not upgraded:
+// call Migrate, as the server does when it next opens db.
+func RestoreSnapshot(ctx context.Context, db *sql.DB, filename string) error {
+	if err := checkSnapshot(ctx, filename); err != nil {
+		return opError("RestoreSnapshot", err)
+	}
+	src, err := sql.Open(SqliteDriver, "file:"+filename+"?mode=ro")
+	if err != nil {
+		return opError("RestoreSnapshot", fmt.Errorf("could not open snapshot: %w", err))
+	}
+	defer src.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return opError("RestoreSnapshot", fmt.Errorf("could not connect to snapshot: %w", err))
+	}
+	defer srcConn.Close()
+	dstConn, err := db.Conn(ctx)
+	if err != nil {
+		return opError("RestoreSnapshot", fmt.Errorf("could not connect: %w", err))
+	}
+	defer dstConn.Close()
+	err = dstConn.Raw(func(dst any) error {
+		return srcConn.Raw(func(src any) error {
+			return copyDB(ctx, dst.(*sqlite3.SQLiteConn), src.(*sqlite3.SQLiteConn))
+		})
+	})
+	if err != nil {
+		return opError("RestoreSnapshot", err)
+	}
+	return nil
+}
+
+// copyDB copies all of the database of src over that of dst.  The copy starts
+// over while dst is locked by other connections.
+func copyDB(ctx context.Context, dst, src *sqlite3.SQLiteConn) error {
+	b, err := dst.Backup("main", src, "main")
+	if err != nil {
+		return fmt.Errorf("could not start copy: %w", err)
+	}
+	defer b.Close()
+	delay := retryDelay
+	for {
+		done, err := b.Step(-1)
+		if err != nil {
+			return fmt.Errorf("could not copy: %w", err)
+		}
+		if done {
+			return b.Finish()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+			delay = min(2*delay, time.Second)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filmil/private-code-comments/tc"
+	lsp "go.lsp.dev/protocol"
+)
+
+func TestSnapshots(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 1, "first"))
+
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := range 4 {
+		tc.Must(MakeSnapshot(ctx, db, dir, "db", start.Add(time.Duration(i)*time.Hour)))
+	}
+	// Neither of these are snapshots of "db".
+	tc.Must(MakeSnapshot(ctx, db, dir, "db-old", start))
+	TMust1(t, os.WriteFile(filepath.Join(dir, "db-notes.sqlite"), nil, 0o644))
+
+	got := tc.Must(ListSnapshots(dir, "db"))
+	if len(got) != 4 || !got[0].Time.Equal(start) || filepath.Base(got[3].Filename) != "db-20260102T060405.000Z.sqlite" {
+		t.Fatalf("ListSnapshots: got: %+v", got)
+	}
+	if n := tc.Must(RotateSnapshots(dir, "db", 2)); n != 2 {
+		t.Errorf("RotateSnapshots: want 2 deleted, got: %v", n)
+	}
+	if got := tc.Must(ListSnapshots(dir, "db")); len(got) != 2 || !got[0].Time.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("want the 2 newest snapshots kept, got: %+v", got)
+	}
+	if got := tc.Must(ListSnapshots(dir, "db-old")); len(got) != 1 {
+		t.Errorf("want the snapshots of other prefixes kept, got: %+v", got)
+	}
+	if n := tc.Must(RotateSnapshots(dir, "none", 2)); n != 0 {
+		t.Errorf("RotateSnapshots without snapshots: got: %v", n)
+	}
+}
+
+func TestBackupDB(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+
+	s := tc.Must(BackupDB(ctx, db, dir, "db", 2, time.Hour))
+	if s.Filename == "" {
+		t.Fatalf("want a first snapshot")
+	}
+	if s := tc.Must(BackupDB(ctx, db, dir, "db", 2, time.Hour)); s.Filename != "" {
+		t.Errorf("want no snapshot within minAge, got: %+v", s)
+	}
+	for range 3 {
+		time.Sleep(2 * time.Millisecond)
+		tc.Must(BackupDB(ctx, db, dir, "db", 2, 0))
+	}
+	if got := tc.Must(ListSnapshots(dir, "db")); len(got) != 2 {
+		t.Errorf("want 2 snapshots kept, got: %+v", got)
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	ctx := context.Background()
+	dbFile := filepath.Join(dir, "db.sqlite")
+	TMust1(t, errOf(CreateDBFile(dbFile)))
+	db := tc.Must(OpenDB(dbFile))
+	defer db.Close()
+	TMust1(t, CreateSchema(ctx, db))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 1, "before"))
+	s := tc.Must(MakeSnapshot(ctx, db, dir, "db", time.Now()))
+
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 1, "after"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 2, "new"))
+	// Another connection sees the restored contents.
+	other := tc.Must(OpenDB(dbFile))
+	defer other.Close()
+	TMust1(t, errOf(GetAnn(ctx, other, "ws", "path", 1)))
+
+	TMust1(t, RestoreSnapshot(ctx, db, s.Filename))
+	if got := tc.Must(GetAnn(ctx, other, "ws", "path", 1)); got != "before" {
+		t.Errorf("GetAnn after restore: want: %q, got: %q", "before", got)
+	}
+	if got, err := GetAnn(ctx, db, "ws", "path", 2); err == nil && got != "" {
+		t.Errorf("want the later notes gone, got: %q", got)
+	}
+
+	// Files that are not snapshots are refused, and leave db as it was.
+	garbage := filepath.Join(dir, "garbage.sqlite")
+	TMust1(t, os.WriteFile(garbage, []byte("not a database"), 0o644))
+	empty := filepath.Join(dir, "empty.sqlite")
+	TMust1(t, errOf(CreateDBFile(empty)))
+	for _, f := range []string{garbage, empty, filepath.Join(dir, "missing.sqlite")} {
+		if err := RestoreSnapshot(ctx, db, f); err == nil {
+			t.Errorf("RestoreSnapshot(%v): want an error", f)
+		}
+	}
+	if got := tc.Must(GetAnn(ctx, db, "ws", "path", 1)); got != "before" {
+		t.Errorf("GetAnn after refused restores: got: %q", got)
+	}
+}
+
+func TestShardedStoreBackup(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dir, backups := t.TempDir(), t.TempDir()
+	s := NewShardedStore(dir, nil)
+	defer s.Close()
+	TMust1(t, s.InsertAnnBy(ctx, "ws", "path", 1, "in ws", "alice"))
+	TMust1(t, s.InsertAnnBy(ctx, "other", "path", 1, "in other", "bob"))
+
+	if got := tc.Must(s.Backup(ctx, backups, 2, 0)); len(got) != 2 {
+		t.Fatalf("Backup: want a snapshot of each database, got: %+v", got)
+	}
+	if got := tc.Must(s.Backup(ctx, backups, 2, time.Hour)); len(got) != 0 {
+		t.Errorf("Backup within minAge: want no snapshots, got: %+v", got)
+	}
+	got := tc.Must(ListSnapshots(backups, SnapshotPrefix(ShardFilename("ws"))))
+	if len(got) != 1 {
+		t.Fatalf("want a snapshot of ws, got: %+v", got)
+	}
+	snap := tc.Must(OpenDB(got[0].Filename))
+	defer snap.Close()
+	if got := tc.Must(GetAnn(ctx, snap, "ws", "path", 1)); got != "in ws" {
+		t.Errorf("GetAnn of the snapshot: got: %q", got)
+	}
+}
+
+func TestShardedStoreRestoreOutsideDir(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dir, project, backups := t.TempDir(), t.TempDir(), t.TempDir()
+	dbFile := filepath.Join(project, ".pcc/notes.sqlite")
+	s := NewShardedStore(dir, nil)
+	defer s.Close()
+	s.SetWorkspaces(
+		[]lsp.WorkspaceFolder{{URI: "file://" + project, Name: "project"}},
+		map[string]WorkspaceConfig{"project": {Database: ".pcc/notes.sqlite"}})
+	TMust1(t, s.InsertAnnBy(ctx, "project", "path", 1, "before", "alice"))
+	tc.Must(s.Backup(ctx, backups, 2, 0))
+	TMust1(t, s.InsertAnnBy(ctx, "project", "path", 1, "after", "alice"))
+	TMust1(t, s.Close())
+
+	// The snapshot is found by the name of the database file alone.
+	prefix := ShardSnapshotPrefix(dir, dbFile)
+	if prefix == SnapshotPrefix(dbFile) {
+		t.Errorf("want the snapshots named after the whole path, got: %q", prefix)
+	}
+	got := tc.Must(ListSnapshots(backups, prefix))
+	if len(got) != 1 {
+		t.Fatalf("want a snapshot of the project, got: %+v", got)
+	}
+	db := tc.Must(OpenDB(dbFile))
+	defer db.Close()
+	TMust1(t, RestoreSnapshot(ctx, db, got[0].Filename))
+	if got := tc.Must(GetAnn(ctx, db, "project", "path", 1)); got != "before" {
+		t.Errorf("GetAnn after restore: want: %q, got: %q", "before", got)
+	}
+}
@@ -0,0 +1,339 @@
+// Encryption of the annotation contents
+package pkg
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// KeySize is the size of the keys in bytes, for AES-256.
+	KeySize = 32
+	// SaltSize is the size of the salt of the keys derived from passphrases.
+	SaltSize = 16
+	// PassphraseIterations is the number of PBKDF2 iterations that derive
+	// a key from a passphrase.
+	PassphraseIterations = 600_000
+
+	// KeyEnv is the environment variable with the hex encoded key.
+	KeyEnv = `PCC_KEY`
+	// PassphraseEnv is the environment variable with the passphrase that
+	// the key is derived from.
+	PassphraseEnv = `PCC_PASSPHRASE`
+
+	// keyCheckSetting is the setting with a known text, encrypted with the
+	// key of the database.  The database is encrypted if it is there.
+	keyCheckSetting = `KeyCheck`
+	keyCheckText    = `private code comments`
+	// saltSetting is the setting with the salt of the key, if the key is
+	// derived from a passphrase.
+	saltSetting = `Salt`
+)
+
+// contentColumn selects the plaintext of the annotation content.
+const contentColumn = `pcc_decrypt(Annotations.Content)`
+
+// Key encrypts and decrypts the annotation contents with AES-GCM.
+//
+// The encrypted contents are kept as BLOBs, and plaintext contents as TEXT,
+// so that a database can be rekeyed, or read, while only some of its contents
+// are encrypted.  Only the contents, with all their revisions, are encrypted:
+// the locations, times, authors, kinds, tags and links stay in plaintext.
+type Key struct {
+	aead cipher.AEAD
+	// salt is the salt that the key was derived with, if it is derived
+	// from a passphrase.
+	salt []byte
+}
+
+// NewKey returns the key with the KeySize bytes raw.
+func NewKey(raw []byte) (*Key, error) {
+	if len(raw) != KeySize {
+		return nil, fmt.Errorf("want a key of %v bytes, got: %v", KeySize, len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not make cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("could not make GCM: %w", err)
+	}
+	return &Key{aead: aead}, nil
+}
+
+// ParseKey returns the key that s encodes in hex, such as the output of
+// `openssl rand -hex 32`.
+func ParseKey(s string) (*Key, error) {
+	raw, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode key: %w", err)
+	}
+	return NewKey(raw)
+}
+
+// ReadKeyFile returns the key in the file filename, hex encoded.
+func ReadKeyFile(filename string) (*Key, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read key: %w", err)
+	}
+	k, err := ParseKey(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+	return k, nil
+}
+
+// NewSalt returns a new random salt for KeyFromPassphrase.
+func NewSalt() []byte {
+	salt := make([]byte, SaltSize)
+	rand.Read(salt)
+	return salt
+}
+
+// KeyFromPassphrase derives a key from passphrase and salt with PBKDF2.  The
+// salt of an encrypted database is given by GetSalt.
+func KeyFromPassphrase(passphrase string, salt []byte) (*Key, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	raw, err := pbkdf2.Key(sha256.New, passphrase, salt, PassphraseIterations, KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("could not derive key: %w", err)
+	}
+	k, err := NewKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	k.salt = salt
+	return k, nil
+}
+
+// Encrypt returns text encrypted with k, preceded by its nonce.
+func (k *Key) Encrypt(text string) []byte {
+	nonce := make([]byte, k.aead.NonceSize(), k.aead.NonceSize()+len(text)+k.aead.Overhead())
+	rand.Read(nonce)
+	return k.aead.Seal(nonce, nonce, []byte(text), nil)
+}
+
+// Decrypt returns the text that Encrypt encrypted to b.
+func (k *Key) Decrypt(b []byte) (string, error) {
+	n := k.aead.NonceSize()
+	if len(b) < n {
+		return "", fmt.Errorf("%w: encrypted content is too short", ErrKey)
+	}
+	text, err := k.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return "", fmt.Errorf("%w: could not decrypt: %v", ErrKey, err)
+	}
+	return string(text), nil
+}
+
+// decrypt is the SQL function pcc_decrypt, see contentColumn.  The plaintext
+// contents, and NULL, are returned unchanged.
+func (k *Key) decrypt(v any) (any, error) {
+	b, ok := v.([]byte)
+	if !ok || b == nil {
+		return v, nil
+	}
+	if k == nil {
+		return nil, fmt.Errorf("%w: the content is encrypted", ErrKey)
+	}
+	return k.Decrypt(b)
+}
+
+// encrypt is the SQL function pcc_encrypt, which encrypts the new contents.
+// The contents are kept in plaintext if k is nil.
+func (k *Key) encrypt(text string) any {
+	if k == nil {
+		return text
+	}
+	return k.Encrypt(text)
+}
+
+// registerFuncs registers the SQL functions that encrypt and decrypt the
+// contents with key, or nil, on the new connection conn.
+func registerFuncs(conn *sqlite3.SQLiteConn, key *Key) error {
+	if err := conn.RegisterFunc("pcc_decrypt", key.decrypt, true); err != nil {
+		return fmt.Errorf("could not register pcc_decrypt: %w", err)
+	}
+	if err := conn.RegisterFunc("pcc_encrypt", key.encrypt, false); err != nil {
+		return fmt.Errorf("could not register pcc_encrypt: %w", err)
+	}
+	return nil
+}
+
+// connector opens the connections of a database, with the SQL functions that
+// encrypt and decrypt its contents.
+type connector struct {
+	dsn    string
+	driver *sqlite3.SQLiteDriver
+}
+
+var _ driver.Connector = (*connector)(nil)
+
+func newConnector(dsn string, key *Key) *connector {
+	return &connector{
+		dsn: dsn,
+		driver: &sqlite3.SQLiteDriver{
+			ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+				return registerFuncs(conn, key)
+			},
+		},
+	}
+}
+
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *connector) Driver() driver.Driver {
+	return c.driver
+}
+
+// getSetting returns the value of the setting name, or nil if it is not set.
+func getSetting(ctx context.Context, db querier, name string) ([]byte, error) {
+	var v []byte
+	err := db.QueryRowContext(ctx, `SELECT Value FROM Settings WHERE Name = ?;`, name).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not get setting: %v: %w", name, err)
+	}
+	return v, nil
+}
+
+// txSetSetting sets the setting name to value, or deletes it if value is nil.
+func txSetSetting(ctx context.Context, tx *sql.Tx, name string, value []byte) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM Settings WHERE Name = ?;`, name); err != nil {
+		return fmt.Errorf("could not delete setting: %v: %w", name, err)
+	}
+	if value == nil {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO Settings(Name, Value) VALUES (?, ?);`, name, value); err != nil {
+		return fmt.Errorf("could not set setting: %v: %w", name, err)
+	}
+	return nil
+}
+
+// IsEncrypted returns true if the contents of db are encrypted.
+func IsEncrypted(ctx context.Context, db querier) (bool, error) {
+	check, err := getSetting(ctx, db, keyCheckSetting)
+	if err != nil {
+		return false, opError("IsEncrypted", err)
+	}
+	return check != nil, nil
+}
+
+// GetSalt returns the salt of the key of db, if the key is derived from a
+// passphrase, see KeyFromPassphrase.
+func GetSalt(ctx context.Context, db *sql.DB) ([]byte, error) {
+	salt, err := getSetting(ctx, db, saltSetting)
+	if err != nil {
+		return nil, opError("GetSalt", err)
+	}
+	if salt == nil {
+		return nil, opError("GetSalt", fmt.Errorf("%w: the database is not encrypted with a passphrase", ErrKey))
+	}
+	return salt, nil
+}
+
+// CheckKey checks that key, or nil, is the key of the contents of db.
+func CheckKey(ctx context.Context, db *sql.DB, key *Key) error {
+	check, err := getSetting(ctx, db, keyCheckSetting)
+	if err != nil {
+		return opError("CheckKey", err)
+	}
+	switch {
+	case check == nil && key == nil:
+		return nil
+	case check == nil:
+		return opError("CheckKey", fmt.Errorf("%w: the database is not encrypted, rekey it first", ErrKey))
+	case key == nil:
+		return opError("CheckKey", fmt.Errorf("%w: the database is encrypted, a key is needed", ErrKey))
+	}
+	if text, err := key.Decrypt(check); err != nil || text != keyCheckText {
+		return opError("CheckKey", fmt.Errorf("%w: wrong key", ErrKey))
+	}
+	return nil
+}
+
+// Rekey encrypts all the contents of db with key, or decrypts them if key is
+// nil, in a single transaction.  db must be opened with the current key, and
+// must be opened again with the new one.  Returns the number of contents.
+//
+// The full text index is dropped when the contents are encrypted, and made
+// again when they are decrypted, see EnsureSearchIndex.  The file of db is
+// then rewritten, so that the previous contents are not left in its free
+// space, nor in its write-ahead log.  The copies of db made before, such as
+// the backups of Migrate and the snapshots of BackupDB, are not changed.
+func Rekey(ctx context.Context, db *sql.DB, key *Key) (int64, error) {
+	var n int64
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		// Overwrites the previous contents, instead of only freeing them.
+		if _, err := tx.ExecContext(ctx, `PRAGMA secure_delete = ON;`); err != nil {
+			return fmt.Errorf("could not set secure_delete: %w", err)
+		}
+		if key != nil {
+			if err := txDropSearchIndex(ctx, tx); err != nil {
+				return err
+			}
+		}
+		err := forEachContent(ctx, tx, func(ctx context.Context, tx *sql.Tx, id int64, text string) error {
+			if _, err := tx.ExecContext(ctx, `UPDATE Annotations SET Content = ? WHERE Id = ?;`,
+				key.encrypt(text), id); err != nil {
+				return fmt.Errorf("could not update: id=%v: %w", id, err)
+			}
+			n++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		var check, salt []byte
+		if key != nil {
+			check, salt = key.Encrypt(keyCheckText), key.salt
+		}
+		if err := txSetSetting(ctx, tx, keyCheckSetting, check); err != nil {
+			return err
+		}
+		if err := txSetSetting(ctx, tx, saltSetting, salt); err != nil {
+			return err
+		}
+		return txEnsureSearchIndex(ctx, tx)
+	})
+	if err != nil {
+		return 0, opError("Rekey", err)
+	}
+	if err := scrub(ctx, db); err != nil {
+		return 0, opError("Rekey", err)
+	}
+	return n, nil
+}
+
+// scrub rewrites the file of db with VACUUM, which leaves out its free pages,
+// and then empties its write-ahead log.
+func scrub(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `VACUUM;`); err != nil {
+		return fmt.Errorf("could not vacuum: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE);`); err != nil {
+		return fmt.Errorf("could not checkpoint: %w", err)
+	}
+	return nil
+}
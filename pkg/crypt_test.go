@@ -0,0 +1,189 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/filmil/private-code-comments/tc"
+)
+
+// newTestKey returns a new random key.
+func newTestKey() *Key {
+	raw := make([]byte, KeySize)
+	rand.Read(raw)
+	return tc.Must(NewKey(raw))
+}
+
+func TestKey(t *testing.T) {
+	t.Parallel()
+	key := newTestKey()
+	for _, text := range []string{"", "a secret", strings.Repeat("long ", 1000)} {
+		b := key.Encrypt(text)
+		if bytes.Contains(b, []byte(text)) && text != "" {
+			t.Errorf("Encrypt(%.10q): the text is in plaintext", text)
+		}
+		if got := tc.Must(key.Decrypt(b)); got != text {
+			t.Errorf("Decrypt: want: %.10q, got: %.10q", text, got)
+		}
+		if _, err := newTestKey().Decrypt(b); !errors.Is(err, ErrKey) {
+			t.Errorf("Decrypt with another key: want an ErrKey, got: %v", err)
+		}
+	}
+	if bytes.Equal(key.Encrypt("same"), key.Encrypt("same")) {
+		t.Errorf("want a new nonce for each encryption")
+	}
+	for _, s := range []string{"", "xyz", "00112233"} {
+		if _, err := ParseKey(s); err == nil {
+			t.Errorf("ParseKey(%q): want an error", s)
+		}
+	}
+	if _, err := ParseKey(strings.Repeat("ab", KeySize) + "\n"); err != nil {
+		t.Errorf("ParseKey: %v", err)
+	}
+
+	salt := NewSalt()
+	b := tc.Must(KeyFromPassphrase("passphrase", salt)).Encrypt("text")
+	if got, err := tc.Must(KeyFromPassphrase("passphrase", salt)).Decrypt(b); err != nil || got != "text" {
+		t.Errorf("want the same key from the same passphrase and salt, got: %q, %v", got, err)
+	}
+	if _, err := tc.Must(KeyFromPassphrase("passphrase", NewSalt())).Decrypt(b); err == nil {
+		t.Errorf("want another key from another salt")
+	}
+}
+
+func TestEncryptedDB(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbFile := filepath.Join(t.TempDir(), "db.sqlite")
+	db := tc.Must(OpenDB(dbFile))
+	TMust1(t, CreateSchema(ctx, db))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 1, "a secret #nda"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 1, "a secret, edited #nda"))
+
+	key := newTestKey()
+	if err := CheckKey(ctx, db, key); !errors.Is(err, ErrKey) {
+		t.Errorf("CheckKey of a plaintext database: want an ErrKey, got: %v", err)
+	}
+	if n := tc.Must(Rekey(ctx, db, key)); n != 2 {
+		t.Errorf("Rekey: want 2 contents, got: %v", n)
+	}
+	if err := CheckKey(ctx, db, nil); !errors.Is(err, ErrKey) {
+		t.Errorf("CheckKey without a key: want an ErrKey, got: %v", err)
+	}
+	TMust1(t, db.Close())
+
+	db = tc.Must(OpenEncryptedDB(dbFile, key))
+	defer db.Close()
+	TMust1(t, CheckKey(ctx, db, key))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 2, "another secret"))
+	var plain int
+	TMust1(t, db.QueryRow(`
+		SELECT COUNT(*) FROM Annotations WHERE typeof(Content) != 'blob' OR instr(Content, 'secret') > 0
+	;`).Scan(&plain))
+	if plain != 0 {
+		t.Errorf("want all contents encrypted, got %v in plaintext", plain)
+	}
+	if got := tc.Must(GetAnn(ctx, db, "ws", "path", 1)); got != "a secret, edited #nda" {
+		t.Errorf("GetAnn: got: %q", got)
+	}
+	if got := tc.Must(GetHistory(ctx, db, "ws", "path", 1)); len(got) != 2 || got[0].Content != "a secret #nda" {
+		t.Errorf("GetHistory: got: %+v", got)
+	}
+	if got := tc.Must(Search(ctx, db, "", "secret", 0)); len(got) != 2 {
+		t.Errorf("Search: want 2 results, got: %+v", got)
+	}
+	if got := tc.Must(ListAnns(ctx, db, ListFilter{Tag: "nda"})); len(got) != 1 {
+		t.Errorf("ListAnns by tag: want 1 note, got: %+v", got)
+	}
+
+	// Another key can neither check nor read the contents.
+	wrong := tc.Must(OpenEncryptedDB(dbFile, newTestKey()))
+	defer wrong.Close()
+	if err := CheckKey(ctx, wrong, newTestKey()); !errors.Is(err, ErrKey) {
+		t.Errorf("CheckKey with the wrong key: want an ErrKey, got: %v", err)
+	}
+	if _, err := GetAnn(ctx, wrong, "ws", "path", 1); err == nil {
+		t.Errorf("GetAnn with the wrong key: want an error")
+	}
+
+	// Rekeyed to a passphrase, and back to plaintext.
+	salt := NewSalt()
+	TMust1(t, errOf(Rekey(ctx, db, tc.Must(KeyFromPassphrase("passphrase", salt)))))
+	if got := tc.Must(GetSalt(ctx, db)); !bytes.Equal(got, salt) {
+		t.Errorf("GetSalt: want: %x, got: %x", salt, got)
+	}
+	pdb := tc.Must(OpenEncryptedDB(dbFile, tc.Must(KeyFromPassphrase("passphrase", salt))))
+	defer pdb.Close()
+	TMust1(t, CheckKey(ctx, pdb, tc.Must(KeyFromPassphrase("passphrase", salt))))
+	TMust1(t, errOf(Rekey(ctx, pdb, nil)))
+	if tc.Must(IsEncrypted(ctx, pdb)) {
+		t.Errorf("want a plaintext database")
+	}
+	if _, err := GetSalt(ctx, pdb); !errors.Is(err, ErrKey) {
+		t.Errorf("GetSalt of a plaintext database: want an ErrKey, got: %v", err)
+	}
+	if got := tc.Must(GetAnn(ctx, pdb, "ws", "path", 2)); got != "another secret" {
+		t.Errorf("GetAnn after decrypting: got: %q", got)
+	}
+}
+
+func TestRekeyLeavesNoPlaintext(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dbFile := filepath.Join(t.TempDir(), "db.sqlite")
+	db := tc.Must(OpenDB(dbFile))
+	TMust1(t, CreateSchema(ctx, db))
+	for i := range 50 {
+		TMust1(t, InsertAnn(ctx, db, "ws", "path", uint32(i), fmt.Sprintf("note %d of the xyzzy project", i)))
+	}
+	// fileHas returns true if the files of the database have text.
+	fileHas := func(text string) bool {
+		var ret bool
+		for _, name := range []string{dbFile, dbFile + "-wal"} {
+			b, err := os.ReadFile(name)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("could not read: %v", err)
+			}
+			ret = ret || bytes.Contains(b, []byte(text))
+		}
+		return ret
+	}
+	tc.Must(db.Exec(`PRAGMA wal_checkpoint(TRUNCATE);`))
+	if !fileHas("xyzzy") {
+		t.Fatalf("want the contents in the file before Rekey")
+	}
+
+	key := newTestKey()
+	TMust1(t, errOf(Rekey(ctx, db, key)))
+	TMust1(t, db.Close())
+	db = tc.Must(OpenEncryptedDB(dbFile, key))
+	defer db.Close()
+	TMust1(t, Migrate(ctx, db, ""))
+	tc.Must(db.Exec(`PRAGMA wal_checkpoint(TRUNCATE);`))
+	if fileHas("xyzzy") {
+		t.Errorf("want no plaintext contents in the file after Rekey")
+	}
+	if tc.Must(hasSearchIndex(ctx, db)) {
+		t.Errorf("want no full text index of the encrypted contents")
+	}
+	if got := tc.Must(Search(ctx, db, "", "xyzzy", 100)); len(got) != 50 {
+		t.Errorf("Search: want 50 results, got: %v", len(got))
+	}
+
+	// Decrypting makes the index again, if SQLite has FTS5.
+	TMust1(t, errOf(Rekey(ctx, db, nil)))
+	if got, want := tc.Must(hasSearchIndex(ctx, db)), tc.Must(HasFTS5(ctx, db)); got != want {
+		t.Errorf("full text index after decrypting: want: %v, got: %v", want, got)
+	}
+	if got := tc.Must(Search(ctx, db, "", "xyzzy", 100)); len(got) != 50 {
+		t.Errorf("Search after decrypting: want 50 results, got: %v", len(got))
+	}
+}
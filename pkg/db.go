@@ -9,6 +9,7 @@ import (
 	"io/fs"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -26,31 +27,6 @@ const (
 const (
 	// SqliteDriver is the name of the used SQL driver module.
 	SqliteDriver = `sqlite3`
-
-	// This is how to delete annotations.
-	deleteDeltaStatementStr = `
-		BEGIN TRANSACTION;
-
-		DELETE FROM TABLE	AnnotationLocations
-		WHERE				File = ? AND
-							Line >= ? AND Line <= ?
-		;
-
-		UPDATE TABLE		AnnotationLocations
-		SET					Line = Line + ?
-		WHERE				File = ? AND Line > ?
-		;
-
-		COMMIT;`
-
-	InsertDeltaStatementStr = `
-		BEGIN TRANSACTION;
-
-		UPDATE TABLE	AnnotationLocations
-		SET				Line = Line + ?
-		WHERE			File = ? AND Line > ?
-
-		COMMIT;`
 )
 
 // CreateDBFile creates an empty database file at the given name.
@@ -83,27 +59,97 @@ func CreateDBFile(dbFilename string) (bool, error) {
 	return needsInit, nil
 }
 
+const (
+	// ForeignKeys is the connection parameter that enables foreign key
+	// constraints.
+	ForeignKeys = `_foreign_keys=1`
+	// WAL is the connection parameter that puts the database in write-ahead
+	// logging mode, so that readers and a writer, possibly of other
+	// processes, do not block each other.  In-memory databases ignore it.
+	WAL = `_journal_mode=WAL`
+	// BusyTimeout is the connection parameter that makes a connection wait
+	// for up to 5 seconds for a lock held by another connection, before it
+	// fails with SQLITE_BUSY.
+	BusyTimeout = `_busy_timeout=5000`
+	// ImmediateTx is the connection parameter that makes transactions take
+	// the write lock when they start.  A transaction that reads and then
+	// writes could otherwise fail with SQLITE_BUSY without waiting, if
+	// another connection wrote in between.
+	ImmediateTx = `_txlock=immediate`
+)
+
+// OpenDB opens the database dbFilename, with foreign key constraints enabled,
+// in WAL mode, and waiting for the locks of other connections, so that several
+// processes can share the database file.  Use it instead of sql.Open, since
+// these settings are off by default, on each connection.  New contents are
+// kept in plaintext, see OpenEncryptedDB.
+func OpenDB(dbFilename string) (*sql.DB, error) {
+	return OpenEncryptedDB(dbFilename, nil)
+}
+
+// OpenEncryptedDB is OpenDB, for a database with its contents encrypted with
+// key, or in plaintext if key is nil.  Use CheckKey to check that key is the
+// key of the database.
+func OpenEncryptedDB(dbFilename string, key *Key) (*sql.DB, error) {
+	sep := "?"
+	if strings.Contains(dbFilename, "?") {
+		sep = "&"
+	}
+	params := strings.Join([]string{ForeignKeys, WAL, BusyTimeout, ImmediateTx}, "&")
+	return sql.OpenDB(newConnector(dbFilename+sep+params, key)), nil
+}
+
+// inTx runs fn in a transaction of db, which is committed if fn succeeds, and
+// rolled back otherwise.  Each operation that runs more than one statement
+// runs them in inTx, so that it either has its full effect or none.
+func inTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin: %w", err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit: %w", err)
+	}
+	return nil
+}
+
 // CreateDBSchema creates the data schema used in this program in an empty
 // database db.
-func CreateDBSchema(db *sql.DB) error {
-	if err := CreateSchema(db); err != nil {
+func CreateDBSchema(ctx context.Context, db *sql.DB) error {
+	if err := CreateSchema(ctx, db); err != nil {
 		return fmt.Errorf("could not create: %w", err)
 	}
 	return nil
 }
 
-// CreateSchema creates the database with the appropriate file pkg.
-func CreateSchema(db *sql.DB) error {
+// CreateSchema creates the database with the appropriate file pkg.  The
+// schema is of the latest version, see Migrations.
+func CreateSchema(ctx context.Context, db *sql.DB) error {
 	const createStatementStr = `
-		BEGIN TRANSACTION;
-
-		-- Each annotation is in a separate table row.
+		-- Each revision of the content of an annotation is in a separate
+		-- table row.
 		CREATE TABLE
 			Annotations (
 				Id		INTEGER PRIMARY KEY AUTOINCREMENT,
-				Content TEXT NOT NULL
+				Content TEXT NOT NULL,
+				-- The note that this is a revision of, i.e. the Id of its
+				-- AnnotationLocations row.
+				NoteId		INTEGER,
+				-- When the revision was made, in seconds since the Unix
+				-- epoch, and by whom.
+				Revised		INTEGER NOT NULL DEFAULT (unixepoch()),
+				RevisedBy	TEXT NOT NULL DEFAULT ''
 			);
 
+		CREATE INDEX
+			RevisionsByNote
+		ON
+			Annotations(NoteId);
+
 		-- Each annotation location refers to an uniquely identified annotation.
 		-- This allows us to change locations quickly.
 		CREATE TABLE
@@ -113,13 +159,120 @@ func CreateSchema(db *sql.DB) error {
 				Path		TEXT NOT NULL,
 				Line		INTEGER,
 				AnnId		INTEGER,
+				-- Set to 1 if the annotation's line could not be found in
+				-- the file anymore.
+				Orphaned	INTEGER NOT NULL DEFAULT 0,
+				-- If set, the qualified name of the Go declaration that
+				-- the annotation is anchored to, and the line offset of the
+				-- annotation from the start of that declaration.
+				Anchor			TEXT,
+				AnchorOffset	INTEGER NOT NULL DEFAULT 0,
+				-- When the annotation was created, in seconds since the
+				-- Unix epoch.
+				Created		INTEGER NOT NULL DEFAULT (unixepoch()),
+				-- When the content of the annotation last changed.
+				Updated		INTEGER NOT NULL DEFAULT (unixepoch()),
+				-- Who wrote the annotation. Empty if not known.
+				Author		TEXT NOT NULL DEFAULT '',
+				-- The kind of the annotation, if set explicitly. Else the
+				-- kind follows from the content, see KindOf.
+				Kind		TEXT,
+
+				-- The content is deleted with the annotation, see
+				-- DeleteContent, not the other way around.
+				FOREIGN KEY(AnnId) REFERENCES Annotations(Id)
+			);
+
+		-- The hashtags in the content of each annotation, normalized to
+		-- lower case and without the leading '#'.
+		CREATE TABLE
+			Tags (
+				AnnId	INTEGER NOT NULL,
+				Tag		TEXT NOT NULL,
 
+				PRIMARY KEY(AnnId, Tag),
 				FOREIGN KEY(AnnId) REFERENCES Annotations(Id)
 					ON DELETE CASCADE
 			);
 
+		CREATE INDEX
+			TagsByTag
+		ON
+			Tags(Tag);
+
+		-- The links from the content of each annotation to other
+		-- annotations, by the Id of their AnnotationLocations row.
+		CREATE TABLE
+			Links (
+				AnnId	INTEGER NOT NULL,
+				Target	INTEGER NOT NULL,
+
+				PRIMARY KEY(AnnId, Target),
+				FOREIGN KEY(AnnId) REFERENCES Annotations(Id)
+					ON DELETE CASCADE
+			);
+
+		CREATE INDEX
+			LinksByTarget
+		ON
+			Links(Target);
+
+		-- Deleted annotation locations, with their original IDs and
+		-- locations, until they are restored or purged.
+		CREATE TABLE
+			Trash (
+				Id				INTEGER PRIMARY KEY,
+				Workspace		TEXT NOT NULL,
+				Path			TEXT NOT NULL,
+				Line			INTEGER,
+				AnnId			INTEGER,
+				Orphaned		INTEGER NOT NULL DEFAULT 0,
+				Anchor			TEXT,
+				AnchorOffset	INTEGER NOT NULL DEFAULT 0,
+				Created			INTEGER NOT NULL DEFAULT (unixepoch()),
+				Updated			INTEGER NOT NULL DEFAULT (unixepoch()),
+				Author			TEXT NOT NULL DEFAULT '',
+				Kind			TEXT,
+				-- When the annotation was deleted.
+				Deleted			INTEGER NOT NULL DEFAULT (unixepoch())
+			);
+
+		-- The content of a deleted annotation, with all its revisions, is
+		-- deleted with it, unless the annotation was moved to the trash.
+		CREATE TRIGGER
+			DeleteContent
+		AFTER DELETE ON
+			AnnotationLocations
+		WHEN
+			OLD.Id NOT IN (SELECT Id FROM Trash)
+		BEGIN
+			DELETE FROM Annotations WHERE NoteId = OLD.Id OR Id = OLD.AnnId;
+		END;
+
+		-- The content of an annotation purged from the trash is deleted with
+		-- it, unless the annotation was restored.
+		CREATE TRIGGER
+			PurgeContent
+		AFTER DELETE ON
+			Trash
+		WHEN
+			OLD.Id NOT IN (SELECT Id FROM AnnotationLocations)
+		BEGIN
+			DELETE FROM Annotations WHERE NoteId = OLD.Id OR Id = OLD.AnnId;
+		END;
+
+		-- The settings of the database, such as the check of the key that
+		-- the contents are encrypted with, see Key.
+		CREATE TABLE
+			Settings (
+				Name	TEXT PRIMARY KEY,
+				Value	BLOB NOT NULL
+			);
+
 		-- We will be querying by workspace and path often, so add the index.
-		CREATE UNIQUE INDEX
+		-- A line may have several annotations, for example when lines with
+		-- annotations get merged.
+		CREATE INDEX
 			AnnotationsByFile
 		ON
 			AnnotationLocations(
@@ -127,82 +280,284 @@ func CreateSchema(db *sql.DB) error {
 				Path,
 				Line
 			);
+		`
 
-		COMMIT;`
-
-	_, err := db.Exec(createStatementStr)
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, createStatementStr); err != nil {
+			return fmt.Errorf("could not create: %w", err)
+		}
+		// PRAGMA does not take parameters.
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d;`, SchemaVersion())); err != nil {
+			return fmt.Errorf("could not set schema version: %w", err)
+		}
+		return txEnsureSearchIndex(ctx, tx)
+	})
 	if err != nil {
-		return fmt.Errorf("could not create: %w", err)
+		return opError("CreateSchema", err)
 	}
 	return nil
 }
 
 // InsertAnn inserts an annotation into the database.
-// The annotation line must not previously exist.
+// If the line already has annotations, the content of the line is replaced
+// with text.
 //
 // Args:
 //   - workspace: the workspace, either an URI or a symbolic prefix.
 //   - path: the file path relative to the workspace. For example,
 //     for ws="file://dir", and file URI
 //     "file://dir/file.txt", then path should be "/file.txt".
-func InsertAnn(db *sql.DB, workspace, path string, line uint32, text string) error {
-	glog.V(2).Infof("db/InsertAnn: ws=%v, path=%v, line=%v", workspace, path, line)
-	tx, err := db.Begin()
+func InsertAnn(ctx context.Context, db *sql.DB, workspace, path string, line uint32, text string) error {
+	return InsertAnnBy(ctx, db, workspace, path, line, text, "")
+}
+
+// InsertAnnBy is InsertAnn, with the annotation written by author.
+func InsertAnnBy(ctx context.Context, db *sql.DB, workspace, path string, line uint32, text, author string) error {
+	glog.V(2).Infof("db/InsertAnn: ws=%v, path=%v, line=%v, author=%v", workspace, path, line, author)
+	return opError("InsertAnn", replaceAnn(ctx, db, workspace, path, line, text, author))
+}
+
+// SetFileAnn sets the annotation of the whole file at path, written by author,
+// to text.  The annotations of a whole workspace have an empty path.
+func SetFileAnn(ctx context.Context, db *sql.DB, workspace, path, text, author string) error {
+	glog.V(2).Infof("db/SetFileAnn: ws=%v, path=%v, author=%v", workspace, path, author)
+	return opError("SetFileAnn", replaceAnn(ctx, db, workspace, path, nil, text, author))
+}
+
+// replaceAnn replaces the annotations of a line with text.  line is nil for
+// the annotations of a whole file, which have no line.
+//
+// If the line has several annotations, text is split at AnnSeparator, as
+// GetAnn joins them, and each part becomes the content of the annotation in
+// its place, if it changed.  The annotations past the parts are trashed, and
+// the parts past the annotations are added as new annotations.
+func replaceAnn(ctx context.Context, db *sql.DB, workspace, path string, line any, text, author string) error {
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		ids, contents, err := txLineContents(ctx, tx, workspace, path, line)
+		if err != nil {
+			return err
+		}
+		parts := []string{text}
+		if len(ids) > 1 {
+			parts = strings.Split(text, AnnSeparator)
+		}
+		for i, part := range parts {
+			if i < len(ids) {
+				if part == contents[i] {
+					continue
+				}
+				if err := txAddRevision(ctx, tx, ids[i], part, author); err != nil {
+					return err
+				}
+				continue
+			}
+			id, err := txInsertLoc(ctx, tx, workspace, path, line, author)
+			if err != nil {
+				return err
+			}
+			if err := txAddRevision(ctx, tx, id, part, author); err != nil {
+				return err
+			}
+		}
+		for _, id := range ids[min(len(parts), len(ids)):] {
+			if err := txTrash(ctx, tx, `Id = ?`, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// txLineContents returns the IDs and the contents of the annotations of a
+// line, in the order of GetAnn.  line is nil for the annotations of a whole
+// file.
+func txLineContents(ctx context.Context, tx *sql.Tx, workspace, path string, line any) ([]int64, []string, error) {
+	r, err := tx.QueryContext(ctx, `
+		SELECT		AnnotationLocations.Id, `+contentColumn+`
+		FROM		AnnotationLocations
+		INNER JOIN	Annotations
+		ON			AnnotationLocations.AnnId = Annotations.Id
+		WHERE		Workspace = ? AND Path = ? AND Line IS ? AND Orphaned = 0
+		ORDER BY	AnnotationLocations.Id
+	;`, workspace, path, line)
 	if err != nil {
-		return fmt.Errorf("could not start transaction: %w", err)
+		return nil, nil, fmt.Errorf("query failed: %w", err)
+	}
+	defer r.Close()
+	var (
+		ids      []int64
+		contents []string
+	)
+	for r.Next() {
+		var (
+			id      int64
+			content string
+		)
+		if err := r.Scan(&id, &content); err != nil {
+			return nil, nil, fmt.Errorf("could not scan: %w", err)
+		}
+		ids, contents = append(ids, id), append(contents, content)
 	}
-	r, err := db.Exec(`INSERT INTO Annotations(Content) VALUES (?);`, text)
+	return ids, contents, r.Err()
+}
+
+// txInsertLoc inserts the location of a new annotation without content, and
+// returns its ID.  The content is added with txAddRevision.  line is nil for
+// an annotation of a whole file.
+func txInsertLoc(ctx context.Context, tx *sql.Tx, workspace, path string, line any, author string) (int64, error) {
+	r, err := tx.ExecContext(ctx, `
+		INSERT INTO AnnotationLocations(Workspace, Path, Line, Author) VALUES (?, ?, ?, ?)
+	;`, workspace, path, line, author)
 	if err != nil {
-		return fmt.Errorf("could not exec: %w", err)
+		return 0, fmt.Errorf("could not insert location: %w", err)
 	}
 	id, err := r.LastInsertId()
 	if err != nil {
-		return fmt.Errorf("could not get last insert ID: %w", err)
+		return 0, fmt.Errorf("could not get last insert ID: %w", err)
 	}
-	const insertAnnLocStmtStr = `
-		INSERT INTO AnnotationLocations(Workspace, Path, Line, AnnId) VALUES (?, ?, ?, ?)
-        ON CONFLICT(Workspace, Path, Line)
-        DO UPDATE SET AnnId=?
-		;`
-	r, err = db.Exec(insertAnnLocStmtStr, workspace, path, line, id, id)
+	return id, nil
+}
+
+// txAddRevision makes text, written by author, the current content of the
+// annotation noteID.  The previous content is kept as an older revision.
+func txAddRevision(ctx context.Context, tx *sql.Tx, noteID int64, text, author string) error {
+	annID, err := txInsertContent(ctx, tx, noteID, text, author)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE	AnnotationLocations
+		SET		AnnId = ?, Updated = unixepoch()
+		WHERE	Id = ?
+	;`, annID, noteID); err != nil {
+		return fmt.Errorf("could not update content: %w", err)
+	}
+	return nil
+}
+
+// txInsertContent inserts a revision of the content of the annotation
+// noteID, along with its tags, and returns its ID.
+func txInsertContent(ctx context.Context, tx *sql.Tx, noteID int64, text, author string) (int64, error) {
+	r, err := tx.ExecContext(ctx, `
+		INSERT INTO Annotations(Content, NoteId, RevisedBy) VALUES (pcc_encrypt(?), ?, ?)
+	;`, text, noteID, author)
+	if err != nil {
+		return 0, fmt.Errorf("could not insert content: %w", err)
+	}
+	id, err := r.LastInsertId()
 	if err != nil {
-		return fmt.Errorf("could not exec statement: %w", err)
+		return 0, fmt.Errorf("could not get last insert ID: %w", err)
+	}
+	if err := txSetTags(ctx, tx, id, text); err != nil {
+		return 0, err
+	}
+	for _, target := range NoteLinks(text) {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO Links(AnnId, Target) VALUES (?, ?);`, id, target); err != nil {
+			return 0, fmt.Errorf("could not insert link: %v: %w", target, err)
+		}
+	}
+	return id, nil
+}
+
+// txSetTags replaces the tags of the annotation content annID with the tags
+// found in text.
+func txSetTags(ctx context.Context, tx *sql.Tx, annID int64, text string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM Tags WHERE AnnId = ?;`, annID); err != nil {
+		return fmt.Errorf("could not delete tags: %w", err)
 	}
-	return tx.Commit()
+	for _, t := range ParseTags(text) {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO Tags(AnnId, Tag) VALUES (?, ?);`, annID, t); err != nil {
+			return fmt.Errorf("could not insert tag: %q: %w", t, err)
+		}
+	}
+	return nil
 }
 
 // DeleteAnn deletes an annotation for the specific workspace, path and line.
-// The annotation does not need to exist.
-func DeleteAnn(db *sql.DB, workspace, path string, line uint32) error {
+// The annotation does not need to exist.  The deleted annotations are moved to
+// the trash.
+func DeleteAnn(ctx context.Context, db *sql.DB, workspace, path string, line uint32) error {
 	glog.V(2).Infof("db/DeleteAnn: ws=%v, path=%v, line=%v", workspace, path, line)
-	r, err := db.Exec(`
-		-- The Annotations table entry is deleted by cascade.
-		DELETE FROM	AnnotationLocations
-		WHERE		Workspace = ?
-				AND
-					Path = ?
-				AND
-					Line = ?
-	;`, workspace, path, line)
+	return opError("DeleteAnn", deleteAnn(ctx, db, workspace, path, line))
+}
+
+// DeleteFileAnn deletes the annotations of the whole file at path, or of the
+// whole workspace if path is empty.  They are moved to the trash.
+func DeleteFileAnn(ctx context.Context, db *sql.DB, workspace, path string) error {
+	glog.V(2).Infof("db/DeleteFileAnn: ws=%v, path=%v", workspace, path)
+	return opError("DeleteFileAnn", deleteAnn(ctx, db, workspace, path, nil))
+}
+
+// deleteAnn deletes the annotations of a line, or of a whole file if line is
+// nil.
+func deleteAnn(ctx context.Context, db *sql.DB, workspace, path string, line any) error {
+	return inTx(ctx, db, func(tx *sql.Tx) error {
+		// It is allowed for an annotation *not* to exist when requested a
+		// delete.
+		if err := txTrash(ctx, tx, `Workspace = ? AND Path = ? AND Line IS ? AND Orphaned = 0`,
+			workspace, path, line); err != nil {
+			return fmt.Errorf("could not delete: workspace=%v, path=%v, line=%v: %w", workspace, path, line, err)
+		}
+		return nil
+	})
+}
+
+// locColumns are the columns of an annotation location, which are kept in the
+// trash.
+const locColumns = `Id, Workspace, Path, Line, AnnId, Orphaned, Anchor, AnchorOffset, Created, Updated, Author, Kind`
+
+// txTrash moves the annotation locations selected by the condition cond, with
+// the arguments args, to the trash.
+func txTrash(ctx context.Context, tx *sql.Tx, cond string, args ...any) error {
+	if _, err := tx.ExecContext(ctx, `
+		INSERT OR REPLACE INTO Trash(`+locColumns+`)
+		SELECT	`+locColumns+`
+		FROM	AnnotationLocations
+		WHERE	`+cond+`
+	;`, args...); err != nil {
+		return fmt.Errorf("could not trash: %w", err)
+	}
+	r, err := tx.ExecContext(ctx, `DELETE FROM AnnotationLocations WHERE `+cond+`;`, args...)
 	if err != nil {
-		return fmt.Errorf("could not delete: workspace=%v, path=%v, line=%v", workspace, path, line)
+		return fmt.Errorf("could not delete: %w", err)
 	}
 	ra, err := r.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("could not get rows affected: workspace=%v, path=%v, line=%v", workspace, path, line)
-	}
-	// It is allowed for an annotation *not* to exist when requested a delete.
-	if ra > 1 {
-		return fmt.Errorf("should affect exactly one row, but affected: %v", ra)
+		return fmt.Errorf("could not get rows affected: %w", err)
 	}
+	glog.V(2).Infof("db/txTrash: trashed %v annotations", ra)
 	return nil
 }
 
-// MoveAnn moves a single annotation from a file location to another location in a possibly different file.
-func MoveAnn(db *sql.DB, workspace, path string, line uint32, newPath string, newLine uint32) error {
+// txUntrash moves the annotation location id from the trash back to the
+// annotations, into the file at path and on line.  line is nil for an
+// annotation of a whole file.  Returns false if the trash has no such
+// annotation.
+func txUntrash(ctx context.Context, tx *sql.Tx, id int64, workspace, path string, line any) (bool, error) {
+	r, err := tx.ExecContext(ctx, `
+		INSERT INTO AnnotationLocations(`+locColumns+`)
+		SELECT	Id, ?, ?, ?, AnnId, 0, Anchor, AnchorOffset, Created, Updated, Author, Kind
+		FROM	Trash
+		WHERE	Id = ?
+	;`, workspace, path, line, id)
+	if err != nil {
+		return false, fmt.Errorf("could not untrash: %w", err)
+	}
+	ra, err := r.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("could not get rows affected: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM Trash WHERE Id = ?;`, id); err != nil {
+		return false, fmt.Errorf("could not delete from trash: %w", err)
+	}
+	return ra != 0, nil
+}
+
+// MoveAnn moves the annotations of a line from a file location to another location in a possibly different file.
+func MoveAnn(ctx context.Context, db *sql.DB, workspace, path string, line uint32, newPath string, newLine uint32) error {
 	glog.V(2).Info("db/MoveAnn: ws=%v, path=%v, line=%v -> newPath=%v, newLine=%v",
 		workspace, path, line, newPath, newLine)
-	r, err := db.Exec(`
+	r, err := db.ExecContext(ctx, `
 		UPDATE		AnnotationLocations
 		SET			Path = ?, Line = ?
 		WHERE		Workspace = ?
@@ -210,18 +565,20 @@ func MoveAnn(db *sql.DB, workspace, path string, line uint32, newPath string, ne
 					Path = ?
 				AND
 					Line = ?
+				AND
+					Orphaned = 0
 	;`, newPath, newLine, workspace, path, line)
 	if err != nil {
-		return fmt.Errorf("could not move: workspace=%v, path=%v, line=%v: %w",
-			workspace, path, line, err)
+		return opError("MoveAnn", fmt.Errorf("could not move: workspace=%v, path=%v, line=%v: %w",
+			workspace, path, line, err))
 	}
 	ra, err := r.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("could not get rows affected: workspace=%v, path=%v, line=%v: %w",
-			workspace, path, line, err)
+		return opError("MoveAnn", fmt.Errorf("could not get rows affected: workspace=%v, path=%v, line=%v: %w",
+			workspace, path, line, err))
 	}
-	if ra != 1 {
-		return fmt.Errorf("should affect exactly one row, but affected: %v", ra)
+	if ra == 0 {
+		return opError("MoveAnn", notFound("workspace=%v, path=%v, line=%v", workspace, path, line))
 	}
 	return nil
 }
@@ -229,28 +586,17 @@ func MoveAnn(db *sql.DB, workspace, path string, line uint32, newPath string, ne
 // BulkMoveAnn moves annotation locations starting from given line to EOF by 'delta'.
 //
 // Note: firstLine is zero-indexed.
-func BulkMoveAnn(db *sql.DB, workspace, path string, firstLine uint32, delta int32) error {
-	tx, err := db.BeginTx(context.TODO(), nil)
-	if err != nil {
-		return fmt.Errorf("could not create TX: %v", err)
-	}
-	err = TxBulkMoveAnn(tx, workspace, path, firstLine, delta)
-	if err != nil {
-		return fmt.Errorf("could not schedule TX: %v", err)
-	}
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf(
-			"BulkMoveAnn: could not move annotations: ws=%q, file=%q, startLine=%v, delta=%v:\n\t%v",
-			workspace, path, firstLine, delta, err)
-	}
-	return nil
+func BulkMoveAnn(ctx context.Context, db *sql.DB, workspace, path string, firstLine uint32, delta int32) error {
+	return opError("BulkMoveAnn", inTx(ctx, db, func(tx *sql.Tx) error {
+		return TxBulkMoveAnn(ctx, tx, workspace, path, firstLine, delta)
+	}))
 }
 
 // TxBulkMoveAnn schedules a BulkMoveAnn into a transaction.
-func TxBulkMoveAnn(tx *sql.Tx, workspace, path string, firstLine uint32, delta int32) error {
+func TxBulkMoveAnn(ctx context.Context, tx *sql.Tx, workspace, path string, firstLine uint32, delta int32) error {
 	glog.V(2).Infof("db/TxBulkMoveAnn: ws=%q, path=%q, firstLine=%v, delta=%v",
 		workspace, path, firstLine, delta)
-	_, err := tx.Exec(`
+	_, err := tx.ExecContext(ctx, `
 		UPDATE			AnnotationLocations
 		SET				Line = Line + ?
 		WHERE			Workspace = ?
@@ -258,138 +604,354 @@ func TxBulkMoveAnn(tx *sql.Tx, workspace, path string, firstLine uint32, delta i
 						Path = ?
 					AND
 						Line >= ?
+					AND
+						Orphaned = 0
 		;`, delta, workspace, path, firstLine)
 	if err != nil {
 		return fmt.Errorf(
-			"BulkMoveAnn: could not move annotations: ws=%q, file=%q, startLine=%v, delta=%v:\n\t%w",
+			"could not move annotations: ws=%q, file=%q, startLine=%v, delta=%v: %w",
 			workspace, path, firstLine, delta, err)
 	}
 	return nil
 }
 
-func addConcat(tx *sql.Tx, workspace, path string, firstline, lastline uint32) (sql.Result, error) {
-	r, err := tx.Exec(`
-        -- Insert the concatenation of content of all affected lines to
-        -- the first line.
-        -- Save the generated ID into r above.
-        INSERT OR IGNORE INTO Annotations(Content)
-            SELECT group_concat(Content, ?) -- check how to use a separator
-            FROM    AnnotationLocations
-            INNER JOIN  Annotations
-            ON  AnnotationLocations.AnnId = Annotations.ID
-            WHERE AnnotationLocations.Workspace = ?     -- workspace
+// orphanAnchored orphans the anchored annotations between firstline and
+// lastline. Anchored annotations are not merged, since they are reattached
+// once their declaration is found again.
+func orphanAnchored(ctx context.Context, tx *sql.Tx, workspace, path string, firstline, lastline uint32) error {
+	_, err := tx.ExecContext(ctx, `
+        UPDATE  AnnotationLocations
+        SET     Orphaned = 1
+        WHERE   Workspace = ?
+                    AND
+                Path = ?
+                    AND
+                Line >= ?
                     AND
-                  AnnotationLocations.Path = ?          -- path
+                Line <= ?
                     AND
-                  AnnotationLocations.Line >= ?         -- firstline
+                Anchor IS NOT NULL
                     AND
-                  AnnotationLocations.Line <= ?          -- lastline
-            ORDER BY AnnotationLocations.Line
-        ;`, "\n--\n", workspace, path, firstline, lastline)
+                Orphaned = 0
+        ;`, workspace, path, firstline, lastline)
 	if err != nil {
-		return r, fmt.Errorf("could not add concat: %w", err)
+		return fmt.Errorf("could not orphan anchored: %w", err)
 	}
-	return r, nil
+	return nil
 }
 
 // TxBulkAppendAnn schedules an append in order of all the annotations on the file path between firstline
 // and lastline in the appropriate sequence.
-func TxBulkAppendAnn(tx *sql.Tx, workspace, path string, firstline, lastline uint32, delta int32) error {
-	r, err := addConcat(tx, workspace, path, firstline, lastline)
-	if err != nil {
+//
+// The annotations keep their identities: they are all moved to firstline, where
+// they are shown together.
+func TxBulkAppendAnn(ctx context.Context, tx *sql.Tx, workspace, path string, firstline, lastline uint32, delta int32) error {
+	if err := orphanAnchored(ctx, tx, workspace, path, firstline, lastline); err != nil {
 		return fmt.Errorf("could not bulk append: %w", err)
 	}
-	annID, err := r.LastInsertId()
+	_, err := tx.ExecContext(ctx, `
+        -- Re-point the notes from the deleted section to the first line.
+        UPDATE  AnnotationLocations
+        SET     Line = ?                -- firstline
+        WHERE   Workspace = ?           -- workspace
+                    AND
+                Path = ?                -- path
+                    AND
+                Line >= ?               -- firstline
+                    AND
+                Line <= ?               -- lastline
+                    AND
+                Orphaned = 0
+        ;`, firstline, workspace, path, firstline, lastline)
 	if err != nil {
-		return fmt.Errorf("could not get last insert ID: %w", err)
+		return fmt.Errorf("could not merge: %w", err)
 	}
 
-	_, err = tx.Exec(`
-        -- delete the notes from the deleted section.
-        -- These are already replaced by the concatenation above.
-        -- The annotation contents are deleted through cascade.
-        DELETE FROM AnnotationLocations
-        WHERE AnnotationLocations.Workspace = ? -- workspace
-                AND
-              AnnotationLocations.Path = ?
-                AND
-              AnnotationLocations.Line >= ? -- firstline
-                AND
-              AnnotationLocations.Line <= ? -- lastline
-        ;`, workspace, path, firstline, lastline)
+	if err := TxBulkMoveAnn(ctx, tx, workspace, path, lastline, delta); err != nil {
+		return fmt.Errorf("could not bulk append: %w", err)
+	}
+	return nil
+}
 
-	if err != nil {
-		return fmt.Errorf("could not schedule exec")
+// TxBulkRemoveAnn schedules the update of the annotations for the removal of
+// the lines in lr, which shrinks the file by -delta lines.  policy decides
+// what happens with the annotations of the removed lines.
+//
+// The lines lr.Start to lr.End are collapsed into the lines of the inserted
+// text.  If the change starts at the beginning of a line, the line lr.End is
+// the one that survives, else it is the line lr.Start.  All other lines of the
+// range are removed.  See RemovesFirstLine for setting lr.StartCol from the
+// text of the line.
+//
+// INVARIANT: delta < 0.
+func TxBulkRemoveAnn(ctx context.Context, tx *sql.Tx, policy DeletePolicy, workspace, path string, lr LineRange, delta int32) error {
+	glog.V(2).Infof("db/TxBulkRemoveAnn: policy=%v, ws=%q, path=%q, lr=%+v, delta=%v",
+		policy, workspace, path, lr, delta)
+	if _, err := ParseDeletePolicy(string(policy)); err != nil || policy == "" {
+		return invalid("unknown delete policy: %q", policy)
+	}
+	if policy == DeletePolicyMerge {
+		return TxBulkAppendAnn(ctx, tx, workspace, path, lr.Start, lr.End, delta)
+	}
+	if err := orphanAnchored(ctx, tx, workspace, path, lr.Start, lr.End); err != nil {
+		return err
+	}
+
+	// The surviving line, before and after the removal.
+	survivor, survivorLine := lr.Start, lr.Start
+	if lr.StartCol == 0 {
+		survivor = lr.End
+		survivorLine = uint32(int32(lr.End) + delta)
+	}
+	// The next line that survived the removal.
+	next := survivorLine
+	if survivor == lr.Start {
+		next = uint32(int32(lr.End) + delta + 1)
 	}
 
-	_, err = tx.Exec(`
-        INSERT OR REPLACE INTO AnnotationLocations(Workspace, Path, Line, AnnId)
-        VALUES (?, ?, ?, ?)
-        ;`, workspace, path, firstline, annID)
+	locs, err := txLocsInRange(ctx, tx, workspace, path, lr.Start, lr.End)
 	if err != nil {
-		return fmt.Errorf("could not insert")
+		return err
+	}
+	// The final lines of the annotations that are kept on a line.
+	kept := map[int64]uint32{}
+	for _, l := range locs {
+		if l.Line == survivor {
+			kept[l.Id] = survivorLine
+			continue
+		}
+		switch policy {
+		case DeletePolicyDrop:
+			err = txTrash(ctx, tx, `Id = ?`, l.Id)
+		case DeletePolicyOrphan:
+			_, err = tx.ExecContext(ctx, `UPDATE AnnotationLocations SET Orphaned = 1 WHERE Id = ?;`, l.Id)
+		case DeletePolicyNext:
+			kept[l.Id] = next
+		default:
+			err = invalid("unknown delete policy: %q", policy)
+		}
+		if err != nil {
+			return fmt.Errorf("line=%v: %w", l.Line, err)
+		}
 	}
 
-	if err := TxBulkMoveAnn(tx, workspace, path, lastline, delta); err != nil {
-		return fmt.Errorf("could not commit")
+	// Park the kept annotations at the start of the range, so that they do
+	// not get moved along with the lines below the range.
+	for id := range kept {
+		if _, err := tx.ExecContext(ctx, `UPDATE AnnotationLocations SET Line = ? WHERE Id = ?;`,
+			lr.Start, id); err != nil {
+			return fmt.Errorf("could not park: %w", err)
+		}
+	}
+	if err := TxBulkMoveAnn(ctx, tx, workspace, path, lr.End, delta); err != nil {
+		return err
+	}
+	for id, line := range kept {
+		if _, err := tx.ExecContext(ctx, `UPDATE AnnotationLocations SET Line = ? WHERE Id = ?;`,
+			line, id); err != nil {
+			return fmt.Errorf("could not move: %w", err)
+		}
 	}
 	return nil
 }
 
-// BulkDeleteAnn bulk-deletes annotations.
-func BulkDeleteAnn(db *sql.DB, workspace, path string, firstLine uint32, lastLine uint32, delta int32) error {
+// AnnSeparator separates the contents of the annotations on the same line,
+// when they are shown together.
+const AnnSeparator = "\n--\n"
+
+// AnnLoc is a single annotation record, at its location.
+type AnnLoc struct {
+	// Id identifies the location of the annotation.
+	Id      int64
+	Line    uint32
+	Content string
+	// Author, Created and Kind are kept so that an annotation that is
+	// recreated by RestoreAnnLocs is as it was.  Kind is empty if the kind
+	// follows from the content.
+	Author  string
+	Created time.Time
+	Kind    Kind
+}
+
+// txLocsInRange returns the live annotations between firstline and lastline,
+// in line order.
+func txLocsInRange(ctx context.Context, tx *sql.Tx, workspace, path string, firstline, lastline uint32) ([]AnnLoc, error) {
+	r, err := tx.QueryContext(ctx, `
+        SELECT      AnnotationLocations.Id, Line, `+contentColumn+`, Author, Created, Kind
+        FROM        AnnotationLocations
+        INNER JOIN  Annotations
+        ON          AnnotationLocations.AnnId = Annotations.Id
+        WHERE       Workspace = ?
+                        AND
+                    Path = ?
+                        AND
+                    Line >= ?
+                        AND
+                    Line <= ?
+                        AND
+                    Orphaned = 0
+        ORDER BY    Line, AnnotationLocations.Id
+        ;`, workspace, path, firstline, lastline)
+	if err != nil {
+		return nil, fmt.Errorf("could not query range: %w", err)
+	}
+	defer r.Close()
+	var ret []AnnLoc
+	for r.Next() {
+		var (
+			l       AnnLoc
+			created int64
+			kind    sql.NullString
+		)
+		if err := r.Scan(&l.Id, &l.Line, &l.Content, &l.Author, &created, &kind); err != nil {
+			return nil, fmt.Errorf("could not scan: %w", err)
+		}
+		l.Created, l.Kind = time.Unix(created, 0), Kind(kind.String)
+		ret = append(ret, l)
+	}
+	return ret, r.Err()
+}
+
+// GetAnnLocs returns the individual annotation records between firstline and
+// lastline, in line order.
+func GetAnnLocs(ctx context.Context, db *sql.DB, workspace, path string, firstline, lastline uint32) ([]AnnLoc, error) {
+	var ret []AnnLoc
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		ret, err = txLocsInRange(ctx, tx, workspace, path, firstline, lastline)
+		return err
+	})
+	if err != nil {
+		return nil, opError("GetAnnLocs", err)
+	}
+	return ret, nil
+}
+
+// RestoreAnnLocs puts the annotation records locs back on their lines in the
+// file at path.  Records that were deleted in the meantime, and are no longer
+// in the trash, are recreated with their previous IDs, authors, creation
+// times and kinds.  The records with a zero Id are inserted as new
+// annotations.
+func RestoreAnnLocs(ctx context.Context, db *sql.DB, workspace, path string, locs []AnnLoc) error {
+	glog.V(2).Infof("db/RestoreAnnLocs: ws=%q, path=%q, locs=%+v", workspace, path, locs)
+	return opError("RestoreAnnLocs", inTx(ctx, db, func(tx *sql.Tx) error {
+		for _, l := range locs {
+			if l.Id != 0 {
+				r, err := tx.ExecContext(ctx, `
+					UPDATE	AnnotationLocations
+					SET		Workspace = ?, Path = ?, Line = ?, Orphaned = 0
+					WHERE	Id = ?
+				;`, workspace, path, l.Line, l.Id)
+				if err != nil {
+					return fmt.Errorf("could not move: %w", err)
+				}
+				ra, err := r.RowsAffected()
+				if err != nil {
+					return fmt.Errorf("could not get rows affected: %w", err)
+				}
+				if ra != 0 {
+					continue
+				}
+				// Dropped annotations are in the trash.
+				ok, err := txUntrash(ctx, tx, l.Id, workspace, path, l.Line)
+				if err != nil {
+					return err
+				}
+				if ok {
+					continue
+				}
+			}
+			// A zero Id is a new one.
+			id := sql.NullInt64{Int64: l.Id, Valid: l.Id != 0}
+			created := sql.NullInt64{Int64: l.Created.Unix(), Valid: !l.Created.IsZero()}
+			r, err := tx.ExecContext(ctx, `
+				INSERT INTO AnnotationLocations(Id, Workspace, Path, Line, Created, Author, Kind)
+				VALUES (?, ?, ?, ?, COALESCE(?, unixepoch()), ?, ?)
+			;`, id, workspace, path, l.Line, created, l.Author,
+				sql.NullString{String: string(l.Kind), Valid: l.Kind != ""})
+			if err != nil {
+				return fmt.Errorf("could not insert location: %w", err)
+			}
+			locID, err := r.LastInsertId()
+			if err != nil {
+				return fmt.Errorf("could not get last insert ID: %w", err)
+			}
+			if err := txAddRevision(ctx, tx, locID, l.Content, l.Author); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+}
+
+// DropAnnLocs deletes the annotation locations ids, and their contents, from
+// the annotations and from the trash alike.  The deleted annotations are not
+// put in the trash.
+func DropAnnLocs(ctx context.Context, db *sql.DB, ids []int64) error {
+	glog.V(2).Infof("db/DropAnnLocs: ids=%v", ids)
+	return opError("DropAnnLocs", inTx(ctx, db, func(tx *sql.Tx) error {
+		for _, id := range ids {
+			// The contents go with the last of the two, see the
+			// DeleteContent and PurgeContent triggers.
+			if _, err := tx.ExecContext(ctx, `DELETE FROM Trash WHERE Id = ?;`, id); err != nil {
+				return fmt.Errorf("could not delete from trash: %w", err)
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM AnnotationLocations WHERE Id = ?;`, id); err != nil {
+				return fmt.Errorf("could not delete: %w", err)
+			}
+		}
+		return nil
+	}))
+}
+
+// BulkDeleteAnn bulk-deletes annotations, by moving them to the trash.
+func BulkDeleteAnn(ctx context.Context, db *sql.DB, workspace, path string, firstLine uint32, lastLine uint32, delta int32) error {
 	// Check invariants.
 	if firstLine > lastLine {
-		return fmt.Errorf("firstline: %v, lastline: %v: lastline must not be smaller", firstLine, lastLine)
+		return opError("BulkDeleteAnn", invalid("firstline: %v, lastline: %v: lastline must not be smaller", firstLine, lastLine))
 	}
 	l := int32(firstLine) - int32(lastLine)
 	if delta < l {
-		return fmt.Errorf("delta: %v, firstline: %v, lastline: %v, l: %v: diff must not be smaller",
-			delta, firstLine, lastLine, l)
+		return opError("BulkDeleteAnn", invalid("delta: %v, firstline: %v, lastline: %v, l: %v: diff must not be smaller",
+			delta, firstLine, lastLine, l))
 	}
 
-	_, err := db.Exec(`
-		BEGIN TRANSACTION;
-
-		DELETE FROM		AnnotationLocations
-		WHERE
-						Workspace = ?
-					AND
-						Path = ?
-					AND
-						Line >= ?
-					AND
-						Line <= ?
-		;
-
-		UPDATE			AnnotationLocations
-		SET				Line = Line + ?
-		WHERE
-						Workspace = ?
-					AND
-						Path = ?
-					AND
-						Line >= ?
-		;
-
-		COMMIT;
-	;`, workspace, path, firstLine, lastLine, delta, workspace, path, lastLine+1)
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		if err := txTrash(ctx, tx, `Workspace = ? AND Path = ? AND Line >= ? AND Line <= ? AND Orphaned = 0`,
+			workspace, path, firstLine, lastLine); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE			AnnotationLocations
+			SET				Line = Line + ?
+			WHERE
+							Workspace = ?
+						AND
+							Path = ?
+						AND
+							Line >= ?
+						AND
+							Orphaned = 0
+		;`, delta, workspace, path, lastLine+1); err != nil {
+			return fmt.Errorf("could not move annotations: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf(
-			"BulkDeleteAnn: could not move annotations: ws=%q, file=%q, startLine=%v, lastLine=%v, delta=%v:\n\t%v",
-			workspace, path, firstLine, lastLine, delta, err)
+		return opError("BulkDeleteAnn", fmt.Errorf("ws=%q, file=%q, startLine=%v, lastLine=%v, delta=%v: %w",
+			workspace, path, firstLine, lastLine, delta, err))
 	}
 	return nil
 }
 
-// GetAnn retrieves a single annotation.  Or an error if that particular annotation
-// does not exist.
-func GetAnn(db *sql.DB, workspace, path string, line uint32) (string, error) {
+// GetAnn retrieves the annotations of a single line, shown together.  Or an
+// error if that particular annotation does not exist.
+func GetAnn(ctx context.Context, db *sql.DB, workspace, path string, line uint32) (string, error) {
 	if workspace == "" || path == "" {
-		return "", fmt.Errorf("GetAnn: empty workspace or path: ws=%q, path=%q", workspace, path)
+		return "", opError("GetAnn", invalid("empty workspace or path: ws=%q, path=%q", workspace, path))
 	}
 	const readAnnStmtStr = `
-		SELECT		Content
+		SELECT		group_concat(` + contentColumn + `, ? ORDER BY AnnotationLocations.Id)
 		FROM		AnnotationLocations
 		INNER JOIN	Annotations
 		ON			AnnotationLocations.AnnId = Annotations.Id
@@ -399,14 +961,17 @@ func GetAnn(db *sql.DB, workspace, path string, line uint32) (string, error) {
 			AnnotationLocations.Path = ?
 				AND
 			AnnotationLocations.Line = ?
+				AND
+			AnnotationLocations.Orphaned = 0
+		GROUP BY	AnnotationLocations.Line
 		;`
-	row := db.QueryRow(readAnnStmtStr, workspace, path, line)
+	row := db.QueryRowContext(ctx, readAnnStmtStr, AnnSeparator, workspace, path, line)
 	var ret string
 	if err := row.Scan(&ret); err != nil {
 		if err == sql.ErrNoRows {
 			glog.Warningf("no rows for query: workspace=%v, path=%v, line=%v", workspace, path, line)
 		} else {
-			return "", fmt.Errorf("GetAnn: scan: %w, %q", err, ret)
+			return "", opError("GetAnn", fmt.Errorf("scan: %w, %q", err, ret))
 		}
 	}
 	return ret, nil
@@ -421,36 +986,38 @@ type Ann struct {
 }
 
 // GetRawAnns gets all the annotations from the database.
-func GetRawAnns(db *sql.DB) ([]Ann, error) {
+func GetRawAnns(ctx context.Context, db *sql.DB) ([]Ann, error) {
 	ret := []Ann{}
-	r, err := db.Query(`
-		SELECT		Id, Content
+	r, err := db.QueryContext(ctx, `
+		SELECT		Id, `+contentColumn+`
 		FROM		Annotations
 		ORDER BY	Id
 	;`)
 	if err != nil {
-		return nil, fmt.Errorf("could not query: %w", err)
+		return nil, opError("GetRawAnns", fmt.Errorf("could not query: %w", err))
 	}
+	defer r.Close()
 
 	for r.Next() {
 		var ann Ann
 		if err := r.Scan(&ann.Line, &ann.Content); err != nil {
-			return nil, fmt.Errorf("could not scan: %w", err)
+			return nil, opError("GetRawAnns", fmt.Errorf("could not scan: %w", err))
 		}
 		ret = append(ret, ann)
 	}
 	glog.V(2).Infof("GetRawAnns: %+v", ret)
-	return ret, err
+	return ret, opError("GetRawAnns", r.Err())
 }
 
-// GetAnns returns all annotations for the given path in the workspace.
-func GetAnns(db *sql.DB, workspace, path string) ([]Ann, error) {
+// GetAnns returns all annotations for the given path in the workspace.  The
+// annotations of the same line are shown together.
+func GetAnns(ctx context.Context, db *sql.DB, workspace, path string) ([]Ann, error) {
 	if workspace == "" || path == "" {
-		return nil, fmt.Errorf("GetAnns: empty workspace or path: ws=%q, path=%q", workspace, path)
+		return nil, opError("GetAnns", invalid("empty workspace or path: ws=%q, path=%q", workspace, path))
 	}
 	ret := []Ann{}
-	r, err := db.Query(`
-		SELECT		Line, Content
+	r, err := db.QueryContext(ctx, `
+		SELECT		Line, group_concat(`+contentColumn+`, ? ORDER BY AnnotationLocations.Id)
 		FROM		AnnotationLocations
 		INNER JOIN	Annotations
 		ON			AnnotationLocations.AnnId = Annotations.Id
@@ -458,20 +1025,959 @@ func GetAnns(db *sql.DB, workspace, path string) ([]Ann, error) {
 			AnnotationLocations.Workspace = ?
 				AND
 			AnnotationLocations.Path = ?
+				AND
+			AnnotationLocations.Line IS NOT NULL
+				AND
+			AnnotationLocations.Orphaned = 0
+		GROUP BY	Line
 		ORDER BY	Line
-	;`, workspace, path)
+	;`, AnnSeparator, workspace, path)
 	if err != nil {
-		return nil, fmt.Errorf("GetAnns: query failed: %v", err)
+		return nil, opError("GetAnns", fmt.Errorf("query failed: %w", err))
 	}
+	defer r.Close()
 
 	for r.Next() {
 		var ann Ann
 		if err := r.Scan(&ann.Line, &ann.Content); err != nil {
-			return nil, fmt.Errorf("could not scan: %w", err)
+			return nil, opError("GetAnns", fmt.Errorf("could not scan: %w", err))
 		}
 		ret = append(ret, ann)
 	}
 	glog.V(2).Infof("GetAnns(ws=%q, file=%q): %+v", workspace, path, ret)
 
-	return ret, err
+	return ret, opError("GetAnns", r.Err())
+}
+
+// MarkOrphaned marks as orphaned all annotations in the file at path whose
+// lines are at or beyond numLines, i.e. past the end of the file. Returns the
+// number of newly orphaned annotations.
+func MarkOrphaned(ctx context.Context, db *sql.DB, workspace, path string, numLines uint32) (int64, error) {
+	glog.V(2).Infof("db/MarkOrphaned: ws=%q, path=%q, numLines=%v", workspace, path, numLines)
+	r, err := db.ExecContext(ctx, `
+		UPDATE		AnnotationLocations
+		SET			Orphaned = 1
+		WHERE		Workspace = ?
+				AND
+					Path = ?
+				AND
+					Line >= ?
+				AND
+					Orphaned = 0
+	;`, workspace, path, numLines)
+	if err != nil {
+		return 0, opError("MarkOrphaned", fmt.Errorf("ws=%q, path=%q, numLines=%v: %w",
+			workspace, path, numLines, err))
+	}
+	ra, err := r.RowsAffected()
+	if err != nil {
+		return 0, opError("MarkOrphaned", fmt.Errorf("could not get rows affected: %w", err))
+	}
+	return ra, nil
+}
+
+// Orphan is an orphaned annotation.  Its Line is the last line it was known
+// to be attached to.
+type Orphan struct {
+	// Id is the ID of the annotation location, see ReattachAnn.
+	Id int64
+	Ann
+}
+
+// GetOrphanedAnns returns all orphaned annotations for the given path in the
+// workspace.
+func GetOrphanedAnns(ctx context.Context, db *sql.DB, workspace, path string) ([]Orphan, error) {
+	if workspace == "" || path == "" {
+		return nil, opError("GetOrphanedAnns", invalid("empty workspace or path: ws=%q, path=%q", workspace, path))
+	}
+	ret := []Orphan{}
+	r, err := db.QueryContext(ctx, `
+		SELECT		AnnotationLocations.Id, Line, `+contentColumn+`
+		FROM		AnnotationLocations
+		INNER JOIN	Annotations
+		ON			AnnotationLocations.AnnId = Annotations.Id
+		WHERE
+			AnnotationLocations.Workspace = ?
+				AND
+			AnnotationLocations.Path = ?
+				AND
+			AnnotationLocations.Orphaned = 1
+		ORDER BY	Line, AnnotationLocations.Id
+	;`, workspace, path)
+	if err != nil {
+		return nil, opError("GetOrphanedAnns", fmt.Errorf("query failed: %w", err))
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var o Orphan
+		if err := r.Scan(&o.Id, &o.Line, &o.Content); err != nil {
+			return nil, opError("GetOrphanedAnns", fmt.Errorf("could not scan: %w", err))
+		}
+		ret = append(ret, o)
+	}
+	return ret, opError("GetOrphanedAnns", r.Err())
+}
+
+// ReattachAnn attaches the orphaned annotation id of the file to newLine, and
+// clears its orphaned state.
+func ReattachAnn(ctx context.Context, db *sql.DB, workspace, path string, id int64, newLine uint32) error {
+	glog.V(2).Infof("db/ReattachAnn: ws=%q, path=%q, id=%v -> newLine=%v",
+		workspace, path, id, newLine)
+	r, err := db.ExecContext(ctx, `
+		UPDATE		AnnotationLocations
+		SET			Line = ?, Orphaned = 0
+		WHERE		Id = ?
+				AND
+					Workspace = ?
+				AND
+					Path = ?
+				AND
+					Orphaned = 1
+	;`, newLine, id, workspace, path)
+	if err != nil {
+		return opError("ReattachAnn", fmt.Errorf("could not reattach: workspace=%v, path=%v, id=%v, newLine=%v: %w",
+			workspace, path, id, newLine, err))
+	}
+	ra, err := r.RowsAffected()
+	if err != nil {
+		return opError("ReattachAnn", fmt.Errorf("could not get rows affected: workspace=%v, path=%v, id=%v: %w",
+			workspace, path, id, err))
+	}
+	if ra == 0 {
+		return opError("ReattachAnn", notFound("orphaned: workspace=%v, path=%v, id=%v", workspace, path, id))
+	}
+	return nil
+}
+
+// SetAnchor anchors the annotations at line to the Go declaration named anchor,
+// which starts at declLine.  An empty anchor removes the anchoring.
+func SetAnchor(ctx context.Context, db *sql.DB, workspace, path string, line uint32, anchor string, declLine uint32) error {
+	glog.V(2).Infof("db/SetAnchor: ws=%q, path=%q, line=%v, anchor=%q, declLine=%v",
+		workspace, path, line, anchor, declLine)
+	var (
+		a   sql.NullString
+		off int64
+	)
+	if anchor != "" {
+		a = sql.NullString{String: anchor, Valid: true}
+		off = int64(line) - int64(declLine)
+	}
+	r, err := db.ExecContext(ctx, `
+		UPDATE		AnnotationLocations
+		SET			Anchor = ?, AnchorOffset = ?
+		WHERE		Workspace = ?
+				AND
+					Path = ?
+				AND
+					Line = ?
+				AND
+					Orphaned = 0
+	;`, a, off, workspace, path, line)
+	if err != nil {
+		return opError("SetAnchor", fmt.Errorf("could not anchor: workspace=%v, path=%v, line=%v: %w",
+			workspace, path, line, err))
+	}
+	ra, err := r.RowsAffected()
+	if err != nil {
+		return opError("SetAnchor", fmt.Errorf("could not get rows affected: workspace=%v, path=%v, line=%v: %w",
+			workspace, path, line, err))
+	}
+	if ra == 0 {
+		return opError("SetAnchor", notFound("workspace=%v, path=%v, line=%v", workspace, path, line))
+	}
+	return nil
+}
+
+// ResolveAnchors moves the anchored annotations of the file at path to the
+// current lines of their declarations.  Annotations whose declarations are
+// not in decls are orphaned, and orphaned annotations whose declarations
+// reappear are reattached.
+func ResolveAnchors(ctx context.Context, db *sql.DB, workspace, path string, decls []GoDecl) error {
+	return opError("ResolveAnchors", inTx(ctx, db, func(tx *sql.Tx) error {
+		type anchored struct {
+			id       int64
+			line     int64
+			anchor   string
+			offset   int64
+			orphaned bool
+		}
+		r, err := tx.QueryContext(ctx, `
+			SELECT		Id, Line, Anchor, AnchorOffset, Orphaned
+			FROM		AnnotationLocations
+			WHERE		Workspace = ?
+					AND
+						Path = ?
+					AND
+						Anchor IS NOT NULL
+		;`, workspace, path)
+		if err != nil {
+			return fmt.Errorf("query failed: %w", err)
+		}
+		var as []anchored
+		for r.Next() {
+			var a anchored
+			if err := r.Scan(&a.id, &a.line, &a.anchor, &a.offset, &a.orphaned); err != nil {
+				r.Close()
+				return fmt.Errorf("could not scan: %w", err)
+			}
+			as = append(as, a)
+		}
+		r.Close()
+		if err := r.Err(); err != nil {
+			return err
+		}
+
+		for _, a := range as {
+			d, ok := FindGoDecl(decls, a.anchor)
+			if !ok {
+				if !a.orphaned {
+					glog.V(1).Infof("ResolveAnchors: orphaning: %q", a.anchor)
+					if _, err := tx.ExecContext(ctx, `UPDATE AnnotationLocations SET Orphaned = 1 WHERE Id = ?;`, a.id); err != nil {
+						return fmt.Errorf("could not orphan: %w", err)
+					}
+				}
+				continue
+			}
+			want := int64(d.Start) + a.offset
+			if want < int64(d.Start) || want > int64(d.End) {
+				// The declaration shrank below the annotation.
+				want = int64(d.Start)
+			}
+			if want == a.line && !a.orphaned {
+				continue
+			}
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE	AnnotationLocations
+				SET		Line = ?, Orphaned = 0
+				WHERE	Id = ?
+			;`, want, a.id); err != nil {
+				return fmt.Errorf("could not move: %w", err)
+			}
+		}
+		return nil
+	}))
+}
+
+// ThreadEntry is a single annotation in the thread of annotations of a line.
+type ThreadEntry struct {
+	// Id identifies the annotation. It does not change when the annotation
+	// is edited or moved.
+	Id      int64
+	Line    uint32
+	Content string
+	Created time.Time
+	// Updated is when the content last changed.
+	Updated time.Time
+	Author  string
+	// Tags are the hashtags of the content, see ParseTags.
+	Tags []string
+	// Kind is the kind of the annotation, see KindOf.
+	Kind Kind
+}
+
+// tagsColumn selects the tags of the annotation content, space separated.
+const tagsColumn = `(
+			SELECT	group_concat(Tag, ' ' ORDER BY Tag)
+			FROM	Tags
+			WHERE	Tags.AnnId = Annotations.Id
+		)`
+
+// splitTags splits the tags selected by tagsColumn.
+func splitTags(s sql.NullString) []string {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	return strings.Split(s.String, " ")
+}
+
+// AppendAnn adds an annotation written by author to the thread of annotations
+// of a line, and returns its ID.
+func AppendAnn(ctx context.Context, db *sql.DB, workspace, path string, line uint32, text, author string) (int64, error) {
+	glog.V(2).Infof("db/AppendAnn: ws=%v, path=%v, line=%v, author=%v", workspace, path, line, author)
+	var id int64
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		if id, err = txInsertLoc(ctx, tx, workspace, path, line, author); err != nil {
+			return err
+		}
+		return txAddRevision(ctx, tx, id, text, author)
+	})
+	if err != nil {
+		return 0, opError("AppendAnn", err)
+	}
+	return id, nil
+}
+
+// GetThread returns the annotations of a line, oldest first.
+func GetThread(ctx context.Context, db *sql.DB, workspace, path string, line uint32) ([]ThreadEntry, error) {
+	ret, err := getThread(ctx, db, workspace, path, line)
+	return ret, opError("GetThread", err)
+}
+
+// GetFileThread returns the annotations of the whole file at path, oldest
+// first.  The annotations of the whole workspace have an empty path.  Their
+// Line is 0.
+func GetFileThread(ctx context.Context, db *sql.DB, workspace, path string) ([]ThreadEntry, error) {
+	ret, err := getThread(ctx, db, workspace, path, nil)
+	return ret, opError("GetFileThread", err)
+}
+
+// getThread returns the annotations of a line, or of a whole file if line is
+// nil.
+func getThread(ctx context.Context, db *sql.DB, workspace, path string, line any) ([]ThreadEntry, error) {
+	r, err := db.QueryContext(ctx, `
+		SELECT		AnnotationLocations.Id, COALESCE(Line, 0), `+contentColumn+`, Created, Updated, Author, Kind, `+tagsColumn+`
+		FROM		AnnotationLocations
+		INNER JOIN	Annotations
+		ON			AnnotationLocations.AnnId = Annotations.Id
+		WHERE
+			AnnotationLocations.Workspace = ?
+				AND
+			AnnotationLocations.Path = ?
+				AND
+			AnnotationLocations.Line IS ?
+				AND
+			AnnotationLocations.Orphaned = 0
+		ORDER BY	AnnotationLocations.Id
+	;`, workspace, path, line)
+	if err != nil {
+		return nil, fmt.Errorf("query failed: %w", err)
+	}
+	defer r.Close()
+	ret := []ThreadEntry{}
+	for r.Next() {
+		var (
+			e                ThreadEntry
+			created, updated int64
+			kind, tags       sql.NullString
+		)
+		if err := r.Scan(&e.Id, &e.Line, &e.Content, &created, &updated, &e.Author, &kind, &tags); err != nil {
+			return nil, fmt.Errorf("could not scan: %w", err)
+		}
+		e.Created, e.Updated = time.Unix(created, 0), time.Unix(updated, 0)
+		e.Tags = splitTags(tags)
+		e.Kind = KindOf(Kind(kind.String), e.Content)
+		ret = append(ret, e)
+	}
+	return ret, r.Err()
+}
+
+// EditAnnById replaces the content of the annotation with the given ID, in
+// the file at path, with a new revision written by author.
+func EditAnnById(ctx context.Context, db *sql.DB, workspace, path string, id int64, text, author string) error {
+	glog.V(2).Infof("db/EditAnnById: ws=%v, path=%v, id=%v, author=%v", workspace, path, id, author)
+	return opError("EditAnnById", inTx(ctx, db, func(tx *sql.Tx) error {
+		if err := txCheckAnn(ctx, tx, workspace, path, id); err != nil {
+			return err
+		}
+		return txAddRevision(ctx, tx, id, text, author)
+	}))
+}
+
+// txCheckAnn returns ErrNotFound if there is no annotation with the given ID
+// in the file at path.
+func txCheckAnn(ctx context.Context, tx *sql.Tx, workspace, path string, id int64) error {
+	var n int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT	COUNT(*)
+		FROM	AnnotationLocations
+		WHERE	Id = ? AND Workspace = ? AND Path = ?
+	;`, id, workspace, path).Scan(&n); err != nil {
+		return fmt.Errorf("id=%v: %w", id, err)
+	}
+	if n == 0 {
+		return notFound("ws=%v, path=%v, id=%v", workspace, path, id)
+	}
+	return nil
+}
+
+// DeleteAnnById moves the annotation with the given ID, in the file at path,
+// to the trash.
+func DeleteAnnById(ctx context.Context, db *sql.DB, workspace, path string, id int64) error {
+	glog.V(2).Infof("db/DeleteAnnById: ws=%v, path=%v, id=%v", workspace, path, id)
+	return opError("DeleteAnnById", inTx(ctx, db, func(tx *sql.Tx) error {
+		if err := txCheckAnn(ctx, tx, workspace, path, id); err != nil {
+			return err
+		}
+		if err := txTrash(ctx, tx, `Id = ?`, id); err != nil {
+			return fmt.Errorf("id=%v: %w", id, err)
+		}
+		return nil
+	}))
+}
+
+// Note is a single annotation with its location and metadata.
+type Note struct {
+	ThreadEntry
+	Workspace, Path string
+	// Orphaned is set if Line is only the last line the note was attached to.
+	Orphaned bool
+	// FileLevel is set if the note is about the whole file, or about the
+	// whole workspace if Path is empty.  Line is then 0.
+	FileLevel bool
+}
+
+// lineColumns selects the line of an annotation location, and whether the
+// annotation is about a whole file instead.
+const lineColumns = `COALESCE(Line, 0), Line IS NULL`
+
+// Sort orders of ListAnns.
+const (
+	SortByLocation = `location`
+	SortByCreated  = `created`
+	SortByUpdated  = `updated`
+	SortByAuthor   = `author`
+)
+
+// noteOrder are the SQL orderings of the sort orders.
+var noteOrder = map[string]string{
+	"":             `Workspace, Path, Line, AnnotationLocations.Id`,
+	SortByLocation: `Workspace, Path, Line, AnnotationLocations.Id`,
+	SortByCreated:  `Created, AnnotationLocations.Id`,
+	SortByUpdated:  `Updated, AnnotationLocations.Id`,
+	SortByAuthor:   `Author, Workspace, Path, Line, AnnotationLocations.Id`,
+}
+
+// ListFilter selects and orders the notes returned by ListAnns.  Zero values
+// select everything.
+type ListFilter struct {
+	Workspace, Path string
+	Author          string
+	// Tag selects the notes with the tag, without the leading '#'.
+	Tag string
+	// The notes created or updated in [Since, Until).
+	CreatedSince, CreatedUntil time.Time
+	UpdatedSince, UpdatedUntil time.Time
+	// SortBy is one of the SortBy values, SortByLocation by default.
+	SortBy string
+	// Desc reverses the sort order.
+	Desc bool
+}
+
+// ListAnns returns the notes, both attached and orphaned, selected by f.
+func ListAnns(ctx context.Context, db *sql.DB, f ListFilter) ([]Note, error) {
+	order, ok := noteOrder[f.SortBy]
+	if !ok {
+		return nil, opError("ListAnns", invalid("unknown sort order: %q", f.SortBy))
+	}
+	if f.Desc {
+		order = strings.ReplaceAll(order, ",", " DESC,") + " DESC"
+	}
+	var (
+		where []string
+		args  []any
+	)
+	add := func(cond string, arg any) {
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+	if f.Workspace != "" {
+		add(`Workspace = ?`, f.Workspace)
+	}
+	if f.Path != "" {
+		add(`Path = ?`, f.Path)
+	}
+	if f.Author != "" {
+		add(`Author = ?`, f.Author)
+	}
+	if f.Tag != "" {
+		add(`AnnId IN (SELECT AnnId FROM Tags WHERE Tag = ?)`, NormalizeTag(f.Tag))
+	}
+	for _, t := range []struct {
+		cond string
+		t    time.Time
+	}{
+		{`Created >= ?`, f.CreatedSince},
+		{`Created < ?`, f.CreatedUntil},
+		{`Updated >= ?`, f.UpdatedSince},
+		{`Updated < ?`, f.UpdatedUntil},
+	} {
+		if !t.t.IsZero() {
+			add(t.cond, t.t.Unix())
+		}
+	}
+	q := `
+		SELECT		AnnotationLocations.Id, Workspace, Path, ` + lineColumns + `, Orphaned,
+					` + contentColumn + `, Created, Updated, Author, Kind, ` + tagsColumn + `
+		FROM		AnnotationLocations
+		INNER JOIN	Annotations
+		ON			AnnotationLocations.AnnId = Annotations.Id`
+	if len(where) > 0 {
+		q += "\n\t\tWHERE\t\t" + strings.Join(where, " AND ")
+	}
+	q += "\n\t\tORDER BY\t" + order + ";"
+	r, err := db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, opError("ListAnns", fmt.Errorf("query failed: %w", err))
+	}
+	defer r.Close()
+	ret := []Note{}
+	for r.Next() {
+		var (
+			n                Note
+			created, updated int64
+			kind, tags       sql.NullString
+		)
+		if err := r.Scan(&n.Id, &n.Workspace, &n.Path, &n.Line, &n.FileLevel, &n.Orphaned,
+			&n.Content, &created, &updated, &n.Author, &kind, &tags); err != nil {
+			return nil, opError("ListAnns", fmt.Errorf("could not scan: %w", err))
+		}
+		n.Created, n.Updated = time.Unix(created, 0), time.Unix(updated, 0)
+		n.Tags = splitTags(tags)
+		n.Kind = KindOf(Kind(kind.String), n.Content)
+		ret = append(ret, n)
+	}
+	return ret, opError("ListAnns", r.Err())
+}
+
+// TagCount is a tag, and the number of notes that have it.
+type TagCount struct {
+	Tag   string
+	Count int
+}
+
+// GetTags returns all tags of the live notes in workspace, or in all
+// workspaces if workspace is empty, with the number of notes that have them.
+func GetTags(ctx context.Context, db *sql.DB, workspace string) ([]TagCount, error) {
+	r, err := db.QueryContext(ctx, `
+		SELECT		Tag, COUNT(*)
+		FROM		Tags
+		INNER JOIN	AnnotationLocations
+		ON			AnnotationLocations.AnnId = Tags.AnnId
+		WHERE		(? = '' OR Workspace = ?)
+		GROUP BY	Tag
+		ORDER BY	Tag
+	;`, workspace, workspace)
+	if err != nil {
+		return nil, opError("GetTags", fmt.Errorf("query failed: %w", err))
+	}
+	defer r.Close()
+	ret := []TagCount{}
+	for r.Next() {
+		var t TagCount
+		if err := r.Scan(&t.Tag, &t.Count); err != nil {
+			return nil, opError("GetTags", fmt.Errorf("could not scan: %w", err))
+		}
+		ret = append(ret, t)
+	}
+	return ret, opError("GetTags", r.Err())
+}
+
+// GetLineTags returns the tags of the live annotations of each line of the
+// file at path.
+func GetLineTags(ctx context.Context, db *sql.DB, workspace, path string) (map[uint32][]string, error) {
+	r, err := db.QueryContext(ctx, `
+		SELECT DISTINCT	Line, Tag
+		FROM			AnnotationLocations
+		INNER JOIN		Tags
+		ON				AnnotationLocations.AnnId = Tags.AnnId
+		WHERE			Workspace = ? AND Path = ? AND Line IS NOT NULL AND Orphaned = 0
+		ORDER BY		Line, Tag
+	;`, workspace, path)
+	if err != nil {
+		return nil, opError("GetLineTags", fmt.Errorf("query failed: %w", err))
+	}
+	defer r.Close()
+	ret := map[uint32][]string{}
+	for r.Next() {
+		var (
+			line uint32
+			tag  string
+		)
+		if err := r.Scan(&line, &tag); err != nil {
+			return nil, opError("GetLineTags", fmt.Errorf("could not scan: %w", err))
+		}
+		ret[line] = append(ret[line], tag)
+	}
+	return ret, opError("GetLineTags", r.Err())
+}
+
+// SetKind sets the kind of the annotation with the given ID, in the file at
+// path.  An empty kind makes the kind follow from the content.
+func SetKind(ctx context.Context, db *sql.DB, workspace, path string, id int64, kind Kind) error {
+	glog.V(2).Infof("db/SetKind: ws=%v, path=%v, id=%v, kind=%v", workspace, path, id, kind)
+	k := sql.NullString{String: string(kind), Valid: kind != ""}
+	r, err := db.ExecContext(ctx, `
+		UPDATE	AnnotationLocations
+		SET		Kind = ?
+		WHERE	Id = ? AND Workspace = ? AND Path = ?
+	;`, k, id, workspace, path)
+	if err != nil {
+		return opError("SetKind", fmt.Errorf("id=%v: %w", id, err))
+	}
+	ra, err := r.RowsAffected()
+	if err != nil {
+		return opError("SetKind", fmt.Errorf("could not get rows affected: %w", err))
+	}
+	if ra == 0 {
+		return opError("SetKind", notFound("ws=%v, path=%v, id=%v", workspace, path, id))
+	}
+	return nil
+}
+
+// GetLineKinds returns the most urgent kind of the live annotations of each
+// line of the file at path.
+func GetLineKinds(ctx context.Context, db *sql.DB, workspace, path string) (map[uint32]Kind, error) {
+	r, err := db.QueryContext(ctx, `
+		SELECT		Line, Kind, `+contentColumn+`
+		FROM		AnnotationLocations
+		INNER JOIN	Annotations
+		ON			AnnotationLocations.AnnId = Annotations.Id
+		WHERE		Workspace = ? AND Path = ? AND Line IS NOT NULL AND Orphaned = 0
+	;`, workspace, path)
+	if err != nil {
+		return nil, opError("GetLineKinds", fmt.Errorf("query failed: %w", err))
+	}
+	defer r.Close()
+	ret := map[uint32]Kind{}
+	for r.Next() {
+		var (
+			line    uint32
+			kind    sql.NullString
+			content string
+		)
+		if err := r.Scan(&line, &kind, &content); err != nil {
+			return nil, opError("GetLineKinds", fmt.Errorf("could not scan: %w", err))
+		}
+		ret[line] = MostUrgent(ret[line], KindOf(Kind(kind.String), content))
+	}
+	return ret, opError("GetLineKinds", r.Err())
+}
+
+// Revision is a single revision of the content of an annotation.
+type Revision struct {
+	// Id identifies the revision.
+	Id      int64
+	Content string
+	// When the revision was made, and by whom.
+	Revised   time.Time
+	RevisedBy string
+}
+
+// GetHistory returns the revisions of the annotation with the given ID, in
+// the file at path, oldest first.  The last revision is the current content.
+func GetHistory(ctx context.Context, db *sql.DB, workspace, path string, id int64) ([]Revision, error) {
+	ret := []Revision{}
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		var annID sql.NullInt64
+		err := tx.QueryRowContext(ctx, `
+			SELECT	AnnId
+			FROM	AnnotationLocations
+			WHERE	Id = ? AND Workspace = ? AND Path = ?
+		;`, id, workspace, path).Scan(&annID)
+		if err == sql.ErrNoRows {
+			return notFound("ws=%v, path=%v, id=%v", workspace, path, id)
+		}
+		if err != nil {
+			return fmt.Errorf("id=%v: %w", id, err)
+		}
+		// The current content is included even if it was written before
+		// revisions were recorded.
+		r, err := tx.QueryContext(ctx, `
+			SELECT		Id, `+contentColumn+`, Revised, RevisedBy
+			FROM		Annotations
+			WHERE		NoteId = ? OR Id = ?
+			ORDER BY	Id
+		;`, id, annID)
+		if err != nil {
+			return fmt.Errorf("query failed: %w", err)
+		}
+		defer r.Close()
+		for r.Next() {
+			var (
+				rev     Revision
+				revised int64
+			)
+			if err := r.Scan(&rev.Id, &rev.Content, &revised, &rev.RevisedBy); err != nil {
+				return fmt.Errorf("could not scan: %w", err)
+			}
+			rev.Revised = time.Unix(revised, 0)
+			ret = append(ret, rev)
+		}
+		return r.Err()
+	})
+	if err != nil {
+		return nil, opError("GetHistory", err)
+	}
+	return ret, nil
+}
+
+// GetThreadsAsOf returns the annotations of the file at path as they were at
+// time t, ordered by line.  The annotations are on their current lines, or on
+// the lines they were deleted from if they are in the trash, with the content
+// of their latest revision made at or before t.  Annotations created after t,
+// or deleted at or before t, are left out.
+func GetThreadsAsOf(ctx context.Context, db *sql.DB, workspace, path string, t time.Time) ([]ThreadEntry, error) {
+	r, err := db.QueryContext(ctx, `
+		SELECT		Locs.Id, Line, `+contentColumn+`, Created, Revised, Author, Kind, `+tagsColumn+`
+		FROM		(
+						SELECT	Id, Workspace, Path, Line, AnnId, Orphaned, Created, Author, Kind
+						FROM	AnnotationLocations
+							UNION ALL
+						SELECT	Id, Workspace, Path, Line, AnnId, Orphaned, Created, Author, Kind
+						FROM	Trash
+						WHERE	Deleted > ?
+					) AS Locs
+		INNER JOIN	Annotations
+		ON			Annotations.Id = (
+						SELECT	MAX(Id)
+						FROM	Annotations
+						WHERE	(NoteId = Locs.Id OR Id = Locs.AnnId)
+									AND
+								Revised <= ?
+					)
+		WHERE
+			Locs.Workspace = ?
+				AND
+			Locs.Path = ?
+				AND
+			Locs.Line IS NOT NULL
+				AND
+			Locs.Orphaned = 0
+				AND
+			Locs.Created <= ?
+		ORDER BY	Line, Locs.Id
+	;`, t.Unix(), t.Unix(), workspace, path, t.Unix())
+	if err != nil {
+		return nil, opError("GetThreadsAsOf", fmt.Errorf("query failed: %w", err))
+	}
+	defer r.Close()
+	ret := []ThreadEntry{}
+	for r.Next() {
+		var (
+			e                ThreadEntry
+			created, revised int64
+			kind, tags       sql.NullString
+		)
+		if err := r.Scan(&e.Id, &e.Line, &e.Content, &created, &revised, &e.Author, &kind, &tags); err != nil {
+			return nil, opError("GetThreadsAsOf", fmt.Errorf("could not scan: %w", err))
+		}
+		e.Created, e.Updated = time.Unix(created, 0), time.Unix(revised, 0)
+		e.Tags = splitTags(tags)
+		e.Kind = KindOf(Kind(kind.String), e.Content)
+		ret = append(ret, e)
+	}
+	return ret, opError("GetThreadsAsOf", r.Err())
+}
+
+// Trashed is a deleted annotation in the trash.
+type Trashed struct {
+	// Note is the annotation at its original location.
+	Note
+	// Deleted is when the annotation was deleted.
+	Deleted time.Time
+}
+
+// ListTrash returns the annotations in the trash, of the file at path in
+// workspace, most recently deleted first.  Empty workspace or path select all.
+func ListTrash(ctx context.Context, db *sql.DB, workspace, path string) ([]Trashed, error) {
+	r, err := db.QueryContext(ctx, `
+		SELECT		Trash.Id, Workspace, Path, `+lineColumns+`, Orphaned, `+contentColumn+`,
+					Created, Updated, Author, Kind, `+tagsColumn+`, Deleted
+		FROM		Trash
+		INNER JOIN	Annotations
+		ON			Trash.AnnId = Annotations.Id
+		WHERE		(? = '' OR Workspace = ?) AND (? = '' OR Path = ?)
+		ORDER BY	Deleted DESC, Trash.Id DESC
+	;`, workspace, workspace, path, path)
+	if err != nil {
+		return nil, opError("ListTrash", fmt.Errorf("query failed: %w", err))
+	}
+	defer r.Close()
+	ret := []Trashed{}
+	for r.Next() {
+		var (
+			t                         Trashed
+			created, updated, deleted int64
+			kind, tags                sql.NullString
+		)
+		if err := r.Scan(&t.Id, &t.Workspace, &t.Path, &t.Line, &t.FileLevel, &t.Orphaned, &t.Content,
+			&created, &updated, &t.Author, &kind, &tags, &deleted); err != nil {
+			return nil, opError("ListTrash", fmt.Errorf("could not scan: %w", err))
+		}
+		t.Created, t.Updated, t.Deleted = time.Unix(created, 0), time.Unix(updated, 0), time.Unix(deleted, 0)
+		t.Tags = splitTags(tags)
+		t.Kind = KindOf(Kind(kind.String), t.Content)
+		ret = append(ret, t)
+	}
+	return ret, opError("ListTrash", r.Err())
+}
+
+// RestoreTrash moves the annotation id from the trash back to its original
+// location, and returns it.  The annotation joins any annotations that are on
+// that line now.
+func RestoreTrash(ctx context.Context, db *sql.DB, id int64) (Note, error) {
+	glog.V(2).Infof("db/RestoreTrash: id=%v", id)
+	var (
+		n                Note
+		created, updated int64
+		kind             sql.NullString
+	)
+	err := inTx(ctx, db, func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, `
+			SELECT		Workspace, Path, `+lineColumns+`, `+contentColumn+`, Created, Updated, Author, Kind
+			FROM		Trash
+			INNER JOIN	Annotations
+			ON			Trash.AnnId = Annotations.Id
+			WHERE		Trash.Id = ?
+		;`, id).Scan(&n.Workspace, &n.Path, &n.Line, &n.FileLevel, &n.Content, &created, &updated, &n.Author, &kind)
+		if err == sql.ErrNoRows {
+			return notFound("in the trash: id=%v", id)
+		}
+		if err != nil {
+			return fmt.Errorf("id=%v: %w", id, err)
+		}
+		var line any = n.Line
+		if n.FileLevel {
+			line = nil
+		}
+		_, err = txUntrash(ctx, tx, id, n.Workspace, n.Path, line)
+		return err
+	})
+	if err != nil {
+		return Note{}, opError("RestoreTrash", err)
+	}
+	n.Id = id
+	n.Created, n.Updated = time.Unix(created, 0), time.Unix(updated, 0)
+	n.Kind = KindOf(Kind(kind.String), n.Content)
+	n.Tags = ParseTags(n.Content)
+	return n, nil
+}
+
+// CollectGarbage deletes the annotation content that no annotation refers to,
+// neither as its current content nor as an older revision, e.g. content left
+// behind by older versions.  Returns the number of deleted content rows.
+func CollectGarbage(ctx context.Context, db *sql.DB) (int64, error) {
+	r, err := db.ExecContext(ctx, collectGarbageStmt)
+	if err != nil {
+		return 0, opError("CollectGarbage", err)
+	}
+	ra, err := r.RowsAffected()
+	if err != nil {
+		return 0, opError("CollectGarbage", fmt.Errorf("could not get rows affected: %w", err))
+	}
+	glog.V(1).Infof("db/CollectGarbage: deleted %v content rows", ra)
+	return ra, nil
+}
+
+// collectGarbageStmt deletes the content that no annotation, attached or in
+// the trash, refers to.
+const collectGarbageStmt = `
+		DELETE FROM	Annotations
+		WHERE		Id NOT IN (SELECT AnnId FROM AnnotationLocations WHERE AnnId IS NOT NULL)
+				AND
+					Id NOT IN (SELECT AnnId FROM Trash WHERE AnnId IS NOT NULL)
+				AND
+					(NoteId IS NULL OR NoteId NOT IN (SELECT Id FROM AnnotationLocations UNION SELECT Id FROM Trash))
+	;`
+
+// PurgeTrash permanently deletes the annotations that were put in the trash
+// before the time before.  Returns the number of purged annotations.
+func PurgeTrash(ctx context.Context, db *sql.DB, before time.Time) (int64, error) {
+	r, err := db.ExecContext(ctx, `DELETE FROM Trash WHERE Deleted < ?;`, before.Unix())
+	if err != nil {
+		return 0, opError("PurgeTrash", err)
+	}
+	ra, err := r.RowsAffected()
+	if err != nil {
+		return 0, opError("PurgeTrash", fmt.Errorf("could not get rows affected: %w", err))
+	}
+	return ra, nil
+}
+
+// GetNote returns the annotation with the given ID, attached or orphaned.
+func GetNote(ctx context.Context, db *sql.DB, id int64) (Note, error) {
+	var (
+		n                Note
+		created, updated int64
+		kind, tags       sql.NullString
+	)
+	err := db.QueryRowContext(ctx, `
+		SELECT		AnnotationLocations.Id, Workspace, Path, `+lineColumns+`, Orphaned,
+					`+contentColumn+`, Created, Updated, Author, Kind, `+tagsColumn+`
+		FROM		AnnotationLocations
+		INNER JOIN	Annotations
+		ON			AnnotationLocations.AnnId = Annotations.Id
+		WHERE		AnnotationLocations.Id = ?
+	;`, id).Scan(&n.Id, &n.Workspace, &n.Path, &n.Line, &n.FileLevel, &n.Orphaned,
+		&n.Content, &created, &updated, &n.Author, &kind, &tags)
+	if err == sql.ErrNoRows {
+		return n, opError("GetNote", notFound("id=%v", id))
+	}
+	if err != nil {
+		return n, opError("GetNote", fmt.Errorf("id=%v: %w", id, err))
+	}
+	n.Created, n.Updated = time.Unix(created, 0), time.Unix(updated, 0)
+	n.Tags = splitTags(tags)
+	n.Kind = KindOf(Kind(kind.String), n.Content)
+	return n, nil
+}
+
+// UpdateNote replaces the content of the annotation with the given ID,
+// attached or orphaned, with a new revision written by author.
+func UpdateNote(ctx context.Context, db *sql.DB, id int64, text, author string) error {
+	glog.V(2).Infof("db/UpdateNote: id=%v, author=%v", id, author)
+	return opError("UpdateNote", inTx(ctx, db, func(tx *sql.Tx) error {
+		if err := txCheckNote(ctx, tx, id); err != nil {
+			return err
+		}
+		return txAddRevision(ctx, tx, id, text, author)
+	}))
+}
+
+// txCheckNote returns ErrNotFound if there is no annotation, attached or
+// orphaned, with the given ID.
+func txCheckNote(ctx context.Context, tx *sql.Tx, id int64) error {
+	var n int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM AnnotationLocations WHERE Id = ?;`, id).Scan(&n); err != nil {
+		return fmt.Errorf("id=%v: %w", id, err)
+	}
+	if n == 0 {
+		return notFound("id=%v", id)
+	}
+	return nil
+}
+
+// DeleteNote moves the annotation with the given ID, attached or orphaned, to
+// the trash.
+func DeleteNote(ctx context.Context, db *sql.DB, id int64) error {
+	glog.V(2).Infof("db/DeleteNote: id=%v", id)
+	return opError("DeleteNote", inTx(ctx, db, func(tx *sql.Tx) error {
+		if err := txCheckNote(ctx, tx, id); err != nil {
+			return err
+		}
+		if err := txTrash(ctx, tx, `Id = ?`, id); err != nil {
+			return fmt.Errorf("id=%v: %w", id, err)
+		}
+		return nil
+	}))
+}
+
+// GetBacklinks returns the annotations whose current content links to the
+// annotation with the given ID, ordered by location.
+func GetBacklinks(ctx context.Context, db *sql.DB, id int64) ([]Note, error) {
+	r, err := db.QueryContext(ctx, `
+		SELECT		AnnotationLocations.Id, Workspace, Path, `+lineColumns+`, Orphaned, `+contentColumn+`
+		FROM		Links
+		INNER JOIN	AnnotationLocations
+		ON			AnnotationLocations.AnnId = Links.AnnId
+		INNER JOIN	Annotations
+		ON			Annotations.Id = Links.AnnId
+		WHERE		Links.Target = ?
+		ORDER BY	Workspace, Path, Line, AnnotationLocations.Id
+	;`, id)
+	if err != nil {
+		return nil, opError("GetBacklinks", fmt.Errorf("query failed: %w", err))
+	}
+	defer r.Close()
+	ret := []Note{}
+	for r.Next() {
+		var n Note
+		if err := r.Scan(&n.Id, &n.Workspace, &n.Path, &n.Line, &n.FileLevel, &n.Orphaned, &n.Content); err != nil {
+			return nil, opError("GetBacklinks", fmt.Errorf("could not scan: %w", err))
+		}
+		ret = append(ret, n)
+	}
+	return ret, opError("GetBacklinks", r.Err())
 }
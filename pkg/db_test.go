@@ -1,11 +1,14 @@
 package pkg
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"reflect"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/filmil/private-code-comments/tc"
 	_ "github.com/mattn/go-sqlite3"
@@ -29,11 +32,11 @@ func DBName() string {
 // data schema for the test.
 func NewDB() *sql.DB {
 	n := DBName()
-	db, err := sql.Open(SqliteDriver, n)
+	db, err := OpenDB(n)
 	if err != nil {
 		panic(fmt.Sprintf("could not open database: %v", err))
 	}
-	if err := CreateSchema(db); err != nil {
+	if err := CreateSchema(context.Background(), db); err != nil {
 		panic(fmt.Sprintf("could not create database schema: %v", err))
 	}
 	return db
@@ -58,6 +61,7 @@ func TMust[V any](t *testing.T, v V, err error) V {
 
 func TestInsertRead(t *testing.T) {
 	t.Parallel()
+	ctx := context.Background()
 	tests := []struct {
 		name            string
 		workspace, path string
@@ -82,11 +86,11 @@ func TestInsertRead(t *testing.T) {
 		db := NewDB()
 		test := test
 		t.Run(test.name, func(t *testing.T) {
-			if err := InsertAnn(db, test.workspace, test.path, test.line, test.content); err != nil {
+			if err := InsertAnn(ctx, db, test.workspace, test.path, test.line, test.content); err != nil {
 				t.Fatalf("could not insert record:\n\t%v:\n\ttest=%+v", err, test)
 			}
 
-			actual, err := GetAnn(db, test.workspace, test.path, test.line)
+			actual, err := GetAnn(ctx, db, test.workspace, test.path, test.line)
 			if err != nil {
 				t.Fatalf("could not read record:\n\t%v:\n\ttest=%+v", err, test)
 			}
@@ -99,6 +103,7 @@ func TestInsertRead(t *testing.T) {
 
 func TestInserts(t *testing.T) {
 	t.Parallel()
+	ctx := context.Background()
 	tests := []struct {
 		name     string
 		inserts  []Ann
@@ -141,12 +146,12 @@ func TestInserts(t *testing.T) {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
 			for _, a := range test.inserts {
-				if err := InsertAnn(db, "ws", "path", a.Line, a.Content); err != nil {
+				if err := InsertAnn(ctx, db, "ws", "path", a.Line, a.Content); err != nil {
 					t.Fatalf("could not insert record:\n\t%v:\n\ttest=%+v", err, test)
 				}
 			}
 
-			anns, err := GetAnns(db, "ws", "path")
+			anns, err := GetAnns(ctx, db, "ws", "path")
 			if err != nil {
 				t.Fatalf("could not read record:\n\t%v:\n\ttest=%+v", err, test)
 			}
@@ -159,6 +164,7 @@ func TestInserts(t *testing.T) {
 
 func TestInsertDelete(t *testing.T) {
 	t.Parallel()
+	ctx := context.Background()
 	tests := []struct {
 		name            string
 		workspace, path string
@@ -182,11 +188,11 @@ func TestInsertDelete(t *testing.T) {
 
 		test := test
 		t.Run(test.name, func(t *testing.T) {
-			if err := InsertAnn(db, test.workspace, test.path, test.line, test.content); err != nil {
+			if err := InsertAnn(ctx, db, test.workspace, test.path, test.line, test.content); err != nil {
 				t.Fatalf("could not insert record:\n\t%v:\n\ttest=%+v", err, test)
 			}
 
-			err := DeleteAnn(db, test.workspace, test.path, test.line)
+			err := DeleteAnn(ctx, db, test.workspace, test.path, test.line)
 			if err != nil {
 				t.Fatalf("could not delete record:\n\t%v:\n\ttest=%+v", err, test)
 			}
@@ -196,6 +202,7 @@ func TestInsertDelete(t *testing.T) {
 
 func TestMove(t *testing.T) {
 	t.Parallel()
+	ctx := context.Background()
 	tests := []struct {
 		name            string
 		workspace, path string
@@ -226,16 +233,16 @@ func TestMove(t *testing.T) {
 
 		test := test
 		t.Run(test.name, func(t *testing.T) {
-			if err := InsertAnn(db, test.workspace, test.path, test.line, test.content); err != nil {
+			if err := InsertAnn(ctx, db, test.workspace, test.path, test.line, test.content); err != nil {
 				t.Fatalf("could not insert record:\n\t%v:\n\ttest=%+v", err, test)
 			}
 
-			err := MoveAnn(db, test.workspace, test.path, test.line, test.newPath, test.newLine)
+			err := MoveAnn(ctx, db, test.workspace, test.path, test.line, test.newPath, test.newLine)
 			if err != nil {
 				t.Fatalf("could not move record:\n\t%v:\n\ttest=%+v", err, test)
 			}
 
-			actual, err := GetAnn(db, test.workspace, test.newPath, test.newLine)
+			actual, err := GetAnn(ctx, db, test.workspace, test.newPath, test.newLine)
 			if err != nil {
 				t.Fatalf("could not GetAnn: %v: %v", err, test)
 			}
@@ -248,17 +255,18 @@ func TestMove(t *testing.T) {
 }
 
 func TestBulkMove(t *testing.T) {
+	ctx := context.Background()
 	db := NewDB()
 
-	TMust1(t, InsertAnn(db, "ws", "path", 43, "one"))
-	TMust1(t, InsertAnn(db, "ws", "path", 44, "two"))
-	TMust1(t, InsertAnn(db, "ws", "path", 45, "three"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 43, "one"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 44, "two"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 45, "three"))
 
-	if err := BulkMoveAnn(db, "ws", "path", 44, 10); err != nil {
+	if err := BulkMoveAnn(ctx, db, "ws", "path", 44, 10); err != nil {
 		t.Fatalf("error while move: %v", err)
 	}
 
-	actual, err := GetAnns(db, "ws", "path")
+	actual, err := GetAnns(ctx, db, "ws", "path")
 	if err != nil {
 		t.Fatalf("could not GetAnns: %v", err)
 	}
@@ -275,6 +283,7 @@ func TestBulkMove(t *testing.T) {
 
 func TestInsertReadMulti(t *testing.T) {
 	t.Parallel()
+	ctx := context.Background()
 	tests := []struct {
 		name      string
 		set       []Ann
@@ -332,14 +341,14 @@ func TestInsertReadMulti(t *testing.T) {
 		test := test
 		t.Run(test.name, func(t *testing.T) {
 			for _, i := range test.set {
-				TMust1(t, InsertAnn(db, "ws", "path", i.Line, i.Content))
+				TMust1(t, InsertAnn(ctx, db, "ws", "path", i.Line, i.Content))
 			}
 
-			if err := BulkMoveAnn(db, "ws", "path", test.firstLine, test.delta); err != nil {
+			if err := BulkMoveAnn(ctx, db, "ws", "path", test.firstLine, test.delta); err != nil {
 				t.Fatalf("could not bulk move: %v", err)
 			}
 
-			anns, err := GetAnns(db, "ws", "path")
+			anns, err := GetAnns(ctx, db, "ws", "path")
 			if err != nil {
 				t.Fatalf("could not GetAnns: %v", err)
 			}
@@ -352,6 +361,7 @@ func TestInsertReadMulti(t *testing.T) {
 }
 
 func TestBulkRemove(t *testing.T) {
+	ctx := context.Background()
 	tests := []struct {
 		name      string
 		set       []Ann
@@ -419,14 +429,14 @@ func TestBulkRemove(t *testing.T) {
 			db := NewDB()
 			defer db.Close()
 			for _, i := range test.set {
-				TMust1(t, InsertAnn(db, "ws", "path", i.Line, i.Content))
+				TMust1(t, InsertAnn(ctx, db, "ws", "path", i.Line, i.Content))
 			}
 
-			if err := BulkDeleteAnn(db, "ws", "path", test.firstLine, test.lastLine, test.delta); err != nil {
+			if err := BulkDeleteAnn(ctx, db, "ws", "path", test.firstLine, test.lastLine, test.delta); err != nil {
 				t.Fatalf("could not bulk move: %v", err)
 			}
 
-			anns, err := GetAnns(db, "ws", "path")
+			anns, err := GetAnns(ctx, db, "ws", "path")
 			if err != nil {
 				t.Fatalf("could not GetAnns: %v", err)
 			}
@@ -434,86 +444,78 @@ func TestBulkRemove(t *testing.T) {
 			if reflect.DeepEqual(anns, test.expected) == false {
 				t.Errorf("want: %+v\n\tgot  : %+v", test.expected, anns)
 			}
+			// The deleted annotations are in the trash.
+			trash, err := ListTrash(ctx, db, "ws", "path")
+			if err != nil {
+				t.Fatalf("could not ListTrash: %v", err)
+			}
+			if len(trash)+len(anns) != len(test.set) {
+				t.Errorf("want the deleted annotations in the trash, got: %+v", trash)
+			}
 		})
 	}
 }
 
-func TestAddConcat(t *testing.T) {
+func TestMergeKeepsRecords(t *testing.T) {
 	t.Parallel()
-	tests := []struct {
-		name      string
-		set       []Ann
-		firstLine uint32
-		lastLine  uint32
-		delta     int32
-		expected  []Ann
-	}{
-		{
-			name: "basic",
-			set: []Ann{
-				{Line: 10, Content: "hello"},
-				{Line: 11, Content: "hello"},
-			},
-			firstLine: 1,
-			lastLine:  2,
-			expected: []Ann{
-				{Line: 1, Content: "hello"},
-				{Line: 2, Content: "hello"},
-			},
-		},
-		{
-			name: "merge",
-			set: []Ann{
-				{Line: 10, Content: "hello1"},
-				{Line: 11, Content: "hello2"},
-			},
-			firstLine: 10,
-			lastLine:  11,
-			expected: []Ann{
-				{Line: 1, Content: "hello1"},
-				{Line: 2, Content: "hello2"},
-				{Line: 3, Content: "hello1\n--\nhello2"},
-			},
-		},
-		{
-			name: "merge_three",
-			set: []Ann{
-				{Line: 10, Content: "hello1"},
-				{Line: 11, Content: "hello2"},
-				{Line: 12, Content: "hello3"},
-			},
-			firstLine: 10,
-			lastLine:  11,
-			expected: []Ann{
-				{Line: 1, Content: "hello1"},
-				{Line: 2, Content: "hello2"},
-				{Line: 3, Content: "hello3"},
-				{Line: 4, Content: "hello1\n--\nhello2"},
-			},
-		},
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 10, "hello1"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 11, "hello2"))
+
+	tx := tc.Must(db.Begin())
+	TMust1(t, TxBulkAppendAnn(ctx, tx, "ws", "path", 10, 11, -1))
+	TMust1(t, tx.Commit())
+
+	// No new content is made by merging.
+	raw := tc.Must(GetRawAnns(ctx, db))
+	if want := []Ann{{1, "hello1"}, {2, "hello2"}}; !reflect.DeepEqual(raw, want) {
+		t.Errorf("raw:\n\twant: %+v\n\tgot : %+v", want, raw)
+	}
+	if a := tc.Must(GetAnn(ctx, db, "ws", "path", 10)); a != "hello1\n--\nhello2" {
+		t.Errorf("merged: got: %q", a)
 	}
-	for _, test := range tests {
-		test := test
-		t.Run(test.name, func(t *testing.T) {
-			db := NewDB()
-			defer db.Close()
-			for _, i := range test.set {
-				TMust1(t, InsertAnn(db, "ws", "path", i.Line, i.Content))
-			}
 
-			tx := tc.Must(db.Begin())
-			tc.Must(addConcat(tx, "ws", "path", test.firstLine, test.lastLine))
-			TMust1(t, tx.Commit())
+	thread := func() []Ann {
+		var ret []Ann
+		for _, e := range tc.Must(GetThread(ctx, db, "ws", "path", 10)) {
+			ret = append(ret, Ann{uint32(e.Id), e.Content})
+		}
+		return ret
+	}
 
-			anns := tc.Must(GetRawAnns(db))
-			if reflect.DeepEqual(anns, test.expected) == false {
-				t.Errorf("\n\twant: %+v\n\tgot : %+v", test.expected, anns)
-			}
-		})
+	// Setting the line to the text shown keeps its records.
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 10, tc.Must(GetAnn(ctx, db, "ws", "path", 10))))
+	if got, want := thread(), []Ann{{1, "hello1"}, {2, "hello2"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after setting the shown text:\n\twant: %+v\n\tgot : %+v", want, got)
+	}
+	if raw := tc.Must(GetRawAnns(ctx, db)); len(raw) != 2 {
+		t.Errorf("want no new revisions, got: %+v", raw)
+	}
+
+	// Each part of the text is the content of the record in its place.
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 10, "hello1\n--\nhello2, edited\n--\nhello3"))
+	if got, want := thread(), []Ann{{1, "hello1"}, {2, "hello2, edited"}, {3, "hello3"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after editing a part:\n\twant: %+v\n\tgot : %+v", want, got)
+	}
+	if h := tc.Must(GetHistory(ctx, db, "ws", "path", 1)); len(h) != 1 {
+		t.Errorf("want the unchanged record unchanged, got: %+v", h)
+	}
+
+	// The records past the parts are trashed.
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 10, "edited"))
+	if got, want := thread(), []Ann{{1, "edited"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after set:\n\twant: %+v\n\tgot : %+v", want, got)
+	}
+	if trash := tc.Must(ListTrash(ctx, db, "ws", "path")); len(trash) != 2 {
+		t.Errorf("want 2 trashed records, got: %+v", trash)
 	}
 }
+
 func TestTxBulkAppendAnn(t *testing.T) {
 	t.Parallel()
+	ctx := context.Background()
 	tests := []struct {
 		name      string
 		set       []Ann
@@ -574,14 +576,14 @@ func TestTxBulkAppendAnn(t *testing.T) {
 			db := NewDB()
 			defer db.Close()
 			for _, i := range test.set {
-				TMust1(t, InsertAnn(db, "ws", "path", i.Line, i.Content))
+				TMust1(t, InsertAnn(ctx, db, "ws", "path", i.Line, i.Content))
 			}
 
 			tx := tc.Must(db.Begin())
-			TMust1(t, TxBulkAppendAnn(tx, "ws", "path", test.firstLine, test.lastLine, test.delta))
+			TMust1(t, TxBulkAppendAnn(ctx, tx, "ws", "path", test.firstLine, test.lastLine, test.delta))
 			TMust1(t, tx.Commit())
 
-			anns, err := GetAnns(db, "ws", "path")
+			anns, err := GetAnns(ctx, db, "ws", "path")
 			if err != nil {
 				t.Fatalf("could not GetAnns: %v", err)
 			}
@@ -592,3 +594,635 @@ func TestTxBulkAppendAnn(t *testing.T) {
 		})
 	}
 }
+
+func TestOrphans(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 1, "one"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 10, "ten"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 20, "twenty"))
+	again := tc.Must(AppendAnn(ctx, db, "ws", "path", 20, "twenty, again", ""))
+
+	if n := tc.Must(MarkOrphaned(ctx, db, "ws", "path", 10)); n != 3 {
+		t.Errorf("want 3 orphaned, got: %v", n)
+	}
+	if n := tc.Must(MarkOrphaned(ctx, db, "ws", "path", 10)); n != 0 {
+		t.Errorf("orphaning is not idempotent, got: %v", n)
+	}
+
+	anns := tc.Must(GetAnns(ctx, db, "ws", "path"))
+	if want := []Ann{{1, "one"}}; !reflect.DeepEqual(anns, want) {
+		t.Errorf("live: want: %+v\n\tgot : %+v", want, anns)
+	}
+	raw := tc.Must(GetOrphanedAnns(ctx, db, "ws", "path"))
+	orphans := orphanAnns(raw)
+	if want := []Ann{{10, "ten"}, {20, "twenty"}, {20, "twenty, again"}}; !reflect.DeepEqual(orphans, want) {
+		t.Fatalf("orphans: want: %+v\n\tgot : %+v", want, orphans)
+	}
+	if raw[2].Id != again {
+		t.Errorf("want the orphan IDs, got: %+v", raw)
+	}
+
+	// Orphans do not move with the lines of the file.
+	TMust1(t, BulkMoveAnn(ctx, db, "ws", "path", 0, 9))
+	// A live annotation can now occupy an orphan's old line.
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 20, "new twenty"))
+
+	// The orphans of one line are reattached one by one.
+	TMust1(t, ReattachAnn(ctx, db, "ws", "path", raw[1].Id, 5))
+	TMust1(t, ReattachAnn(ctx, db, "ws", "path", again, 6))
+	if err := ReattachAnn(ctx, db, "ws", "path", again, 3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reattaching a live annotation: want an ErrNotFound, got: %v", err)
+	}
+	if err := ReattachAnn(ctx, db, "ws", "other", raw[0].Id, 3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reattaching an orphan of another file: want an ErrNotFound, got: %v", err)
+	}
+
+	anns = tc.Must(GetAnns(ctx, db, "ws", "path"))
+	want := []Ann{{5, "twenty"}, {6, "twenty, again"}, {10, "one"}, {20, "new twenty"}}
+	if !reflect.DeepEqual(anns, want) {
+		t.Errorf("after reattach: want: %+v\n\tgot : %+v", want, anns)
+	}
+	orphans = orphanAnns(tc.Must(GetOrphanedAnns(ctx, db, "ws", "path")))
+	if want := []Ann{{10, "ten"}}; !reflect.DeepEqual(orphans, want) {
+		t.Errorf("orphans after reattach: want: %+v\n\tgot : %+v", want, orphans)
+	}
+}
+
+// orphanAnns returns the lines and contents of the orphans.
+func orphanAnns(orphans []Orphan) []Ann {
+	ret := []Ann{}
+	for _, o := range orphans {
+		ret = append(ret, o.Ann)
+	}
+	return ret
+}
+
+func TestTxBulkRemoveAnn(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var (
+		// Line 10 is deleted whole.
+		deleteLine = LineRange{Start: 10, End: 11}
+		// Line 11 is joined to the end of line 10.
+		joinLines = LineRange{Start: 10, StartCol: 5, End: 11}
+		// Lines 10 to 12 are replaced with a single line.
+		replaceLines = LineRange{Start: 10, End: 13}
+	)
+	tests := []struct {
+		name     string
+		policy   DeletePolicy
+		set      []Ann
+		lr       LineRange
+		delta    int32
+		expected []Ann
+		orphans  []Ann
+	}{
+		{
+			name:     "merge delete",
+			policy:   DeletePolicyMerge,
+			set:      []Ann{{10, "a"}, {11, "b"}, {12, "c"}},
+			lr:       deleteLine,
+			delta:    -1,
+			expected: []Ann{{10, "a\n--\nb"}, {11, "c"}},
+		},
+		{
+			name:     "drop delete",
+			policy:   DeletePolicyDrop,
+			set:      []Ann{{10, "a"}, {11, "b"}, {12, "c"}},
+			lr:       deleteLine,
+			delta:    -1,
+			expected: []Ann{{10, "b"}, {11, "c"}},
+		},
+		{
+			name:     "next delete",
+			policy:   DeletePolicyNext,
+			set:      []Ann{{10, "a"}, {11, "b"}, {12, "c"}},
+			lr:       deleteLine,
+			delta:    -1,
+			expected: []Ann{{10, "a\n--\nb"}, {11, "c"}},
+		},
+		{
+			name:     "orphan delete",
+			policy:   DeletePolicyOrphan,
+			set:      []Ann{{10, "a"}, {11, "b"}, {12, "c"}},
+			lr:       deleteLine,
+			delta:    -1,
+			expected: []Ann{{10, "b"}, {11, "c"}},
+			orphans:  []Ann{{10, "a"}},
+		},
+		{
+			name:     "drop join",
+			policy:   DeletePolicyDrop,
+			set:      []Ann{{10, "a"}, {11, "b"}, {12, "c"}},
+			lr:       joinLines,
+			delta:    -1,
+			expected: []Ann{{10, "a"}, {11, "c"}},
+		},
+		{
+			name:     "next join",
+			policy:   DeletePolicyNext,
+			set:      []Ann{{10, "a"}, {11, "b"}, {12, "c"}},
+			lr:       joinLines,
+			delta:    -1,
+			expected: []Ann{{10, "a"}, {11, "b\n--\nc"}},
+		},
+		{
+			name:     "next join at the end",
+			policy:   DeletePolicyNext,
+			set:      []Ann{{10, "a"}, {11, "b"}},
+			lr:       joinLines,
+			delta:    -1,
+			expected: []Ann{{10, "a"}, {11, "b"}},
+		},
+		{
+			name:     "orphan join",
+			policy:   DeletePolicyOrphan,
+			set:      []Ann{{10, "a"}, {11, "b"}, {12, "c"}},
+			lr:       joinLines,
+			delta:    -1,
+			expected: []Ann{{10, "a"}, {11, "c"}},
+			orphans:  []Ann{{11, "b"}},
+		},
+		{
+			name:     "merge replace",
+			policy:   DeletePolicyMerge,
+			set:      []Ann{{10, "a"}, {11, "b"}, {13, "d"}, {14, "e"}},
+			lr:       replaceLines,
+			delta:    -2,
+			expected: []Ann{{10, "a\n--\nb\n--\nd"}, {12, "e"}},
+		},
+		{
+			name:     "drop replace",
+			policy:   DeletePolicyDrop,
+			set:      []Ann{{10, "a"}, {11, "b"}, {13, "d"}, {14, "e"}},
+			lr:       replaceLines,
+			delta:    -2,
+			expected: []Ann{{11, "d"}, {12, "e"}},
+		},
+		{
+			name:     "next replace",
+			policy:   DeletePolicyNext,
+			set:      []Ann{{10, "a"}, {11, "b"}, {13, "d"}, {14, "e"}},
+			lr:       replaceLines,
+			delta:    -2,
+			expected: []Ann{{11, "a\n--\nb\n--\nd"}, {12, "e"}},
+		},
+		{
+			name:     "orphan replace",
+			policy:   DeletePolicyOrphan,
+			set:      []Ann{{10, "a"}, {11, "b"}, {13, "d"}, {14, "e"}},
+			lr:       replaceLines,
+			delta:    -2,
+			expected: []Ann{{11, "d"}, {12, "e"}},
+			orphans:  []Ann{{10, "a"}, {11, "b"}},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			db := NewDB()
+			defer db.Close()
+			for _, i := range test.set {
+				TMust1(t, InsertAnn(ctx, db, "ws", "path", i.Line, i.Content))
+			}
+
+			tx := tc.Must(db.Begin())
+			TMust1(t, TxBulkRemoveAnn(ctx, tx, test.policy, "ws", "path", test.lr, test.delta))
+			TMust1(t, tx.Commit())
+
+			anns := tc.Must(GetAnns(ctx, db, "ws", "path"))
+			if !reflect.DeepEqual(anns, test.expected) {
+				t.Errorf("\n\twant: %+v\n\tgot : %+v", test.expected, anns)
+			}
+			orphans := orphanAnns(tc.Must(GetOrphanedAnns(ctx, db, "ws", "path")))
+			if test.orphans == nil {
+				test.orphans = []Ann{}
+			}
+			if !reflect.DeepEqual(orphans, test.orphans) {
+				t.Errorf("orphans:\n\twant: %+v\n\tgot : %+v", test.orphans, orphans)
+			}
+		})
+	}
+}
+
+func TestParseDeletePolicy(t *testing.T) {
+	t.Parallel()
+	for _, s := range []string{"", "merge", "drop", "next", "orphan"} {
+		if _, err := ParseDeletePolicy(s); err != nil {
+			t.Errorf("ParseDeletePolicy(%q): %v", s, err)
+		}
+	}
+	if _, err := ParseDeletePolicy("shred"); err == nil {
+		t.Errorf("ParseDeletePolicy(shred): expected error")
+	}
+}
+
+func TestThread(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 10, "first"))
+	id2 := tc.Must(AppendAnn(ctx, db, "ws", "path", 10, "second", ""))
+	id3 := tc.Must(AppendAnn(ctx, db, "ws", "path", 10, "third", ""))
+	tc.Must(AppendAnn(ctx, db, "ws", "path", 11, "elsewhere", ""))
+
+	contents := func() []string {
+		var ret []string
+		for _, e := range tc.Must(GetThread(ctx, db, "ws", "path", 10)) {
+			if e.Created.IsZero() {
+				t.Errorf("no creation time: %+v", e)
+			}
+			ret = append(ret, e.Content)
+		}
+		return ret
+	}
+	if want, got := []string{"first", "second", "third"}, contents(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+	TMust1(t, EditAnnById(ctx, db, "ws", "path", id2, "edited", ""))
+	TMust1(t, DeleteAnnById(ctx, db, "ws", "path", id3))
+	if want, got := []string{"first", "edited"}, contents(); !reflect.DeepEqual(want, got) {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+	if a := tc.Must(GetAnn(ctx, db, "ws", "path", 10)); a != "first\n--\nedited" {
+		t.Errorf("shown together: got: %q", a)
+	}
+
+	// IDs are scoped to their files.
+	if err := EditAnnById(ctx, db, "ws", "other", id2, "x", ""); err == nil {
+		t.Errorf("edited an annotation of another file")
+	}
+	if err := DeleteAnnById(ctx, db, "ws", "path", id3); err == nil {
+		t.Errorf("deleted an annotation twice")
+	}
+}
+
+func TestListAnns(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnnBy(ctx, db, "ws", "b", 1, "one", "alice"))
+	tc.Must(AppendAnn(ctx, db, "ws", "a", 2, "two", "bob"))
+	tc.Must(AppendAnn(ctx, db, "ws2", "a", 3, "three", "alice"))
+	// Spread the times out, the annotations above are all made within the
+	// same second.
+	for id, ts := range map[int]int64{1: 300, 2: 100, 3: 200} {
+		tc.Must(db.Exec(`UPDATE AnnotationLocations SET Created = ?, Updated = ? WHERE Id = ?;`,
+			ts, 1000-ts, id))
+	}
+
+	tests := []struct {
+		name     string
+		f        ListFilter
+		expected []string
+	}{
+		{"all", ListFilter{}, []string{"two", "one", "three"}},
+		{"workspace", ListFilter{Workspace: "ws"}, []string{"two", "one"}},
+		{"file", ListFilter{Workspace: "ws", Path: "a"}, []string{"two"}},
+		{"author", ListFilter{Author: "alice"}, []string{"one", "three"}},
+		{"by created", ListFilter{SortBy: SortByCreated}, []string{"two", "three", "one"}},
+		{"by created desc", ListFilter{SortBy: SortByCreated, Desc: true}, []string{"one", "three", "two"}},
+		{"by updated", ListFilter{SortBy: SortByUpdated}, []string{"one", "three", "two"}},
+		{"by author", ListFilter{SortBy: SortByAuthor}, []string{"one", "three", "two"}},
+		{"created since", ListFilter{CreatedSince: time.Unix(200, 0)}, []string{"one", "three"}},
+		{"created until", ListFilter{CreatedUntil: time.Unix(200, 0)}, []string{"two"}},
+		{"updated range", ListFilter{UpdatedSince: time.Unix(750, 0), UpdatedUntil: time.Unix(850, 0)}, []string{"three"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, n := range tc.Must(ListAnns(ctx, db, test.f)) {
+			got = append(got, n.Content)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%v: want: %q, got: %q", test.name, test.expected, got)
+		}
+	}
+
+	n := tc.Must(ListAnns(ctx, db, ListFilter{Author: "bob"}))[0]
+	if n.Workspace != "ws" || n.Path != "a" || n.Line != 2 || n.Author != "bob" ||
+		!n.Created.Equal(time.Unix(100, 0)) || !n.Updated.Equal(time.Unix(900, 0)) {
+		t.Errorf("unexpected note: %+v", n)
+	}
+	if _, err := ListAnns(ctx, db, ListFilter{SortBy: "size"}); err == nil {
+		t.Errorf("accepted an unknown sort order")
+	}
+}
+
+func TestHistory(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnnBy(ctx, db, "ws", "path", 10, "v1", "alice"))
+	id := tc.Must(GetThread(ctx, db, "ws", "path", 10))[0].Id
+	TMust1(t, InsertAnnBy(ctx, db, "ws", "path", 10, "v2", "bob"))
+	TMust1(t, EditAnnById(ctx, db, "ws", "path", id, "v3", "carol"))
+	other := tc.Must(AppendAnn(ctx, db, "ws", "path", 10, "other", "dave"))
+	gone := tc.Must(AppendAnn(ctx, db, "ws", "path", 20, "gone", "erin"))
+
+	// Spread the revisions out in time, they were all made within the same
+	// second.
+	for annID, ts := range map[int]int64{1: 100, 2: 200, 3: 300, 4: 250, 5: 100} {
+		tc.Must(db.Exec(`UPDATE Annotations SET Revised = ? WHERE Id = ?;`, ts, annID))
+	}
+	tc.Must(db.Exec(`UPDATE AnnotationLocations SET Created = 100 WHERE Id IN (?, ?);`, id, gone))
+	tc.Must(db.Exec(`UPDATE AnnotationLocations SET Created = 250 WHERE Id = ?;`, other))
+	TMust1(t, DeleteNote(ctx, db, gone))
+	tc.Must(db.Exec(`UPDATE Trash SET Deleted = 500 WHERE Id = ?;`, gone))
+
+	var got []string
+	for _, r := range tc.Must(GetHistory(ctx, db, "ws", "path", id)) {
+		got = append(got, r.Content+"/"+r.RevisedBy)
+	}
+	if want := []string{"v1/alice", "v2/bob", "v3/carol"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("GetHistory: want: %q, got: %q", want, got)
+	}
+	if _, err := GetHistory(ctx, db, "ws", "other", id); err == nil {
+		t.Errorf("got the history of an annotation of another file")
+	}
+
+	tests := []struct {
+		t        int64
+		expected []string
+	}{
+		{50, nil},
+		{100, []string{"v1", "gone"}},
+		{249, []string{"v2", "gone"}},
+		{250, []string{"v2", "other", "gone"}},
+		{499, []string{"v3", "other", "gone"}},
+		{500, []string{"v3", "other"}},
+		{1000, []string{"v3", "other"}},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, e := range tc.Must(GetThreadsAsOf(ctx, db, "ws", "path", time.Unix(test.t, 0))) {
+			got = append(got, e.Content)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("GetThreadsAsOf(%v): want: %q, got: %q", test.t, test.expected, got)
+		}
+	}
+}
+
+func TestTrash(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnnBy(ctx, db, "ws", "path", 10, "careful #note", "alice"))
+	id := tc.Must(GetThread(ctx, db, "ws", "path", 10))[0].Id
+	id2 := tc.Must(AppendAnn(ctx, db, "ws", "path", 11, "second", ""))
+	tc.Must(AppendAnn(ctx, db, "ws", "path", 12, "third", ""))
+
+	// A stray delete, and one by ID.
+	TMust1(t, DeleteAnn(ctx, db, "ws", "path", 10))
+	TMust1(t, DeleteAnnById(ctx, db, "ws", "path", id2))
+	if anns, want := tc.Must(GetAnns(ctx, db, "ws", "path")), []Ann{{12, "third"}}; !reflect.DeepEqual(anns, want) {
+		t.Errorf("after delete:\n\twant: %+v\n\tgot : %+v", want, anns)
+	}
+	trash := tc.Must(ListTrash(ctx, db, "ws", ""))
+	if len(trash) != 2 {
+		t.Fatalf("want 2 annotations in the trash, got: %+v", trash)
+	}
+	if len(tc.Must(ListTrash(ctx, db, "ws", "other"))) != 0 {
+		t.Errorf("listed the trash of another file")
+	}
+
+	// The line was reused in the meantime.
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 10, "new"))
+	n := tc.Must(RestoreTrash(ctx, db, id))
+	if n.Line != 10 || n.Content != "careful #note" || n.Author != "alice" {
+		t.Errorf("unexpected restored note: %+v", n)
+	}
+	// The restored annotation is older, so it comes first in the thread.
+	if a := tc.Must(GetAnn(ctx, db, "ws", "path", 10)); a != "careful #note\n--\nnew" {
+		t.Errorf("after restore: got: %q", a)
+	}
+	if _, err := RestoreTrash(ctx, db, id); err == nil {
+		t.Errorf("restored an annotation twice")
+	}
+
+	// Only the annotations deleted before the cutoff are purged.
+	tc.Must(db.Exec(`UPDATE Trash SET Deleted = 100;`))
+	if n := tc.Must(PurgeTrash(ctx, db, time.Unix(50, 0))); n != 0 {
+		t.Errorf("purged %v annotations too early", n)
+	}
+	if n := tc.Must(PurgeTrash(ctx, db, time.Unix(150, 0))); n != 1 {
+		t.Errorf("want 1 purged annotation, got: %v", n)
+	}
+	if trash := tc.Must(ListTrash(ctx, db, "", "")); len(trash) != 0 {
+		t.Errorf("trash not empty: %+v", trash)
+	}
+}
+
+func TestDropMovesToTrash(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 10, "a"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 11, "b"))
+	locs := tc.Must(GetAnnLocs(ctx, db, "ws", "path", 10, 11))
+
+	tx := tc.Must(db.Begin())
+	TMust1(t, TxBulkRemoveAnn(ctx, tx, DeletePolicyDrop, "ws", "path", LineRange{Start: 10, End: 11}, -1))
+	TMust1(t, tx.Commit())
+	if trash := tc.Must(ListTrash(ctx, db, "ws", "path")); len(trash) != 1 || trash[0].Content != "a" {
+		t.Errorf("dropped annotation not in the trash: %+v", trash)
+	}
+
+	// Undoing the deletion takes the annotation out of the trash.
+	TMust1(t, BulkMoveAnn(ctx, db, "ws", "path", 10, 1))
+	TMust1(t, RestoreAnnLocs(ctx, db, "ws", "path", locs))
+	if trash := tc.Must(ListTrash(ctx, db, "ws", "path")); len(trash) != 0 {
+		t.Errorf("trash not empty: %+v", trash)
+	}
+	if anns, want := tc.Must(GetAnns(ctx, db, "ws", "path")), []Ann{{10, "a"}, {11, "b"}}; !reflect.DeepEqual(anns, want) {
+		t.Errorf("\n\twant: %+v\n\tgot : %+v", want, anns)
+	}
+}
+
+func TestFileAnns(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 0, "on the first line"))
+	TMust1(t, SetFileAnn(ctx, db, "ws", "path", "deprecated", "alice"))
+	TMust1(t, SetFileAnn(ctx, db, "ws", "path", "deprecated, use other", "bob"))
+	TMust1(t, SetFileAnn(ctx, db, "ws", "", "about the workspace", ""))
+
+	// File notes are not on any line, and stay put when lines move.
+	TMust1(t, BulkMoveAnn(ctx, db, "ws", "path", 0, 5))
+	tc.Must(MarkOrphaned(ctx, db, "ws", "path", 6))
+	if anns, want := tc.Must(GetAnns(ctx, db, "ws", "path")), []Ann{{5, "on the first line"}}; !reflect.DeepEqual(anns, want) {
+		t.Errorf("line notes:\n\twant: %+v\n\tgot : %+v", want, anns)
+	}
+	file := tc.Must(GetFileThread(ctx, db, "ws", "path"))
+	// The author is the one who wrote the note first.
+	if len(file) != 1 || file[0].Content != "deprecated, use other" || file[0].Author != "alice" {
+		t.Errorf("unexpected file notes: %+v", file)
+	}
+	if ws := tc.Must(GetFileThread(ctx, db, "ws", "")); len(ws) != 1 || ws[0].Content != "about the workspace" {
+		t.Errorf("unexpected workspace notes: %+v", ws)
+	}
+
+	var got []string
+	for _, n := range tc.Must(ListAnns(ctx, db, ListFilter{Workspace: "ws"})) {
+		got = append(got, fmt.Sprintf("%q:%v:%v", n.Path, n.Line, n.FileLevel))
+	}
+	if want := []string{`"":0:true`, `"path":0:true`, `"path":5:false`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListAnns:\n\twant: %v\n\tgot : %v", want, got)
+	}
+
+	// A deleted file note is restored as a file note.
+	TMust1(t, DeleteFileAnn(ctx, db, "ws", "path"))
+	if file := tc.Must(GetFileThread(ctx, db, "ws", "path")); len(file) != 0 {
+		t.Errorf("file notes not deleted: %+v", file)
+	}
+	n := tc.Must(RestoreTrash(ctx, db, file[0].Id))
+	if !n.FileLevel {
+		t.Errorf("restored note is not a file note: %+v", n)
+	}
+	if file := tc.Must(GetFileThread(ctx, db, "ws", "path")); len(file) != 1 {
+		t.Errorf("file note not restored: %+v", file)
+	}
+}
+
+func TestNoteById(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	id := tc.Must(AppendAnn(ctx, db, "ws", "path", 3, "before", "alice"))
+	tc.Must(AppendAnn(ctx, db, "ws", "path", 3, "other", "alice"))
+
+	// The ID still refers to the note after its line moved.
+	TMust1(t, BulkMoveAnn(ctx, db, "ws", "path", 0, 2))
+	TMust1(t, UpdateNote(ctx, db, id, "after", "bob"))
+	n := tc.Must(GetNote(ctx, db, id))
+	if n.Line != 5 || n.Content != "after" || n.Author != "alice" {
+		t.Errorf("unexpected note: %+v", n)
+	}
+	if h := tc.Must(GetHistory(ctx, db, "ws", "path", id)); len(h) != 2 || h[1].RevisedBy != "bob" {
+		t.Errorf("unexpected history: %+v", h)
+	}
+
+	TMust1(t, DeleteNote(ctx, db, id))
+	if a := tc.Must(GetAnn(ctx, db, "ws", "path", 5)); a != "other" {
+		t.Errorf("after delete: got: %q", a)
+	}
+	if trash := tc.Must(ListTrash(ctx, db, "ws", "path")); len(trash) != 1 || trash[0].Id != id {
+		t.Errorf("deleted note not in the trash: %+v", trash)
+	}
+	if err := UpdateNote(ctx, db, id, "gone", ""); err == nil {
+		t.Errorf("updated a deleted note")
+	}
+	if err := DeleteNote(ctx, db, id); err == nil {
+		t.Errorf("deleted a note twice")
+	}
+}
+
+func TestContentIntegrity(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	count := func(q string) int {
+		t.Helper()
+		var n int
+		TMust1(t, db.QueryRow(q).Scan(&n))
+		return n
+	}
+	if count(`PRAGMA foreign_keys;`) != 1 {
+		t.Fatalf("foreign keys are not enabled")
+	}
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 1, "one #perf"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 1, "one, edited #perf"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 2, "two"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 3, "three"))
+
+	// Deleting an annotation for good deletes all its revisions and tags.
+	TMust1(t, DropAnnLocs(ctx, db, []int64{tc.Must(GetThread(ctx, db, "ws", "path", 1))[0].Id}))
+	if n := count(`SELECT COUNT(*) FROM Annotations;`); n != 2 {
+		t.Errorf("want 2 contents left, got: %v", n)
+	}
+	if n := count(`SELECT COUNT(*) FROM Tags;`); n != 0 {
+		t.Errorf("want no tags left, got: %v", n)
+	}
+
+	// The content of an annotation in the trash is kept until it is purged.
+	TMust1(t, DeleteAnn(ctx, db, "ws", "path", 2))
+	if n := count(`SELECT COUNT(*) FROM Annotations;`); n != 2 {
+		t.Errorf("trashed content deleted, %v contents left", n)
+	}
+	tc.Must(PurgeTrash(ctx, db, time.Now().Add(time.Hour)))
+	if n := count(`SELECT COUNT(*) FROM Annotations;`); n != 1 {
+		t.Errorf("want 1 content left after purge, got: %v", n)
+	}
+
+	// Content that nothing refers to is collected.
+	tc.Must(db.Exec(`INSERT INTO Annotations(Content) VALUES ('stale'), ('also stale');`))
+	if n := tc.Must(CollectGarbage(ctx, db)); n != 2 {
+		t.Errorf("want 2 collected contents, got: %v", n)
+	}
+	if a := tc.Must(GetAnn(ctx, db, "ws", "path", 3)); a != "three" {
+		t.Errorf("reachable content collected: got: %q", a)
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnn(ctx, db, "ws", "fail", 1, "one"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "fail", 5, "five"))
+	// The last statement of each operation fails.
+	tc.Must(db.Exec(`
+		CREATE TRIGGER FailInsert BEFORE INSERT ON AnnotationLocations
+		WHEN NEW.Path = 'fail'
+		BEGIN SELECT RAISE(ABORT, 'injected failure'); END;
+		CREATE TRIGGER FailUpdate BEFORE UPDATE OF Line ON AnnotationLocations
+		WHEN NEW.Path = 'fail'
+		BEGIN SELECT RAISE(ABORT, 'injected failure'); END;
+	`))
+	contents := func() int {
+		t.Helper()
+		var n int
+		TMust1(t, db.QueryRow(`SELECT COUNT(*) FROM Annotations;`).Scan(&n))
+		return n
+	}
+	before := contents()
+
+	var e *OpError
+	if _, err := AppendAnn(ctx, db, "ws", "fail", 2, "two", ""); !errors.As(err, &e) || e.Op != "AppendAnn" {
+		t.Errorf("AppendAnn: want an error, got: %v", err)
+	}
+	if n := contents(); n != before {
+		t.Errorf("AppendAnn: want %v contents, got: %v", before, n)
+	}
+	if err := BulkDeleteAnn(ctx, db, "ws", "fail", 1, 1, -1); !errors.As(err, &e) || e.Op != "BulkDeleteAnn" {
+		t.Errorf("BulkDeleteAnn: want an error, got: %v", err)
+	}
+	if got, want := tc.Must(GetAnns(ctx, db, "ws", "fail")), []Ann{{1, "one"}, {5, "five"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("BulkDeleteAnn:\n\twant: %+v\n\tgot : %+v", want, got)
+	}
+
+	// Nothing is done once the context is done.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := InsertAnn(cctx, db, "ws", "path", 1, "canceled"); !errors.Is(err, context.Canceled) {
+		t.Errorf("want a canceled error, got: %v", err)
+	}
+	if got := tc.Must(GetAnns(ctx, db, "ws", "path")); len(got) != 0 {
+		t.Errorf("want no annotations, got: %+v", got)
+	}
+}
@@ -0,0 +1,225 @@
+// Open text document tracking.
+package pkg
+
+import (
+	"strings"
+	"sync"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	lsp "go.lsp.dev/protocol"
+)
+
+// Document is the server side copy of the text of an open document.
+//
+// The copy is kept up to date by applying the incremental changes sent by
+// the client in `textDocument/didChange`.
+type Document struct {
+	// Lines are the lines of text, without the line terminators.
+	Lines []string
+}
+
+// NewDocument creates a document from its full text.
+func NewDocument(text string) *Document {
+	return &Document{Lines: strings.Split(text, "\n")}
+}
+
+// NumLines returns the number of lines in the document, as an editor would
+// show them. A trailing newline does not start a new line.
+func (d *Document) NumLines() uint32 {
+	n := len(d.Lines)
+	if n > 1 && d.Lines[n-1] == "" {
+		n--
+	}
+	return uint32(n)
+}
+
+// Text returns the full text of the document.
+func (d *Document) Text() string {
+	return strings.Join(d.Lines, "\n")
+}
+
+// Apply replaces the text in the range r with text, and returns the text that
+// was replaced.
+func (d *Document) Apply(r lsp.Range, text string) string {
+	sl, sc := d.offset(r.Start)
+	el, ec := d.offset(r.End)
+	if el < sl || (el == sl && ec < sc) {
+		// Malformed range, treat as an insertion at start.
+		el, ec = sl, sc
+	}
+	var deleted string
+	if sl == el {
+		deleted = d.Lines[sl][sc:ec]
+	} else {
+		parts := []string{d.Lines[sl][sc:]}
+		parts = append(parts, d.Lines[sl+1:el]...)
+		parts = append(parts, d.Lines[el][:ec])
+		deleted = strings.Join(parts, "\n")
+	}
+	ins := strings.Split(d.Lines[sl][:sc]+text+d.Lines[el][ec:], "\n")
+	lines := make([]string, 0, len(d.Lines)-(el-sl)+len(ins))
+	lines = append(lines, d.Lines[:sl]...)
+	lines = append(lines, ins...)
+	lines = append(lines, d.Lines[el+1:]...)
+	d.Lines = lines
+	return deleted
+}
+
+// offset converts an LSP position into a line index and a byte offset in that
+// line, clamping the position to the document.
+func (d *Document) offset(p lsp.Position) (int, int) {
+	l := int(p.Line)
+	if l >= len(d.Lines) {
+		l = len(d.Lines) - 1
+		return l, len(d.Lines[l])
+	}
+	return l, UTF16ToByteOffset(d.Lines[l], p.Character)
+}
+
+// UTF16ToByteOffset converts a column expressed in UTF-16 code units, as LSP
+// does by default, into a byte offset in line. Columns past the end of the line
+// are clamped to the line length.
+func UTF16ToByteOffset(line string, col uint32) int {
+	var u uint32
+	for i, r := range line {
+		if u >= col {
+			return i
+		}
+		if r == utf8.RuneError {
+			u++
+			continue
+		}
+		u += uint32(utf16.RuneLen(r))
+	}
+	return len(line)
+}
+
+// IndentWidth returns the width of the leading whitespace of line, in UTF-16
+// code units.
+func IndentWidth(line string) uint32 {
+	return uint32(len(line) - len(strings.TrimLeft(line, " \t")))
+}
+
+// IsBlank returns true if line has only whitespace.
+func IsBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+// FirstMovedLine returns the first line whose content is pushed down when new
+// lines are inserted at lr, given the text of the line lr.Start before the
+// change.
+//
+// Inserting at or before the first non-blank character of a line pushes the
+// line itself down.  Inserting after it, for example at the end of the line,
+// splits the line, and the line itself stays in place.
+func FirstMovedLine(lr LineRange, line string) uint32 {
+	if IsBlank(line) {
+		if lr.StartCol == 0 {
+			return lr.Start
+		}
+		return lr.Start + 1
+	}
+	if lr.StartCol <= IndentWidth(line) {
+		return lr.Start
+	}
+	return lr.Start + 1
+}
+
+// RemovesFirstLine returns true if a change in lr removes all of the content
+// of the line lr.Start, given the text of that line before the change.  That
+// is so when the change starts at or before its first non-blank character.
+func RemovesFirstLine(lr LineRange, line string) bool {
+	return lr.StartCol == 0 || (!IsBlank(line) && lr.StartCol <= IndentWidth(line))
+}
+
+// Documents is a concurrency safe collection of open documents.
+type Documents struct {
+	m    sync.Mutex
+	docs map[lsp.URI]*Document
+}
+
+// NewDocuments creates an empty document collection.
+func NewDocuments() *Documents {
+	return &Documents{docs: map[lsp.URI]*Document{}}
+}
+
+// Open starts tracking a document with the given full text.
+func (d *Documents) Open(uri lsp.URI, text string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.docs[uri] = NewDocument(text)
+}
+
+// Close stops tracking the document.
+func (d *Documents) Close(uri lsp.URI) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	delete(d.docs, uri)
+}
+
+// Apply applies a change to the document uri, and returns the replaced text.
+// Returns false if the document is not tracked.
+func (d *Documents) Apply(uri lsp.URI, r lsp.Range, text string) (string, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	doc, ok := d.docs[uri]
+	if !ok {
+		return "", false
+	}
+	return doc.Apply(r, text), true
+}
+
+// NumLines returns the number of lines of the document uri. Returns false if
+// the document is not tracked.
+func (d *Documents) NumLines(uri lsp.URI) (uint32, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	doc, ok := d.docs[uri]
+	if !ok {
+		return 0, false
+	}
+	return doc.NumLines(), true
+}
+
+// Text returns the full text of the document uri. Returns false if the
+// document is not tracked.
+func (d *Documents) Text(uri lsp.URI) (string, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	doc, ok := d.docs[uri]
+	if !ok {
+		return "", false
+	}
+	return doc.Text(), true
+}
+
+// Line returns the text of the line i of the document uri. Returns false if
+// the document is not tracked, or has no such line.
+func (d *Documents) Line(uri lsp.URI, i uint32) (string, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	doc, ok := d.docs[uri]
+	if !ok || int(i) >= len(doc.Lines) {
+		return "", false
+	}
+	return doc.Lines[i], true
+}
+
+// Lines returns the text of the lines first to last of the document uri, as
+// far as the document has them. Returns false if the document is not tracked.
+func (d *Documents) Lines(uri lsp.URI, first, last uint32) ([]string, bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	doc, ok := d.docs[uri]
+	if !ok {
+		return nil, false
+	}
+	if int(last) >= len(doc.Lines) {
+		last = uint32(len(doc.Lines) - 1)
+	}
+	if first > last {
+		return nil, true
+	}
+	return append([]string(nil), doc.Lines[first:last+1]...), true
+}
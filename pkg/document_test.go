@@ -0,0 +1,149 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	lsp "go.lsp.dev/protocol"
+)
+
+func rng(sl, sc, el, ec uint32) lsp.Range {
+	return lsp.Range{
+		Start: lsp.Position{Line: sl, Character: sc},
+		End:   lsp.Position{Line: el, Character: ec},
+	}
+}
+
+func TestDocumentApply(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		text     string
+		r        lsp.Range
+		insert   string
+		expected []string
+		deleted  string
+	}{
+		{
+			name:     "insert line at top",
+			text:     "one\ntwo\n",
+			r:        rng(0, 0, 0, 0),
+			insert:   "zero\n",
+			expected: []string{"zero", "one", "two", ""},
+		},
+		{
+			name:     "delete first line",
+			text:     "one\ntwo\n",
+			r:        rng(0, 0, 1, 0),
+			expected: []string{"two", ""},
+			deleted:  "one\n",
+		},
+		{
+			name:     "join lines",
+			text:     "one\ntwo\n",
+			r:        rng(0, 3, 1, 0),
+			insert:   " ",
+			expected: []string{"one two", ""},
+			deleted:  "\n",
+		},
+		{
+			name:     "edit within a line",
+			text:     "one\ntwo\n",
+			r:        rng(1, 1, 1, 2),
+			insert:   "W",
+			expected: []string{"one", "tWo", ""},
+			deleted:  "w",
+		},
+		{
+			name:     "utf-16 columns",
+			text:     "a😀b\n",
+			r:        rng(0, 3, 0, 4),
+			insert:   "c",
+			expected: []string{"a😀c", ""},
+			deleted:  "b",
+		},
+		{
+			name:     "range past the end",
+			text:     "one",
+			r:        rng(5, 0, 5, 0),
+			insert:   "\ntwo",
+			expected: []string{"one", "two"},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDocument(test.text)
+			deleted := d.Apply(test.r, test.insert)
+			if !reflect.DeepEqual(d.Lines, test.expected) {
+				t.Errorf("\n\twant: %q\n\tgot : %q", test.expected, d.Lines)
+			}
+			if deleted != test.deleted {
+				t.Errorf("deleted: want: %q, got: %q", test.deleted, deleted)
+			}
+		})
+	}
+}
+
+func TestDocumentNumLines(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		text     string
+		expected uint32
+	}{
+		{"", 1},
+		{"one", 1},
+		{"one\n", 1},
+		{"one\ntwo", 2},
+		{"one\ntwo\n\n", 3},
+	}
+	for _, test := range tests {
+		if n := NewDocument(test.text).NumLines(); n != test.expected {
+			t.Errorf("NumLines(%q): want: %v, got: %v", test.text, test.expected, n)
+		}
+	}
+}
+
+func TestFirstMovedLine(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		name     string
+		line     string
+		col      uint32
+		expected uint32
+	}{
+		{"at the end", "\tfoo()", 6, 11},
+		{"in the middle", "\tfoo()", 3, 11},
+		{"before the first non-blank", "\tfoo()", 1, 10},
+		{"at the start", "\tfoo()", 0, 10},
+		{"blank line start", "  ", 0, 10},
+		{"blank line end", "  ", 2, 11},
+	}
+	for _, test := range tests {
+		lr := LineRange{Start: 10, StartCol: test.col, End: 10, EndCol: test.col}
+		if l := FirstMovedLine(lr, test.line); l != test.expected {
+			t.Errorf("%v: want: %v, got: %v", test.name, test.expected, l)
+		}
+	}
+}
+
+func TestRemovesFirstLine(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		line     string
+		col      uint32
+		expected bool
+	}{
+		{"\tfoo()", 0, true},
+		{"\tfoo()", 1, true},
+		{"\tfoo()", 2, false},
+		{"\tfoo()", 6, false},
+		{"", 0, true},
+	}
+	for _, test := range tests {
+		lr := LineRange{Start: 10, StartCol: test.col, End: 11}
+		if r := RemovesFirstLine(lr, test.line); r != test.expected {
+			t.Errorf("RemovesFirstLine(%q, %v): want: %v, got: %v", test.line, test.col, test.expected, r)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Errors of the annotation operations
+package pkg
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	// ErrNotFound is the error of an operation on an annotation, or a
+	// trashed annotation, that does not exist.
+	ErrNotFound = errors.New("no such annotation")
+	// ErrInvalid is the error of an operation with invalid arguments, such
+	// as an empty path or an unknown sort order.
+	ErrInvalid = errors.New("invalid argument")
+	// ErrKey is the error of a missing or wrong key of the encrypted
+	// contents, see Key.
+	ErrKey = errors.New("wrong or missing key")
+)
+
+// OpError is the error of a failed operation of a Store, or of the database
+// functions behind SQLStore.  Use errors.Is with ErrNotFound and ErrInvalid,
+// and IsTransient, to tell the reasons apart.
+type OpError struct {
+	// Op is the name of the operation, such as "GetNote".
+	Op  string
+	Err error
+}
+
+func (e *OpError) Error() string {
+	return e.Op + ": " + e.Err.Error()
+}
+
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// opError returns err as an error of the operation op, or nil if err is nil.
+func opError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &OpError{Op: op, Err: err}
+}
+
+// notFound returns an ErrNotFound, detailed by format and args.
+func notFound(format string, args ...any) error {
+	return fmt.Errorf("%w: "+format, append([]any{ErrNotFound}, args...)...)
+}
+
+// invalid returns an ErrInvalid, detailed by format and args.
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: "+format, append([]any{ErrInvalid}, args...)...)
+}
+
+// IsTransient returns true if err is because the database was locked by
+// another connection, possibly of another process, for longer than the busy
+// timeout.  The failed operation may succeed if tried again.
+func IsTransient(err error) bool {
+	var e sqlite3.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	return e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked
+}
@@ -53,6 +53,17 @@ func FindWorkspace(w []lsp.WorkspaceFolder, fileURI lsp.URI) (string, string) {
 	return pWs, pFile
 }
 
+// FileURI is the inverse of FindWorkspace: it returns the URI of the file at
+// path in the workspace ws, if ws is one of the workspaces in w.
+func FileURI(w []lsp.WorkspaceFolder, ws, path string) (lsp.URI, bool) {
+	for _, f := range w {
+		if f.Name == ws || (f.Name == "" && f.URI == ws) {
+			return lsp.URI(f.URI + path), true
+		}
+	}
+	return "", false
+}
+
 // ConfigFilename is the file name that, if found in the workspace, is used to
 // name the workspace.
 const ConfigFilename = `pcc.config.json`
@@ -66,6 +77,14 @@ const ConfigFilename = `pcc.config.json`
 //
 // ("ws", "/file.txt")
 func ResolveWs(in []lsp.WorkspaceFolder) []lsp.WorkspaceFolder {
+	ret, _ := ResolveWsConfigs(in)
+	return ret
+}
+
+// ResolveWsConfigs is like ResolveWs, but also returns the workspace configs
+// that were found, keyed by the resolved workspace name.
+func ResolveWsConfigs(in []lsp.WorkspaceFolder) ([]lsp.WorkspaceFolder, map[string]WorkspaceConfig) {
+	cfgs := map[string]WorkspaceConfig{}
 	for i := range in {
 		ws := lsp.URI(in[i].URI)
 		cfg := path.Join(ws.Filename(), ConfigFilename)
@@ -82,13 +101,23 @@ func ResolveWs(in []lsp.WorkspaceFolder) []lsp.WorkspaceFolder {
 			continue
 		}
 		c, err := JSONUnmarshal[WorkspaceConfig](f)
+		f.Close()
 		if err != nil {
 			glog.Warningf("could not parse config from: %v: %v", cfg, err)
 			continue
 		}
+		if _, err := ParseDeletePolicy(string(c.DeletePolicy)); err != nil {
+			glog.Warningf("ignoring config: %v: %v", cfg, err)
+			c.DeletePolicy = ""
+		}
 		in[i].Name = c.WorkspaceName
+		name := in[i].Name
+		if name == "" {
+			name = in[i].URI
+		}
+		cfgs[name] = c
 	}
-	return in
+	return in, cfgs
 }
 
 // JSONUnmarshal is a typed parser for a go type.
@@ -68,6 +68,9 @@ func TestFindWorkspace(t *testing.T) {
 			if aw != test.ws || af != test.fn {
 				t.Errorf("want: (w:%v, f:%v), got: (w:%v, f:%v)", test.ws, test.fn, aw, af)
 			}
+			if u, ok := FileURI(test.w, aw, af); !ok || u != test.f {
+				t.Errorf("FileURI: want: %v, got: %v", test.f, u)
+			}
 		})
 	}
 }
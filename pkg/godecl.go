@@ -0,0 +1,126 @@
+// Go declaration lookup, for anchoring annotations to declarations.
+package pkg
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+)
+
+// AnchorAuto is the anchor name that requests anchoring to the innermost
+// declaration enclosing the annotated line.
+const AnchorAuto = `auto`
+
+// GoDecl is a single top level declaration in a Go source file.
+type GoDecl struct {
+	// Name is the qualified declaration name, e.g. `pkg.(*Server).Shutdown`.
+	Name string
+	// Start is the 0-based line where the declaration starts.
+	Start uint32
+	// End is the 0-based line where the declaration ends.
+	End uint32
+}
+
+// IsGoFile returns true if the annotations of path can be anchored to Go
+// declarations.
+func IsGoFile(path string) bool {
+	return strings.HasSuffix(path, ".go")
+}
+
+// ParseGoDecls parses the Go source src, and returns its top level
+// declarations in source order.
+//
+// Functions are named `pkg.Func`, methods `pkg.Type.Method` or
+// `pkg.(*Type).Method` depending on the receiver, and types, variables and
+// constants `pkg.Name`.
+func ParseGoDecls(src string) ([]GoDecl, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse Go source: %w", err)
+	}
+	pkg := f.Name.Name
+	lines := func(n ast.Node) (uint32, uint32) {
+		return uint32(fset.Position(n.Pos()).Line - 1), uint32(fset.Position(n.End()).Line - 1)
+	}
+	var ret []GoDecl
+	for _, d := range f.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			s, e := lines(d)
+			ret = append(ret, GoDecl{Name: pkg + "." + funcName(d), Start: s, End: e})
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				// A declaration without parens spans its only spec, including
+				// the keyword.
+				var n ast.Node = spec
+				if !d.Lparen.IsValid() {
+					n = d
+				}
+				s, e := lines(n)
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					ret = append(ret, GoDecl{Name: pkg + "." + spec.Name.Name, Start: s, End: e})
+				case *ast.ValueSpec:
+					for _, id := range spec.Names {
+						if id.Name == "_" {
+							continue
+						}
+						ret = append(ret, GoDecl{Name: pkg + "." + id.Name, Start: s, End: e})
+					}
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+// funcName returns the name of a function or method, without the package.
+func funcName(d *ast.FuncDecl) string {
+	if d.Recv == nil || len(d.Recv.List) == 0 {
+		return d.Name.Name
+	}
+	t := d.Recv.List[0].Type
+	ptr := false
+	if s, ok := t.(*ast.StarExpr); ok {
+		ptr = true
+		t = s.X
+	}
+	// Strip type parameters of generic receivers.
+	switch x := t.(type) {
+	case *ast.IndexExpr:
+		t = x.X
+	case *ast.IndexListExpr:
+		t = x.X
+	}
+	var recv string
+	if id, ok := t.(*ast.Ident); ok {
+		recv = id.Name
+	}
+	if ptr {
+		return fmt.Sprintf("(*%s).%s", recv, d.Name.Name)
+	}
+	return fmt.Sprintf("%s.%s", recv, d.Name.Name)
+}
+
+// FindGoDecl returns the declaration with the given qualified name.
+func FindGoDecl(decls []GoDecl, name string) (GoDecl, bool) {
+	for _, d := range decls {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return GoDecl{}, false
+}
+
+// EnclosingGoDecl returns the declaration that spans line.
+func EnclosingGoDecl(decls []GoDecl, line uint32) (GoDecl, bool) {
+	for _, d := range decls {
+		if d.Start <= line && line <= d.End {
+			return d, true
+		}
+	}
+	return GoDecl{}, false
+}
@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/filmil/private-code-comments/tc"
+)
+
+const goSrc = `package pkg
+
+type Server struct {
+	n int
+}
+
+type (
+	A int
+	B[T any] struct{}
+)
+
+const x, y = 1, 2
+
+func NewServer() *Server {
+	return &Server{}
+}
+
+func (s *Server) Shutdown() {
+}
+
+func (Server) Value() {}
+
+func (b *B[T]) Get() {}
+`
+
+func TestParseGoDecls(t *testing.T) {
+	t.Parallel()
+	decls, err := ParseGoDecls(goSrc)
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	want := []GoDecl{
+		{Name: "pkg.Server", Start: 2, End: 4},
+		{Name: "pkg.A", Start: 7, End: 7},
+		{Name: "pkg.B", Start: 8, End: 8},
+		{Name: "pkg.x", Start: 11, End: 11},
+		{Name: "pkg.y", Start: 11, End: 11},
+		{Name: "pkg.NewServer", Start: 13, End: 15},
+		{Name: "pkg.(*Server).Shutdown", Start: 17, End: 18},
+		{Name: "pkg.Server.Value", Start: 20, End: 20},
+		{Name: "pkg.(*B).Get", Start: 22, End: 22},
+	}
+	if !reflect.DeepEqual(decls, want) {
+		t.Errorf("\n\twant: %+v\n\tgot : %+v", want, decls)
+	}
+
+	if d, ok := EnclosingGoDecl(decls, 14); !ok || d.Name != "pkg.NewServer" {
+		t.Errorf("EnclosingGoDecl: got: %+v, %v", d, ok)
+	}
+	if _, ok := EnclosingGoDecl(decls, 12); ok {
+		t.Errorf("EnclosingGoDecl: line 12 is not in a declaration")
+	}
+}
+
+func TestParseGoDeclsError(t *testing.T) {
+	t.Parallel()
+	if _, err := ParseGoDecls("package pkg\nfunc {"); err == nil {
+		t.Errorf("expected a parse error")
+	}
+}
+
+func TestResolveAnchors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+
+	TMust1(t, InsertAnn(ctx, db, "ws", "f.go", 2, "the server"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "f.go", 14, "inside NewServer"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "f.go", 17, "shutdown"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "f.go", 20, "not anchored"))
+	TMust1(t, SetAnchor(ctx, db, "ws", "f.go", 2, "pkg.Server", 2))
+	TMust1(t, SetAnchor(ctx, db, "ws", "f.go", 14, "pkg.NewServer", 13))
+	TMust1(t, SetAnchor(ctx, db, "ws", "f.go", 17, "pkg.(*Server).Shutdown", 17))
+
+	// Shutdown and NewServer swap places, Server is gone.
+	decls := []GoDecl{
+		{Name: "pkg.(*Server).Shutdown", Start: 13, End: 14},
+		{Name: "pkg.NewServer", Start: 16, End: 18},
+	}
+	TMust1(t, ResolveAnchors(ctx, db, "ws", "f.go", decls))
+
+	want := []Ann{
+		{13, "shutdown"},
+		{17, "inside NewServer"},
+		{20, "not anchored"},
+	}
+	if anns := tc.Must(GetAnns(ctx, db, "ws", "f.go")); !reflect.DeepEqual(anns, want) {
+		t.Errorf("\n\twant: %+v\n\tgot : %+v", want, anns)
+	}
+	if o := orphanAnns(tc.Must(GetOrphanedAnns(ctx, db, "ws", "f.go"))); !reflect.DeepEqual(o, []Ann{{2, "the server"}}) {
+		t.Errorf("orphans: got: %+v", o)
+	}
+
+	// Server comes back, onto a line that has an annotation.
+	decls = append(decls, GoDecl{Name: "pkg.Server", Start: 20, End: 22})
+	TMust1(t, ResolveAnchors(ctx, db, "ws", "f.go", decls))
+	if o := orphanAnns(tc.Must(GetOrphanedAnns(ctx, db, "ws", "f.go"))); len(o) != 0 {
+		t.Errorf("orphans: got: %+v", o)
+	}
+	if a := tc.Must(GetAnn(ctx, db, "ws", "f.go", 20)); a != "the server\n--\nnot anchored" {
+		t.Errorf("reattached: got: %q", a)
+	}
+}
+
+func TestDeletedAnchoredAnnIsOrphaned(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+
+	TMust1(t, InsertAnn(ctx, db, "ws", "f.go", 10, "anchored"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "f.go", 11, "plain"))
+	TMust1(t, SetAnchor(ctx, db, "ws", "f.go", 10, "pkg.F", 10))
+
+	tx := tc.Must(db.Begin())
+	TMust1(t, TxBulkAppendAnn(ctx, tx, "ws", "f.go", 10, 11, -1))
+	TMust1(t, tx.Commit())
+
+	if anns := tc.Must(GetAnns(ctx, db, "ws", "f.go")); !reflect.DeepEqual(anns, []Ann{{10, "plain"}}) {
+		t.Errorf("anns: got: %+v", anns)
+	}
+	if o := orphanAnns(tc.Must(GetOrphanedAnns(ctx, db, "ws", "f.go"))); !reflect.DeepEqual(o, []Ann{{10, "anchored"}}) {
+		t.Errorf("orphans: got: %+v", o)
+	}
+}
@@ -0,0 +1,100 @@
+// Annotation kinds, and how they are shown.
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	lsp "go.lsp.dev/protocol"
+)
+
+// Kind is the kind of an annotation, which decides how urgently it is shown.
+type Kind string
+
+const (
+	KindNote     Kind = `note`
+	KindQuestion Kind = `question`
+	KindTodo     Kind = `todo`
+	KindWarning  Kind = `warning`
+	KindBug      Kind = `bug`
+
+	// DefaultKind is the kind of annotations that do not say otherwise.
+	DefaultKind = KindNote
+)
+
+// kindPrefixes are the content prefixes that set the kind of an annotation.
+var kindPrefixes = []struct {
+	prefix string
+	kind   Kind
+}{
+	{"NOTE:", KindNote},
+	{"QUESTION:", KindQuestion},
+	{"TODO:", KindTodo},
+	{"FIXME:", KindTodo},
+	{"WARNING:", KindWarning},
+	{"WARN:", KindWarning},
+	{"BUG:", KindBug},
+}
+
+// ParseKind parses a kind name. An empty name is no kind.
+func ParseKind(s string) (Kind, error) {
+	switch k := Kind(strings.ToLower(s)); k {
+	case "", KindNote, KindQuestion, KindTodo, KindWarning, KindBug:
+		return k, nil
+	default:
+		return "", fmt.Errorf("unknown kind: %q", s)
+	}
+}
+
+// KindOf returns the kind of an annotation with the content text. If kind is
+// empty, the kind is taken from a prefix of the content, such as `TODO:`.
+func KindOf(kind Kind, text string) Kind {
+	if kind != "" {
+		return kind
+	}
+	t := strings.ToUpper(strings.TrimSpace(text))
+	for _, p := range kindPrefixes {
+		if strings.HasPrefix(t, p.prefix) {
+			return p.kind
+		}
+	}
+	return DefaultKind
+}
+
+// Severity returns the diagnostic severity used to show annotations of kind k.
+func (k Kind) Severity() lsp.DiagnosticSeverity {
+	switch k {
+	case KindQuestion, KindTodo:
+		return lsp.DiagnosticSeverityInformation
+	case KindWarning, KindBug:
+		return lsp.DiagnosticSeverityWarning
+	default:
+		return lsp.DiagnosticSeverityHint
+	}
+}
+
+// Code returns the diagnostic code of annotations of kind k, e.g. `pcc-todo`.
+func (k Kind) Code() string {
+	if k == "" {
+		k = DefaultKind
+	}
+	return "pcc-" + string(k)
+}
+
+// urgency orders the kinds from the least to the most urgent.
+var urgency = map[Kind]int{
+	KindNote:     0,
+	KindQuestion: 1,
+	KindTodo:     2,
+	KindWarning:  3,
+	KindBug:      4,
+}
+
+// MostUrgent returns the more urgent of the kinds a and b.  An empty kind is
+// less urgent than all others.
+func MostUrgent(a, b Kind) Kind {
+	if a == "" || urgency[b] > urgency[a] {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,82 @@
+package pkg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/filmil/private-code-comments/tc"
+	lsp "go.lsp.dev/protocol"
+)
+
+func TestKindOf(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		kind     Kind
+		text     string
+		expected Kind
+	}{
+		{"", "just a note", KindNote},
+		{"", "TODO: fix this", KindTodo},
+		{"", "  bug: off by one", KindBug},
+		{"", "Warn: slow", KindWarning},
+		{"", "question: why?", KindQuestion},
+		{"", "not a TODO: here", KindNote},
+		{KindQuestion, "TODO: fix this", KindQuestion},
+	}
+	for _, test := range tests {
+		if k := KindOf(test.kind, test.text); k != test.expected {
+			t.Errorf("KindOf(%q, %q): want: %v, got: %v", test.kind, test.text, test.expected, k)
+		}
+	}
+}
+
+func TestParseKind(t *testing.T) {
+	t.Parallel()
+	if k := tc.Must(ParseKind("TODO")); k != KindTodo {
+		t.Errorf("want: %v, got: %v", KindTodo, k)
+	}
+	if _, err := ParseKind("urgent"); err == nil {
+		t.Errorf("accepted an unknown kind")
+	}
+}
+
+func TestKindDiagnostics(t *testing.T) {
+	t.Parallel()
+	if s := KindNote.Severity(); s != lsp.DiagnosticSeverityHint {
+		t.Errorf("note: got: %v", s)
+	}
+	if s := KindBug.Severity(); s != lsp.DiagnosticSeverityWarning {
+		t.Errorf("bug: got: %v", s)
+	}
+	if c := KindTodo.Code(); c != "pcc-todo" {
+		t.Errorf("todo: got: %v", c)
+	}
+	if k := MostUrgent(KindBug, KindTodo); k != KindBug {
+		t.Errorf("MostUrgent: got: %v", k)
+	}
+}
+
+func TestLineKinds(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 1, "a note"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 2, "TODO: later"))
+	id := tc.Must(AppendAnn(ctx, db, "ws", "path", 2, "BUG: now", ""))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 3, "TODO: later"))
+	TMust1(t, SetKind(ctx, db, "ws", "path", tc.Must(GetThread(ctx, db, "ws", "path", 3))[0].Id, KindQuestion))
+
+	kinds := tc.Must(GetLineKinds(ctx, db, "ws", "path"))
+	for line, want := range map[uint32]Kind{1: KindNote, 2: KindBug, 3: KindQuestion} {
+		if kinds[line] != want {
+			t.Errorf("line %v: want: %v, got: %v", line, want, kinds[line])
+		}
+	}
+	if err := SetKind(ctx, db, "ws", "other", id, KindNote); err == nil {
+		t.Errorf("set the kind of an annotation of another file")
+	}
+	if th := tc.Must(GetThread(ctx, db, "ws", "path", 2)); th[1].Kind != KindBug {
+		t.Errorf("GetThread: want: %v, got: %+v", KindBug, th[1])
+	}
+}
@@ -0,0 +1,72 @@
+// Links between annotations, and from annotations to files.
+package pkg
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// Link is a link in the content of an annotation.  It is either a link to
+// another annotation, written `[[note:42]]`, or a link to a line of a file,
+// written `other.go:120`.
+type Link struct {
+	// Note is the ID of the linked annotation, or 0 for a file link.
+	Note int64
+	// Path is the linked file, as written, and Line the 1-based line in it.
+	Path string
+	Line uint32
+}
+
+var (
+	noteLinkRe = regexp.MustCompile(`\[\[note:(\d+)\]\]`)
+	// A file name with an extension, followed by a line number.
+	fileLinkRe = regexp.MustCompile(`(?:^|[\s(\[,;"'])((?:[\w.-]+/)*[\w.-]*\w\.\w+):(\d+)\b`)
+)
+
+// ParseLinks returns the links in text, in order of appearance in text.
+func ParseLinks(text string) []Link {
+	type at struct {
+		pos  int
+		link Link
+	}
+	var found []at
+	for _, m := range noteLinkRe.FindAllStringSubmatchIndex(text, -1) {
+		id, err := strconv.ParseInt(text[m[2]:m[3]], 10, 64)
+		if err != nil || id == 0 {
+			continue
+		}
+		found = append(found, at{m[0], Link{Note: id}})
+	}
+	for _, m := range fileLinkRe.FindAllStringSubmatchIndex(text, -1) {
+		line, err := strconv.ParseUint(text[m[4]:m[5]], 10, 32)
+		if err != nil || line == 0 {
+			continue
+		}
+		found = append(found, at{m[2], Link{Path: text[m[2]:m[3]], Line: uint32(line)}})
+	}
+	// Restore the order of appearance.
+	for i := 1; i < len(found); i++ {
+		for j := i; j > 0 && found[j].pos < found[j-1].pos; j-- {
+			found[j], found[j-1] = found[j-1], found[j]
+		}
+	}
+	var ret []Link
+	for _, f := range found {
+		ret = append(ret, f.link)
+	}
+	return ret
+}
+
+// NoteLinks returns the IDs of the annotations linked from text, without
+// duplicates.
+func NoteLinks(text string) []int64 {
+	seen := map[int64]bool{}
+	var ret []int64
+	for _, l := range ParseLinks(text) {
+		if l.Note != 0 && !seen[l.Note] {
+			seen[l.Note] = true
+			ret = append(ret, l.Note)
+		}
+	}
+	return ret
+}
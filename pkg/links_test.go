@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/filmil/private-code-comments/tc"
+)
+
+func TestParseLinks(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		text     string
+		expected []Link
+	}{
+		{"no links", nil},
+		{"see [[note:42]]", []Link{{Note: 42}}},
+		{"see other.go:120 and [[note:7]]", []Link{{Path: "other.go", Line: 120}, {Note: 7}}},
+		{"(pkg/db.go:12), ../x/y.txt:3", []Link{{Path: "pkg/db.go", Line: 12}, {Path: "../x/y.txt", Line: 3}}},
+		{"at 10:30, [[note:0]] and file.go:0", nil},
+		{"http://host.com:80/x", nil},
+	}
+	for _, test := range tests {
+		if links := ParseLinks(test.text); !reflect.DeepEqual(links, test.expected) {
+			t.Errorf("ParseLinks(%q): want: %+v, got: %+v", test.text, test.expected, links)
+		}
+	}
+}
+
+func TestBacklinks(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnn(ctx, db, "ws", "a", 10, "the target"))
+	target := tc.Must(GetThread(ctx, db, "ws", "a", 10))[0].Id
+	from := tc.Must(AppendAnn(ctx, db, "ws", "b", 3, "see [[note:1]]", ""))
+	tc.Must(AppendAnn(ctx, db, "ws", "b", 4, "unrelated", ""))
+
+	got := tc.Must(GetBacklinks(ctx, db, target))
+	if len(got) != 1 || got[0].Id != from || got[0].Path != "b" || got[0].Line != 3 {
+		t.Errorf("GetBacklinks: got: %+v", got)
+	}
+
+	// Editing the link away removes the backlink.
+	TMust1(t, EditAnnById(ctx, db, "ws", "b", from, "no more link", ""))
+	if got := tc.Must(GetBacklinks(ctx, db, target)); len(got) != 0 {
+		t.Errorf("GetBacklinks after edit: got: %+v", got)
+	}
+
+	n := tc.Must(GetNote(ctx, db, target))
+	if n.Workspace != "ws" || n.Path != "a" || n.Line != 10 || n.Content != "the target" {
+		t.Errorf("GetNote: got: %+v", n)
+	}
+	if _, err := GetNote(ctx, db, 1000); err == nil {
+		t.Errorf("GetNote: found a missing note")
+	}
+}
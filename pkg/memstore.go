@@ -0,0 +1,859 @@
+// In-memory annotation storage
+package pkg
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// MemStore is a Store that keeps the annotations in memory only.  It is meant
+// for tests and for sessions whose annotations need not outlive the server.
+//
+// The annotations behave as in SQLStore, except that there is no garbage to
+// collect: the content of an annotation goes away with the annotation.
+type MemStore struct {
+	mu sync.Mutex
+	// The last used IDs of the annotations and of their revisions.
+	lastID, lastRev int64
+	notes           map[int64]*memNote
+	trash           map[int64]*memNote
+}
+
+var _ Store = (*MemStore)(nil)
+
+// memNote is a single annotation of a MemStore.
+type memNote struct {
+	id              int64
+	workspace, path string
+	line            uint32
+	fileLevel       bool
+	orphaned        bool
+	// anchor is empty if the annotation is not anchored.
+	anchor       string
+	anchorOffset int64
+	created      time.Time
+	updated      time.Time
+	author       string
+	// kind is empty if the kind follows from the content.
+	kind Kind
+	// revs are the revisions of the content, oldest first.  The last one is
+	// the current content.
+	revs []Revision
+	// deleted is when the annotation was put in the trash.
+	deleted time.Time
+}
+
+// NewMemStore returns an empty in-memory store.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		notes: map[int64]*memNote{},
+		trash: map[int64]*memNote{},
+	}
+}
+
+// memNow returns the current time, at the resolution of the timestamps of
+// SQLStore.
+func memNow() time.Time {
+	return time.Unix(time.Now().Unix(), 0)
+}
+
+func (n *memNote) content() string {
+	if len(n.revs) == 0 {
+		return ""
+	}
+	return n.revs[len(n.revs)-1].Content
+}
+
+// at returns true if the live annotation n is on line, or is about the whole
+// file if line is nil.
+func (n *memNote) at(workspace, path string, line *uint32) bool {
+	if n.workspace != workspace || n.path != path || n.orphaned {
+		return false
+	}
+	if line == nil {
+		return n.fileLevel
+	}
+	return !n.fileLevel && n.line == *line
+}
+
+// inRange returns true if the live annotation n is on a line between
+// firstline and lastline.
+func (n *memNote) inRange(workspace, path string, firstline, lastline uint32) bool {
+	return n.workspace == workspace && n.path == path && !n.orphaned && !n.fileLevel &&
+		n.line >= firstline && n.line <= lastline
+}
+
+func (n *memNote) entry() ThreadEntry {
+	c := n.content()
+	return ThreadEntry{
+		Id:      n.id,
+		Line:    n.line,
+		Content: c,
+		Created: n.created,
+		Updated: n.updated,
+		Author:  n.author,
+		Tags:    ParseTags(c),
+		Kind:    KindOf(n.kind, c),
+	}
+}
+
+func (n *memNote) note() Note {
+	return Note{
+		ThreadEntry: n.entry(),
+		Workspace:   n.workspace,
+		Path:        n.path,
+		Orphaned:    n.orphaned,
+		FileLevel:   n.fileLevel,
+	}
+}
+
+// byLocation orders annotations by workspace, path and line, with the
+// annotations of whole files first.
+func byLocation(a, b *memNote) int {
+	return cmp.Or(
+		cmp.Compare(a.workspace, b.workspace),
+		cmp.Compare(a.path, b.path),
+		compareBool(!a.fileLevel, !b.fileLevel),
+		cmp.Compare(a.line, b.line),
+		cmp.Compare(a.id, b.id),
+	)
+}
+
+func byLine(a, b *memNote) int {
+	return cmp.Or(cmp.Compare(a.line, b.line), cmp.Compare(a.id, b.id))
+}
+
+func byID(a, b *memNote) int {
+	return cmp.Compare(a.id, b.id)
+}
+
+func compareBool(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// selectNotes returns the annotations of notes for which fn returns true,
+// ordered by order.
+func selectNotes(notes map[int64]*memNote, fn func(n *memNote) bool, order func(a, b *memNote) int) []*memNote {
+	var ret []*memNote
+	for _, n := range notes {
+		if fn(n) {
+			ret = append(ret, n)
+		}
+	}
+	slices.SortFunc(ret, order)
+	return ret
+}
+
+// insertLoc adds a new annotation without content, see addRevision.
+func (s *MemStore) insertLoc(workspace, path string, line *uint32, author string) *memNote {
+	s.lastID++
+	now := memNow()
+	n := &memNote{
+		id:        s.lastID,
+		workspace: workspace,
+		path:      path,
+		fileLevel: line == nil,
+		created:   now,
+		updated:   now,
+		author:    author,
+	}
+	if line != nil {
+		n.line = *line
+	}
+	s.notes[n.id] = n
+	return n
+}
+
+// addRevision makes text, written by author, the current content of n.
+func (s *MemStore) addRevision(n *memNote, text, author string) {
+	s.lastRev++
+	now := memNow()
+	n.revs = append(n.revs, Revision{Id: s.lastRev, Content: text, Revised: now, RevisedBy: author})
+	n.updated = now
+}
+
+// moveToTrash moves the annotations notes to the trash.
+func (s *MemStore) moveToTrash(notes []*memNote) {
+	now := memNow()
+	for _, n := range notes {
+		n.deleted = now
+		delete(s.notes, n.id)
+		s.trash[n.id] = n
+	}
+	glog.V(2).Infof("memstore/moveToTrash: trashed %v annotations", len(notes))
+}
+
+// untrash moves the annotation id from the trash back to the annotations,
+// into the file at path and on line.  Returns false if the trash has no such
+// annotation.
+func (s *MemStore) untrash(id int64, workspace, path string, line *uint32) bool {
+	n, ok := s.trash[id]
+	if !ok {
+		return false
+	}
+	var l uint32
+	if line != nil {
+		l = *line
+	}
+	delete(s.trash, id)
+	n.workspace, n.path, n.line, n.orphaned, n.fileLevel = workspace, path, l, false, line == nil
+	s.notes[id] = n
+	return true
+}
+
+// replace replaces the annotations of a line, or of a whole file if line is
+// nil, with text, split as in replaceAnn.
+func (s *MemStore) replace(workspace, path string, line *uint32, text, author string) {
+	notes := selectNotes(s.notes, func(n *memNote) bool { return n.at(workspace, path, line) }, byID)
+	parts := []string{text}
+	if len(notes) > 1 {
+		parts = strings.Split(text, AnnSeparator)
+	}
+	for i, part := range parts {
+		if i < len(notes) {
+			if part != notes[i].content() {
+				s.addRevision(notes[i], part, author)
+			}
+			continue
+		}
+		s.addRevision(s.insertLoc(workspace, path, line, author), part, author)
+	}
+	s.moveToTrash(notes[min(len(parts), len(notes)):])
+}
+
+func (s *MemStore) thread(workspace, path string, line *uint32) []ThreadEntry {
+	ret := []ThreadEntry{}
+	for _, n := range selectNotes(s.notes, func(n *memNote) bool { return n.at(workspace, path, line) }, byID) {
+		ret = append(ret, n.entry())
+	}
+	return ret
+}
+
+// noteIn returns the annotation id, attached or orphaned, if it is in the file
+// at path.
+func (s *MemStore) noteIn(workspace, path string, id int64) (*memNote, bool) {
+	n, ok := s.notes[id]
+	if !ok || n.workspace != workspace || n.path != path {
+		return nil, false
+	}
+	return n, true
+}
+
+func (s *MemStore) GetAnn(ctx context.Context, workspace, path string, line uint32) (string, error) {
+	if workspace == "" || path == "" {
+		return "", opError("GetAnn", invalid("empty workspace or path: ws=%q, path=%q", workspace, path))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cs []string
+	for _, n := range selectNotes(s.notes, func(n *memNote) bool { return n.at(workspace, path, &line) }, byID) {
+		cs = append(cs, n.content())
+	}
+	if len(cs) == 0 {
+		glog.Warningf("no annotations: workspace=%v, path=%v, line=%v", workspace, path, line)
+	}
+	return strings.Join(cs, AnnSeparator), nil
+}
+
+func (s *MemStore) GetAnns(ctx context.Context, workspace, path string) ([]Ann, error) {
+	if workspace == "" || path == "" {
+		return nil, opError("GetAnns", invalid("empty workspace or path: ws=%q, path=%q", workspace, path))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Ann{}
+	for _, n := range selectNotes(s.notes, func(n *memNote) bool {
+		return n.inRange(workspace, path, 0, ^uint32(0))
+	}, byLine) {
+		if l := len(ret); l > 0 && ret[l-1].Line == n.line {
+			ret[l-1].Content += AnnSeparator + n.content()
+			continue
+		}
+		ret = append(ret, Ann{Line: n.line, Content: n.content()})
+	}
+	return ret, nil
+}
+
+func (s *MemStore) GetThread(ctx context.Context, workspace, path string, line uint32) ([]ThreadEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.thread(workspace, path, &line), nil
+}
+
+func (s *MemStore) InsertAnnBy(ctx context.Context, workspace, path string, line uint32, text, author string) error {
+	glog.V(2).Infof("memstore/InsertAnn: ws=%v, path=%v, line=%v, author=%v", workspace, path, line, author)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replace(workspace, path, &line, text, author)
+	return nil
+}
+
+func (s *MemStore) DeleteAnn(ctx context.Context, workspace, path string, line uint32) error {
+	glog.V(2).Infof("memstore/DeleteAnn: ws=%v, path=%v, line=%v", workspace, path, line)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.moveToTrash(selectNotes(s.notes, func(n *memNote) bool { return n.at(workspace, path, &line) }, byID))
+	return nil
+}
+
+func (s *MemStore) AppendAnn(ctx context.Context, workspace, path string, line uint32, text, author string) (int64, error) {
+	glog.V(2).Infof("memstore/AppendAnn: ws=%v, path=%v, line=%v, author=%v", workspace, path, line, author)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.insertLoc(workspace, path, &line, author)
+	s.addRevision(n, text, author)
+	return n.id, nil
+}
+
+func (s *MemStore) EditAnnById(ctx context.Context, workspace, path string, id int64, text, author string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.noteIn(workspace, path, id)
+	if !ok {
+		return opError("EditAnnById", notFound("ws=%v, path=%v, id=%v", workspace, path, id))
+	}
+	s.addRevision(n, text, author)
+	return nil
+}
+
+func (s *MemStore) DeleteAnnById(ctx context.Context, workspace, path string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.noteIn(workspace, path, id)
+	if !ok {
+		return opError("DeleteAnnById", notFound("ws=%v, path=%v, id=%v", workspace, path, id))
+	}
+	s.moveToTrash([]*memNote{n})
+	return nil
+}
+
+func (s *MemStore) GetFileThread(ctx context.Context, workspace, path string) ([]ThreadEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.thread(workspace, path, nil), nil
+}
+
+func (s *MemStore) SetFileAnn(ctx context.Context, workspace, path, text, author string) error {
+	glog.V(2).Infof("memstore/SetFileAnn: ws=%v, path=%v, author=%v", workspace, path, author)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replace(workspace, path, nil, text, author)
+	return nil
+}
+
+func (s *MemStore) DeleteFileAnn(ctx context.Context, workspace, path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.moveToTrash(selectNotes(s.notes, func(n *memNote) bool { return n.at(workspace, path, nil) }, byID))
+	return nil
+}
+
+func (s *MemStore) GetNote(ctx context.Context, id int64) (Note, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.notes[id]
+	if !ok {
+		return Note{}, opError("GetNote", notFound("id=%v", id))
+	}
+	return n.note(), nil
+}
+
+func (s *MemStore) UpdateNote(ctx context.Context, id int64, text, author string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.notes[id]
+	if !ok {
+		return opError("UpdateNote", notFound("id=%v", id))
+	}
+	s.addRevision(n, text, author)
+	return nil
+}
+
+func (s *MemStore) DeleteNote(ctx context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.notes[id]
+	if !ok {
+		return opError("DeleteNote", notFound("id=%v", id))
+	}
+	s.moveToTrash([]*memNote{n})
+	return nil
+}
+
+// bulkMove moves the live annotations from firstLine to EOF by delta.
+func (s *MemStore) bulkMove(workspace, path string, firstLine uint32, delta int32) {
+	for _, n := range s.notes {
+		if n.inRange(workspace, path, firstLine, ^uint32(0)) {
+			n.line = uint32(int32(n.line) + delta)
+		}
+	}
+}
+
+// orphanAnchored orphans the anchored annotations between firstline and
+// lastline.
+func (s *MemStore) orphanAnchored(workspace, path string, firstline, lastline uint32) {
+	for _, n := range s.notes {
+		if n.inRange(workspace, path, firstline, lastline) && n.anchor != "" {
+			n.orphaned = true
+		}
+	}
+}
+
+func (s *MemStore) BulkMoveAnn(ctx context.Context, workspace, path string, firstLine uint32, delta int32) error {
+	glog.V(2).Infof("memstore/BulkMoveAnn: ws=%q, path=%q, firstLine=%v, delta=%v",
+		workspace, path, firstLine, delta)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bulkMove(workspace, path, firstLine, delta)
+	return nil
+}
+
+// BulkRemoveAnn updates the annotations as TxBulkRemoveAnn does.
+func (s *MemStore) BulkRemoveAnn(ctx context.Context, policy DeletePolicy, workspace, path string, lr LineRange, delta int32) error {
+	glog.V(2).Infof("memstore/BulkRemoveAnn: policy=%v, ws=%q, path=%q, lr=%+v, delta=%v",
+		policy, workspace, path, lr, delta)
+	// Nothing is changed for an unknown policy, as there is no transaction
+	// to roll back.
+	if _, err := ParseDeletePolicy(string(policy)); err != nil || policy == "" {
+		return opError("BulkRemoveAnn", invalid("unknown delete policy: %q", policy))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.orphanAnchored(workspace, path, lr.Start, lr.End)
+	if policy == DeletePolicyMerge {
+		for _, n := range s.notes {
+			if n.inRange(workspace, path, lr.Start, lr.End) {
+				n.line = lr.Start
+			}
+		}
+		s.bulkMove(workspace, path, lr.End, delta)
+		return nil
+	}
+
+	// The surviving line, before and after the removal.
+	survivor, survivorLine := lr.Start, lr.Start
+	if lr.StartCol == 0 {
+		survivor = lr.End
+		survivorLine = uint32(int32(lr.End) + delta)
+	}
+	// The next line that survived the removal.
+	next := survivorLine
+	if survivor == lr.Start {
+		next = uint32(int32(lr.End) + delta + 1)
+	}
+
+	kept := map[*memNote]uint32{}
+	for _, n := range selectNotes(s.notes, func(n *memNote) bool {
+		return n.inRange(workspace, path, lr.Start, lr.End)
+	}, byLine) {
+		if n.line == survivor {
+			kept[n] = survivorLine
+			continue
+		}
+		switch policy {
+		case DeletePolicyDrop:
+			s.moveToTrash([]*memNote{n})
+		case DeletePolicyOrphan:
+			n.orphaned = true
+		case DeletePolicyNext:
+			kept[n] = next
+		}
+	}
+	// Detach the kept annotations, so that they do not get moved along with
+	// the lines below the range.
+	for n := range kept {
+		n.orphaned = true
+	}
+	s.bulkMove(workspace, path, lr.End, delta)
+	for n, line := range kept {
+		n.line = line
+		n.orphaned = false
+	}
+	return nil
+}
+
+func (s *MemStore) GetAnnLocs(ctx context.Context, workspace, path string, firstline, lastline uint32) ([]AnnLoc, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret []AnnLoc
+	for _, n := range selectNotes(s.notes, func(n *memNote) bool {
+		return n.inRange(workspace, path, firstline, lastline)
+	}, byLine) {
+		ret = append(ret, AnnLoc{
+			Id:      n.id,
+			Line:    n.line,
+			Content: n.content(),
+			Author:  n.author,
+			Created: n.created,
+			Kind:    n.kind,
+		})
+	}
+	return ret, nil
+}
+
+func (s *MemStore) RestoreAnnLocs(ctx context.Context, workspace, path string, locs []AnnLoc) error {
+	glog.V(2).Infof("memstore/RestoreAnnLocs: ws=%q, path=%q, locs=%+v", workspace, path, locs)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range locs {
+		if n, ok := s.notes[l.Id]; ok {
+			n.workspace, n.path, n.line, n.fileLevel, n.orphaned = workspace, path, l.Line, false, false
+			continue
+		}
+		// Dropped annotations are in the trash.
+		if s.untrash(l.Id, workspace, path, &l.Line) {
+			continue
+		}
+		created := l.Created
+		if created.IsZero() {
+			created = memNow()
+		}
+		// A zero Id is a new one.
+		id := l.Id
+		if id == 0 {
+			id = s.lastID + 1
+		}
+		n := &memNote{
+			id:        id,
+			workspace: workspace,
+			path:      path,
+			line:      l.Line,
+			created:   created,
+			author:    l.Author,
+			kind:      l.Kind,
+		}
+		s.notes[n.id] = n
+		s.lastID = max(s.lastID, n.id)
+		s.addRevision(n, l.Content, l.Author)
+	}
+	return nil
+}
+
+func (s *MemStore) MarkOrphaned(ctx context.Context, workspace, path string, numLines uint32) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret int64
+	for _, n := range s.notes {
+		if n.inRange(workspace, path, numLines, ^uint32(0)) {
+			n.orphaned = true
+			ret++
+		}
+	}
+	return ret, nil
+}
+
+func (s *MemStore) GetOrphanedAnns(ctx context.Context, workspace, path string) ([]Orphan, error) {
+	if workspace == "" || path == "" {
+		return nil, opError("GetOrphanedAnns", invalid("empty workspace or path: ws=%q, path=%q", workspace, path))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Orphan{}
+	for _, n := range selectNotes(s.notes, func(n *memNote) bool {
+		return n.workspace == workspace && n.path == path && n.orphaned
+	}, byLine) {
+		ret = append(ret, Orphan{Id: n.id, Ann: Ann{Line: n.line, Content: n.content()}})
+	}
+	return ret, nil
+}
+
+func (s *MemStore) ReattachAnn(ctx context.Context, workspace, path string, id int64, newLine uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.notes[id]
+	if n == nil || n.workspace != workspace || n.path != path || !n.orphaned || n.fileLevel {
+		return opError("ReattachAnn", notFound("orphaned: workspace=%v, path=%v, id=%v", workspace, path, id))
+	}
+	n.line, n.orphaned = newLine, false
+	return nil
+}
+
+func (s *MemStore) SetAnchor(ctx context.Context, workspace, path string, line uint32, anchor string, declLine uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var off int64
+	if anchor != "" {
+		off = int64(line) - int64(declLine)
+	}
+	var found bool
+	for _, n := range s.notes {
+		if n.at(workspace, path, &line) {
+			n.anchor, n.anchorOffset = anchor, off
+			found = true
+		}
+	}
+	if !found {
+		return opError("SetAnchor", notFound("workspace=%v, path=%v, line=%v", workspace, path, line))
+	}
+	return nil
+}
+
+func (s *MemStore) ResolveAnchors(ctx context.Context, workspace, path string, decls []GoDecl) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.notes {
+		if n.workspace != workspace || n.path != path || n.anchor == "" {
+			continue
+		}
+		d, ok := FindGoDecl(decls, n.anchor)
+		if !ok {
+			n.orphaned = true
+			continue
+		}
+		want := int64(d.Start) + n.anchorOffset
+		if want < int64(d.Start) || want > int64(d.End) {
+			// The declaration shrank below the annotation.
+			want = int64(d.Start)
+		}
+		n.line, n.orphaned = uint32(want), false
+	}
+	return nil
+}
+
+// memNoteOrder are the orderings of the sort orders of ListAnns.
+var memNoteOrder = map[string]func(a, b *memNote) int{
+	"":             byLocation,
+	SortByLocation: byLocation,
+	SortByCreated: func(a, b *memNote) int {
+		return cmp.Or(a.created.Compare(b.created), byID(a, b))
+	},
+	SortByUpdated: func(a, b *memNote) int {
+		return cmp.Or(a.updated.Compare(b.updated), byID(a, b))
+	},
+	SortByAuthor: func(a, b *memNote) int {
+		return cmp.Or(cmp.Compare(a.author, b.author), byLocation(a, b))
+	},
+}
+
+func (s *MemStore) ListAnns(ctx context.Context, f ListFilter) ([]Note, error) {
+	order, ok := memNoteOrder[f.SortBy]
+	if !ok {
+		return nil, opError("ListAnns", invalid("unknown sort order: %q", f.SortBy))
+	}
+	if f.Desc {
+		asc := order
+		order = func(a, b *memNote) int { return asc(b, a) }
+	}
+	// The bounds are compared at the resolution of the timestamps.
+	since := func(t, bound time.Time) bool { return bound.IsZero() || t.Unix() >= bound.Unix() }
+	until := func(t, bound time.Time) bool { return bound.IsZero() || t.Unix() < bound.Unix() }
+	tag := NormalizeTag(f.Tag)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Note{}
+	for _, n := range selectNotes(s.notes, func(n *memNote) bool {
+		return (f.Workspace == "" || n.workspace == f.Workspace) &&
+			(f.Path == "" || n.path == f.Path) &&
+			(f.Author == "" || n.author == f.Author) &&
+			(f.Tag == "" || slices.Contains(ParseTags(n.content()), tag)) &&
+			since(n.created, f.CreatedSince) && until(n.created, f.CreatedUntil) &&
+			since(n.updated, f.UpdatedSince) && until(n.updated, f.UpdatedUntil)
+	}, order) {
+		ret = append(ret, n.note())
+	}
+	return ret, nil
+}
+
+func (s *MemStore) GetTags(ctx context.Context, workspace string) ([]TagCount, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := map[string]int{}
+	for _, n := range s.notes {
+		if workspace != "" && n.workspace != workspace {
+			continue
+		}
+		for _, t := range ParseTags(n.content()) {
+			counts[t]++
+		}
+	}
+	ret := []TagCount{}
+	for t, c := range counts {
+		ret = append(ret, TagCount{Tag: t, Count: c})
+	}
+	slices.SortFunc(ret, func(a, b TagCount) int { return cmp.Compare(a.Tag, b.Tag) })
+	return ret, nil
+}
+
+func (s *MemStore) GetLineTags(ctx context.Context, workspace, path string) (map[uint32][]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := map[uint32][]string{}
+	for _, n := range s.notes {
+		if n.inRange(workspace, path, 0, ^uint32(0)) {
+			ret[n.line] = append(ret[n.line], ParseTags(n.content())...)
+		}
+	}
+	for l, ts := range ret {
+		if len(ts) == 0 {
+			delete(ret, l)
+			continue
+		}
+		slices.Sort(ts)
+		ret[l] = slices.Compact(ts)
+	}
+	return ret, nil
+}
+
+func (s *MemStore) SetKind(ctx context.Context, workspace, path string, id int64, kind Kind) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.noteIn(workspace, path, id)
+	if !ok {
+		return opError("SetKind", notFound("ws=%v, path=%v, id=%v", workspace, path, id))
+	}
+	n.kind = kind
+	return nil
+}
+
+func (s *MemStore) GetLineKinds(ctx context.Context, workspace, path string) (map[uint32]Kind, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := map[uint32]Kind{}
+	for _, n := range s.notes {
+		if n.inRange(workspace, path, 0, ^uint32(0)) {
+			ret[n.line] = MostUrgent(ret[n.line], KindOf(n.kind, n.content()))
+		}
+	}
+	return ret, nil
+}
+
+func (s *MemStore) GetHistory(ctx context.Context, workspace, path string, id int64) ([]Revision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.noteIn(workspace, path, id)
+	if !ok {
+		return nil, opError("GetHistory", notFound("ws=%v, path=%v, id=%v", workspace, path, id))
+	}
+	return append([]Revision{}, n.revs...), nil
+}
+
+func (s *MemStore) GetThreadsAsOf(ctx context.Context, workspace, path string, t time.Time) ([]ThreadEntry, error) {
+	at := t.Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	notes := maps.Clone(s.notes)
+	for id, n := range s.trash {
+		if n.deleted.Unix() > at {
+			notes[id] = n
+		}
+	}
+	ret := []ThreadEntry{}
+	for _, n := range selectNotes(notes, func(n *memNote) bool {
+		return n.inRange(workspace, path, 0, ^uint32(0)) && n.created.Unix() <= at
+	}, byLine) {
+		// The latest revision at t, if any.
+		i := len(n.revs) - 1
+		for i >= 0 && n.revs[i].Revised.Unix() > at {
+			i--
+		}
+		if i < 0 {
+			continue
+		}
+		e := n.entry()
+		e.Content, e.Updated = n.revs[i].Content, n.revs[i].Revised
+		e.Tags, e.Kind = ParseTags(e.Content), KindOf(n.kind, e.Content)
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+func (s *MemStore) GetBacklinks(ctx context.Context, id int64) ([]Note, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Note{}
+	for _, n := range selectNotes(s.notes, func(n *memNote) bool {
+		return slices.Contains(NoteLinks(n.content()), id)
+	}, byLocation) {
+		ret = append(ret, Note{
+			ThreadEntry: ThreadEntry{Id: n.id, Line: n.line, Content: n.content()},
+			Workspace:   n.workspace,
+			Path:        n.path,
+			Orphaned:    n.orphaned,
+			FileLevel:   n.fileLevel,
+		})
+	}
+	return ret, nil
+}
+
+// Search is Search without a full text index.
+func (s *MemStore) Search(ctx context.Context, workspace, query string, limit int) ([]SearchResult, error) {
+	terms := SearchTerms(query)
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var notes []Note
+	for _, n := range s.notes {
+		if workspace == "" || n.workspace == workspace {
+			notes = append(notes, n.note())
+		}
+	}
+	return RankSearchResults(notes, terms, limit), nil
+}
+
+func (s *MemStore) ListTrash(ctx context.Context, workspace, path string) ([]Trashed, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ret := []Trashed{}
+	for _, n := range selectNotes(s.trash, func(n *memNote) bool {
+		return (workspace == "" || n.workspace == workspace) && (path == "" || n.path == path)
+	}, func(a, b *memNote) int {
+		// Most recently deleted first.
+		return cmp.Or(b.deleted.Compare(a.deleted), byID(b, a))
+	}) {
+		ret = append(ret, Trashed{Note: n.note(), Deleted: n.deleted})
+	}
+	return ret, nil
+}
+
+func (s *MemStore) RestoreTrash(ctx context.Context, id int64) (Note, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.trash[id]
+	if !ok {
+		return Note{}, opError("RestoreTrash", notFound("in the trash: id=%v", id))
+	}
+	var line *uint32
+	if !n.fileLevel {
+		line = &n.line
+	}
+	s.untrash(id, n.workspace, n.path, line)
+	return n.note(), nil
+}
+
+func (s *MemStore) PurgeTrash(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ret int64
+	for id, n := range s.trash {
+		if n.deleted.Unix() < before.Unix() {
+			delete(s.trash, id)
+			ret++
+		}
+	}
+	return ret, nil
+}
+
+// CollectGarbage does nothing, since the content of an annotation goes away
+// with the annotation.
+func (s *MemStore) CollectGarbage(ctx context.Context) (int64, error) {
+	return 0, nil
+}
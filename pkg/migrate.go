@@ -0,0 +1,410 @@
+// Database schema migrations
+package pkg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Migration upgrades the database schema by one version.
+type Migration struct {
+	// Name describes the change of the schema.
+	Name string
+	// Up makes the change in the transaction tx.
+	Up func(ctx context.Context, tx *sql.Tx) error
+}
+
+// execMigration is a Migration that runs the SQL statements stmts.
+func execMigration(stmts string) func(ctx context.Context, tx *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, stmts); err != nil {
+			return fmt.Errorf("could not exec: %w", err)
+		}
+		return nil
+	}
+}
+
+// Migrations are the changes of the database schema, oldest first.  Migration
+// i upgrades the schema from version i to version i+1.  Version 0 is the
+// schema of databases created before migrations were introduced.
+//
+// Only ever append to Migrations, and keep CreateSchema in sync: it creates
+// the schema of the latest version directly.
+var Migrations = []Migration{
+	{
+		Name: "orphaned annotations",
+		Up: execMigration(`
+			ALTER TABLE AnnotationLocations ADD COLUMN Orphaned INTEGER NOT NULL DEFAULT 0;
+		`),
+	},
+	{
+		Name: "anchors",
+		Up: execMigration(`
+			ALTER TABLE AnnotationLocations ADD COLUMN Anchor TEXT;
+			ALTER TABLE AnnotationLocations ADD COLUMN AnchorOffset INTEGER NOT NULL DEFAULT 0;
+		`),
+	},
+	{
+		Name: "several annotations per line",
+		Up: execMigration(`
+			DROP INDEX AnnotationsByFile;
+			CREATE INDEX AnnotationsByFile ON AnnotationLocations(Workspace, Path, Line);
+		`),
+	},
+	{
+		// Columns with an expression as their default can not be added, so
+		// the table is rebuilt.
+		Name: "authors and times",
+		Up: execMigration(`
+			CREATE TABLE
+				NewAnnotationLocations (
+					Id			INTEGER PRIMARY KEY AUTOINCREMENT,
+					Workspace	TEXT NOT NULL,
+					Path		TEXT NOT NULL,
+					Line		INTEGER,
+					AnnId		INTEGER,
+					Orphaned	INTEGER NOT NULL DEFAULT 0,
+					Anchor			TEXT,
+					AnchorOffset	INTEGER NOT NULL DEFAULT 0,
+					Created		INTEGER NOT NULL DEFAULT (unixepoch()),
+					Updated		INTEGER NOT NULL DEFAULT (unixepoch()),
+					Author		TEXT NOT NULL DEFAULT '',
+
+					FOREIGN KEY(AnnId) REFERENCES Annotations(Id)
+						ON DELETE CASCADE
+				);
+			INSERT INTO NewAnnotationLocations(
+				Id, Workspace, Path, Line, AnnId, Orphaned, Anchor, AnchorOffset)
+			SELECT
+				Id, Workspace, Path, Line, AnnId, Orphaned, Anchor, AnchorOffset
+			FROM AnnotationLocations;
+			DROP TABLE AnnotationLocations;
+			ALTER TABLE NewAnnotationLocations RENAME TO AnnotationLocations;
+			CREATE INDEX AnnotationsByFile ON AnnotationLocations(Workspace, Path, Line);
+		`),
+	},
+	{
+		Name: "tags",
+		Up: func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `
+				CREATE TABLE
+					Tags (
+						AnnId	INTEGER NOT NULL,
+						Tag		TEXT NOT NULL,
+
+						PRIMARY KEY(AnnId, Tag),
+						FOREIGN KEY(AnnId) REFERENCES Annotations(Id)
+							ON DELETE CASCADE
+					);
+				CREATE INDEX TagsByTag ON Tags(Tag);
+			`); err != nil {
+				return fmt.Errorf("could not create tags: %w", err)
+			}
+			return forEachContent(ctx, tx, txSetTags)
+		},
+	},
+	{
+		Name: "kinds",
+		Up: execMigration(`
+			ALTER TABLE AnnotationLocations ADD COLUMN Kind TEXT;
+		`),
+	},
+	{
+		Name: "revisions",
+		Up: execMigration(`
+			-- The locations without content can not be shown.
+			DELETE FROM AnnotationLocations
+			WHERE AnnId IS NULL OR AnnId NOT IN (SELECT Id FROM Annotations);
+
+			CREATE TABLE
+				NewAnnotations (
+					Id		INTEGER PRIMARY KEY AUTOINCREMENT,
+					Content TEXT NOT NULL,
+					NoteId		INTEGER,
+					Revised		INTEGER NOT NULL DEFAULT (unixepoch()),
+					RevisedBy	TEXT NOT NULL DEFAULT ''
+				);
+			-- Each content belongs to the first of its locations.
+			INSERT INTO NewAnnotations(Id, Content, NoteId)
+			SELECT	Id, Content, (SELECT MIN(Id) FROM AnnotationLocations WHERE AnnId = Annotations.Id)
+			FROM	Annotations;
+			-- The other locations of a content, which older versions could
+			-- make, get copies of it, with its tags.
+			INSERT INTO NewAnnotations(Content, NoteId)
+			SELECT		Content, AnnotationLocations.Id
+			FROM		AnnotationLocations
+			INNER JOIN	Annotations
+			ON			Annotations.Id = AnnotationLocations.AnnId
+			WHERE		AnnotationLocations.Id != (
+							SELECT MIN(Id) FROM AnnotationLocations AS First WHERE First.AnnId = Annotations.Id
+						);
+			INSERT INTO Tags(AnnId, Tag)
+			SELECT		NewAnnotations.Id, Tag
+			FROM		NewAnnotations
+			INNER JOIN	AnnotationLocations
+			ON			AnnotationLocations.Id = NewAnnotations.NoteId
+			INNER JOIN	Tags
+			ON			Tags.AnnId = AnnotationLocations.AnnId
+			WHERE		NewAnnotations.Id != AnnotationLocations.AnnId;
+			UPDATE	AnnotationLocations
+			SET		AnnId = (SELECT Id FROM NewAnnotations WHERE NoteId = AnnotationLocations.Id);
+			DROP TABLE Annotations;
+			ALTER TABLE NewAnnotations RENAME TO Annotations;
+			CREATE INDEX RevisionsByNote ON Annotations(NoteId);
+		`),
+	},
+	{
+		Name: "trash",
+		Up: execMigration(`
+			CREATE TABLE
+				Trash (
+					Id				INTEGER PRIMARY KEY,
+					Workspace		TEXT NOT NULL,
+					Path			TEXT NOT NULL,
+					Line			INTEGER,
+					AnnId			INTEGER,
+					Orphaned		INTEGER NOT NULL DEFAULT 0,
+					Anchor			TEXT,
+					AnchorOffset	INTEGER NOT NULL DEFAULT 0,
+					Created			INTEGER NOT NULL DEFAULT (unixepoch()),
+					Updated			INTEGER NOT NULL DEFAULT (unixepoch()),
+					Author			TEXT NOT NULL DEFAULT '',
+					Kind			TEXT,
+					Deleted			INTEGER NOT NULL DEFAULT (unixepoch())
+				);
+		`),
+	},
+	{
+		Name: "links",
+		Up: func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `
+				CREATE TABLE
+					Links (
+						AnnId	INTEGER NOT NULL,
+						Target	INTEGER NOT NULL,
+
+						PRIMARY KEY(AnnId, Target),
+						FOREIGN KEY(AnnId) REFERENCES Annotations(Id)
+							ON DELETE CASCADE
+					);
+				CREATE INDEX LinksByTarget ON Links(Target);
+			`); err != nil {
+				return fmt.Errorf("could not create links: %w", err)
+			}
+			return forEachContent(ctx, tx, func(ctx context.Context, tx *sql.Tx, id int64, text string) error {
+				for _, target := range NoteLinks(text) {
+					if _, err := tx.ExecContext(ctx, `INSERT INTO Links(AnnId, Target) VALUES (?, ?);`, id, target); err != nil {
+						return fmt.Errorf("could not insert link: %v: %w", target, err)
+					}
+				}
+				return nil
+			})
+		},
+	},
+	{
+		// Deleting content no longer deletes its annotation.  Instead,
+		// deleting an annotation deletes its content, and unreachable content
+		// is collected.
+		Name: "integrity",
+		Up: func(ctx context.Context, tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx, `
+				CREATE TABLE
+					NewAnnotationLocations (
+						Id			INTEGER PRIMARY KEY AUTOINCREMENT,
+						Workspace	TEXT NOT NULL,
+						Path		TEXT NOT NULL,
+						Line		INTEGER,
+						AnnId		INTEGER,
+						Orphaned	INTEGER NOT NULL DEFAULT 0,
+						Anchor			TEXT,
+						AnchorOffset	INTEGER NOT NULL DEFAULT 0,
+						Created		INTEGER NOT NULL DEFAULT (unixepoch()),
+						Updated		INTEGER NOT NULL DEFAULT (unixepoch()),
+						Author		TEXT NOT NULL DEFAULT '',
+						Kind		TEXT,
+
+						FOREIGN KEY(AnnId) REFERENCES Annotations(Id)
+					);
+				INSERT INTO NewAnnotationLocations SELECT * FROM AnnotationLocations;
+				DROP TABLE AnnotationLocations;
+				ALTER TABLE NewAnnotationLocations RENAME TO AnnotationLocations;
+				CREATE INDEX AnnotationsByFile ON AnnotationLocations(Workspace, Path, Line);
+
+				CREATE TRIGGER DeleteContent AFTER DELETE ON AnnotationLocations
+				WHEN OLD.Id NOT IN (SELECT Id FROM Trash)
+				BEGIN
+					DELETE FROM Annotations WHERE NoteId = OLD.Id OR Id = OLD.AnnId;
+				END;
+
+				CREATE TRIGGER PurgeContent AFTER DELETE ON Trash
+				WHEN OLD.Id NOT IN (SELECT Id FROM AnnotationLocations)
+				BEGIN
+					DELETE FROM Annotations WHERE NoteId = OLD.Id OR Id = OLD.AnnId;
+				END;
+			`); err != nil {
+				return fmt.Errorf("could not exec: %w", err)
+			}
+			if _, err := tx.ExecContext(ctx, collectGarbageStmt); err != nil {
+				return fmt.Errorf("could not collect garbage: %w", err)
+			}
+			// The foreign key actions are off while migrating, so the
+			// tags and links of the collected content are deleted here.
+			if _, err := tx.ExecContext(ctx, `
+				DELETE FROM Tags WHERE AnnId NOT IN (SELECT Id FROM Annotations);
+				DELETE FROM Links WHERE AnnId NOT IN (SELECT Id FROM Annotations);
+			`); err != nil {
+				return fmt.Errorf("could not delete dangling rows: %w", err)
+			}
+			return nil
+		},
+	},
+	{
+		Name: "settings",
+		Up: execMigration(`
+			CREATE TABLE
+				Settings (
+					Name	TEXT PRIMARY KEY,
+					Value	BLOB NOT NULL
+				);
+		`),
+	},
+}
+
+// forEachContent calls fn with the ID and the text of each annotation content.
+func forEachContent(ctx context.Context, tx *sql.Tx, fn func(ctx context.Context, tx *sql.Tx, id int64, text string) error) error {
+	r, err := tx.QueryContext(ctx, `SELECT Id, `+contentColumn+` FROM Annotations;`)
+	if err != nil {
+		return fmt.Errorf("could not query content: %w", err)
+	}
+	// The rows are read before fn is called, since fn may write.
+	type content struct {
+		id   int64
+		text string
+	}
+	var cs []content
+	for r.Next() {
+		var c content
+		if err := r.Scan(&c.id, &c.text); err != nil {
+			r.Close()
+			return fmt.Errorf("could not scan: %w", err)
+		}
+		cs = append(cs, c)
+	}
+	r.Close()
+	if err := r.Err(); err != nil {
+		return fmt.Errorf("could not read content: %w", err)
+	}
+	for _, c := range cs {
+		if err := fn(ctx, tx, c.id, c.text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SchemaVersion is the version of the schema that CreateSchema creates.
+func SchemaVersion() int {
+	return len(Migrations)
+}
+
+// GetSchemaVersion returns the schema version of the database db.
+func GetSchemaVersion(ctx context.Context, db *sql.DB) (int, error) {
+	var v int
+	if err := db.QueryRowContext(ctx, `PRAGMA user_version;`).Scan(&v); err != nil {
+		return 0, fmt.Errorf("could not get schema version: %w", err)
+	}
+	return v, nil
+}
+
+// Migrate upgrades the schema of the database db to SchemaVersion, in a single
+// transaction.  If backup is not empty, and the schema needs upgrading, the
+// database is first copied to a file named after backup, the schema version
+// and the time.  A database with a newer schema than SchemaVersion is an
+// error.
+//
+// The full text search index, which is not versioned, is then created if
+// missing, see EnsureSearchIndex.
+func Migrate(ctx context.Context, db *sql.DB, backup string) error {
+	if err := migrateSchema(ctx, db, backup); err != nil {
+		return opError("Migrate", err)
+	}
+	if err := EnsureSearchIndex(ctx, db); err != nil {
+		return opError("Migrate", err)
+	}
+	return nil
+}
+
+// migrateSchema runs the pending migrations of db, see Migrate.
+func migrateSchema(ctx context.Context, db *sql.DB, backup string) error {
+	from, err := GetSchemaVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	to := SchemaVersion()
+	if from > to {
+		return fmt.Errorf("database schema version %v is newer than the supported version %v", from, to)
+	}
+	if from == to {
+		glog.V(1).Infof("Migrate: schema is up to date: version=%v", from)
+		return nil
+	}
+	if backup != "" {
+		name := fmt.Sprintf("%s.v%d-%s.bak", backup, from, time.Now().UTC().Format("20060102T150405"))
+		if _, err := db.ExecContext(ctx, `VACUUM INTO ?;`, name); err != nil {
+			return fmt.Errorf("could not back up to: %v: %w", name, err)
+		}
+		glog.Infof("Migrate: backed up the database to: %v", name)
+	}
+	// Migrations rebuild tables, which must not run the foreign key
+	// actions.  Foreign keys can only be turned off outside of a
+	// transaction, on the connection that runs it.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get a connection: %w", err)
+	}
+	defer conn.Close()
+	var fk bool
+	if err := conn.QueryRowContext(ctx, `PRAGMA foreign_keys;`).Scan(&fk); err != nil {
+		return fmt.Errorf("could not get foreign keys: %w", err)
+	}
+	if fk {
+		if _, err := conn.ExecContext(ctx, `PRAGMA foreign_keys = OFF;`); err != nil {
+			return fmt.Errorf("could not turn off foreign keys: %w", err)
+		}
+		defer conn.ExecContext(ctx, `PRAGMA foreign_keys = ON;`)
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not start transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for v := from; v < to; v++ {
+		glog.Infof("Migrate: version %v -> %v: %v", v, v+1, Migrations[v].Name)
+		if err := Migrations[v].Up(ctx, tx); err != nil {
+			return fmt.Errorf("version %v -> %v: %v: %w", v, v+1, Migrations[v].Name, err)
+		}
+	}
+	var (
+		table string
+		rowid sql.NullInt64
+	)
+	err = tx.QueryRowContext(ctx, `SELECT "table", rowid FROM pragma_foreign_key_check;`).Scan(&table, &rowid)
+	if err == nil {
+		return fmt.Errorf("foreign key violation: table=%v, rowid=%v", table, rowid.Int64)
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("could not check foreign keys: %w", err)
+	}
+	// PRAGMA does not take parameters.
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d;`, to)); err != nil {
+		return fmt.Errorf("could not set schema version: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("could not commit: %w", err)
+	}
+	return nil
+}
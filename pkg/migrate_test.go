@@ -0,0 +1,187 @@
+package pkg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/filmil/private-code-comments/tc"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// baselineSchema is the schema of the databases created before migrations
+// were introduced, i.e. schema version 0.
+const baselineSchema = `
+	BEGIN TRANSACTION;
+
+	CREATE TABLE
+		Annotations (
+			Id		INTEGER PRIMARY KEY AUTOINCREMENT,
+			Content TEXT NOT NULL
+		);
+
+	CREATE TABLE
+		AnnotationLocations (
+			Id			INTEGER PRIMARY KEY AUTOINCREMENT,
+			Workspace	TEXT NOT NULL,
+			Path		TEXT NOT NULL,
+			Line		INTEGER,
+			AnnId		INTEGER,
+
+			FOREIGN KEY(AnnId) REFERENCES Annotations(Id)
+				ON DELETE CASCADE
+		);
+
+	CREATE UNIQUE INDEX
+		AnnotationsByFile
+	ON
+		AnnotationLocations(
+			Workspace,
+			Path,
+			Line
+		);
+
+	COMMIT;`
+
+// schemaOf describes the tables, columns, indexes and foreign keys of db.
+func schemaOf(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	var ret []string
+	query := func(q string, fn func(r *sql.Rows)) {
+		t.Helper()
+		r := tc.Must(db.Query(q))
+		defer r.Close()
+		for r.Next() {
+			fn(r)
+		}
+		if err := r.Err(); err != nil {
+			t.Fatalf("query: %v: %v", q, err)
+		}
+	}
+	var tables []string
+	query(`SELECT name FROM sqlite_master WHERE type = 'table' AND name != 'sqlite_sequence' ORDER BY name;`,
+		func(r *sql.Rows) {
+			var n string
+			TMust1(t, r.Scan(&n))
+			tables = append(tables, n)
+		})
+	for _, table := range tables {
+		query(fmt.Sprintf(`SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info('%s');`, table),
+			func(r *sql.Rows) {
+				var (
+					name, typ string
+					notnull   bool
+					dflt      sql.NullString
+					pk        int
+				)
+				TMust1(t, r.Scan(&name, &typ, &notnull, &dflt, &pk))
+				ret = append(ret, fmt.Sprintf("column %v.%v %v notnull=%v default=%v pk=%v",
+					table, name, typ, notnull, dflt.String, pk))
+			})
+		query(fmt.Sprintf(`SELECT "table", "from", "to", on_delete FROM pragma_foreign_key_list('%s');`, table),
+			func(r *sql.Rows) {
+				var to, from, toCol, onDelete string
+				TMust1(t, r.Scan(&to, &from, &toCol, &onDelete))
+				ret = append(ret, fmt.Sprintf("foreign key %v.%v -> %v.%v on delete %v",
+					table, from, to, toCol, onDelete))
+			})
+	}
+	query(`SELECT name, tbl_name FROM sqlite_master WHERE type = 'trigger' ORDER BY name;`,
+		func(r *sql.Rows) {
+			var name, table string
+			TMust1(t, r.Scan(&name, &table))
+			ret = append(ret, fmt.Sprintf("trigger %v on %v", name, table))
+		})
+	query(`
+		SELECT		m.name, m.tbl_name, i.name
+		FROM		sqlite_master AS m, pragma_index_info(m.name) AS i
+		WHERE		m.type = 'index' AND m.sql IS NOT NULL
+		ORDER BY	m.name, i.seqno;`,
+		func(r *sql.Rows) {
+			var name, table, column string
+			TMust1(t, r.Scan(&name, &table, &column))
+			ret = append(ret, fmt.Sprintf("index %v on %v.%v", name, table, column))
+		})
+	return ret
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := tc.Must(OpenDB(DBName()))
+	defer db.Close()
+	tc.Must(db.Exec(baselineSchema))
+	// Content 3 was left behind by an update.  Older versions could give
+	// the content of a location to another one, such as on line 30, or a
+	// missing content, such as on line 40.
+	tc.Must(db.Exec(`
+		PRAGMA foreign_keys = OFF;
+		INSERT INTO Annotations(Id, Content)
+		VALUES (1, 'first #perf'), (2, 'see [[note:1]]'), (3, 'stale #perf');
+		INSERT INTO AnnotationLocations(Workspace, Path, Line, AnnId)
+		VALUES ('ws', 'path', 10, 1), ('ws', 'path', 20, 2), ('ws', 'path', 30, 1), ('ws', 'path', 40, 42);
+		PRAGMA foreign_keys = ON;
+	`))
+
+	TMust1(t, Migrate(ctx, db, ""))
+	if v := tc.Must(GetSchemaVersion(ctx, db)); v != SchemaVersion() {
+		t.Errorf("want schema version %v, got: %v", SchemaVersion(), v)
+	}
+	fresh := NewDB()
+	defer fresh.Close()
+	if got, want := schemaOf(t, db), schemaOf(t, fresh); !reflect.DeepEqual(got, want) {
+		t.Errorf("migrated schema differs from a new one:\n\twant: %v\n\tgot : %v", want, got)
+	}
+
+	// The existing annotations keep working, with their tags, links and
+	// history.
+	want := []Ann{{10, "first #perf"}, {20, "see [[note:1]]"}, {30, "first #perf"}}
+	if anns := tc.Must(GetAnns(ctx, db, "ws", "path")); !reflect.DeepEqual(anns, want) {
+		t.Errorf("\n\twant: %+v\n\tgot : %+v", want, anns)
+	}
+	if notes := tc.Must(ListAnns(ctx, db, ListFilter{Tag: "perf"})); len(notes) != 2 || notes[0].Id != 1 || notes[1].Line != 30 {
+		t.Errorf("unexpected tagged notes: %+v", notes)
+	}
+	if b := tc.Must(GetBacklinks(ctx, db, 1)); len(b) != 1 || b[0].Id != 2 {
+		t.Errorf("unexpected backlinks: %+v", b)
+	}
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 10, "second"))
+	if h := tc.Must(GetHistory(ctx, db, "ws", "path", 1)); len(h) != 2 {
+		t.Errorf("unexpected history: %+v", h)
+	}
+	if got := tc.Must(GetThread(ctx, db, "ws", "path", 30)); len(got) != 1 || got[0].Content != "first #perf" {
+		t.Errorf("the copy changed with the first note: %+v", got)
+	}
+	var n int
+	TMust1(t, db.QueryRow(`SELECT COUNT(*) FROM Tags WHERE Tag = 'perf';`).Scan(&n))
+	if n != 2 {
+		t.Errorf("want the tags of the collected content deleted, got %v tags", n)
+	}
+}
+
+func TestMigrateBackup(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	name := filepath.Join(t.TempDir(), "db.sqlite")
+	db := tc.Must(OpenDB(name))
+	defer db.Close()
+	tc.Must(db.Exec(baselineSchema))
+
+	TMust1(t, Migrate(ctx, db, name))
+	if b := tc.Must(filepath.Glob(name + ".v0-*.bak")); len(b) != 1 {
+		t.Errorf("want a single backup, got: %v", b)
+	}
+	// An up to date database is neither migrated nor backed up.
+	TMust1(t, Migrate(ctx, db, name))
+	if b := tc.Must(filepath.Glob(name + ".*.bak")); len(b) != 1 {
+		t.Errorf("want a single backup, got: %v", b)
+	}
+
+	tc.Must(db.Exec(fmt.Sprintf(`PRAGMA user_version = %d;`, SchemaVersion()+1)))
+	if err := Migrate(ctx, db, name); err == nil {
+		t.Errorf("migrated a database newer than supported")
+	}
+}
@@ -1,24 +1,388 @@
 package pkg
 
-import lsp "go.lsp.dev/protocol"
+import (
+	"fmt"
+
+	lsp "go.lsp.dev/protocol"
+)
 
 type PccGet struct {
 	File lsp.URI `json:"file"`
 	Line uint32  `json:"line"`
+	// Scope is one of `line` (default), `file` or `workspace`. The
+	// annotations of a whole file, or of the whole workspace of File, have no
+	// line, and Line is ignored.
+	Scope string `json:"scope,omitempty"`
 }
 
+// The scopes of the annotations addressed by PccGet.
+const (
+	ScopeLine      = `line`
+	ScopeFile      = `file`
+	ScopeWorkspace = `workspace`
+)
+
 type PccGetResp struct {
 	Content []string `json:"content"`
+	// Entries are the annotations of the line, with their IDs, locations
+	// and metadata.
+	Entries []PccNote `json:"entries,omitempty"`
 }
 
 type PccSet struct {
 	PccGet
 	Content []string `json:"content"`
+	// Kind is the annotation kind, one of `note`, `question`, `todo`,
+	// `warning` or `bug`. If empty, the kind follows from a prefix of the
+	// content, such as `TODO:`.
+	Kind string `json:"kind,omitempty"`
+}
+
+type PccSetRes struct {
+	// Entries are the annotations of the line after the change, as in
+	// PccGetResp. Empty if the annotations were deleted.
+	Entries []PccNote `json:"entries,omitempty"`
+}
+
+// PccGetById requests the annotation Id, wherever it is.
+type PccGetById struct {
+	Id int64 `json:"id"`
+}
+
+type PccGetByIdResp struct {
+	Note PccNote `json:"note"`
+}
+
+// PccUpdateById replaces the content of the annotation Id, wherever it is.
+type PccUpdateById struct {
+	Id      int64    `json:"id"`
+	Content []string `json:"content"`
+	// Kind is the annotation kind, as in PccSet.
+	Kind string `json:"kind,omitempty"`
+}
+
+type PccUpdateByIdResp struct {
+	// Note is the annotation after the update.
+	Note PccNote `json:"note"`
+}
+
+// PccDeleteById deletes the annotation Id, wherever it is.
+type PccDeleteById struct {
+	Id int64 `json:"id"`
+}
+
+type PccDeleteByIdResp struct{}
+
+// PccOrphans requests the orphaned annotations of a file.
+type PccOrphans struct {
+	File lsp.URI `json:"file"`
+}
+
+// PccOrphan is a single orphaned annotation.
+type PccOrphan struct {
+	// Id identifies the annotation to PccReattach.
+	Id int64 `json:"id"`
+	// Line is the last line the annotation was attached to.
+	Line    uint32   `json:"line"`
+	Content []string `json:"content"`
+}
+
+type PccOrphansResp struct {
+	Orphans []PccOrphan `json:"orphans"`
+}
+
+// PccReattach attaches the orphaned annotation Id of File to NewLine.
+type PccReattach struct {
+	File    lsp.URI `json:"file"`
+	Id      int64   `json:"id"`
+	NewLine uint32  `json:"new_line"`
+}
+
+type PccReattachResp struct{}
+
+// PccAnchor anchors the annotation at Line to a Go declaration.
+type PccAnchor struct {
+	PccGet
+	// Anchor is the qualified name of the declaration, such as
+	// `pkg.(*Server).Shutdown`, or `auto` for the declaration enclosing
+	// Line. Empty removes the anchor.
+	Anchor string `json:"anchor"`
+}
+
+type PccAnchorResp struct {
+	// Anchor is the name of the declaration that was anchored to.
+	Anchor string `json:"anchor"`
+}
+
+// PccThreadGet requests the thread of annotations of a line.
+type PccThreadGet struct {
+	PccGet
+}
+
+// PccThreadEntry is a single annotation in a thread.
+type PccThreadEntry struct {
+	Id      int64    `json:"id"`
+	Content []string `json:"content"`
+	// Created is when the annotation was created, in RFC 3339 format.
+	Created string `json:"created"`
+	// Updated is when the content last changed, in RFC 3339 format.
+	Updated string `json:"updated"`
+	Author  string `json:"author,omitempty"`
+	// Tags are the hashtags in the content, without the leading '#'.
+	Tags []string `json:"tags,omitempty"`
+	Kind string   `json:"kind"`
+}
+
+type PccThreadGetResp struct {
+	Entries []PccThreadEntry `json:"entries"`
+}
+
+// PccThreadAppend adds an annotation at the end of the thread of a line.
+type PccThreadAppend struct {
+	PccGet
+	Content []string `json:"content"`
+	// Kind is the annotation kind, as in PccSet.
+	Kind string `json:"kind,omitempty"`
+}
+
+type PccThreadAppendResp struct {
+	Id int64 `json:"id"`
+}
+
+// PccThreadEdit replaces the content of the annotation Id in File.
+type PccThreadEdit struct {
+	File    lsp.URI  `json:"file"`
+	Id      int64    `json:"id"`
+	Content []string `json:"content"`
+}
+
+type PccThreadEditResp struct{}
+
+// PccThreadDelete deletes the annotation Id in File.
+type PccThreadDelete struct {
+	File lsp.URI `json:"file"`
+	Id   int64   `json:"id"`
+}
+
+type PccThreadDeleteResp struct{}
+
+// PccList lists the annotations matching a filter. All fields are optional.
+type PccList struct {
+	// File restricts the list to a single file.
+	File lsp.URI `json:"file,omitempty"`
+	// Workspace restricts the list to a single workspace, by name.
+	Workspace string `json:"workspace,omitempty"`
+	Author    string `json:"author,omitempty"`
+	// Tag selects the annotations with the hashtag, e.g. `perf` or `#perf`.
+	Tag string `json:"tag,omitempty"`
+	// Time ranges, in RFC 3339 format. Since is inclusive, Until exclusive.
+	CreatedSince string `json:"created_since,omitempty"`
+	CreatedUntil string `json:"created_until,omitempty"`
+	UpdatedSince string `json:"updated_since,omitempty"`
+	UpdatedUntil string `json:"updated_until,omitempty"`
+	// SortBy is one of `location` (default), `created`, `updated`, `author`.
+	SortBy string `json:"sort_by,omitempty"`
+	Desc   bool   `json:"desc,omitempty"`
+}
+
+// PccNote is a single annotation with its location and metadata, as listed
+// or exported.
+type PccNote struct {
+	PccThreadEntry
+	Workspace string `json:"workspace"`
+	Path      string `json:"path"`
+	// File is the URI of the file, if its workspace is open.
+	File     lsp.URI `json:"file,omitempty"`
+	Line     uint32  `json:"line"`
+	Orphaned bool    `json:"orphaned,omitempty"`
+	// FileLevel is set for an annotation of the whole file, or of the whole
+	// workspace if Path is empty. Line is then 0.
+	FileLevel bool `json:"file_level,omitempty"`
+}
+
+type PccListResp struct {
+	Notes []PccNote `json:"notes"`
+}
+
+// PccHistory requests the revisions of the annotation Id in File.
+type PccHistory struct {
+	File lsp.URI `json:"file"`
+	Id   int64   `json:"id"`
+}
+
+// PccRevision is a single revision of the content of an annotation.
+type PccRevision struct {
+	Id      int64    `json:"id"`
+	Content []string `json:"content"`
+	// Revised is when the revision was made, in RFC 3339 format.
+	Revised   string `json:"revised"`
+	RevisedBy string `json:"revised_by,omitempty"`
+}
+
+type PccHistoryResp struct {
+	// Revisions are ordered oldest first. The last one is the current
+	// content.
+	Revisions []PccRevision `json:"revisions"`
+}
+
+// PccAsOf requests the annotations of File as they were at Time.
+type PccAsOf struct {
+	File lsp.URI `json:"file"`
+	// Time is in RFC 3339 format.
+	Time string `json:"time"`
+}
+
+type PccAsOfResp struct {
+	Notes []PccNote `json:"notes"`
+}
+
+// PccTrash lists the deleted annotations in the trash. All fields are
+// optional.
+type PccTrash struct {
+	// File restricts the list to a single file.
+	File lsp.URI `json:"file,omitempty"`
+	// Workspace restricts the list to a single workspace, by name.
+	Workspace string `json:"workspace,omitempty"`
+}
+
+// PccTrashed is an annotation in the trash, at its original location.
+type PccTrashed struct {
+	PccNote
+	// Deleted is when the annotation was deleted, in RFC 3339 format.
+	Deleted string `json:"deleted"`
+}
+
+type PccTrashResp struct {
+	Notes []PccTrashed `json:"notes"`
+}
+
+// PccTrashRestore restores the annotation Id from the trash, to its original
+// location.
+type PccTrashRestore struct {
+	Id int64 `json:"id"`
 }
 
-type PccSetRes struct{}
+type PccTrashRestoreResp struct {
+	Note PccNote `json:"note"`
+}
+
+// PccWorkspaceNotes requests the annotations of a whole workspace.  Either
+// field selects the workspace.
+type PccWorkspaceNotes struct {
+	// File is any file in the workspace.
+	File lsp.URI `json:"file,omitempty"`
+	// Workspace is the name of the workspace.
+	Workspace string `json:"workspace,omitempty"`
+}
+
+type PccWorkspaceNotesResp struct {
+	Entries []PccThreadEntry `json:"entries"`
+}
+
+// PccGc deletes the annotation content that no annotation refers to.
+type PccGc struct{}
+
+type PccGcResp struct {
+	// Removed is the number of deleted contents.
+	Removed int64 `json:"removed"`
+}
+
+// PccTags lists the hashtags in use.
+type PccTags struct {
+	// Workspace restricts the tags to a single workspace, by name.
+	Workspace string `json:"workspace,omitempty"`
+}
+
+// PccTag is a hashtag, and the number of annotations that have it.
+type PccTag struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+type PccTagsResp struct {
+	Tags []PccTag `json:"tags"`
+}
+
+// PccSearch searches the annotations for the words of Query.  Each word
+// matches the start of a word in the content, ignoring case.
+type PccSearch struct {
+	Query string `json:"query"`
+	// Workspace restricts the search to a single workspace, by name.
+	Workspace string `json:"workspace,omitempty"`
+	// File, if set, restricts the search to the workspace of the file.
+	File lsp.URI `json:"file,omitempty"`
+	// Limit is the maximum number of results, 50 if not set.
+	Limit int `json:"limit,omitempty"`
+}
+
+// PccSpan is where a search word matched.  Line is the index of the line of
+// the content, 0 in a snippet.  Start and End are the byte offsets of the
+// match in the line, End is exclusive.
+type PccSpan struct {
+	Line  uint32 `json:"line"`
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+// PccSearchResult is an annotation that matched a search.
+type PccSearchResult struct {
+	PccNote
+	// Snippet is the part of a line of the content around the first match.
+	Snippet string `json:"snippet"`
+	// Matches are in the content, SnippetMatches in Snippet.
+	Matches        []PccSpan `json:"matches"`
+	SnippetMatches []PccSpan `json:"snippet_matches"`
+}
+
+type PccSearchResp struct {
+	// Results are ordered from the best match.
+	Results []PccSearchResult `json:"results"`
+}
 
 // Config file is put into the workspace.
 type WorkspaceConfig struct {
 	WorkspaceName string `json:"workspace_name,omitempty"`
+	// Author is recorded as the author of the annotations written in the
+	// workspace. Uses the server default if empty.
+	Author string `json:"author,omitempty"`
+	// DeletePolicy is what happens to annotations on deleted lines. One of
+	// the DeletePolicy values. Uses the server default if empty.
+	DeletePolicy DeletePolicy `json:"delete_policy,omitempty"`
+	// Database is the file of the annotations of the workspace, relative to
+	// the workspace directory, if the server keeps a database for each
+	// workspace. Uses the server directory of databases if empty.
+	Database string `json:"database,omitempty"`
+}
+
+// DeletePolicy decides what happens to the annotations on lines that are
+// deleted from a file.
+type DeletePolicy string
+
+const (
+	// DeletePolicyMerge merges the annotations of the deleted lines into the
+	// annotation of the first line of the deleted range.
+	DeletePolicyMerge DeletePolicy = `merge`
+	// DeletePolicyDrop deletes the annotations of the deleted lines.
+	DeletePolicyDrop DeletePolicy = `drop`
+	// DeletePolicyNext moves the annotations of the deleted lines to the next
+	// line that survived the deletion.
+	DeletePolicyNext DeletePolicy = `next`
+	// DeletePolicyOrphan orphans the annotations of the deleted lines.
+	DeletePolicyOrphan DeletePolicy = `orphan`
+
+	// DefaultDeletePolicy is the policy used when none is configured.
+	DefaultDeletePolicy = DeletePolicyMerge
+)
+
+// ParseDeletePolicy parses a delete policy name. An empty name is the
+// default policy.
+func ParseDeletePolicy(s string) (DeletePolicy, error) {
+	switch p := DeletePolicy(s); p {
+	case "":
+		return DefaultDeletePolicy, nil
+	case DeletePolicyMerge, DeletePolicyDrop, DeletePolicyNext, DeletePolicyOrphan:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown delete policy: %q", s)
+	}
 }
@@ -0,0 +1,442 @@
+// Full text search of the annotations
+package pkg
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// SearchIndex is the FTS5 full text index of the annotation contents.
+	// It is only there if SQLite was built with FTS5, see HasFTS5.
+	SearchIndex = `AnnotationsSearch`
+	// FTS5Tag is the build tag that builds SQLite with FTS5.
+	FTS5Tag = `sqlite_fts5`
+	// DefaultSearchLimit is the number of search results returned if no
+	// limit is given.
+	DefaultSearchLimit = 50
+	// snippetContext is the number of bytes kept on each side of the first
+	// match in a snippet.
+	snippetContext = 40
+	// snippetEllipsis marks the text cut from a snippet.
+	snippetEllipsis = "…"
+)
+
+// createSearchIndexStmt creates the full text index of all the revisions of
+// the annotation contents, and the triggers that keep it in sync with them.
+// The index refers to the contents, instead of keeping a copy.
+const createSearchIndexStmt = `
+		CREATE VIRTUAL TABLE
+			AnnotationsSearch
+		USING fts5(
+			Content,
+			content = 'Annotations',
+			content_rowid = 'Id'
+		);
+
+		CREATE TRIGGER
+			AnnotationsSearchInsert
+		AFTER INSERT ON
+			Annotations
+		BEGIN
+			INSERT INTO AnnotationsSearch(rowid, Content) VALUES (NEW.Id, NEW.Content);
+		END;
+
+		CREATE TRIGGER
+			AnnotationsSearchDelete
+		AFTER DELETE ON
+			Annotations
+		BEGIN
+			INSERT INTO AnnotationsSearch(AnnotationsSearch, rowid, Content)
+			VALUES ('delete', OLD.Id, OLD.Content);
+		END;
+
+		CREATE TRIGGER
+			AnnotationsSearchUpdate
+		AFTER UPDATE ON
+			Annotations
+		BEGIN
+			INSERT INTO AnnotationsSearch(AnnotationsSearch, rowid, Content)
+			VALUES ('delete', OLD.Id, OLD.Content);
+			INSERT INTO AnnotationsSearch(rowid, Content) VALUES (NEW.Id, NEW.Content);
+		END;
+
+		-- Index the existing contents.
+		INSERT INTO AnnotationsSearch(AnnotationsSearch) VALUES ('rebuild');
+	`
+
+// dropSearchIndexStmt drops the full text index, and its triggers.
+const dropSearchIndexStmt = `
+		DROP TRIGGER IF EXISTS AnnotationsSearchInsert;
+		DROP TRIGGER IF EXISTS AnnotationsSearchDelete;
+		DROP TRIGGER IF EXISTS AnnotationsSearchUpdate;
+		DROP TABLE IF EXISTS AnnotationsSearch;
+	`
+
+// querier is a *sql.DB, or a *sql.Tx.
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// HasFTS5 returns true if the SQLite of db is built with FTS5 full text
+// indexes, see FTS5Tag.
+func HasFTS5(ctx context.Context, db querier) (bool, error) {
+	var ok bool
+	if err := db.QueryRowContext(ctx, `SELECT sqlite_compileoption_used('ENABLE_FTS5');`).Scan(&ok); err != nil {
+		return false, fmt.Errorf("could not check for FTS5: %w", err)
+	}
+	return ok, nil
+}
+
+// hasSearchIndex returns true if db has the full text index.
+func hasSearchIndex(ctx context.Context, db querier) (bool, error) {
+	var n int
+	if err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?
+	;`, SearchIndex).Scan(&n); err != nil {
+		return false, fmt.Errorf("could not check for the search index: %w", err)
+	}
+	return n > 0, nil
+}
+
+// EnsureSearchIndex creates the full text index of db, if SQLite is built with
+// FTS5 and the index is not there yet.  A database with the index can not be
+// changed without FTS5, since the triggers that update the index would fail,
+// so that is an error.  An encrypted database has no index, since it would
+// keep the words of the contents in plaintext, so its index is dropped.
+func EnsureSearchIndex(ctx context.Context, db *sql.DB) error {
+	return opError("EnsureSearchIndex", inTx(ctx, db, func(tx *sql.Tx) error {
+		return txEnsureSearchIndex(ctx, tx)
+	}))
+}
+
+// txEnsureSearchIndex is EnsureSearchIndex, as part of the transaction tx.
+func txEnsureSearchIndex(ctx context.Context, tx *sql.Tx) error {
+	fts, err := HasFTS5(ctx, tx)
+	if err != nil {
+		return err
+	}
+	has, err := hasSearchIndex(ctx, tx)
+	if err != nil {
+		return err
+	}
+	check, err := getSetting(ctx, tx, keyCheckSetting)
+	if err != nil {
+		return err
+	}
+	switch {
+	case has && !fts:
+		return fmt.Errorf("the database has a full text index, but SQLite is built without FTS5: build with -tags %v", FTS5Tag)
+	case has && check != nil:
+		glog.Infof("EnsureSearchIndex: dropping the full text index of the encrypted database")
+		return txDropSearchIndex(ctx, tx)
+	case check != nil, has:
+		return nil
+	case !fts:
+		glog.Warningf("EnsureSearchIndex: SQLite is built without FTS5, searches are not indexed: build with -tags %v", FTS5Tag)
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, createSearchIndexStmt); err != nil {
+		return fmt.Errorf("could not create the search index: %w", err)
+	}
+	glog.Infof("EnsureSearchIndex: created the full text index")
+	return nil
+}
+
+// txDropSearchIndex drops the full text index, if it is there, as part of the
+// transaction tx.
+func txDropSearchIndex(ctx context.Context, tx *sql.Tx) error {
+	if _, err := tx.ExecContext(ctx, dropSearchIndexStmt); err != nil {
+		return fmt.Errorf("could not drop the search index: %w", err)
+	}
+	return nil
+}
+
+// Span is the range [Start, End) of bytes in a text.
+type Span struct {
+	Start, End int
+}
+
+// SearchResult is an annotation that matches a search.
+type SearchResult struct {
+	Note
+	// Snippet is the part of a line of Content around the first match.
+	Snippet string
+	// Matches are where the search terms are in Content, and SnippetMatches
+	// where they are in Snippet.
+	Matches, SnippetMatches []Span
+}
+
+// SearchTerms splits query into the terms to search for, at white space.  The
+// punctuation around the terms, such as the '#' of tags, is left out, as are
+// terms without letters or digits.
+func SearchTerms(query string) []string {
+	var ret []string
+	for _, t := range strings.Fields(query) {
+		t = strings.TrimFunc(t, func(r rune) bool { return !isWordRune(r) })
+		if t != "" {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// ftsQuery makes an FTS5 query that matches all the terms, each as the
+// start of a word.  The terms are quoted, so that their punctuation is not
+// taken for query syntax.
+func ftsQuery(terms []string) string {
+	q := make([]string, 0, len(terms))
+	for _, t := range terms {
+		q = append(q, `"`+strings.ReplaceAll(t, `"`, `""`)+`"*`)
+	}
+	return strings.Join(q, " ")
+}
+
+// prefixFold returns the length of the prefix of s that equals t, ignoring
+// case, or -1 if s does not start with t.
+func prefixFold(s, t string) int {
+	i := 0
+	for _, tr := range t {
+		if i >= len(s) {
+			return -1
+		}
+		sr, n := utf8.DecodeRuneInString(s[i:])
+		if sr != tr && unicode.ToLower(sr) != unicode.ToLower(tr) {
+			return -1
+		}
+		i += n
+	}
+	return i
+}
+
+// MatchTerms returns where the terms are in text, ignoring case.  A term only
+// matches at the start of a word.  The matches do not overlap, the longest
+// term wins.
+func MatchTerms(text string, terms []string) []Span {
+	var ret []Span
+	prev := ' '
+	for i := 0; i < len(text); {
+		r, n := utf8.DecodeRuneInString(text[i:])
+		if isWordRune(prev) {
+			prev, i = r, i+n
+			continue
+		}
+		best := -1
+		for _, t := range terms {
+			best = max(best, prefixFold(text[i:], t))
+		}
+		if best <= 0 {
+			prev, i = r, i+n
+			continue
+		}
+		ret = append(ret, Span{i, i + best})
+		prev, _ = utf8.DecodeLastRuneInString(text[:i+best])
+		i += best
+	}
+	return ret
+}
+
+// matchesAll returns true if each of the terms is among the matches in text.
+func matchesAll(text string, matches []Span, terms []string) bool {
+	for _, t := range terms {
+		if !slices.ContainsFunc(matches, func(m Span) bool {
+			return prefixFold(text[m.Start:m.End], t) >= 0
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// MakeSnippet returns the part of the line of text with the first of the
+// matches, around that match, and where the matches are in it.  Without
+// matches, the snippet is the start of the first line.
+func MakeSnippet(text string, matches []Span) (string, []Span) {
+	first := Span{0, 0}
+	if len(matches) > 0 {
+		first = matches[0]
+	}
+	lineStart := strings.LastIndexByte(text[:first.Start], '\n') + 1
+	lineEnd := len(text)
+	if i := strings.IndexByte(text[first.End:], '\n'); i >= 0 {
+		lineEnd = first.End + i
+	}
+	lo := max(lineStart, first.Start-snippetContext)
+	hi := min(lineEnd, first.End+snippetContext)
+	if len(matches) == 0 {
+		hi = min(lineEnd, 2*snippetContext)
+	}
+	// Do not cut runes in half.
+	for lo > lineStart && !utf8.RuneStart(text[lo]) {
+		lo--
+	}
+	for hi < lineEnd && !utf8.RuneStart(text[hi]) {
+		hi++
+	}
+	var prefix, suffix string
+	if lo > lineStart {
+		prefix = snippetEllipsis
+	}
+	if hi < lineEnd {
+		suffix = snippetEllipsis
+	}
+	shift := len(prefix) - lo
+	var ret []Span
+	for _, m := range matches {
+		if m.Start >= lo && m.End <= hi {
+			ret = append(ret, Span{m.Start + shift, m.End + shift})
+		}
+	}
+	return prefix + text[lo:hi] + suffix, ret
+}
+
+// newSearchResult makes the search result of the note n, for terms.
+func newSearchResult(n Note, terms []string) SearchResult {
+	r := SearchResult{Note: n, Matches: MatchTerms(n.Content, terms)}
+	r.Snippet, r.SnippetMatches = MakeSnippet(n.Content, r.Matches)
+	return r
+}
+
+// RankSearchResults selects the notes whose content matches all of the terms,
+// and orders them from the most matches to the least, then from the most
+// recently updated.  It ranks the search results of stores without a full
+// text index.  At most limit results are returned.
+func RankSearchResults(notes []Note, terms []string, limit int) []SearchResult {
+	ret := []SearchResult{}
+	for _, n := range notes {
+		r := newSearchResult(n, terms)
+		if matchesAll(n.Content, r.Matches, terms) {
+			ret = append(ret, r)
+		}
+	}
+	slices.SortFunc(ret, func(a, b SearchResult) int {
+		return cmp.Or(
+			cmp.Compare(len(b.Matches), len(a.Matches)),
+			b.Updated.Compare(a.Updated),
+			cmp.Compare(a.Id, b.Id),
+		)
+	})
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+	return ret
+}
+
+// Search returns the annotations, attached or orphaned, whose current content
+// has all the terms of query, see SearchTerms, at the start of words and
+// ignoring case.  The best matches come first, at most limit of them, or
+// DefaultSearchLimit if limit is not positive.  A nonempty workspace
+// restricts the search to that workspace.
+//
+// The full text index ranks the matches, if there is one and the contents
+// are not encrypted, see Key.  Else the contents are scanned, and the results
+// are ranked by RankSearchResults.
+func Search(ctx context.Context, db *sql.DB, workspace, query string, limit int) ([]SearchResult, error) {
+	terms := SearchTerms(query)
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	indexed, err := hasSearchIndex(ctx, db)
+	if err != nil {
+		return nil, opError("Search", err)
+	}
+	// The index of encrypted contents only has the ciphertexts.
+	check, err := getSetting(ctx, db, keyCheckSetting)
+	if err != nil {
+		return nil, opError("Search", err)
+	}
+	if !indexed || check != nil {
+		return scanSearch(ctx, db, workspace, terms, limit)
+	}
+	r, err := db.QueryContext(ctx, `
+		SELECT		AnnotationLocations.Id, Workspace, Path, `+lineColumns+`, Orphaned,
+					`+contentColumn+`, Created, Updated, Author, Kind, `+tagsColumn+`
+		FROM		AnnotationsSearch
+		INNER JOIN	AnnotationLocations
+		ON			AnnotationLocations.AnnId = AnnotationsSearch.rowid
+		INNER JOIN	Annotations
+		ON			Annotations.Id = AnnotationLocations.AnnId
+		WHERE		AnnotationsSearch MATCH ? AND (? = '' OR Workspace = ?)
+		ORDER BY	rank, AnnotationLocations.Id
+		LIMIT		?
+	;`, ftsQuery(terms), workspace, workspace, limit)
+	if err != nil {
+		return nil, opError("Search", fmt.Errorf("query failed: %w", err))
+	}
+	notes, err := scanNotes(r)
+	if err != nil {
+		return nil, opError("Search", err)
+	}
+	ret := []SearchResult{}
+	for _, n := range notes {
+		ret = append(ret, newSearchResult(n, terms))
+	}
+	return ret, nil
+}
+
+// scanSearch searches the contents without a full text index.
+func scanSearch(ctx context.Context, db *sql.DB, workspace string, terms []string, limit int) ([]SearchResult, error) {
+	where := []string{`(? = '' OR Workspace = ?)`}
+	args := []any{workspace, workspace}
+	for _, t := range terms {
+		where = append(where, contentColumn+` LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(t)+"%")
+	}
+	r, err := db.QueryContext(ctx, `
+		SELECT		AnnotationLocations.Id, Workspace, Path, `+lineColumns+`, Orphaned,
+					`+contentColumn+`, Created, Updated, Author, Kind, `+tagsColumn+`
+		FROM		AnnotationLocations
+		INNER JOIN	Annotations
+		ON			AnnotationLocations.AnnId = Annotations.Id
+		WHERE		`+strings.Join(where, " AND ")+`
+	;`, args...)
+	if err != nil {
+		return nil, opError("Search", fmt.Errorf("query failed: %w", err))
+	}
+	notes, err := scanNotes(r)
+	if err != nil {
+		return nil, opError("Search", err)
+	}
+	return RankSearchResults(notes, terms, limit), nil
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// scanNotes reads the notes selected as in ListAnns from r, and closes it.
+func scanNotes(r *sql.Rows) ([]Note, error) {
+	defer r.Close()
+	ret := []Note{}
+	for r.Next() {
+		var (
+			n                Note
+			created, updated int64
+			kind, tags       sql.NullString
+		)
+		if err := r.Scan(&n.Id, &n.Workspace, &n.Path, &n.Line, &n.FileLevel, &n.Orphaned,
+			&n.Content, &created, &updated, &n.Author, &kind, &tags); err != nil {
+			return nil, fmt.Errorf("could not scan: %w", err)
+		}
+		n.Created, n.Updated = time.Unix(created, 0), time.Unix(updated, 0)
+		n.Tags = splitTags(tags)
+		n.Kind = KindOf(Kind(kind.String), n.Content)
+		ret = append(ret, n)
+	}
+	return ret, r.Err()
+}
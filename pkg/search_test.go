@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/filmil/private-code-comments/tc"
+)
+
+func TestMatchTerms(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		text     string
+		terms    []string
+		expected []Span
+	}{
+		{"slow path", []string{"slow"}, []Span{{0, 4}}},
+		{"a SLOW path", []string{"slow"}, []Span{{2, 6}}},
+		{"performance #perf", []string{"perf"}, []Span{{0, 4}, {13, 17}}},
+		// Only at the start of words.
+		{"superfast", []string{"perf"}, nil},
+		// The longest term wins.
+		{"performance", []string{"perf", "perform"}, []Span{{0, 7}}},
+		{"über Über", []string{"über"}, []Span{{0, 5}, {6, 11}}},
+		{"", []string{"x"}, nil},
+	}
+	for _, test := range tests {
+		if got := MatchTerms(test.text, test.terms); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("MatchTerms(%q, %q):\n\twant: %v\n\tgot : %v", test.text, test.terms, test.expected, got)
+		}
+	}
+}
+
+func TestMakeSnippet(t *testing.T) {
+	t.Parallel()
+	text := "first line\n" +
+		"a rather long line that goes on and on, until the needle shows up, and then it goes on some more, and then stops"
+	matches := MatchTerms(text, []string{"needle"})
+	snippet, spans := MakeSnippet(text, matches)
+	want := "…ong line that goes on and on, until the needle shows up, and then it goes on some more…"
+	if snippet != want {
+		t.Errorf("snippet:\n\twant: %q\n\tgot : %q", want, snippet)
+	}
+	if len(spans) != 1 || snippet[spans[0].Start:spans[0].End] != "needle" {
+		t.Errorf("unexpected snippet matches: %v", spans)
+	}
+	if snippet, spans := MakeSnippet("short\nsecond", nil); snippet != "short" || spans != nil {
+		t.Errorf("unexpected snippet without matches: %q, %v", snippet, spans)
+	}
+}
+
+// ids returns the IDs of the notes of the search results.
+func ids(results []SearchResult) []int64 {
+	ret := []int64{}
+	for _, r := range results {
+		ret = append(ret, r.Id)
+	}
+	return ret
+}
+
+func TestSearch(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	forEachStore(t, func(t *testing.T, s Store) {
+		slow := tc.Must(s.AppendAnn(ctx, "ws", "a", 1, "Slow path, see the #perf notes", ""))
+		perf := tc.Must(s.AppendAnn(ctx, "ws", "a", 2, "performance matters here\nreally: perf perf perf", ""))
+		other := tc.Must(s.AppendAnn(ctx, "other", "b", 1, "perf in another workspace", ""))
+		tc.Must(s.AppendAnn(ctx, "ws", "a", 3, "superfast", ""))
+
+		results := tc.Must(s.Search(ctx, "", "perf", 0))
+		if got, want := ids(results), []int64{perf, slow, other}; !reflect.DeepEqual(got[:1], want[:1]) || len(got) != 3 {
+			t.Errorf("want %v, best first, got: %v", want, got)
+		}
+		r := results[0]
+		if r.Snippet != "performance matters here" || len(r.Matches) != 4 {
+			t.Errorf("unexpected result: %+v", r)
+		}
+		if got, want := NewPccSpans(r.Content, r.Matches), []PccSpan{{0, 0, 4}, {1, 8, 12}, {1, 13, 17}, {1, 18, 22}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("spans:\n\twant: %+v\n\tgot : %+v", want, got)
+		}
+
+		if got, want := ids(tc.Must(s.Search(ctx, "ws", "PERF", 0))), []int64{perf, slow}; !reflect.DeepEqual(got, want) {
+			t.Errorf("workspace search:\n\twant: %v\n\tgot : %v", want, got)
+		}
+		if got, want := ids(tc.Must(s.Search(ctx, "", "slow perf", 0))), []int64{slow}; !reflect.DeepEqual(got, want) {
+			t.Errorf("all terms:\n\twant: %v\n\tgot : %v", want, got)
+		}
+		if got := tc.Must(s.Search(ctx, "", "perf", 1)); len(got) != 1 {
+			t.Errorf("want a single result, got: %+v", got)
+		}
+		if got := tc.Must(s.Search(ctx, "", `"#Perf"`, 0)); len(got) != 3 {
+			t.Errorf("want the punctuation ignored, got: %+v", got)
+		}
+		for _, q := range []string{"", "# --", "erf", "100%"} {
+			if got := ids(tc.Must(s.Search(ctx, "", q, 0))); len(got) != 0 {
+				t.Errorf("Search(%q): want no results, got: %v", q, got)
+			}
+		}
+
+		// Only the current content is searched, and only live notes.
+		TMust1(t, s.UpdateNote(ctx, slow, "fixed", ""))
+		TMust1(t, s.DeleteNote(ctx, other))
+		if got, want := ids(tc.Must(s.Search(ctx, "", "perf", 0))), []int64{perf}; !reflect.DeepEqual(got, want) {
+			t.Errorf("after changes:\n\twant: %v\n\tgot : %v", want, got)
+		}
+		if got, want := ids(tc.Must(s.Search(ctx, "", "fix", 0))), []int64{slow}; !reflect.DeepEqual(got, want) {
+			t.Errorf("updated:\n\twant: %v\n\tgot : %v", want, got)
+		}
+	})
+}
+
+func TestSearchIndex(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	fresh := NewDB()
+	defer fresh.Close()
+	fts := tc.Must(HasFTS5(ctx, fresh))
+	if indexed := tc.Must(hasSearchIndex(ctx, fresh)); indexed != fts {
+		t.Fatalf("want a search index: %v, got: %v", fts, indexed)
+	}
+	if !fts {
+		t.Skipf("SQLite is built without FTS5, use -tags %v", FTS5Tag)
+	}
+
+	// The contents of a migrated database are indexed.
+	db := tc.Must(OpenDB(DBName()))
+	defer db.Close()
+	tc.Must(db.Exec(baselineSchema))
+	tc.Must(db.Exec(`
+		INSERT INTO Annotations(Id, Content) VALUES (1, 'a needle');
+		INSERT INTO AnnotationLocations(Workspace, Path, Line, AnnId) VALUES ('ws', 'path', 1, 1);
+	`))
+	TMust1(t, Migrate(ctx, db, ""))
+	if !tc.Must(hasSearchIndex(ctx, db)) {
+		t.Fatalf("want a search index")
+	}
+	if got := tc.Must(Search(ctx, db, "", "needle", 0)); len(got) != 1 {
+		t.Errorf("want the migrated note found, got: %+v", got)
+	}
+	// The index is only used for the terms, the matches are found anew.
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 1, "no needles here"))
+	if got := tc.Must(Search(ctx, db, "", "needle", 0)); len(got) != 1 || got[0].Snippet != "no needles here" {
+		t.Errorf("want the updated note found, got: %+v", got)
+	}
+}
@@ -2,10 +2,12 @@ package pkg
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/golang/glog"
@@ -25,6 +27,22 @@ type DiagnosticMsg struct {
 	Force bool
 }
 
+// ServerOpts are the settings of a Server.
+type ServerOpts struct {
+	// DeletePolicy is the default delete policy, for workspaces that do not
+	// configure one.
+	DeletePolicy DeletePolicy
+	// Author is the default author of new annotations, for workspaces that
+	// do not configure one.
+	Author string
+	// TrashRetention is how long deleted annotations are kept in the trash.
+	// Zero keeps them forever.
+	TrashRetention time.Duration
+}
+
+// PurgeInterval is how often the trash is purged.
+const PurgeInterval = time.Hour
+
 type Server struct {
 	// For sending notifications.
 	conn jsonrpc2.Conn
@@ -37,14 +55,23 @@ type Server struct {
 	// Info from the `initialize` call.
 	clientInfo       *lsp.ClientInfo
 	workspaceFolders []lsp.WorkspaceFolder
+	// Workspace configs, keyed by the resolved workspace name.
+	wsConfigs map[string]WorkspaceConfig
+
+	opts ServerOpts
 
 	// Closed when the initialized message is sent.
 	initialized     chan struct{}
 	diagnosticQueue chan DiagnosticMsg
 	globalCtx       context.Context
-	db              *sql.DB
+	store           Store
 	cancel          context.CancelFunc
 
+	// The text of the currently open documents.
+	docs *Documents
+	// Recently deleted annotation placements, for undo.
+	tombstones *Tombstones
+
 	// Just a temporary thing.
 	count int
 }
@@ -56,7 +83,26 @@ func (s *Server) FindWorkspace(fileURI lsp.URI) (string, string) {
 	return FindWorkspace(s.workspaceFolders, fileURI)
 }
 
-func NewServer(ctx context.Context, db *sql.DB, conn jsonrpc2.Conn) (*Server, error) {
+// DeletePolicy returns the delete policy for the workspace ws.
+func (s *Server) DeletePolicy(ws string) DeletePolicy {
+	if p := s.wsConfigs[ws].DeletePolicy; p != "" {
+		return p
+	}
+	if s.opts.DeletePolicy != "" {
+		return s.opts.DeletePolicy
+	}
+	return DefaultDeletePolicy
+}
+
+// Author returns the author of annotations written in the workspace ws.
+func (s *Server) Author(ws string) string {
+	if a := s.wsConfigs[ws].Author; a != "" {
+		return a
+	}
+	return s.opts.Author
+}
+
+func NewServer(ctx context.Context, store Store, conn jsonrpc2.Conn, opts ServerOpts) (*Server, error) {
 	// Initialize the database.
 	ctx, cancel := context.WithCancel(ctx)
 
@@ -66,12 +112,19 @@ func NewServer(ctx context.Context, db *sql.DB, conn jsonrpc2.Conn) (*Server, er
 		diagnosticQueue: make(chan DiagnosticMsg, 10),
 		initialized:     make(chan struct{}, 1),
 		globalCtx:       ctx,
-		db:              db,
+		store:           store,
 		cancel:          cancel,
 		conn:            conn,
+		docs:            NewDocuments(),
+		tombstones:      NewTombstones(),
+		wsConfigs:       map[string]WorkspaceConfig{},
+		opts:            opts,
 	}
 
 	go s.DiagnosticsFn()
+	if opts.TrashRetention > 0 {
+		go s.PurgeTrashFn()
+	}
 
 	return &s, nil
 }
@@ -99,6 +152,27 @@ func (l LineRange) NumLines() uint32 {
 	return l.End - l.Start
 }
 
+// OrphanedLine is the line on which the orphaned annotations are shown.
+const OrphanedLine = 0
+
+// MakeOrphanedDiagnostic creates a file level diagnostic for an annotation
+// that is no longer attached to a line.
+func MakeOrphanedDiagnostic(a Ann) lsp.Diagnostic {
+	return MakeDiagnostic(
+		LineRange{Start: OrphanedLine, End: OrphanedLine + 1},
+		fmt.Sprintf("orphaned note (was on line %d):\n%s", a.Line+1, a.Content))
+}
+
+// FileLine is the line on which the annotations of a whole file are shown.
+const FileLine = 0
+
+// MakeFileDiagnostic creates a diagnostic for an annotation of a whole file.
+func MakeFileDiagnostic(e ThreadEntry) lsp.Diagnostic {
+	return MakeAnnDiagnostic(
+		LineRange{Start: FileLine, End: FileLine + 1},
+		"file note:\n"+e.Content, e.Kind, e.Tags)
+}
+
 // MakeDiagnostic creates a single diagnostic line.
 func MakeDiagnostic(lr LineRange, m string) lsp.Diagnostic {
 	ret := lsp.Diagnostic{
@@ -111,12 +185,49 @@ func MakeDiagnostic(lr LineRange, m string) lsp.Diagnostic {
 			},
 		},
 		Severity: lsp.DiagnosticSeverityHint,
-		Source:   "private comments",
+		Source:   DiagnosticSource,
 		Message:  m,
 	}
 	return ret
 }
 
+// DiagnosticSource is the source of the diagnostics that show annotations.
+const DiagnosticSource = "private comments"
+
+// MakeAnnDiagnostic is MakeDiagnostic for the annotations of a line, of the
+// given kind and with the given tags.  The kind sets the severity and the
+// code of the diagnostic.  The tags are shown in the source of the diagnostic,
+// e.g. `private comments #perf #todo`, so that clients can filter on them.
+func MakeAnnDiagnostic(lr LineRange, m string, kind Kind, tags []string) lsp.Diagnostic {
+	ret := MakeDiagnostic(lr, m)
+	ret.Severity = kind.Severity()
+	ret.Code = kind.Code()
+	if len(tags) > 0 {
+		ret.Source = DiagnosticSource + " " + TagsString(tags)
+	}
+	return ret
+}
+
+// PurgeTrashFn purges the annotations that were in the trash for longer than
+// the retention period, now and then every PurgeInterval.
+func (s *Server) PurgeTrashFn() {
+	t := time.NewTicker(PurgeInterval)
+	defer t.Stop()
+	for {
+		n, err := s.store.PurgeTrash(s.globalCtx, time.Now().Add(-s.opts.TrashRetention))
+		if err != nil {
+			glog.Errorf("could not purge the trash: %v", err)
+		} else if n > 0 {
+			glog.V(1).Infof("purged %v annotations from the trash", n)
+		}
+		select {
+		case <-s.globalCtx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
 func (s *Server) Shutdown() {
 	s.clientInfo = nil
 	s.gotInitialized = false
@@ -142,19 +253,51 @@ func (s *Server) DiagnosticsFn() {
 			glog.V(1).Infof("diagnosticFn: command: %+v", q)
 			ws, rpath := s.FindWorkspace(uri)
 			glog.V(4).Infof("Operating on ws=%q, path=%q for: %v", ws, rpath, uri)
-			anns, err := GetAnns(s.db, ws, rpath)
+			if n, ok := s.docs.NumLines(uri); ok {
+				// Annotations past the end of the file can not be shown on
+				// their line.
+				c, err := s.store.MarkOrphaned(ctx, ws, rpath, n)
+				if err != nil {
+					glog.Errorf("error orphaning annotations: workspace=%v, file=%v: %v", ws, rpath, err)
+				} else if c > 0 {
+					glog.V(1).Infof("orphaned %v annotations: workspace=%v, file=%v", c, ws, rpath)
+				}
+			}
+			anns, err := s.store.GetAnns(ctx, ws, rpath)
 			if err != nil {
 				glog.Errorf("error getting annotations: workspace=%v, file=%v: %v", ws, rpath, err)
 			}
-			if len(anns) == 0 && !q.Force {
+			orphans, err := s.store.GetOrphanedAnns(ctx, ws, rpath)
+			if err != nil {
+				glog.Errorf("error getting orphaned annotations: workspace=%v, file=%v: %v", ws, rpath, err)
+			}
+			tags, err := s.store.GetLineTags(ctx, ws, rpath)
+			if err != nil {
+				glog.Errorf("error getting tags: workspace=%v, file=%v: %v", ws, rpath, err)
+			}
+			kinds, err := s.store.GetLineKinds(ctx, ws, rpath)
+			if err != nil {
+				glog.Errorf("error getting kinds: workspace=%v, file=%v: %v", ws, rpath, err)
+			}
+			fileAnns, err := s.store.GetFileThread(ctx, ws, rpath)
+			if err != nil {
+				glog.Errorf("error getting file annotations: workspace=%v, file=%v: %v", ws, rpath, err)
+			}
+			if len(anns) == 0 && len(orphans) == 0 && len(fileAnns) == 0 && !q.Force {
 				glog.V(1).Infof("DiagnosticsFn: nothing to publish.")
 				continue
 			}
 			// This will delete diagnostics when not present.
 			d := []lsp.Diagnostic{}
+			for _, e := range fileAnns {
+				d = append(d, MakeFileDiagnostic(e))
+			}
+			for _, a := range orphans {
+				d = append(d, MakeOrphanedDiagnostic(a.Ann))
+			}
 			for _, a := range anns {
-				d = append(d, MakeDiagnostic(
-					LineRange{Start: a.Line, End: a.Line + 1}, a.Content))
+				d = append(d, MakeAnnDiagnostic(
+					LineRange{Start: a.Line, End: a.Line + 1}, a.Content, kinds[a.Line], tags[a.Line]))
 			}
 			p := lsp.PublishDiagnosticsParams{URI: uri, Diagnostics: d}
 			glog.V(2).Infof("publishing diagnostics: %s", spew.Sdump(p))
@@ -166,6 +309,96 @@ func (s *Server) DiagnosticsFn() {
 	}
 }
 
+// ApplyChange updates the open document uri and its annotations for a single
+// content change.
+//
+// A change that undoes a recent deletion, i.e. inserts the deleted text back
+// where it was, restores the annotations of the deleted lines to their
+// original places.
+func (s *Server) ApplyChange(ctx context.Context, uri lsp.URI, c lsp.TextDocumentContentChangeEvent) error {
+	lr := NewLineRange(c.Range)
+	// The text of the changed lines, before the change.
+	before, _ := s.docs.Lines(uri, lr.Start, lr.End)
+	line, hasLine := "", len(before) > 0
+	if hasLine {
+		line = before[0]
+	}
+	replaced, tracked := s.docs.Apply(uri, c.Range, c.Text)
+	nl := strings.Count(c.Text, "\n")
+	delta := int32(nl - int(lr.NumLines()))
+	if delta == 0 {
+		glog.V(1).Infof("No newline count change. Skipping update: lr=%+v, nl=%v", lr, nl)
+		return nil
+	}
+	ws, rpath := s.FindWorkspace(uri)
+
+	if delta > 0 {
+		ts, undo := s.tombstones.TakeInverse(uri, c.Range.Start, replaced, c.Text)
+		s.tombstones.Shift(uri, lr.Start, delta)
+		// Only the lines whose content was pushed down are moved.
+		moved := lr
+		if hasLine {
+			moved.Start = FirstMovedLine(lr, line)
+		}
+		if err := s.MoveAnnotations(ctx, moved, delta, uri); err != nil {
+			return err
+		}
+		if undo {
+			glog.V(1).Infof("undo: restoring: %+v", ts.Locs)
+			if err := s.store.RestoreAnnLocs(ctx, ws, rpath, ts.Locs); err != nil {
+				return fmt.Errorf("could not restore annotations: %w", err)
+			}
+			s.diagnosticQueue <- DiagnosticMsg{URI: uri}
+			return nil
+		}
+		// A block of lines deleted recently may have been pasted here.
+		after, _ := s.docs.Lines(uri, lr.Start, lr.Start+uint32(nl))
+		if ts, locs, ok := s.tombstones.TakeMoved(after, lr.Start); ok {
+			glog.V(1).Infof("block moved from %v: %+v", ts.URI, locs)
+			if err := s.store.RestoreAnnLocs(ctx, ws, rpath, locs); err != nil {
+				return fmt.Errorf("could not move annotations: %w", err)
+			}
+			s.diagnosticQueue <- DiagnosticMsg{URI: uri}
+			if ts.URI != uri {
+				s.diagnosticQueue <- DiagnosticMsg{URI: ts.URI, Force: true}
+			}
+		}
+		return nil
+	}
+
+	// Remember the annotations of the deleted lines, in case the deletion
+	// is undone.
+	locs, err := s.store.GetAnnLocs(ctx, ws, rpath, lr.Start, lr.End)
+	if err != nil {
+		return fmt.Errorf("could not get annotations: %w", err)
+	}
+	removed := lr
+	if hasLine && RemovesFirstLine(lr, line) {
+		// The content of the first line is gone, so it is the last line
+		// of the range that survives.
+		removed.StartCol = 0
+	}
+	if err := s.MoveAnnotations(ctx, removed, delta, uri); err != nil {
+		return err
+	}
+	s.tombstones.Shift(uri, lr.Start, delta)
+	if tracked && len(locs) > 0 {
+		block, carried := CarriedBlock(lr, before, locs)
+		s.tombstones.Add(Tombstone{
+			URI:       uri,
+			Workspace: ws,
+			Path:      rpath,
+			Start:     c.Range.Start,
+			Deleted:   replaced,
+			Inserted:  c.Text,
+			Locs:      locs,
+			Block:     block,
+			Carried:   carried,
+		})
+	}
+	return nil
+}
+
 // INVARIANT: delta != 0.
 func (s *Server) MoveAnnotations(ctx context.Context, lr LineRange, delta int32, uri lsp.URI) error {
 	if delta == 0 {
@@ -178,26 +411,18 @@ func (s *Server) MoveAnnotations(ctx context.Context, lr LineRange, delta int32,
 	ws, rpath := s.FindWorkspace(uri)
 
 	if delta > 0 {
-		if err := BulkMoveAnn(s.db, ws, rpath, lr.Start, delta); err != nil {
+		if err := s.store.BulkMoveAnn(ctx, ws, rpath, lr.Start, delta); err != nil {
 			return fmt.Errorf("MoveAnnotations: %w", err)
 		}
 	}
 	if delta < 0 {
 		// Deletion is a tad bit complicated.
 		// (1) The lines below the delete are moved up by delta.
-		// (2) The lines affected by the delete, are merged in sequence, and
-		// attached to the first line. As a transaction.
-		tx, err := s.db.BeginTx(ctx, nil)
-		if err != nil {
-			return fmt.Errorf("could not begin tx")
-		}
-		err = TxBulkAppendAnn(tx, ws, rpath, lr.Start, lr.End, delta)
-		if err != nil {
+		// (2) The lines affected by the delete are handled according to
+		// the workspace delete policy. As a transaction.
+		if err := s.store.BulkRemoveAnn(ctx, s.DeletePolicy(ws), ws, rpath, lr, delta); err != nil {
 			return fmt.Errorf("MoveAnnotations: %w", err)
 		}
-		if err := tx.Commit(); err != nil {
-			glog.Errorf("could not commit: %v", err)
-		}
 	}
 
 	glog.V(1).Info("refresh diagnostics.")
@@ -205,10 +430,303 @@ func (s *Server) MoveAnnotations(ctx context.Context, lr LineRange, delta int32,
 	return nil
 }
 
+// goDecls returns the declarations of the open Go document uri.
+func (s *Server) goDecls(uri lsp.URI) ([]GoDecl, error) {
+	text, ok := s.docs.Text(uri)
+	if !ok {
+		return nil, fmt.Errorf("document is not open: %v", uri)
+	}
+	return ParseGoDecls(text)
+}
+
+// ResolveAnchors moves the annotations anchored to Go declarations in the
+// document uri to the current lines of those declarations.  Nothing is done
+// for documents that are not Go sources, or that do not parse.
+//
+// Returns true if the anchors were resolved.
+func (s *Server) ResolveAnchors(ctx context.Context, uri lsp.URI) bool {
+	ws, rpath := s.FindWorkspace(uri)
+	if !IsGoFile(rpath) {
+		return false
+	}
+	decls, err := s.goDecls(uri)
+	if err != nil {
+		// Likely in the middle of an edit. The annotations keep following
+		// the line moves until the source parses again.
+		glog.V(2).Infof("ResolveAnchors: not resolving: %v", err)
+		return false
+	}
+	if err := s.store.ResolveAnchors(ctx, ws, rpath, decls); err != nil {
+		glog.Errorf("ResolveAnchors: %v: %v", uri, err)
+		return false
+	}
+	return true
+}
+
+// NewPccThreadEntry converts a thread entry for sending to the client.
+func NewPccThreadEntry(e ThreadEntry) PccThreadEntry {
+	return PccThreadEntry{
+		Id:      e.Id,
+		Content: strings.Split(e.Content, "\n"),
+		Created: e.Created.UTC().Format(time.RFC3339),
+		Updated: e.Updated.UTC().Format(time.RFC3339),
+		Author:  e.Author,
+		Tags:    e.Tags,
+		Kind:    string(e.Kind),
+	}
+}
+
+// NewPccNote converts a note for sending to the client, or for export. w are
+// the open workspaces, used to find the URI of the note's file.
+func NewPccNote(w []lsp.WorkspaceFolder, n Note) PccNote {
+	uri, _ := FileURI(w, n.Workspace, n.Path)
+	return PccNote{
+		PccThreadEntry: NewPccThreadEntry(n.ThreadEntry),
+		Workspace:      n.Workspace,
+		Path:           n.Path,
+		File:           uri,
+		Line:           n.Line,
+		Orphaned:       n.Orphaned,
+		FileLevel:      n.FileLevel,
+	}
+}
+
+// threadNotes converts the annotations of a thread in the file path of the
+// workspace ws for sending to the client.  fileLevel is set for the
+// annotations of a whole file.
+func (s *Server) threadNotes(ws, path string, fileLevel bool, entries []ThreadEntry) []PccNote {
+	ret := []PccNote{}
+	for _, e := range entries {
+		n := Note{ThreadEntry: e, Workspace: ws, Path: path, FileLevel: fileLevel}
+		ret = append(ret, NewPccNote(s.workspaceFolders, n))
+	}
+	return ret
+}
+
+// setKinds sets the kind of the annotations in entries, in the file rpath.
+func (s *Server) setKinds(ctx context.Context, ws, rpath string, entries []ThreadEntry, kind Kind) error {
+	for _, e := range entries {
+		if err := s.store.SetKind(ctx, ws, rpath, e.Id, kind); err != nil {
+			return fmt.Errorf("could not set kind: %w", err)
+		}
+	}
+	return nil
+}
+
+// setFileAnn sets, or deletes if content is empty, the annotation of the whole
+// file rpath, or of the whole workspace if rpath is empty.
+func (s *Server) setFileAnn(ctx context.Context, ws, rpath, content string, kind Kind) error {
+	if content == "" {
+		return s.store.DeleteFileAnn(ctx, ws, rpath)
+	}
+	if err := s.store.SetFileAnn(ctx, ws, rpath, content, s.Author(ws)); err != nil {
+		return err
+	}
+	if kind == "" {
+		return nil
+	}
+	entries, err := s.store.GetFileThread(ctx, ws, rpath)
+	if err != nil {
+		return fmt.Errorf("could not set kind: %w", err)
+	}
+	return s.setKinds(ctx, ws, rpath, entries, kind)
+}
+
+// ScopePath returns the path of the annotations in the scope, one of the Scope
+// values, given the path rpath of the file that was asked about.  The path is
+// empty for the workspace scope.  Returns false if the annotations have no
+// line.
+func ScopePath(scope, rpath string) (string, bool, error) {
+	switch scope {
+	case "", ScopeLine:
+		return rpath, true, nil
+	case ScopeFile:
+		return rpath, false, nil
+	case ScopeWorkspace:
+		return "", false, nil
+	}
+	return "", false, fmt.Errorf("unknown scope: %q", scope)
+}
+
+// JoinContent joins the content of the annotations in entries, as they are
+// shown together.
+func JoinContent(entries []ThreadEntry) string {
+	c := make([]string, 0, len(entries))
+	for _, e := range entries {
+		c = append(c, e.Content)
+	}
+	return strings.Join(c, AnnSeparator)
+}
+
+// ResolveLink returns the location that the link l, in an annotation of the
+// file uri in the workspace ws, points to.
+//
+// Links to annotations point to the current line of the annotation.  Links to
+// files are resolved relative to the directory of uri, then to the root of
+// the workspace, and must name an existing file.
+func (s *Server) ResolveLink(ctx context.Context, uri lsp.URI, ws string, l Link) (lsp.Location, bool) {
+	if l.Note != 0 {
+		n, err := s.store.GetNote(ctx, l.Note)
+		if err != nil {
+			glog.V(1).Infof("ResolveLink: %v", err)
+			return lsp.Location{}, false
+		}
+		target, ok := FileURI(s.workspaceFolders, n.Workspace, n.Path)
+		if !ok {
+			return lsp.Location{}, false
+		}
+		return LineLocation(target, n.Line), true
+	}
+	dirs := []string{filepath.Dir(uri.Filename())}
+	if root, ok := FileURI(s.workspaceFolders, ws, ""); ok {
+		dirs = append(dirs, root.Filename())
+	}
+	for _, d := range dirs {
+		p := l.Path
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(d, p)
+		}
+		if st, err := os.Stat(p); err == nil && !st.IsDir() {
+			return LineLocation(lsp.URI("file://"+p), l.Line-1), true
+		}
+	}
+	return lsp.Location{}, false
+}
+
+// LineLocation returns the location of the start of a line.
+func LineLocation(u lsp.URI, line uint32) lsp.Location {
+	pos := lsp.Position{Line: line}
+	return lsp.Location{URI: u, Range: lsp.Range{Start: pos, End: pos}}
+}
+
+// FormatBacklinks formats the annotations that link to the annotations of a
+// line, for display on hover.
+func FormatBacklinks(backlinks []Note) string {
+	if len(backlinks) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("\n\n---\n\nLinked from:\n")
+	for _, n := range backlinks {
+		fmt.Fprintf(&b, "\n* %s%s:%d [[note:%d]]", n.Workspace, n.Path, n.Line+1, n.Id)
+	}
+	return b.String()
+}
+
+// NewPccTrashed converts a trashed annotation for sending to the client.
+func NewPccTrashed(w []lsp.WorkspaceFolder, t Trashed) PccTrashed {
+	return PccTrashed{
+		PccNote: NewPccNote(w, t.Note),
+		Deleted: t.Deleted.UTC().Format(time.RFC3339),
+	}
+}
+
+// NewPccSpans converts the spans in text to the lines of text.
+func NewPccSpans(text string, spans []Span) []PccSpan {
+	ret := []PccSpan{}
+	for _, s := range spans {
+		lineStart := strings.LastIndexByte(text[:s.Start], '\n') + 1
+		ret = append(ret, PccSpan{
+			Line:  uint32(strings.Count(text[:s.Start], "\n")),
+			Start: uint32(s.Start - lineStart),
+			End:   uint32(s.End - lineStart),
+		})
+	}
+	return ret
+}
+
+// NewPccSearchResult converts a search result for sending to the client.
+func NewPccSearchResult(w []lsp.WorkspaceFolder, r SearchResult) PccSearchResult {
+	return PccSearchResult{
+		PccNote:        NewPccNote(w, r.Note),
+		Snippet:        r.Snippet,
+		Matches:        NewPccSpans(r.Content, r.Matches),
+		SnippetMatches: NewPccSpans(r.Snippet, r.SnippetMatches),
+	}
+}
+
+// ListFilter converts a list request into a filter for ListAnns.
+func (s *Server) ListFilter(p PccList) (ListFilter, error) {
+	f := ListFilter{
+		Workspace: p.Workspace,
+		Author:    p.Author,
+		Tag:       p.Tag,
+		SortBy:    p.SortBy,
+		Desc:      p.Desc,
+	}
+	if p.File != "" {
+		if !strings.HasPrefix(string(p.File), "file:") {
+			return f, fmt.Errorf("malformed file URI, no scheme: %+v", p)
+		}
+		f.Workspace, f.Path = s.FindWorkspace(p.File)
+	}
+	for _, t := range []struct {
+		s string
+		t *time.Time
+	}{
+		{p.CreatedSince, &f.CreatedSince},
+		{p.CreatedUntil, &f.CreatedUntil},
+		{p.UpdatedSince, &f.UpdatedSince},
+		{p.UpdatedUntil, &f.UpdatedUntil},
+	} {
+		if t.s == "" {
+			continue
+		}
+		var err error
+		if *t.t, err = time.Parse(time.RFC3339, t.s); err != nil {
+			return f, fmt.Errorf("malformed time: %w", err)
+		}
+	}
+	return f, nil
+}
+
+// FormatThread formats the annotations of a line for display on hover, with
+// their authors and times.
+func FormatThread(entries []ThreadEntry) string {
+	var b strings.Builder
+	for i, e := range entries {
+		if i > 0 {
+			b.WriteString("\n\n---\n\n")
+		}
+		author := e.Author
+		if author == "" {
+			author = "unknown"
+		}
+		fmt.Fprintf(&b, "**%s**, %s, `[[note:%d]]`", author, e.Created.UTC().Format(time.DateTime), e.Id)
+		if e.Updated.After(e.Created) {
+			fmt.Fprintf(&b, " (edited %s)", e.Updated.UTC().Format(time.DateTime))
+		}
+		b.WriteString("\n\n")
+		b.WriteString(e.Content)
+	}
+	return b.String()
+}
+
 const (
-	PccSetCmd = `$/pcc/set`
-	PccGetCmd = `$/pcc/get`
-	CancelCmd = `%/cancelRequest`
+	PccSetCmd      = `$/pcc/set`
+	PccGetCmd      = `$/pcc/get`
+	PccOrphansCmd  = `$/pcc/orphans`
+	PccReattachCmd = `$/pcc/reattach`
+	PccAnchorCmd   = `$/pcc/anchor`
+
+	PccGetByIdCmd    = `$/pcc/getById`
+	PccUpdateByIdCmd = `$/pcc/updateById`
+	PccDeleteByIdCmd = `$/pcc/deleteById`
+	// Threads of annotations on a line, with annotations addressed by ID.
+	PccThreadGetCmd      = `$/pcc/thread/get`
+	PccThreadAppendCmd   = `$/pcc/thread/append`
+	PccThreadEditCmd     = `$/pcc/thread/edit`
+	PccThreadDeleteCmd   = `$/pcc/thread/delete`
+	PccListCmd           = `$/pcc/list`
+	PccSearchCmd         = `$/pcc/search`
+	PccTagsCmd           = `$/pcc/tags`
+	PccWorkspaceNotesCmd = `$/pcc/workspaceNotes`
+	PccHistoryCmd        = `$/pcc/history`
+	PccAsOfCmd           = `$/pcc/asOf`
+	PccTrashCmd          = `$/pcc/trash`
+	PccTrashRestoreCmd   = `$/pcc/trash/restore`
+	PccGcCmd             = `$/pcc/gc`
+	CancelCmd            = `%/cancelRequest`
 )
 
 // GetHandlerFunc returns a stateful function that can be given to jsonrpc2.StreamServer
@@ -236,12 +754,30 @@ func (s *Server) GetHandlerFunc() jsonrpc2.Handler {
 				return fmt.Errorf("malformed file URI, no scheme: %+v", p)
 			}
 			ws, rpath := FindWorkspace(s.workspaceFolders, p.File)
-			ann, err := GetAnn(s.db, ws, rpath, p.Line)
+			spath, onLine, err := ScopePath(p.Scope, rpath)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			var (
+				ann     string
+				entries []ThreadEntry
+			)
+			if onLine {
+				ann, err = s.store.GetAnn(ctx, ws, rpath, p.Line)
+				if err != nil {
+					return fmt.Errorf("could not get annotation: %+v: %w", p, err)
+				}
+				entries, err = s.store.GetThread(ctx, ws, rpath, p.Line)
+			} else {
+				entries, err = s.store.GetFileThread(ctx, ws, spath)
+				ann = JoinContent(entries)
+			}
 			if err != nil {
 				return fmt.Errorf("could not get annotation: %+v: %w", p, err)
 			}
 			r := PccGetResp{
 				Content: strings.Split(ann, "\n"),
+				Entries: s.threadNotes(ws, spath, !onLine, entries),
 			}
 			glog.V(3).Infof(PccGetCmd+": reply: %v", spew.Sdump(r))
 			return reply(ctx, r, nil)
@@ -254,9 +790,33 @@ func (s *Server) GetHandlerFunc() jsonrpc2.Handler {
 			glog.V(3).Infof(PccSetCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
 			ws, rpath := FindWorkspace(s.workspaceFolders, p.File)
 			content := strings.Join(p.Content, "\n")
+			kind, err := ParseKind(p.Kind)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			spath, onLine, err := ScopePath(p.Scope, rpath)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			if !onLine {
+				if err := s.setFileAnn(ctx, ws, spath, content, kind); err != nil {
+					err := fmt.Errorf("could not set: %+v: %w", p, err)
+					glog.V(1).Infof(PccSetCmd+": error: %v", err)
+					return reply(ctx, nil, err)
+				}
+				entries, err := s.store.GetFileThread(ctx, ws, spath)
+				if err != nil {
+					return reply(ctx, nil, fmt.Errorf("could not get annotation: %+v: %w", p, err))
+				}
+				reply(ctx, PccSetRes{Entries: s.threadNotes(ws, spath, true, entries)}, nil)
+				if spath != "" {
+					s.diagnosticQueue <- DiagnosticMsg{URI: p.File, Force: true}
+				}
+				return nil
+			}
 			force := false
 			if content == "" {
-				if err := DeleteAnn(s.db, ws, rpath, p.Line); err != nil {
+				if err := s.store.DeleteAnn(ctx, ws, rpath, p.Line); err != nil {
 					err := fmt.Errorf("could not delete: %+v: %w", p, err)
 					glog.V(1).Infof(PccSetCmd+": error: %v", err)
 					return err
@@ -264,15 +824,480 @@ func (s *Server) GetHandlerFunc() jsonrpc2.Handler {
 				force = true
 			} else {
 				// Update.
-				if err := InsertAnn(s.db, ws, rpath, p.Line, content); err != nil {
+				if err := s.store.InsertAnnBy(ctx, ws, rpath, p.Line, content, s.Author(ws)); err != nil {
 					err := fmt.Errorf("could not upsert: %+v: %w", p, err)
 					glog.V(1).Infof(PccSetCmd+": error: %v", err)
 					return err
 				}
+				if kind != "" {
+					entries, err := s.store.GetThread(ctx, ws, rpath, p.Line)
+					if err == nil {
+						err = s.setKinds(ctx, ws, rpath, entries, kind)
+					}
+					if err != nil {
+						glog.V(1).Infof(PccSetCmd+": error: %v", err)
+						return reply(ctx, nil, err)
+					}
+				}
+			}
+			entries, err := s.store.GetThread(ctx, ws, rpath, p.Line)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not get annotation: %+v: %w", p, err))
 			}
-			reply(ctx, PccSetRes{}, nil)
+			reply(ctx, PccSetRes{Entries: s.threadNotes(ws, rpath, false, entries)}, nil)
 			s.diagnosticQueue <- DiagnosticMsg{URI: p.File, Force: force}
 
+		case PccGetByIdCmd:
+			var p PccGetById
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/getById: %w", err)
+			}
+			n, err := s.store.GetNote(ctx, p.Id)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not get annotation: %+v: %w", p, err))
+			}
+			return reply(ctx, PccGetByIdResp{Note: NewPccNote(s.workspaceFolders, n)}, nil)
+
+		case PccUpdateByIdCmd:
+			var p PccUpdateById
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/updateById: %w", err)
+			}
+			glog.V(3).Infof(PccUpdateByIdCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			content := strings.Join(p.Content, "\n")
+			if content == "" {
+				return reply(ctx, nil, fmt.Errorf("empty annotation, use %v to delete: %+v", PccDeleteByIdCmd, p))
+			}
+			kind, err := ParseKind(p.Kind)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			n, err := s.store.GetNote(ctx, p.Id)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not update: %+v: %w", p, err))
+			}
+			if err := s.store.UpdateNote(ctx, p.Id, content, s.Author(n.Workspace)); err != nil {
+				err := fmt.Errorf("could not update: %+v: %w", p, err)
+				glog.V(1).Infof(PccUpdateByIdCmd+": error: %v", err)
+				return reply(ctx, nil, err)
+			}
+			if kind != "" {
+				if err := s.store.SetKind(ctx, n.Workspace, n.Path, p.Id, kind); err != nil {
+					return reply(ctx, nil, fmt.Errorf("could not set kind: %+v: %w", p, err))
+				}
+			}
+			if n, err = s.store.GetNote(ctx, p.Id); err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not get annotation: %+v: %w", p, err))
+			}
+			r := PccUpdateByIdResp{Note: NewPccNote(s.workspaceFolders, n)}
+			reply(ctx, r, nil)
+			if r.Note.File != "" {
+				s.diagnosticQueue <- DiagnosticMsg{URI: r.Note.File}
+			}
+
+		case PccDeleteByIdCmd:
+			var p PccDeleteById
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/deleteById: %w", err)
+			}
+			glog.V(3).Infof(PccDeleteByIdCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			n, err := s.store.GetNote(ctx, p.Id)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not delete: %+v: %w", p, err))
+			}
+			if err := s.store.DeleteNote(ctx, p.Id); err != nil {
+				err := fmt.Errorf("could not delete: %+v: %w", p, err)
+				glog.V(1).Infof(PccDeleteByIdCmd+": error: %v", err)
+				return reply(ctx, nil, err)
+			}
+			reply(ctx, PccDeleteByIdResp{}, nil)
+			if uri := NewPccNote(s.workspaceFolders, n).File; uri != "" {
+				s.diagnosticQueue <- DiagnosticMsg{URI: uri, Force: true}
+			}
+
+		case PccOrphansCmd:
+			var p PccOrphans
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/orphans: %w", err)
+			}
+			glog.V(3).Infof(PccOrphansCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			ws, rpath := FindWorkspace(s.workspaceFolders, p.File)
+			anns, err := s.store.GetOrphanedAnns(ctx, ws, rpath)
+			if err != nil {
+				return fmt.Errorf("could not get orphaned annotations: %+v: %w", p, err)
+			}
+			r := PccOrphansResp{Orphans: []PccOrphan{}}
+			for _, a := range anns {
+				r.Orphans = append(r.Orphans, PccOrphan{
+					Id:      a.Id,
+					Line:    a.Line,
+					Content: strings.Split(a.Content, "\n"),
+				})
+			}
+			return reply(ctx, r, nil)
+
+		case PccReattachCmd:
+			var p PccReattach
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/reattach: %w", err)
+			}
+			glog.V(3).Infof(PccReattachCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			ws, rpath := FindWorkspace(s.workspaceFolders, p.File)
+			if err := s.store.ReattachAnn(ctx, ws, rpath, p.Id, p.NewLine); err != nil {
+				err := fmt.Errorf("could not reattach: %+v: %w", p, err)
+				glog.V(1).Infof(PccReattachCmd+": error: %v", err)
+				return reply(ctx, nil, err)
+			}
+			reply(ctx, PccReattachResp{}, nil)
+			s.diagnosticQueue <- DiagnosticMsg{URI: p.File, Force: true}
+
+		case PccAnchorCmd:
+			var p PccAnchor
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/anchor: %w", err)
+			}
+			glog.V(3).Infof(PccAnchorCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			ws, rpath := FindWorkspace(s.workspaceFolders, p.File)
+			var d GoDecl
+			if p.Anchor != "" {
+				if !IsGoFile(rpath) {
+					return reply(ctx, nil, fmt.Errorf("not a Go file: %v", p.File))
+				}
+				decls, err := s.goDecls(p.File)
+				if err != nil {
+					return reply(ctx, nil, fmt.Errorf("could not find declarations: %w", err))
+				}
+				var ok bool
+				if p.Anchor == AnchorAuto {
+					d, ok = EnclosingGoDecl(decls, p.Line)
+				} else {
+					d, ok = FindGoDecl(decls, p.Anchor)
+				}
+				if !ok {
+					return reply(ctx, nil, fmt.Errorf("no declaration %q for line %v", p.Anchor, p.Line))
+				}
+			}
+			if err := s.store.SetAnchor(ctx, ws, rpath, p.Line, d.Name, d.Start); err != nil {
+				err := fmt.Errorf("could not anchor: %+v: %w", p, err)
+				glog.V(1).Infof(PccAnchorCmd+": error: %v", err)
+				return reply(ctx, nil, err)
+			}
+			reply(ctx, PccAnchorResp{Anchor: d.Name}, nil)
+
+		case PccThreadGetCmd:
+			var p PccThreadGet
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/thread/get: %w", err)
+			}
+			glog.V(3).Infof(PccThreadGetCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			ws, rpath := FindWorkspace(s.workspaceFolders, p.File)
+			spath, onLine, err := ScopePath(p.Scope, rpath)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			var entries []ThreadEntry
+			if onLine {
+				entries, err = s.store.GetThread(ctx, ws, rpath, p.Line)
+			} else {
+				entries, err = s.store.GetFileThread(ctx, ws, spath)
+			}
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not get thread: %+v: %w", p, err))
+			}
+			r := PccThreadGetResp{Entries: []PccThreadEntry{}}
+			for _, e := range entries {
+				r.Entries = append(r.Entries, NewPccThreadEntry(e))
+			}
+			return reply(ctx, r, nil)
+
+		case PccThreadAppendCmd:
+			var p PccThreadAppend
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/thread/append: %w", err)
+			}
+			glog.V(3).Infof(PccThreadAppendCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			content := strings.Join(p.Content, "\n")
+			if content == "" {
+				return reply(ctx, nil, fmt.Errorf("empty annotation: %+v", p))
+			}
+			kind, err := ParseKind(p.Kind)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			ws, rpath := FindWorkspace(s.workspaceFolders, p.File)
+			id, err := s.store.AppendAnn(ctx, ws, rpath, p.Line, content, s.Author(ws))
+			if err != nil {
+				err := fmt.Errorf("could not append: %+v: %w", p, err)
+				glog.V(1).Infof(PccThreadAppendCmd+": error: %v", err)
+				return reply(ctx, nil, err)
+			}
+			if kind != "" {
+				if err := s.store.SetKind(ctx, ws, rpath, id, kind); err != nil {
+					return reply(ctx, nil, fmt.Errorf("could not set kind: %+v: %w", p, err))
+				}
+			}
+			reply(ctx, PccThreadAppendResp{Id: id}, nil)
+			s.diagnosticQueue <- DiagnosticMsg{URI: p.File}
+
+		case PccThreadEditCmd:
+			var p PccThreadEdit
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/thread/edit: %w", err)
+			}
+			glog.V(3).Infof(PccThreadEditCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			content := strings.Join(p.Content, "\n")
+			if content == "" {
+				return reply(ctx, nil, fmt.Errorf("empty annotation, use %v to delete: %+v", PccThreadDeleteCmd, p))
+			}
+			ws, rpath := FindWorkspace(s.workspaceFolders, p.File)
+			if err := s.store.EditAnnById(ctx, ws, rpath, p.Id, content, s.Author(ws)); err != nil {
+				err := fmt.Errorf("could not edit: %+v: %w", p, err)
+				glog.V(1).Infof(PccThreadEditCmd+": error: %v", err)
+				return reply(ctx, nil, err)
+			}
+			reply(ctx, PccThreadEditResp{}, nil)
+			s.diagnosticQueue <- DiagnosticMsg{URI: p.File}
+
+		case PccThreadDeleteCmd:
+			var p PccThreadDelete
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/thread/delete: %w", err)
+			}
+			glog.V(3).Infof(PccThreadDeleteCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			ws, rpath := FindWorkspace(s.workspaceFolders, p.File)
+			if err := s.store.DeleteAnnById(ctx, ws, rpath, p.Id); err != nil {
+				err := fmt.Errorf("could not delete: %+v: %w", p, err)
+				glog.V(1).Infof(PccThreadDeleteCmd+": error: %v", err)
+				return reply(ctx, nil, err)
+			}
+			reply(ctx, PccThreadDeleteResp{}, nil)
+			s.diagnosticQueue <- DiagnosticMsg{URI: p.File, Force: true}
+
+		case PccListCmd:
+			var p PccList
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/list: %w", err)
+			}
+			glog.V(3).Infof(PccListCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			f, err := s.ListFilter(p)
+			if err != nil {
+				return reply(ctx, nil, err)
+			}
+			notes, err := s.store.ListAnns(ctx, f)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not list: %+v: %w", p, err))
+			}
+			r := PccListResp{Notes: []PccNote{}}
+			for _, n := range notes {
+				r.Notes = append(r.Notes, NewPccNote(s.workspaceFolders, n))
+			}
+			return reply(ctx, r, nil)
+
+		case PccSearchCmd:
+			var p PccSearch
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/search: %w", err)
+			}
+			glog.V(3).Infof(PccSearchCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			ws := p.Workspace
+			if p.File != "" {
+				if !strings.HasPrefix(string(p.File), "file:") {
+					return reply(ctx, nil, fmt.Errorf("malformed file URI, no scheme: %+v", p))
+				}
+				ws, _ = s.FindWorkspace(p.File)
+			}
+			results, err := s.store.Search(ctx, ws, p.Query, p.Limit)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not search: %+v: %w", p, err))
+			}
+			r := PccSearchResp{Results: []PccSearchResult{}}
+			for _, res := range results {
+				r.Results = append(r.Results, NewPccSearchResult(s.workspaceFolders, res))
+			}
+			return reply(ctx, r, nil)
+
+		case PccWorkspaceNotesCmd:
+			var p PccWorkspaceNotes
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/workspaceNotes: %w", err)
+			}
+			ws := p.Workspace
+			if p.File != "" {
+				if !strings.HasPrefix(string(p.File), "file:") {
+					return reply(ctx, nil, fmt.Errorf("malformed file URI, no scheme: %+v", p))
+				}
+				ws, _ = s.FindWorkspace(p.File)
+			}
+			if ws == "" {
+				return reply(ctx, nil, fmt.Errorf("no workspace: %+v", p))
+			}
+			entries, err := s.store.GetFileThread(ctx, ws, "")
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not get workspace notes: %+v: %w", p, err))
+			}
+			r := PccWorkspaceNotesResp{Entries: []PccThreadEntry{}}
+			for _, e := range entries {
+				r.Entries = append(r.Entries, NewPccThreadEntry(e))
+			}
+			return reply(ctx, r, nil)
+
+		case PccTagsCmd:
+			var p PccTags
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/tags: %w", err)
+			}
+			tags, err := s.store.GetTags(ctx, p.Workspace)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not get tags: %+v: %w", p, err))
+			}
+			r := PccTagsResp{Tags: []PccTag{}}
+			for _, t := range tags {
+				r.Tags = append(r.Tags, PccTag{Tag: t.Tag, Count: t.Count})
+			}
+			return reply(ctx, r, nil)
+
+		case PccHistoryCmd:
+			var p PccHistory
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/history: %w", err)
+			}
+			glog.V(3).Infof(PccHistoryCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			ws, rpath := FindWorkspace(s.workspaceFolders, p.File)
+			revs, err := s.store.GetHistory(ctx, ws, rpath, p.Id)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not get history: %+v: %w", p, err))
+			}
+			r := PccHistoryResp{Revisions: []PccRevision{}}
+			for _, rev := range revs {
+				r.Revisions = append(r.Revisions, PccRevision{
+					Id:        rev.Id,
+					Content:   strings.Split(rev.Content, "\n"),
+					Revised:   rev.Revised.UTC().Format(time.RFC3339),
+					RevisedBy: rev.RevisedBy,
+				})
+			}
+			return reply(ctx, r, nil)
+
+		case PccAsOfCmd:
+			var p PccAsOf
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/asOf: %w", err)
+			}
+			glog.V(3).Infof(PccAsOfCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			t, err := time.Parse(time.RFC3339, p.Time)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("malformed time: %w", err))
+			}
+			ws, rpath := FindWorkspace(s.workspaceFolders, p.File)
+			entries, err := s.store.GetThreadsAsOf(ctx, ws, rpath, t)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not get annotations: %+v: %w", p, err))
+			}
+			r := PccAsOfResp{Notes: []PccNote{}}
+			for _, e := range entries {
+				n := Note{ThreadEntry: e, Workspace: ws, Path: rpath}
+				r.Notes = append(r.Notes, NewPccNote(s.workspaceFolders, n))
+			}
+			return reply(ctx, r, nil)
+
+		case PccTrashCmd:
+			var p PccTrash
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/trash: %w", err)
+			}
+			glog.V(3).Infof(PccTrashCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			ws, rpath := p.Workspace, ""
+			if p.File != "" {
+				if !strings.HasPrefix(string(p.File), "file:") {
+					return reply(ctx, nil, fmt.Errorf("malformed file URI, no scheme: %+v", p))
+				}
+				ws, rpath = s.FindWorkspace(p.File)
+			}
+			trash, err := s.store.ListTrash(ctx, ws, rpath)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not list the trash: %+v: %w", p, err))
+			}
+			r := PccTrashResp{Notes: []PccTrashed{}}
+			for _, t := range trash {
+				r.Notes = append(r.Notes, NewPccTrashed(s.workspaceFolders, t))
+			}
+			return reply(ctx, r, nil)
+
+		case PccTrashRestoreCmd:
+			var p PccTrashRestore
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during $/pcc/trash/restore: %w", err)
+			}
+			glog.V(3).Infof(PccTrashRestoreCmd+": Request: %v", spew.Sdump(p)) // This is expensive.
+			n, err := s.store.RestoreTrash(ctx, p.Id)
+			if err != nil {
+				err := fmt.Errorf("could not restore: %+v: %w", p, err)
+				glog.V(1).Infof(PccTrashRestoreCmd+": error: %v", err)
+				return reply(ctx, nil, err)
+			}
+			r := PccTrashRestoreResp{Note: NewPccNote(s.workspaceFolders, n)}
+			reply(ctx, r, nil)
+			if r.Note.File != "" {
+				s.diagnosticQueue <- DiagnosticMsg{URI: r.Note.File}
+			}
+
+		case PccGcCmd:
+			n, err := s.store.CollectGarbage(ctx)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not collect garbage: %w", err))
+			}
+			return reply(ctx, PccGcResp{Removed: n}, nil)
+
+		case lsp.MethodTextDocumentHover:
+			var p lsp.HoverParams
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during hover: %w", err)
+			}
+			glog.V(1).Infof("hover: Request: %v", spew.Sdump(p)) // This is expensive.
+			ws, rpath := s.FindWorkspace(p.TextDocument.URI)
+			entries, err := s.store.GetThread(ctx, ws, rpath, p.Position.Line)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not get annotations: %w", err))
+			}
+			if len(entries) == 0 {
+				return reply(ctx, nil, nil)
+			}
+			var backlinks []Note
+			for _, e := range entries {
+				b, err := s.store.GetBacklinks(ctx, e.Id)
+				if err != nil {
+					return reply(ctx, nil, fmt.Errorf("could not get backlinks: %w", err))
+				}
+				backlinks = append(backlinks, b...)
+			}
+			return reply(ctx, lsp.Hover{
+				Contents: lsp.MarkupContent{
+					Kind:  lsp.Markdown,
+					Value: FormatThread(entries) + FormatBacklinks(backlinks),
+				},
+			}, nil)
+
+		case lsp.MethodTextDocumentDefinition:
+			var p lsp.DefinitionParams
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during definition: %w", err)
+			}
+			glog.V(1).Infof("definition: Request: %v", spew.Sdump(p)) // This is expensive.
+			ws, rpath := s.FindWorkspace(p.TextDocument.URI)
+			entries, err := s.store.GetThread(ctx, ws, rpath, p.Position.Line)
+			if err != nil {
+				return reply(ctx, nil, fmt.Errorf("could not get annotations: %w", err))
+			}
+			locs := []lsp.Location{}
+			for _, e := range entries {
+				for _, l := range ParseLinks(e.Content) {
+					if loc, ok := s.ResolveLink(ctx, p.TextDocument.URI, ws, l); ok {
+						locs = append(locs, loc)
+					}
+				}
+			}
+			return reply(ctx, locs, nil)
+
 		case lsp.MethodTextDocumentDidSave:
 			var p lsp.DidSaveTextDocumentParams
 			glog.V(1).Infof("didSave: Request: %v", spew.Sdump(p)) // This is expensive.
@@ -286,6 +1311,8 @@ func (s *Server) GetHandlerFunc() jsonrpc2.Handler {
 			}
 			glog.V(1).Infof("didOpen: Request: %v", spew.Sdump(p)) // This is expensive.
 			s.count++
+			s.docs.Open(p.TextDocument.URI, p.TextDocument.Text)
+			s.ResolveAnchors(ctx, p.TextDocument.URI)
 			s.diagnosticQueue <- DiagnosticMsg{URI: p.TextDocument.URI}
 
 		case lsp.MethodTextDocumentDidChange:
@@ -295,18 +1322,22 @@ func (s *Server) GetHandlerFunc() jsonrpc2.Handler {
 			}
 			glog.V(1).Infof("didChange: Request: %v", spew.Sdump(p)) // This is expensive.
 			for _, c := range p.ContentChanges {
-				lr := NewLineRange(c.Range)
 				// Process each content change.
-				nl := strings.Count(c.Text, "\n")
-				delta := int32(nl - int(lr.NumLines()))
-				if delta == 0 {
-					glog.V(1).Infof("No newline count change. Skipping update: lr=%+v, nl=%v", lr, nl)
-					continue
-				}
-				if err := s.MoveAnnotations(ctx, lr, delta, p.TextDocument.URI); err != nil {
+				if err := s.ApplyChange(ctx, p.TextDocument.URI, c); err != nil {
 					return fmt.Errorf("error while moving annotations: %v", err)
 				}
 			}
+			if s.ResolveAnchors(ctx, p.TextDocument.URI) {
+				s.diagnosticQueue <- DiagnosticMsg{URI: p.TextDocument.URI}
+			}
+
+		case lsp.MethodTextDocumentDidClose:
+			var p lsp.DidCloseTextDocumentParams
+			if err := json.Unmarshal(req.Params(), &p); err != nil {
+				return fmt.Errorf("error during didClose: %v", err)
+			}
+			glog.V(1).Infof("didClose: Request: %v", spew.Sdump(p)) // This is expensive.
+			s.docs.Close(p.TextDocument.URI)
 
 		case lsp.MethodInitialized:
 			if !s.gotInitialize {
@@ -331,7 +1362,10 @@ func (s *Server) GetHandlerFunc() jsonrpc2.Handler {
 			}
 			glog.V(1).Infof("Request: %v", spew.Sdump(p)) // This is expensive.
 			s.clientInfo = p.ClientInfo
-			s.workspaceFolders = ResolveWs(append(s.workspaceFolders, p.WorkspaceFolders...))
+			s.workspaceFolders, s.wsConfigs = ResolveWsConfigs(append(s.workspaceFolders, p.WorkspaceFolders...))
+			if ws, ok := s.store.(WorkspaceStore); ok {
+				ws.SetWorkspaces(s.workspaceFolders, s.wsConfigs)
+			}
 			glog.V(1).Infof("workspaces: %+v", s.workspaceFolders)
 			// Result
 			r := lsp.InitializeResult{
@@ -350,6 +1384,8 @@ func (s *Server) GetHandlerFunc() jsonrpc2.Handler {
 							//IncludeText: true,
 						},
 					},
+					HoverProvider:      true,
+					DefinitionProvider: true,
 					CodeLensProvider: &lsp.CodeLensOptions{
 						// Have code lens, but no resolve provider.
 						ResolveProvider: false,
@@ -0,0 +1,757 @@
+// Annotation storage with a database for each workspace
+package pkg
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	lsp "go.lsp.dev/protocol"
+)
+
+const (
+	// ShardExt is the extension of the database files of the workspaces
+	// in the directory of a ShardedStore.
+	ShardExt = `.sqlite`
+	// ShardIDs is the number of annotation IDs of each workspace database.
+	// The IDs of a database are in [base, base+ShardIDs), for a base that
+	// is a multiple of ShardIDs, so that the IDs of all the workspaces are
+	// distinct.
+	ShardIDs = 1_000_000_000
+	// maxShardBases is the number of the bases of the IDs.  The IDs stay
+	// below 1e14, which the JSON numbers of the clients keep exactly.
+	maxShardBases = 100_000
+
+	// idBaseSetting is the setting with the base of the IDs of a database.
+	idBaseSetting = `IdBase`
+	// defaultShard names the database of the workspaces whose names have
+	// no letters or digits, such as the empty workspace.
+	defaultShard = `default`
+)
+
+// ShardFilename returns the name of the database file of the workspace ws in
+// the directory of a ShardedStore.  The name is made of the letters and digits
+// of ws, and a hash of ws, since workspace names are often URIs.  The files
+// outside of all workspace folders are in the empty workspace, whose database
+// is named after defaultShard.
+func ShardFilename(ws string) string {
+	name := strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, ws)
+	h := uint32(2166136261)
+	for i := 0; i < len(ws); i++ {
+		h = (h ^ uint32(ws[i])) * 16777619
+	}
+	return fmt.Sprintf("%s-%08x%s", cmp.Or(strings.Trim(name, "_."), defaultShard), h, ShardExt)
+}
+
+// shard is a database of a ShardedStore.
+type shard struct {
+	db *sql.DB
+	*SQLStore
+	// base is the first ID of the annotations of the database.
+	base int64
+}
+
+// has returns true if the annotation id belongs to sh.
+func (sh *shard) has(id int64) bool {
+	return sh.base <= id && id < sh.base+ShardIDs
+}
+
+// ShardedStore is a Store that keeps the annotations of each workspace in a
+// SQLite database of its own, so that the annotations of a workspace can be
+// archived, shared or deleted on their own.  A database is opened, and
+// created if needed, when its workspace is first used.
+//
+// The database of a workspace is in the directory of the store, see
+// ShardFilename, or where the Database of the WorkspaceConfig says.  The
+// operations on all workspaces, and on annotations by ID alone, use all the
+// databases in the directory, and of the configured workspaces.
+type ShardedStore struct {
+	dir string
+	key *Key
+
+	// use is held for reading while the databases are used, and for writing
+	// by Close, so that Close waits for the operations that use them.
+	use sync.RWMutex
+	mu  sync.Mutex
+	// paths are the database files of the workspaces with a configured
+	// Database.
+	paths map[string]string
+	// shards are the open databases, by file name.
+	shards map[string]*shard
+}
+
+var _ WorkspaceStore = (*ShardedStore)(nil)
+
+// NewShardedStore returns a store that keeps the databases of the workspaces
+// in the directory dir, with the contents encrypted with key, if not nil.
+func NewShardedStore(dir string, key *Key) *ShardedStore {
+	return &ShardedStore{
+		dir:    dir,
+		key:    key,
+		paths:  map[string]string{},
+		shards: map[string]*shard{},
+	}
+}
+
+// SetWorkspaces sets the database files of the workspaces whose configs
+// have a Database, relative to their folders.  The workspaces whose database
+// is already open keep it.
+func (s *ShardedStore) SetWorkspaces(folders []lsp.WorkspaceFolder, cfgs map[string]WorkspaceConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range folders {
+		ws := f.Name
+		if ws == "" {
+			ws = f.URI
+		}
+		cfg := cfgs[ws]
+		if cfg.Database == "" {
+			continue
+		}
+		p := cfg.Database
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(lsp.URI(f.URI).Filename(), p)
+		}
+		if old := s.filename(ws); s.shards[old] != nil && old != p {
+			glog.Warningf("ShardedStore: the database of workspace %q is already open: %v, not using: %v", ws, old, p)
+			continue
+		}
+		s.paths[ws] = p
+	}
+}
+
+// Close closes the open databases, once the operations that use them are
+// done.
+func (s *ShardedStore) Close() error {
+	s.use.Lock()
+	defer s.use.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for name, sh := range s.shards {
+		if err := sh.db.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %w", name, err))
+		}
+		delete(s.shards, name)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("could not close: %v", errs)
+	}
+	return nil
+}
+
+// filename returns the database file of the workspace ws.
+func (s *ShardedStore) filename(ws string) string {
+	if p, ok := s.paths[ws]; ok {
+		return p
+	}
+	return filepath.Join(s.dir, ShardFilename(ws))
+}
+
+// open returns the database in the file filename, which is opened, and
+// created, if needed.  Must be called with s.mu held.
+func (s *ShardedStore) open(ctx context.Context, filename string) (*shard, error) {
+	if sh, ok := s.shards[filename]; ok {
+		return sh, nil
+	}
+	// The base of a new database is chosen before it is created, as all the
+	// databases in the directory are opened to choose it.
+	var base int64
+	if _, err := os.Stat(filename); errors.Is(err, fs.ErrNotExist) {
+		if base, err = s.newBase(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := MakeAllDirs(filepath.Dir(filename)); err != nil {
+		return nil, fmt.Errorf("could not make directory: %w", err)
+	}
+	needsInit, err := CreateDBFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	db, err := OpenEncryptedDB(filename, s.key)
+	if err != nil {
+		return nil, err
+	}
+	sh, err := s.init(ctx, db, filename, needsInit, base)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%v: %w", filename, err)
+	}
+	glog.Infof("ShardedStore: opened: %v, ids from: %v", filename, sh.base)
+	s.shards[filename] = sh
+	return sh, nil
+}
+
+// init creates the schema of the new database db, with IDs from base, if
+// needsInit, and brings it up to date.
+func (s *ShardedStore) init(ctx context.Context, db *sql.DB, filename string, needsInit bool, base int64) (*shard, error) {
+	if needsInit {
+		if err := CreateSchema(ctx, db); err != nil {
+			return nil, err
+		}
+		err := inTx(ctx, db, func(tx *sql.Tx) error {
+			// The next ID is one past the sequence.
+			if _, err := tx.ExecContext(ctx, `
+				INSERT INTO sqlite_sequence(name, seq) VALUES ('AnnotationLocations', ?)
+			;`, base-1); err != nil {
+				return fmt.Errorf("could not set the first ID: %w", err)
+			}
+			return txSetSetting(ctx, tx, idBaseSetting, []byte(strconv.FormatInt(base, 10)))
+		})
+		if err != nil {
+			return nil, err
+		}
+		if s.key != nil {
+			if _, err := Rekey(ctx, db, s.key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := Migrate(ctx, db, filename); err != nil {
+		return nil, err
+	}
+	if err := CheckKey(ctx, db, s.key); err != nil {
+		return nil, err
+	}
+	// The IDs of a database that was not created as a shard start at 1.
+	var first int64
+	b, err := getSetting(ctx, db, idBaseSetting)
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		if first, err = strconv.ParseInt(string(b), 10, 64); err != nil {
+			return nil, fmt.Errorf("could not parse the first ID: %w", err)
+		}
+	}
+	return &shard{db: db, SQLStore: NewSQLStore(db), base: first}, nil
+}
+
+// newBase returns a random base for the IDs of a new database, which no other
+// database uses.
+func (s *ShardedStore) newBase(ctx context.Context) (int64, error) {
+	shards, err := s.all(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		base := int64(1+rand.IntN(maxShardBases-1)) * ShardIDs
+		if !slices.ContainsFunc(shards, func(sh *shard) bool { return sh.has(base) }) {
+			return base, nil
+		}
+	}
+}
+
+// all returns all the databases: those in the directory, of the configured
+// workspaces, and those open.  Must be called with s.mu held.
+func (s *ShardedStore) all(ctx context.Context) ([]*shard, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+ShardExt))
+	if err != nil {
+		return nil, fmt.Errorf("could not list databases: %w", err)
+	}
+	for _, p := range s.paths {
+		if _, err := os.Stat(p); err == nil {
+			names = append(names, p)
+		}
+	}
+	for name := range s.shards {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	ret := []*shard{}
+	for _, name := range slices.Compact(names) {
+		sh, err := s.open(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, sh)
+	}
+	return ret, nil
+}
+
+// onShard runs fn on the database of the workspace ws, which is that of the
+// files outside of all workspace folders if ws is empty.
+func onShard[T any](ctx context.Context, s *ShardedStore, op, ws string, fn func(sh *shard) (T, error)) (T, error) {
+	var zero T
+	s.use.RLock()
+	defer s.use.RUnlock()
+	s.mu.Lock()
+	sh, err := s.open(ctx, s.filename(ws))
+	s.mu.Unlock()
+	if err != nil {
+		return zero, opError(op, err)
+	}
+	return fn(sh)
+}
+
+// onShard1 is onShard, for a fn that only returns an error.
+func onShard1(ctx context.Context, s *ShardedStore, op, ws string, fn func(sh *shard) error) error {
+	_, err := onShard(ctx, s, op, ws, func(sh *shard) (struct{}, error) {
+		return struct{}{}, fn(sh)
+	})
+	return err
+}
+
+// noteShard returns the database of the annotation id, or nil if no database
+// has it.  Must be called with s.use held.
+func (s *ShardedStore) noteShard(ctx context.Context, id int64) (*shard, error) {
+	s.mu.Lock()
+	shards, err := s.all(ctx)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, sh := range shards {
+		if sh.has(id) {
+			return sh, nil
+		}
+	}
+	return nil, nil
+}
+
+// onNote runs fn on the database of the annotation id.
+func onNote[T any](ctx context.Context, s *ShardedStore, op string, id int64, fn func(sh *shard) (T, error)) (T, error) {
+	var zero T
+	s.use.RLock()
+	defer s.use.RUnlock()
+	sh, err := s.noteShard(ctx, id)
+	if err != nil {
+		return zero, opError(op, err)
+	}
+	if sh == nil {
+		return zero, opError(op, notFound("id=%v", id))
+	}
+	return fn(sh)
+}
+
+// onNote1 is onNote, for a fn that only returns an error.
+func onNote1(ctx context.Context, s *ShardedStore, op string, id int64, fn func(sh *shard) error) error {
+	_, err := onNote(ctx, s, op, id, func(sh *shard) (struct{}, error) {
+		return struct{}{}, fn(sh)
+	})
+	return err
+}
+
+// onAll runs fn on the database of the workspace ws, or on all databases if
+// ws is empty, and returns all the results.
+func onAll[T any](ctx context.Context, s *ShardedStore, op, ws string, fn func(sh *shard) ([]T, error)) ([]T, error) {
+	if ws != "" {
+		return onShard(ctx, s, op, ws, fn)
+	}
+	s.use.RLock()
+	defer s.use.RUnlock()
+	s.mu.Lock()
+	shards, err := s.all(ctx)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, opError(op, err)
+	}
+	ret := []T{}
+	for _, sh := range shards {
+		r, err := fn(sh)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, r...)
+	}
+	return ret, nil
+}
+
+func (s *ShardedStore) GetAnn(ctx context.Context, workspace, path string, line uint32) (string, error) {
+	return onShard(ctx, s, "GetAnn", workspace, func(sh *shard) (string, error) {
+		return sh.GetAnn(ctx, workspace, path, line)
+	})
+}
+
+func (s *ShardedStore) GetAnns(ctx context.Context, workspace, path string) ([]Ann, error) {
+	return onShard(ctx, s, "GetAnns", workspace, func(sh *shard) ([]Ann, error) {
+		return sh.GetAnns(ctx, workspace, path)
+	})
+}
+
+func (s *ShardedStore) GetThread(ctx context.Context, workspace, path string, line uint32) ([]ThreadEntry, error) {
+	return onShard(ctx, s, "GetThread", workspace, func(sh *shard) ([]ThreadEntry, error) {
+		return sh.GetThread(ctx, workspace, path, line)
+	})
+}
+
+func (s *ShardedStore) InsertAnnBy(ctx context.Context, workspace, path string, line uint32, text, author string) error {
+	return onShard1(ctx, s, "InsertAnnBy", workspace, func(sh *shard) error {
+		return sh.InsertAnnBy(ctx, workspace, path, line, text, author)
+	})
+}
+
+func (s *ShardedStore) DeleteAnn(ctx context.Context, workspace, path string, line uint32) error {
+	return onShard1(ctx, s, "DeleteAnn", workspace, func(sh *shard) error {
+		return sh.DeleteAnn(ctx, workspace, path, line)
+	})
+}
+
+func (s *ShardedStore) AppendAnn(ctx context.Context, workspace, path string, line uint32, text, author string) (int64, error) {
+	return onShard(ctx, s, "AppendAnn", workspace, func(sh *shard) (int64, error) {
+		return sh.AppendAnn(ctx, workspace, path, line, text, author)
+	})
+}
+
+func (s *ShardedStore) EditAnnById(ctx context.Context, workspace, path string, id int64, text, author string) error {
+	return onShard1(ctx, s, "EditAnnById", workspace, func(sh *shard) error {
+		return sh.EditAnnById(ctx, workspace, path, id, text, author)
+	})
+}
+
+func (s *ShardedStore) DeleteAnnById(ctx context.Context, workspace, path string, id int64) error {
+	return onShard1(ctx, s, "DeleteAnnById", workspace, func(sh *shard) error {
+		return sh.DeleteAnnById(ctx, workspace, path, id)
+	})
+}
+
+func (s *ShardedStore) GetFileThread(ctx context.Context, workspace, path string) ([]ThreadEntry, error) {
+	return onShard(ctx, s, "GetFileThread", workspace, func(sh *shard) ([]ThreadEntry, error) {
+		return sh.GetFileThread(ctx, workspace, path)
+	})
+}
+
+func (s *ShardedStore) SetFileAnn(ctx context.Context, workspace, path, text, author string) error {
+	return onShard1(ctx, s, "SetFileAnn", workspace, func(sh *shard) error {
+		return sh.SetFileAnn(ctx, workspace, path, text, author)
+	})
+}
+
+func (s *ShardedStore) DeleteFileAnn(ctx context.Context, workspace, path string) error {
+	return onShard1(ctx, s, "DeleteFileAnn", workspace, func(sh *shard) error {
+		return sh.DeleteFileAnn(ctx, workspace, path)
+	})
+}
+
+func (s *ShardedStore) GetNote(ctx context.Context, id int64) (Note, error) {
+	return onNote(ctx, s, "GetNote", id, func(sh *shard) (Note, error) {
+		return sh.GetNote(ctx, id)
+	})
+}
+
+func (s *ShardedStore) UpdateNote(ctx context.Context, id int64, text, author string) error {
+	return onNote1(ctx, s, "UpdateNote", id, func(sh *shard) error {
+		return sh.UpdateNote(ctx, id, text, author)
+	})
+}
+
+func (s *ShardedStore) DeleteNote(ctx context.Context, id int64) error {
+	return onNote1(ctx, s, "DeleteNote", id, func(sh *shard) error {
+		return sh.DeleteNote(ctx, id)
+	})
+}
+
+func (s *ShardedStore) BulkMoveAnn(ctx context.Context, workspace, path string, firstLine uint32, delta int32) error {
+	return onShard1(ctx, s, "BulkMoveAnn", workspace, func(sh *shard) error {
+		return sh.BulkMoveAnn(ctx, workspace, path, firstLine, delta)
+	})
+}
+
+func (s *ShardedStore) BulkRemoveAnn(ctx context.Context, policy DeletePolicy, workspace, path string, lr LineRange, delta int32) error {
+	return onShard1(ctx, s, "BulkRemoveAnn", workspace, func(sh *shard) error {
+		return sh.BulkRemoveAnn(ctx, policy, workspace, path, lr, delta)
+	})
+}
+
+func (s *ShardedStore) GetAnnLocs(ctx context.Context, workspace, path string, firstline, lastline uint32) ([]AnnLoc, error) {
+	return onShard(ctx, s, "GetAnnLocs", workspace, func(sh *shard) ([]AnnLoc, error) {
+		return sh.GetAnnLocs(ctx, workspace, path, firstline, lastline)
+	})
+}
+
+// RestoreAnnLocs moves the annotations of the other workspaces, such as those
+// of a block of lines moved to a file of another workspace, out of their
+// databases and into that of workspace, with new IDs.  The IDs of each
+// database thus stay in its range.
+func (s *ShardedStore) RestoreAnnLocs(ctx context.Context, workspace, path string, locs []AnnLoc) error {
+	return onShard1(ctx, s, "RestoreAnnLocs", workspace, func(sh *shard) error {
+		locs = slices.Clone(locs)
+		moved := map[*shard][]int64{}
+		for i, l := range locs {
+			if l.Id == 0 || sh.has(l.Id) {
+				continue
+			}
+			from, err := s.noteShard(ctx, l.Id)
+			if err != nil {
+				return opError("RestoreAnnLocs", err)
+			}
+			if from != nil {
+				moved[from] = append(moved[from], l.Id)
+			}
+			locs[i].Id = 0
+		}
+		// The annotations are copied first, so that they are not lost if
+		// they can not be deleted.
+		if err := sh.RestoreAnnLocs(ctx, workspace, path, locs); err != nil {
+			return err
+		}
+		for from, ids := range moved {
+			if err := DropAnnLocs(ctx, from.db, ids); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *ShardedStore) MarkOrphaned(ctx context.Context, workspace, path string, numLines uint32) (int64, error) {
+	return onShard(ctx, s, "MarkOrphaned", workspace, func(sh *shard) (int64, error) {
+		return sh.MarkOrphaned(ctx, workspace, path, numLines)
+	})
+}
+
+func (s *ShardedStore) GetOrphanedAnns(ctx context.Context, workspace, path string) ([]Orphan, error) {
+	return onShard(ctx, s, "GetOrphanedAnns", workspace, func(sh *shard) ([]Orphan, error) {
+		return sh.GetOrphanedAnns(ctx, workspace, path)
+	})
+}
+
+func (s *ShardedStore) ReattachAnn(ctx context.Context, workspace, path string, id int64, newLine uint32) error {
+	return onShard1(ctx, s, "ReattachAnn", workspace, func(sh *shard) error {
+		return sh.ReattachAnn(ctx, workspace, path, id, newLine)
+	})
+}
+
+func (s *ShardedStore) SetAnchor(ctx context.Context, workspace, path string, line uint32, anchor string, declLine uint32) error {
+	return onShard1(ctx, s, "SetAnchor", workspace, func(sh *shard) error {
+		return sh.SetAnchor(ctx, workspace, path, line, anchor, declLine)
+	})
+}
+
+func (s *ShardedStore) ResolveAnchors(ctx context.Context, workspace, path string, decls []GoDecl) error {
+	return onShard1(ctx, s, "ResolveAnchors", workspace, func(sh *shard) error {
+		return sh.ResolveAnchors(ctx, workspace, path, decls)
+	})
+}
+
+// noteOrders are the orderings of the sort orders of ListAnns, see noteOrder.
+var noteOrders = map[string]func(a, b Note) int{
+	"":             byNoteLocation,
+	SortByLocation: byNoteLocation,
+	SortByCreated: func(a, b Note) int {
+		return cmp.Or(a.Created.Compare(b.Created), cmp.Compare(a.Id, b.Id))
+	},
+	SortByUpdated: func(a, b Note) int {
+		return cmp.Or(a.Updated.Compare(b.Updated), cmp.Compare(a.Id, b.Id))
+	},
+	SortByAuthor: func(a, b Note) int {
+		return cmp.Or(cmp.Compare(a.Author, b.Author), byNoteLocation(a, b))
+	},
+}
+
+// byNoteLocation orders notes as byLocation does.
+func byNoteLocation(a, b Note) int {
+	return cmp.Or(
+		cmp.Compare(a.Workspace, b.Workspace),
+		cmp.Compare(a.Path, b.Path),
+		compareBool(!a.FileLevel, !b.FileLevel),
+		cmp.Compare(a.Line, b.Line),
+		cmp.Compare(a.Id, b.Id),
+	)
+}
+
+func (s *ShardedStore) ListAnns(ctx context.Context, f ListFilter) ([]Note, error) {
+	order, ok := noteOrders[f.SortBy]
+	if !ok {
+		return nil, opError("ListAnns", invalid("unknown sort order: %q", f.SortBy))
+	}
+	ret, err := onAll(ctx, s, "ListAnns", f.Workspace, func(sh *shard) ([]Note, error) {
+		return sh.ListAnns(ctx, f)
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(ret, func(a, b Note) int {
+		if f.Desc {
+			return order(b, a)
+		}
+		return order(a, b)
+	})
+	return ret, nil
+}
+
+func (s *ShardedStore) GetTags(ctx context.Context, workspace string) ([]TagCount, error) {
+	tags, err := onAll(ctx, s, "GetTags", workspace, func(sh *shard) ([]TagCount, error) {
+		return sh.GetTags(ctx, workspace)
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for _, t := range tags {
+		counts[t.Tag] += t.Count
+	}
+	ret := []TagCount{}
+	for t, c := range counts {
+		ret = append(ret, TagCount{Tag: t, Count: c})
+	}
+	slices.SortFunc(ret, func(a, b TagCount) int { return cmp.Compare(a.Tag, b.Tag) })
+	return ret, nil
+}
+
+func (s *ShardedStore) GetLineTags(ctx context.Context, workspace, path string) (map[uint32][]string, error) {
+	return onShard(ctx, s, "GetLineTags", workspace, func(sh *shard) (map[uint32][]string, error) {
+		return sh.GetLineTags(ctx, workspace, path)
+	})
+}
+
+func (s *ShardedStore) SetKind(ctx context.Context, workspace, path string, id int64, kind Kind) error {
+	return onShard1(ctx, s, "SetKind", workspace, func(sh *shard) error {
+		return sh.SetKind(ctx, workspace, path, id, kind)
+	})
+}
+
+func (s *ShardedStore) GetLineKinds(ctx context.Context, workspace, path string) (map[uint32]Kind, error) {
+	return onShard(ctx, s, "GetLineKinds", workspace, func(sh *shard) (map[uint32]Kind, error) {
+		return sh.GetLineKinds(ctx, workspace, path)
+	})
+}
+
+func (s *ShardedStore) GetHistory(ctx context.Context, workspace, path string, id int64) ([]Revision, error) {
+	return onShard(ctx, s, "GetHistory", workspace, func(sh *shard) ([]Revision, error) {
+		return sh.GetHistory(ctx, workspace, path, id)
+	})
+}
+
+func (s *ShardedStore) GetThreadsAsOf(ctx context.Context, workspace, path string, t time.Time) ([]ThreadEntry, error) {
+	return onShard(ctx, s, "GetThreadsAsOf", workspace, func(sh *shard) ([]ThreadEntry, error) {
+		return sh.GetThreadsAsOf(ctx, workspace, path, t)
+	})
+}
+
+func (s *ShardedStore) GetBacklinks(ctx context.Context, id int64) ([]Note, error) {
+	return onNote(ctx, s, "GetBacklinks", id, func(sh *shard) ([]Note, error) {
+		return sh.GetBacklinks(ctx, id)
+	})
+}
+
+// Search ranks the results of all the databases anew, by RankSearchResults,
+// if workspace is empty.
+func (s *ShardedStore) Search(ctx context.Context, workspace, query string, limit int) ([]SearchResult, error) {
+	if workspace != "" {
+		return onShard(ctx, s, "Search", workspace, func(sh *shard) ([]SearchResult, error) {
+			return sh.Search(ctx, workspace, query, limit)
+		})
+	}
+	results, err := onAll(ctx, s, "Search", workspace, func(sh *shard) ([]SearchResult, error) {
+		return sh.Search(ctx, workspace, query, limit)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var notes []Note
+	for _, r := range results {
+		notes = append(notes, r.Note)
+	}
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	return RankSearchResults(notes, SearchTerms(query), limit), nil
+}
+
+func (s *ShardedStore) ListTrash(ctx context.Context, workspace, path string) ([]Trashed, error) {
+	ret, err := onAll(ctx, s, "ListTrash", workspace, func(sh *shard) ([]Trashed, error) {
+		return sh.ListTrash(ctx, workspace, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Most recently deleted first.
+	slices.SortStableFunc(ret, func(a, b Trashed) int {
+		return cmp.Or(b.Deleted.Compare(a.Deleted), cmp.Compare(b.Id, a.Id))
+	})
+	return ret, nil
+}
+
+func (s *ShardedStore) RestoreTrash(ctx context.Context, id int64) (Note, error) {
+	return onNote(ctx, s, "RestoreTrash", id, func(sh *shard) (Note, error) {
+		return sh.RestoreTrash(ctx, id)
+	})
+}
+
+// ShardSnapshotPrefix returns the prefix of the snapshots of the database file
+// filename of a ShardedStore on the directory dir, see SnapshotPrefix.  The
+// snapshots of the databases in dir are named after their files, and those of
+// the others after their whole paths, see ShardFilename, since the databases
+// inside of projects are often named alike.
+func ShardSnapshotPrefix(dir, filename string) string {
+	if abs, err := filepath.Abs(filename); err == nil {
+		filename = abs
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	if filepath.Dir(filename) == dir {
+		return SnapshotPrefix(filename)
+	}
+	return SnapshotPrefix(ShardFilename(filename))
+}
+
+// Backup backs up each database to the directory dir, by BackupDB, named
+// after ShardSnapshotPrefix.  Returns the new snapshots.
+func (s *ShardedStore) Backup(ctx context.Context, dir string, keep int, minAge time.Duration) ([]Snapshot, error) {
+	s.use.RLock()
+	defer s.use.RUnlock()
+	s.mu.Lock()
+	_, err := s.all(ctx)
+	shards := maps.Clone(s.shards)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, opError("Backup", err)
+	}
+	ret := []Snapshot{}
+	for _, name := range slices.Sorted(maps.Keys(shards)) {
+		snap, err := BackupDB(ctx, shards[name].db, dir, ShardSnapshotPrefix(s.dir, name), keep, minAge)
+		if err != nil {
+			return ret, err
+		}
+		if snap.Filename != "" {
+			ret = append(ret, snap)
+		}
+	}
+	return ret, nil
+}
+
+// count returns the sum of fn over all the databases.
+func (s *ShardedStore) count(ctx context.Context, op string, fn func(sh *shard) (int64, error)) (int64, error) {
+	ns, err := onAll(ctx, s, op, "", func(sh *shard) ([]int64, error) {
+		n, err := fn(sh)
+		return []int64{n}, err
+	})
+	var ret int64
+	for _, n := range ns {
+		ret += n
+	}
+	return ret, err
+}
+
+func (s *ShardedStore) PurgeTrash(ctx context.Context, before time.Time) (int64, error) {
+	return s.count(ctx, "PurgeTrash", func(sh *shard) (int64, error) {
+		return sh.PurgeTrash(ctx, before)
+	})
+}
+
+func (s *ShardedStore) CollectGarbage(ctx context.Context) (int64, error) {
+	return s.count(ctx, "CollectGarbage", func(sh *shard) (int64, error) {
+		return sh.CollectGarbage(ctx)
+	})
+}
@@ -0,0 +1,191 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/filmil/private-code-comments/tc"
+	lsp "go.lsp.dev/protocol"
+)
+
+func TestShardFilename(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		ws, prefix string
+	}{
+		{"ws", "ws-"},
+		{"file:///home/user/project/", "file____home_user_project-"},
+		{"a b/c", "a_b_c-"},
+		{"", "default-"},
+	}
+	for _, test := range tests {
+		got := ShardFilename(test.ws)
+		if filepath.Base(got) != got || filepath.Ext(got) != ShardExt || got[:len(test.prefix)] != test.prefix {
+			t.Errorf("ShardFilename(%q): got: %q", test.ws, got)
+		}
+	}
+	if ShardFilename("a/b") == ShardFilename("a_b") {
+		t.Errorf("want distinct files for distinct workspaces")
+	}
+}
+
+func TestShardedStore(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dir := t.TempDir()
+	project := t.TempDir()
+	s := NewShardedStore(dir, nil)
+	defer s.Close()
+	s.SetWorkspaces(
+		[]lsp.WorkspaceFolder{{URI: "file://" + project, Name: "project"}},
+		map[string]WorkspaceConfig{"project": {Database: ".pcc/notes.sqlite"}})
+
+	a := tc.Must(s.AppendAnn(ctx, "ws", "path", 1, "in ws #x", "alice"))
+	b := tc.Must(s.AppendAnn(ctx, "other", "path", 1, "in other #x", "bob"))
+	c := tc.Must(s.AppendAnn(ctx, "project", "path", 1, "in project", "carol"))
+	for _, name := range []string{
+		filepath.Join(dir, ShardFilename("ws")),
+		filepath.Join(dir, ShardFilename("other")),
+		filepath.Join(project, ".pcc/notes.sqlite"),
+	} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("want a database: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ShardFilename("project"))); err == nil {
+		t.Errorf("want the database of project in the project only")
+	}
+	if a/ShardIDs == b/ShardIDs || a/ShardIDs == c/ShardIDs || a >= 1e14 {
+		t.Errorf("want IDs of distinct ranges, below 1e14, got: %v, %v, %v", a, b, c)
+	}
+	if got := tc.Must(s.GetAnn(ctx, "other", "path", 1)); got != "in other #x" {
+		t.Errorf("GetAnn: got: %q", got)
+	}
+	// The files outside of all workspace folders have a database too.
+	TMust1(t, s.InsertAnnBy(ctx, "", "path", 1, "outside", "dave"))
+	if got := tc.Must(s.GetThread(ctx, "", "path", 1)); len(got) != 1 || got[0].Content != "outside" {
+		t.Errorf("GetThread without a workspace: got: %+v", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ShardFilename(""))); err != nil {
+		t.Errorf("want a database without a workspace: %v", err)
+	}
+
+	// A store on the same directory finds the notes, by workspace, by ID,
+	// and in all workspaces.
+	TMust1(t, s.Close())
+	s = NewShardedStore(dir, nil)
+	defer s.Close()
+	if n := tc.Must(s.GetNote(ctx, b)); n.Workspace != "other" || n.Content != "in other #x" {
+		t.Errorf("GetNote: got: %+v", n)
+	}
+	TMust1(t, s.UpdateNote(ctx, a, "in ws, edited #x", "alice"))
+	if got := tc.Must(s.GetAnn(ctx, "ws", "path", 1)); got != "in ws, edited #x" {
+		t.Errorf("GetAnn after UpdateNote: got: %q", got)
+	}
+	if got := tc.Must(s.GetTags(ctx, "")); len(got) != 1 || got[0] != (TagCount{Tag: "x", Count: 2}) {
+		t.Errorf("GetTags: got: %+v", got)
+	}
+	if got := tc.Must(s.Search(ctx, "", "in", 0)); len(got) != 2 {
+		t.Errorf("Search: want the 2 notes of the directory, got: %+v", got)
+	}
+	if _, err := s.GetNote(ctx, c); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetNote of an unconfigured workspace: want an ErrNotFound, got: %v", err)
+	}
+	TMust1(t, s.DeleteNote(ctx, a))
+	TMust1(t, s.DeleteNote(ctx, b))
+	if got := tc.Must(s.ListTrash(ctx, "", "")); len(got) != 2 {
+		t.Errorf("ListTrash: want the 2 notes, got: %+v", got)
+	}
+	if n := tc.Must(s.RestoreTrash(ctx, a)); n.Workspace != "ws" {
+		t.Errorf("RestoreTrash: got: %+v", n)
+	}
+}
+
+func TestShardedStoreKey(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dir := t.TempDir()
+	key := newTestKey()
+	s := NewShardedStore(dir, key)
+	defer s.Close()
+	TMust1(t, s.InsertAnnBy(ctx, "ws", "path", 1, "a secret", "alice"))
+
+	db := tc.Must(OpenEncryptedDB(filepath.Join(dir, ShardFilename("ws")), key))
+	defer db.Close()
+	TMust1(t, CheckKey(ctx, db, key))
+	other := NewShardedStore(dir, newTestKey())
+	defer other.Close()
+	if _, err := other.GetAnn(ctx, "ws", "path", 1); !errors.Is(err, ErrKey) {
+		t.Errorf("GetAnn with another key: want an ErrKey, got: %v", err)
+	}
+}
+
+func TestShardedStoreCloseWaits(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	s := NewShardedStore(t.TempDir(), nil)
+	started, release := make(chan struct{}), make(chan struct{})
+	done, closed := make(chan error), make(chan error)
+	go func() {
+		done <- onShard1(ctx, s, "test", "ws", func(sh *shard) error {
+			close(started)
+			<-release
+			return sh.InsertAnnBy(ctx, "ws", "path", 1, "late", "alice")
+		})
+	}()
+	<-started
+	go func() { closed <- s.Close() }()
+	select {
+	case err := <-closed:
+		t.Fatalf("want Close to wait for the operation, got: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	TMust1(t, <-done)
+	TMust1(t, <-closed)
+}
+
+func TestShardedStoreMoveAcrossWorkspaces(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	s := NewShardedStore(t.TempDir(), nil)
+	defer s.Close()
+	for _, policy := range []DeletePolicy{DeletePolicyMerge, DeletePolicyDrop} {
+		id := tc.Must(s.AppendAnn(ctx, "a", "a.go", 2, "moved #x", "alice"))
+		stays := tc.Must(s.AppendAnn(ctx, "a", "a.go", 5, "stays", "bob"))
+		TMust1(t, s.SetKind(ctx, "a", "a.go", id, KindQuestion))
+		before := tc.Must(s.GetNote(ctx, id))
+
+		// The block of lines 2 and 3 is cut from a.go, and pasted in b.go.
+		locs := tc.Must(s.GetAnnLocs(ctx, "a", "a.go", 2, 3))
+		TMust1(t, s.BulkRemoveAnn(ctx, policy, "a", "a.go", LineRange{Start: 2, End: 4}, -2))
+		locs[0].Line = 7
+		TMust1(t, s.RestoreAnnLocs(ctx, "b", "b.go", locs))
+
+		got := tc.Must(s.GetThread(ctx, "b", "b.go", 7))
+		if len(got) != 1 || got[0].Content != "moved #x" || got[0].Author != "alice" ||
+			got[0].Kind != KindQuestion || !got[0].Created.Equal(before.Created) {
+			t.Fatalf("%v: GetThread of the pasted block: got: %+v", policy, got)
+		}
+		if n := tc.Must(s.GetNote(ctx, got[0].Id)); n.Workspace != "b" {
+			t.Errorf("%v: GetNote of the moved note: got: %+v", policy, n)
+		}
+		if _, err := s.GetNote(ctx, id); !errors.Is(err, ErrNotFound) {
+			t.Errorf("%v: GetNote of the old ID: want an ErrNotFound, got: %v", policy, err)
+		}
+		if got := tc.Must(s.ListAnns(ctx, ListFilter{Workspace: "a"})); len(got) != 1 || got[0].Id != stays {
+			t.Errorf("%v: want only the note that stays in a, got: %+v", policy, got)
+		}
+		if got := tc.Must(s.ListTrash(ctx, "a", "")); len(got) != 0 {
+			t.Errorf("%v: want nothing in the trash of a, got: %+v", policy, got)
+		}
+		TMust1(t, s.DeleteNote(ctx, stays))
+		TMust1(t, errOf(s.PurgeTrash(ctx, time.Now().Add(time.Hour))))
+		TMust1(t, s.DeleteNote(ctx, got[0].Id))
+		TMust1(t, errOf(s.PurgeTrash(ctx, time.Now().Add(time.Hour))))
+	}
+}
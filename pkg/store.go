@@ -0,0 +1,351 @@
+// Annotation storage
+package pkg
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/golang/glog"
+	lsp "go.lsp.dev/protocol"
+)
+
+// Store keeps the annotations.  The methods are those of the package level
+// functions of the same names, which keep the annotations in a SQLite
+// database, see SQLStore.  Each operation is atomic: it takes effect in full,
+// or not at all.  The errors of the operations are of type *OpError.
+type Store interface {
+	// Annotations of a line.
+	GetAnn(ctx context.Context, workspace, path string, line uint32) (string, error)
+	GetAnns(ctx context.Context, workspace, path string) ([]Ann, error)
+	GetThread(ctx context.Context, workspace, path string, line uint32) ([]ThreadEntry, error)
+	InsertAnnBy(ctx context.Context, workspace, path string, line uint32, text, author string) error
+	DeleteAnn(ctx context.Context, workspace, path string, line uint32) error
+	AppendAnn(ctx context.Context, workspace, path string, line uint32, text, author string) (int64, error)
+	EditAnnById(ctx context.Context, workspace, path string, id int64, text, author string) error
+	DeleteAnnById(ctx context.Context, workspace, path string, id int64) error
+
+	// Annotations of a whole file or workspace.
+	GetFileThread(ctx context.Context, workspace, path string) ([]ThreadEntry, error)
+	SetFileAnn(ctx context.Context, workspace, path, text, author string) error
+	DeleteFileAnn(ctx context.Context, workspace, path string) error
+
+	// Annotations by ID alone.
+	GetNote(ctx context.Context, id int64) (Note, error)
+	UpdateNote(ctx context.Context, id int64, text, author string) error
+	DeleteNote(ctx context.Context, id int64) error
+
+	// Following the edits of a file.
+	BulkMoveAnn(ctx context.Context, workspace, path string, firstLine uint32, delta int32) error
+	// BulkRemoveAnn is TxBulkRemoveAnn, in a transaction of its own.
+	BulkRemoveAnn(ctx context.Context, policy DeletePolicy, workspace, path string, lr LineRange, delta int32) error
+	GetAnnLocs(ctx context.Context, workspace, path string, firstline, lastline uint32) ([]AnnLoc, error)
+	RestoreAnnLocs(ctx context.Context, workspace, path string, locs []AnnLoc) error
+
+	// Orphans and anchors.
+	MarkOrphaned(ctx context.Context, workspace, path string, numLines uint32) (int64, error)
+	GetOrphanedAnns(ctx context.Context, workspace, path string) ([]Orphan, error)
+	ReattachAnn(ctx context.Context, workspace, path string, id int64, newLine uint32) error
+	SetAnchor(ctx context.Context, workspace, path string, line uint32, anchor string, declLine uint32) error
+	ResolveAnchors(ctx context.Context, workspace, path string, decls []GoDecl) error
+
+	// Metadata.
+	ListAnns(ctx context.Context, f ListFilter) ([]Note, error)
+	GetTags(ctx context.Context, workspace string) ([]TagCount, error)
+	GetLineTags(ctx context.Context, workspace, path string) (map[uint32][]string, error)
+	SetKind(ctx context.Context, workspace, path string, id int64, kind Kind) error
+	GetLineKinds(ctx context.Context, workspace, path string) (map[uint32]Kind, error)
+	GetHistory(ctx context.Context, workspace, path string, id int64) ([]Revision, error)
+	GetThreadsAsOf(ctx context.Context, workspace, path string, t time.Time) ([]ThreadEntry, error)
+	GetBacklinks(ctx context.Context, id int64) ([]Note, error)
+	Search(ctx context.Context, workspace, query string, limit int) ([]SearchResult, error)
+
+	// The trash.
+	ListTrash(ctx context.Context, workspace, path string) ([]Trashed, error)
+	RestoreTrash(ctx context.Context, id int64) (Note, error)
+	PurgeTrash(ctx context.Context, before time.Time) (int64, error)
+	CollectGarbage(ctx context.Context) (int64, error)
+}
+
+// WorkspaceStore is a Store that is told about the workspaces of the server,
+// and their configs, once they are known.
+type WorkspaceStore interface {
+	Store
+	SetWorkspaces(folders []lsp.WorkspaceFolder, cfgs map[string]WorkspaceConfig)
+}
+
+const (
+	// retryAttempts is the number of times that a SQLStore operation is
+	// tried, while it fails because the database is locked.
+	retryAttempts = 5
+	// retryDelay is the wait before the first retry, and doubles for each
+	// following one.
+	retryDelay = 50 * time.Millisecond
+)
+
+// retry runs fn until it succeeds, fails with an error that is not transient,
+// or has been tried retryAttempts times.  fn must have no effect if it fails,
+// such as a single statement or a transaction.  The waits between the tries
+// end early if ctx is done.
+func retry[T any](ctx context.Context, fn func() (T, error)) (T, error) {
+	delay := retryDelay
+	for i := 1; ; i++ {
+		v, err := fn()
+		if err == nil || i == retryAttempts || !IsTransient(err) {
+			return v, err
+		}
+		glog.Warningf("database is locked, retrying in %v: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return v, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// retry1 is retry, for a fn that only returns an error.
+func retry1(ctx context.Context, fn func() error) error {
+	_, err := retry(ctx, func() (struct{}, error) {
+		return struct{}{}, fn()
+	})
+	return err
+}
+
+// SQLStore is a Store that keeps the annotations in a SQLite database.  The
+// operations that fail because another process holds a lock on the database
+// are retried, see IsTransient.
+type SQLStore struct {
+	db *sql.DB
+}
+
+var _ Store = (*SQLStore)(nil)
+
+// NewSQLStore returns a store that keeps the annotations in db, which has the
+// schema created by CreateSchema.
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+// DB returns the database of the store.
+func (s *SQLStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLStore) GetAnn(ctx context.Context, workspace, path string, line uint32) (string, error) {
+	return retry(ctx, func() (string, error) {
+		return GetAnn(ctx, s.db, workspace, path, line)
+	})
+}
+
+func (s *SQLStore) GetAnns(ctx context.Context, workspace, path string) ([]Ann, error) {
+	return retry(ctx, func() ([]Ann, error) {
+		return GetAnns(ctx, s.db, workspace, path)
+	})
+}
+
+func (s *SQLStore) GetThread(ctx context.Context, workspace, path string, line uint32) ([]ThreadEntry, error) {
+	return retry(ctx, func() ([]ThreadEntry, error) {
+		return GetThread(ctx, s.db, workspace, path, line)
+	})
+}
+
+func (s *SQLStore) InsertAnnBy(ctx context.Context, workspace, path string, line uint32, text, author string) error {
+	return retry1(ctx, func() error {
+		return InsertAnnBy(ctx, s.db, workspace, path, line, text, author)
+	})
+}
+
+func (s *SQLStore) DeleteAnn(ctx context.Context, workspace, path string, line uint32) error {
+	return retry1(ctx, func() error {
+		return DeleteAnn(ctx, s.db, workspace, path, line)
+	})
+}
+
+func (s *SQLStore) AppendAnn(ctx context.Context, workspace, path string, line uint32, text, author string) (int64, error) {
+	return retry(ctx, func() (int64, error) {
+		return AppendAnn(ctx, s.db, workspace, path, line, text, author)
+	})
+}
+
+func (s *SQLStore) EditAnnById(ctx context.Context, workspace, path string, id int64, text, author string) error {
+	return retry1(ctx, func() error {
+		return EditAnnById(ctx, s.db, workspace, path, id, text, author)
+	})
+}
+
+func (s *SQLStore) DeleteAnnById(ctx context.Context, workspace, path string, id int64) error {
+	return retry1(ctx, func() error {
+		return DeleteAnnById(ctx, s.db, workspace, path, id)
+	})
+}
+
+func (s *SQLStore) GetFileThread(ctx context.Context, workspace, path string) ([]ThreadEntry, error) {
+	return retry(ctx, func() ([]ThreadEntry, error) {
+		return GetFileThread(ctx, s.db, workspace, path)
+	})
+}
+
+func (s *SQLStore) SetFileAnn(ctx context.Context, workspace, path, text, author string) error {
+	return retry1(ctx, func() error {
+		return SetFileAnn(ctx, s.db, workspace, path, text, author)
+	})
+}
+
+func (s *SQLStore) DeleteFileAnn(ctx context.Context, workspace, path string) error {
+	return retry1(ctx, func() error {
+		return DeleteFileAnn(ctx, s.db, workspace, path)
+	})
+}
+
+func (s *SQLStore) GetNote(ctx context.Context, id int64) (Note, error) {
+	return retry(ctx, func() (Note, error) {
+		return GetNote(ctx, s.db, id)
+	})
+}
+
+func (s *SQLStore) UpdateNote(ctx context.Context, id int64, text, author string) error {
+	return retry1(ctx, func() error {
+		return UpdateNote(ctx, s.db, id, text, author)
+	})
+}
+
+func (s *SQLStore) DeleteNote(ctx context.Context, id int64) error {
+	return retry1(ctx, func() error {
+		return DeleteNote(ctx, s.db, id)
+	})
+}
+
+func (s *SQLStore) BulkMoveAnn(ctx context.Context, workspace, path string, firstLine uint32, delta int32) error {
+	return retry1(ctx, func() error {
+		return BulkMoveAnn(ctx, s.db, workspace, path, firstLine, delta)
+	})
+}
+
+func (s *SQLStore) BulkRemoveAnn(ctx context.Context, policy DeletePolicy, workspace, path string, lr LineRange, delta int32) error {
+	return retry1(ctx, func() error {
+		return opError("BulkRemoveAnn", inTx(ctx, s.db, func(tx *sql.Tx) error {
+			return TxBulkRemoveAnn(ctx, tx, policy, workspace, path, lr, delta)
+		}))
+	})
+}
+
+func (s *SQLStore) GetAnnLocs(ctx context.Context, workspace, path string, firstline, lastline uint32) ([]AnnLoc, error) {
+	return retry(ctx, func() ([]AnnLoc, error) {
+		return GetAnnLocs(ctx, s.db, workspace, path, firstline, lastline)
+	})
+}
+
+func (s *SQLStore) RestoreAnnLocs(ctx context.Context, workspace, path string, locs []AnnLoc) error {
+	return retry1(ctx, func() error {
+		return RestoreAnnLocs(ctx, s.db, workspace, path, locs)
+	})
+}
+
+func (s *SQLStore) MarkOrphaned(ctx context.Context, workspace, path string, numLines uint32) (int64, error) {
+	return retry(ctx, func() (int64, error) {
+		return MarkOrphaned(ctx, s.db, workspace, path, numLines)
+	})
+}
+
+func (s *SQLStore) GetOrphanedAnns(ctx context.Context, workspace, path string) ([]Orphan, error) {
+	return retry(ctx, func() ([]Orphan, error) {
+		return GetOrphanedAnns(ctx, s.db, workspace, path)
+	})
+}
+
+func (s *SQLStore) ReattachAnn(ctx context.Context, workspace, path string, id int64, newLine uint32) error {
+	return retry1(ctx, func() error {
+		return ReattachAnn(ctx, s.db, workspace, path, id, newLine)
+	})
+}
+
+func (s *SQLStore) SetAnchor(ctx context.Context, workspace, path string, line uint32, anchor string, declLine uint32) error {
+	return retry1(ctx, func() error {
+		return SetAnchor(ctx, s.db, workspace, path, line, anchor, declLine)
+	})
+}
+
+func (s *SQLStore) ResolveAnchors(ctx context.Context, workspace, path string, decls []GoDecl) error {
+	return retry1(ctx, func() error {
+		return ResolveAnchors(ctx, s.db, workspace, path, decls)
+	})
+}
+
+func (s *SQLStore) ListAnns(ctx context.Context, f ListFilter) ([]Note, error) {
+	return retry(ctx, func() ([]Note, error) {
+		return ListAnns(ctx, s.db, f)
+	})
+}
+
+func (s *SQLStore) GetTags(ctx context.Context, workspace string) ([]TagCount, error) {
+	return retry(ctx, func() ([]TagCount, error) {
+		return GetTags(ctx, s.db, workspace)
+	})
+}
+
+func (s *SQLStore) GetLineTags(ctx context.Context, workspace, path string) (map[uint32][]string, error) {
+	return retry(ctx, func() (map[uint32][]string, error) {
+		return GetLineTags(ctx, s.db, workspace, path)
+	})
+}
+
+func (s *SQLStore) SetKind(ctx context.Context, workspace, path string, id int64, kind Kind) error {
+	return retry1(ctx, func() error {
+		return SetKind(ctx, s.db, workspace, path, id, kind)
+	})
+}
+
+func (s *SQLStore) GetLineKinds(ctx context.Context, workspace, path string) (map[uint32]Kind, error) {
+	return retry(ctx, func() (map[uint32]Kind, error) {
+		return GetLineKinds(ctx, s.db, workspace, path)
+	})
+}
+
+func (s *SQLStore) GetHistory(ctx context.Context, workspace, path string, id int64) ([]Revision, error) {
+	return retry(ctx, func() ([]Revision, error) {
+		return GetHistory(ctx, s.db, workspace, path, id)
+	})
+}
+
+func (s *SQLStore) GetThreadsAsOf(ctx context.Context, workspace, path string, t time.Time) ([]ThreadEntry, error) {
+	return retry(ctx, func() ([]ThreadEntry, error) {
+		return GetThreadsAsOf(ctx, s.db, workspace, path, t)
+	})
+}
+
+func (s *SQLStore) GetBacklinks(ctx context.Context, id int64) ([]Note, error) {
+	return retry(ctx, func() ([]Note, error) {
+		return GetBacklinks(ctx, s.db, id)
+	})
+}
+
+func (s *SQLStore) Search(ctx context.Context, workspace, query string, limit int) ([]SearchResult, error) {
+	return retry(ctx, func() ([]SearchResult, error) {
+		return Search(ctx, s.db, workspace, query, limit)
+	})
+}
+
+func (s *SQLStore) ListTrash(ctx context.Context, workspace, path string) ([]Trashed, error) {
+	return retry(ctx, func() ([]Trashed, error) {
+		return ListTrash(ctx, s.db, workspace, path)
+	})
+}
+
+func (s *SQLStore) RestoreTrash(ctx context.Context, id int64) (Note, error) {
+	return retry(ctx, func() (Note, error) {
+		return RestoreTrash(ctx, s.db, id)
+	})
+}
+
+func (s *SQLStore) PurgeTrash(ctx context.Context, before time.Time) (int64, error) {
+	return retry(ctx, func() (int64, error) {
+		return PurgeTrash(ctx, s.db, before)
+	})
+}
+
+func (s *SQLStore) CollectGarbage(ctx context.Context) (int64, error) {
+	return retry(ctx, func() (int64, error) {
+		return CollectGarbage(ctx, s.db)
+	})
+}
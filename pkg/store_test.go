@@ -0,0 +1,344 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/filmil/private-code-comments/tc"
+	"github.com/mattn/go-sqlite3"
+)
+
+// forEachStore runs fn with a new, empty store of each kind.
+func forEachStore(t *testing.T, fn func(t *testing.T, s Store)) {
+	t.Helper()
+	t.Run("sqlite", func(t *testing.T) {
+		t.Parallel()
+		db := NewDB()
+		defer db.Close()
+		fn(t, NewSQLStore(db))
+	})
+	t.Run("memory", func(t *testing.T) {
+		t.Parallel()
+		fn(t, NewMemStore())
+	})
+	t.Run("sharded", func(t *testing.T) {
+		t.Parallel()
+		s := NewShardedStore(t.TempDir(), nil)
+		defer s.Close()
+		fn(t, s)
+	})
+}
+
+// contents returns the contents of the thread entries.
+func contents(entries []ThreadEntry) []string {
+	ret := []string{}
+	for _, e := range entries {
+		ret = append(ret, e.Content)
+	}
+	return ret
+}
+
+func TestStoreThreads(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	forEachStore(t, func(t *testing.T, s Store) {
+		first := tc.Must(s.AppendAnn(ctx, "ws", "path", 10, "first #perf", "alice"))
+		second := tc.Must(s.AppendAnn(ctx, "ws", "path", 10, "TODO: second", "bob"))
+		link := fmt.Sprintf("see [[note:%d]]", first)
+		TMust1(t, s.InsertAnnBy(ctx, "ws", "path", 20, link, "carol"))
+		TMust1(t, s.SetFileAnn(ctx, "ws", "path", "about the file", "alice"))
+
+		if got, want := contents(tc.Must(s.GetThread(ctx, "ws", "path", 10))), []string{"first #perf", "TODO: second"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("thread:\n\twant: %q\n\tgot : %q", want, got)
+		}
+		if got, want := tc.Must(s.GetAnns(ctx, "ws", "path")), []Ann{{10, "first #perf\n--\nTODO: second"}, {20, link}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("anns:\n\twant: %+v\n\tgot : %+v", want, got)
+		}
+		if got, want := contents(tc.Must(s.GetFileThread(ctx, "ws", "path"))), []string{"about the file"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("file thread:\n\twant: %q\n\tgot : %q", want, got)
+		}
+		if got, want := tc.Must(s.GetLineTags(ctx, "ws", "path")), map[uint32][]string{10: {"perf"}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("tags:\n\twant: %v\n\tgot : %v", want, got)
+		}
+		if got, want := tc.Must(s.GetLineKinds(ctx, "ws", "path"))[10], KindTodo; got != want {
+			t.Errorf("kind: want: %v, got: %v", want, got)
+		}
+		if b := tc.Must(s.GetBacklinks(ctx, first)); len(b) != 1 || b[0].Line != 20 {
+			t.Errorf("unexpected backlinks: %+v", b)
+		}
+
+		TMust1(t, s.EditAnnById(ctx, "ws", "path", first, "first, edited", "alice"))
+		if h := tc.Must(s.GetHistory(ctx, "ws", "path", first)); len(h) != 2 || h[1].Content != "first, edited" {
+			t.Errorf("unexpected history: %+v", h)
+		}
+		if err := s.EditAnnById(ctx, "ws", "other", first, "nope", "alice"); err == nil {
+			t.Errorf("edited an annotation of another file")
+		}
+
+		TMust1(t, s.DeleteAnnById(ctx, "ws", "path", second))
+		trash := tc.Must(s.ListTrash(ctx, "ws", ""))
+		if len(trash) != 1 || trash[0].Id != second {
+			t.Fatalf("unexpected trash: %+v", trash)
+		}
+		n := tc.Must(s.RestoreTrash(ctx, second))
+		if n.Line != 10 || n.Content != "TODO: second" {
+			t.Errorf("unexpected restored note: %+v", n)
+		}
+		if got, want := contents(tc.Must(s.GetThread(ctx, "ws", "path", 10))), []string{"first, edited", "TODO: second"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("restored thread:\n\twant: %q\n\tgot : %q", want, got)
+		}
+
+		// Setting the line to the text shown keeps its records.
+		shown := tc.Must(s.GetAnn(ctx, "ws", "path", 10))
+		TMust1(t, s.InsertAnnBy(ctx, "ws", "path", 10, shown+AnnSeparator+"third", "dave"))
+		if got := tc.Must(s.GetThread(ctx, "ws", "path", 10)); len(got) != 3 || got[0].Id != first || got[1].Id != second || got[2].Content != "third" {
+			t.Errorf("set thread: got: %+v", got)
+		}
+
+		// Setting the line replaces its whole thread.
+		TMust1(t, s.InsertAnnBy(ctx, "ws", "path", 10, "replaced", "dave"))
+		if got, want := contents(tc.Must(s.GetThread(ctx, "ws", "path", 10))), []string{"replaced"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("replaced thread:\n\twant: %q\n\tgot : %q", want, got)
+		}
+		if n := tc.Must(s.GetNote(ctx, first)); n.Author != "alice" {
+			t.Errorf("want the oldest annotation to keep its author, got: %+v", n)
+		}
+		if h := tc.Must(s.GetHistory(ctx, "ws", "path", first)); h[len(h)-1].RevisedBy != "dave" {
+			t.Errorf("want the editor in the history, got: %+v", h)
+		}
+		TMust1(t, s.DeleteAnn(ctx, "ws", "path", 10))
+		TMust1(t, s.DeleteFileAnn(ctx, "ws", "path"))
+		if got := tc.Must(s.ListTrash(ctx, "", "")); len(got) != 4 {
+			t.Errorf("want 4 trashed notes, got: %+v", got)
+		}
+		if n := tc.Must(s.PurgeTrash(ctx, time.Now().Add(time.Hour))); n != 4 {
+			t.Errorf("want 4 purged notes, got: %v", n)
+		}
+	})
+}
+
+func TestStoreBulkRemove(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	replaceLines := LineRange{Start: 10, End: 13}
+	tests := []struct {
+		name     string
+		policy   DeletePolicy
+		expected []Ann
+		orphans  []Ann
+	}{
+		{
+			name:     "merge",
+			policy:   DeletePolicyMerge,
+			expected: []Ann{{10, "a\n--\nb\n--\nd"}, {12, "e"}},
+			orphans:  []Ann{},
+		},
+		{
+			name:     "drop",
+			policy:   DeletePolicyDrop,
+			expected: []Ann{{11, "d"}, {12, "e"}},
+			orphans:  []Ann{},
+		},
+		{
+			name:     "next",
+			policy:   DeletePolicyNext,
+			expected: []Ann{{11, "a\n--\nb\n--\nd"}, {12, "e"}},
+			orphans:  []Ann{},
+		},
+		{
+			name:     "orphan",
+			policy:   DeletePolicyOrphan,
+			expected: []Ann{{11, "d"}, {12, "e"}},
+			orphans:  []Ann{{10, "a"}, {11, "b"}},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			forEachStore(t, func(t *testing.T, s Store) {
+				for _, a := range []Ann{{10, "a"}, {11, "b"}, {13, "d"}, {14, "e"}} {
+					TMust1(t, s.InsertAnnBy(ctx, "ws", "path", a.Line, a.Content, ""))
+				}
+				TMust1(t, s.BulkRemoveAnn(ctx, test.policy, "ws", "path", replaceLines, -2))
+				if anns := tc.Must(s.GetAnns(ctx, "ws", "path")); !reflect.DeepEqual(anns, test.expected) {
+					t.Errorf("\n\twant: %+v\n\tgot : %+v", test.expected, anns)
+				}
+				if orphans := orphanAnns(tc.Must(s.GetOrphanedAnns(ctx, "ws", "path"))); !reflect.DeepEqual(orphans, test.orphans) {
+					t.Errorf("orphans:\n\twant: %+v\n\tgot : %+v", test.orphans, orphans)
+				}
+			})
+		})
+	}
+}
+
+func TestStoreAnchors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	forEachStore(t, func(t *testing.T, s Store) {
+		TMust1(t, s.InsertAnnBy(ctx, "ws", "path", 12, "in Foo", ""))
+		TMust1(t, s.SetAnchor(ctx, "ws", "path", 12, "Foo", 10))
+		TMust1(t, s.BulkMoveAnn(ctx, "ws", "path", 0, 5))
+		TMust1(t, s.ResolveAnchors(ctx, "ws", "path", []GoDecl{{Name: "Foo", Start: 20, End: 30}}))
+		if got, want := tc.Must(s.GetAnns(ctx, "ws", "path")), []Ann{{22, "in Foo"}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("\n\twant: %+v\n\tgot : %+v", want, got)
+		}
+		TMust1(t, s.ResolveAnchors(ctx, "ws", "path", nil))
+		orphans := tc.Must(s.GetOrphanedAnns(ctx, "ws", "path"))
+		if got, want := orphanAnns(orphans), []Ann{{22, "in Foo"}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("orphans:\n\twant: %+v\n\tgot : %+v", want, got)
+		}
+		TMust1(t, s.ReattachAnn(ctx, "ws", "path", orphans[0].Id, 3))
+		if n := tc.Must(s.MarkOrphaned(ctx, "ws", "path", 3)); n != 1 {
+			t.Errorf("want 1 orphaned annotation, got: %v", n)
+		}
+
+		TMust1(t, s.InsertAnnBy(ctx, "ws", "path", 1, "one", ""))
+		locs := tc.Must(s.GetAnnLocs(ctx, "ws", "path", 0, 5))
+		TMust1(t, s.BulkRemoveAnn(ctx, DeletePolicyDrop, "ws", "path", LineRange{Start: 0, End: 2}, -2))
+		TMust1(t, s.RestoreAnnLocs(ctx, "ws", "path", locs))
+		if got, want := tc.Must(s.GetAnns(ctx, "ws", "path")), []Ann{{1, "one"}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("restored:\n\twant: %+v\n\tgot : %+v", want, got)
+		}
+
+		// A note purged from the trash is recreated as it was.
+		id := tc.Must(s.AppendAnn(ctx, "ws", "path", 4, "a question", "alice"))
+		TMust1(t, s.SetKind(ctx, "ws", "path", id, KindQuestion))
+		before := tc.Must(s.GetNote(ctx, id))
+		locs = tc.Must(s.GetAnnLocs(ctx, "ws", "path", 4, 5))
+		TMust1(t, s.BulkRemoveAnn(ctx, DeletePolicyDrop, "ws", "path", LineRange{Start: 4, End: 5}, -1))
+		tc.Must(s.PurgeTrash(ctx, time.Now().Add(time.Hour)))
+		TMust1(t, s.RestoreAnnLocs(ctx, "ws", "path", locs))
+		n := tc.Must(s.GetNote(ctx, id))
+		if n.Author != "alice" || n.Kind != KindQuestion || !n.Created.Equal(before.Created) {
+			t.Errorf("restored after purge:\n\twant: %+v\n\tgot : %+v", before, n)
+		}
+
+		// A record without an ID is a new annotation.
+		TMust1(t, s.RestoreAnnLocs(ctx, "ws", "path", []AnnLoc{{Line: 6, Content: "new", Author: "erin"}}))
+		if got := tc.Must(s.GetThread(ctx, "ws", "path", 6)); len(got) != 1 || got[0].Id == 0 || got[0].Author != "erin" {
+			t.Errorf("restored without an ID: got: %+v", got)
+		}
+	})
+}
+
+// errOf returns the error of a call, without its value.
+func errOf[T any](_ T, err error) error {
+	return err
+}
+
+func TestStoreErrors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	forEachStore(t, func(t *testing.T, s Store) {
+		tests := []struct {
+			op       string
+			err      error
+			expected error
+		}{
+			{"GetNote", errOf(s.GetNote(ctx, 42)), ErrNotFound},
+			{"UpdateNote", s.UpdateNote(ctx, 42, "text", ""), ErrNotFound},
+			{"DeleteNote", s.DeleteNote(ctx, 42), ErrNotFound},
+			{"EditAnnById", s.EditAnnById(ctx, "ws", "path", 42, "text", ""), ErrNotFound},
+			{"RestoreTrash", errOf(s.RestoreTrash(ctx, 42)), ErrNotFound},
+			{"ReattachAnn", s.ReattachAnn(ctx, "ws", "path", 42, 2), ErrNotFound},
+			{"GetAnns", errOf(s.GetAnns(ctx, "", "path")), ErrInvalid},
+			{"ListAnns", errOf(s.ListAnns(ctx, ListFilter{SortBy: "size"})), ErrInvalid},
+			{"BulkRemoveAnn", s.BulkRemoveAnn(ctx, "keep", "ws", "path", LineRange{Start: 1, End: 2}, -1), ErrInvalid},
+		}
+		for _, test := range tests {
+			var e *OpError
+			if !errors.As(test.err, &e) || e.Op != test.op || !errors.Is(test.err, test.expected) {
+				t.Errorf("%v: want an %v error, got: %v", test.op, test.expected, test.err)
+			}
+		}
+	})
+}
+
+func TestIsTransient(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{errors.New("database is locked"), false},
+		{sqlite3.Error{Code: sqlite3.ErrBusy}, true},
+		{fmt.Errorf("wrapped: %w", sqlite3.Error{Code: sqlite3.ErrLocked}), true},
+		{fmt.Errorf("wrapped: %w", sqlite3.Error{Code: sqlite3.ErrConstraint}), false},
+	}
+	for _, test := range tests {
+		if got := IsTransient(test.err); got != test.expected {
+			t.Errorf("IsTransient(%v): want: %v, got: %v", test.err, test.expected, got)
+		}
+	}
+}
+
+// withoutIDs returns a copy of notes without their IDs.  The IDs of a
+// ShardedStore are from the ranges of its databases.
+func withoutIDs(notes []Note) []Note {
+	ret := slices.Clone(notes)
+	for i := range ret {
+		ret[i].Id = 0
+	}
+	return ret
+}
+
+// TestStoresAgree checks that the stores list the same notes, in the same
+// order, after the same changes.
+func TestStoresAgree(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	sharded := NewShardedStore(t.TempDir(), nil)
+	defer sharded.Close()
+	stores := []Store{NewSQLStore(db), NewMemStore(), sharded}
+	for _, s := range stores {
+		TMust1(t, s.InsertAnnBy(ctx, "ws", "b", 3, "b3 #x", "bob"))
+		TMust1(t, s.InsertAnnBy(ctx, "ws", "a", 7, "a7 #y #x", "alice"))
+		tc.Must(s.AppendAnn(ctx, "ws", "a", 7, "a7 again", "bob"))
+		TMust1(t, s.SetFileAnn(ctx, "ws", "a", "about a", "carol"))
+		TMust1(t, s.SetFileAnn(ctx, "ws", "", "about ws", "carol"))
+		TMust1(t, s.InsertAnnBy(ctx, "other", "a", 1, "elsewhere #x", "alice"))
+		tc.Must(s.MarkOrphaned(ctx, "ws", "b", 2))
+	}
+	// The timestamps depend on when the changes were made.
+	clear := func(notes []Note) []Note {
+		for i := range notes {
+			notes[i].Created, notes[i].Updated = time.Time{}, time.Time{}
+		}
+		return notes
+	}
+	for _, f := range []ListFilter{
+		{},
+		{Desc: true},
+		{SortBy: SortByAuthor},
+		{Workspace: "ws", Tag: "#X"},
+		{Author: "bob", SortBy: SortByLocation, Desc: true},
+	} {
+		want := clear(tc.Must(stores[0].ListAnns(ctx, f)))
+		for _, s := range stores[1:] {
+			got, want := clear(tc.Must(s.ListAnns(ctx, f))), want
+			if s == sharded {
+				got, want = withoutIDs(got), withoutIDs(want)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%T: ListAnns(%+v):\n\twant: %+v\n\tgot : %+v", s, f, want, got)
+			}
+		}
+	}
+	for _, ws := range []string{"ws", ""} {
+		want := tc.Must(stores[0].GetTags(ctx, ws))
+		for _, s := range stores[1:] {
+			if got := tc.Must(s.GetTags(ctx, ws)); !reflect.DeepEqual(got, want) {
+				t.Errorf("%T: GetTags(%q):\n\twant: %+v\n\tgot : %+v", s, ws, want, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/filmil/private-code-comments/tc"
+	"go.lsp.dev/jsonrpc2"
+	lsp "go.lsp.dev/protocol"
+)
+
+const (
+	// stressDBEnv is the database file that TestStressServer serves, if set.
+	stressDBEnv = `PCC_STRESS_DB`
+	// stressClientEnv is the number of the TestStressServer process.
+	stressClientEnv = `PCC_STRESS_CLIENT`
+
+	// stressServers is the number of servers that share the database file.
+	stressServers = 4
+	// stressEdits is the number of edits made by each server.
+	stressEdits = 50
+	// stressSharedLine is the line that all the servers append to.
+	stressSharedLine = 100
+)
+
+// stressFile is the file that the stress test annotates.
+const stressFile = lsp.URI(`file:///stress/file.txt`)
+
+// TestMultiProcess runs several server processes against one database file,
+// each making edits as fast as it can, and checks that none of the edits is
+// lost.
+func TestMultiProcess(t *testing.T) {
+	ctx := context.Background()
+	if testing.Short() {
+		t.Skip("skipping the stress test in short mode")
+	}
+	dbFile := filepath.Join(t.TempDir(), "stress.sqlite")
+	tc.Must(CreateDBFile(dbFile))
+	db := tc.Must(OpenDB(dbFile))
+	defer db.Close()
+	TMust1(t, CreateSchema(ctx, db))
+
+	var wg sync.WaitGroup
+	for i := 0; i < stressServers; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestStressServer$", "-test.v")
+		cmd.Env = append(os.Environ(),
+			stressDBEnv+"="+dbFile, fmt.Sprintf("%v=%d", stressClientEnv, i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Errorf("server %v failed: %v\n%s", cmd.Env[len(cmd.Env)-1], err, out)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s := NewSQLStore(db)
+	for i := 0; i < stressServers; i++ {
+		if got := tc.Must(s.GetThread(ctx, "stress", "/file.txt", uint32(i))); len(got) != stressEdits {
+			t.Errorf("server %v: want %v annotations, got: %v", i, stressEdits, len(got))
+		}
+	}
+	if got := tc.Must(s.GetThread(ctx, "stress", "/file.txt", stressSharedLine)); len(got) != stressServers*stressEdits {
+		t.Errorf("shared line: want %v annotations, got: %v", stressServers*stressEdits, len(got))
+	}
+	if got := tc.Must(s.GetFileThread(ctx, "stress", "/file.txt")); len(got) != 1 {
+		t.Errorf("want a single file annotation, got: %+v", got)
+	}
+}
+
+// TestStressServer is a server process of TestMultiProcess.  It serves a
+// client that appends to its own line and to a shared one, replaces the file
+// annotation, and reads the shared line back.
+func TestStressServer(t *testing.T) {
+	dbFile := os.Getenv(stressDBEnv)
+	if dbFile == "" {
+		t.Skip("only run by TestMultiProcess")
+	}
+	client := tc.Must(strconv.Atoi(os.Getenv(stressClientEnv)))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	db := tc.Must(OpenDB(dbFile))
+	defer db.Close()
+	sc, cc := net.Pipe()
+	sconn := jsonrpc2.NewConn(jsonrpc2.NewStream(sc))
+	s := tc.Must(NewServer(ctx, NewSQLStore(db), sconn, ServerOpts{}))
+	sconn.Go(ctx, s.GetHandlerFunc())
+	defer sconn.Close()
+	conn := jsonrpc2.NewConn(jsonrpc2.NewStream(cc))
+	conn.Go(ctx, func(ctx context.Context, reply jsonrpc2.Replier, req jsonrpc2.Request) error {
+		// Diagnostics and other notifications are ignored.
+		return reply(ctx, nil, nil)
+	})
+	defer conn.Close()
+
+	call := func(method string, params, result any) {
+		t.Helper()
+		if _, err := conn.Call(ctx, method, params, result); err != nil {
+			t.Fatalf("%v: %v", method, err)
+		}
+	}
+	call(lsp.MethodInitialize, lsp.InitializeParams{
+		WorkspaceFolders: []lsp.WorkspaceFolder{{URI: "file:///stress", Name: "stress"}},
+	}, &lsp.InitializeResult{})
+	TMust1(t, conn.Notify(ctx, lsp.MethodInitialized, lsp.InitializedParams{}))
+
+	for i := 0; i < stressEdits; i++ {
+		content := []string{fmt.Sprintf("server %v, edit %v", client, i)}
+		call(PccThreadAppendCmd, PccThreadAppend{
+			PccGet:  PccGet{File: stressFile, Line: uint32(client)},
+			Content: content,
+		}, &PccThreadAppendResp{})
+		call(PccThreadAppendCmd, PccThreadAppend{
+			PccGet:  PccGet{File: stressFile, Line: stressSharedLine},
+			Content: content,
+		}, &PccThreadAppendResp{})
+		call(PccSetCmd, PccSet{
+			PccGet:  PccGet{File: stressFile, Scope: ScopeFile},
+			Content: content,
+		}, &PccSetRes{})
+		var r PccThreadGetResp
+		call(PccThreadGetCmd, PccThreadGet{
+			PccGet: PccGet{File: stressFile, Line: stressSharedLine},
+		}, &r)
+		if len(r.Entries) == 0 {
+			t.Fatalf("edit %v: the shared line has no annotations", i)
+		}
+	}
+}
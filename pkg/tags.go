@@ -0,0 +1,66 @@
+// Hashtags in annotation content.
+package pkg
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// ParseTags returns the normalized hashtags in text, such as `#perf` or
+// `#question`, sorted and without duplicates.
+//
+// A hashtag is a '#' at the start of a word, followed by a letter, then by
+// letters, digits, '_' or '-'.  So `C#` and `http://host/#anchor` have no tags.
+func ParseTags(text string) []string {
+	seen := map[string]bool{}
+	var ret []string
+	rs := []rune(text)
+	for i := 0; i < len(rs); i++ {
+		if rs[i] != '#' || (i > 0 && !isTagBoundary(rs[i-1])) {
+			continue
+		}
+		j := i + 1
+		if j >= len(rs) || !unicode.IsLetter(rs[j]) {
+			continue
+		}
+		for j < len(rs) && isTagRune(rs[j]) {
+			j++
+		}
+		// A tag may not end in a '-', e.g. at the end of a sentence.
+		t := NormalizeTag(strings.TrimRight(string(rs[i+1:j]), "-"))
+		if !seen[t] {
+			seen[t] = true
+			ret = append(ret, t)
+		}
+		i = j - 1
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// NormalizeTag returns the normalized form of a tag, in lower case and
+// without the leading '#'.
+func NormalizeTag(t string) string {
+	return strings.ToLower(strings.TrimPrefix(t, "#"))
+}
+
+// TagsString formats tags for display, as `#a #b`.
+func TagsString(tags []string) string {
+	var b strings.Builder
+	for i, t := range tags {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		b.WriteString("#" + t)
+	}
+	return b.String()
+}
+
+func isTagBoundary(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("([{,;\"'", r)
+}
+
+func isTagRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-'
+}
@@ -0,0 +1,65 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/filmil/private-code-comments/tc"
+)
+
+func TestParseTags(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		text     string
+		expected []string
+	}{
+		{"no tags", nil},
+		{"#perf", []string{"perf"}},
+		{"slow #Perf, see #question.", []string{"perf", "question"}},
+		{"#todo\nand #TODO again", []string{"todo"}},
+		{"(#a-b_c) #x-", []string{"a-b_c", "x"}},
+		{"C# and http://host/#anchor and #1 and ##", nil},
+	}
+	for _, test := range tests {
+		if tags := ParseTags(test.text); !reflect.DeepEqual(tags, test.expected) {
+			t.Errorf("ParseTags(%q): want: %q, got: %q", test.text, test.expected, tags)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 10, "slow #perf"))
+	id := tc.Must(AppendAnn(ctx, db, "ws", "path", 10, "why? #question", ""))
+	tc.Must(AppendAnn(ctx, db, "ws", "other", 1, "#perf again", ""))
+	tc.Must(AppendAnn(ctx, db, "ws2", "path", 1, "#todo", ""))
+
+	if want, got := []TagCount{{"perf", 2}, {"question", 1}}, tc.Must(GetTags(ctx, db, "ws")); !reflect.DeepEqual(want, got) {
+		t.Errorf("GetTags: want: %+v, got: %+v", want, got)
+	}
+	want := map[uint32][]string{10: {"perf", "question"}}
+	if got := tc.Must(GetLineTags(ctx, db, "ws", "path")); !reflect.DeepEqual(want, got) {
+		t.Errorf("GetLineTags: want: %+v, got: %+v", want, got)
+	}
+
+	// Editing updates the tags.
+	TMust1(t, EditAnnById(ctx, db, "ws", "path", id, "answered #done", ""))
+	var got []string
+	for _, n := range tc.Must(ListAnns(ctx, db, ListFilter{Tag: "#Done"})) {
+		got = append(got, n.Content)
+	}
+	if want := []string{"answered #done"}; !reflect.DeepEqual(want, got) {
+		t.Errorf("ListAnns: want: %q, got: %q", want, got)
+	}
+	th := tc.Must(GetThread(ctx, db, "ws", "path", 10))
+	if want := [][]string{{"perf"}, {"done"}}; !reflect.DeepEqual([][]string{th[0].Tags, th[1].Tags}, want) {
+		t.Errorf("GetThread: want: %q, got: %+v", want, th)
+	}
+	if s := TagsString(th[0].Tags); s != "#perf" {
+		t.Errorf("TagsString: got: %q", s)
+	}
+}
@@ -0,0 +1,189 @@
+// Short-lived memory of annotations displaced by deletions, for undo.
+package pkg
+
+import (
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	lsp "go.lsp.dev/protocol"
+)
+
+const (
+	// TombstoneTTL is how long a deletion can be undone with its annotations
+	// restored.
+	TombstoneTTL = 5 * time.Minute
+	// MaxTombstones is the maximum number of deletions remembered.
+	MaxTombstones = 32
+)
+
+// Tombstone records the placement of the annotations on lines, before a
+// deletion of those lines moved, merged or removed them.
+type Tombstone struct {
+	URI             lsp.URI
+	Workspace, Path string
+	// Start is where the change that deleted the lines started.
+	Start lsp.Position
+	// Deleted is the text that was deleted by the change.
+	Deleted string
+	// Inserted is the text that the change inserted in place of Deleted.
+	Inserted string
+	// Locs are the annotations of the affected lines, on their lines from
+	// before the deletion.
+	Locs []AnnLoc
+	// Block are the lines whose whole content was deleted, as they were
+	// before the deletion.
+	Block []string
+	// Carried are the annotations of the lines in Block, with lines relative
+	// to the first line of Block.  They follow the block if it is inserted
+	// again, as when a block of code is cut and pasted.
+	Carried []AnnLoc
+	// When the deletion happened.
+	Time time.Time
+}
+
+// Tombstones is a concurrency safe log of recent tombstones.
+type Tombstones struct {
+	m   sync.Mutex
+	ts  []Tombstone
+	now func() time.Time
+}
+
+// NewTombstones creates an empty tombstone log.
+func NewTombstones() *Tombstones {
+	return &Tombstones{now: time.Now}
+}
+
+// Add records a tombstone, forgetting the oldest ones if needed.
+func (t *Tombstones) Add(ts Tombstone) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	ts.Time = t.now()
+	t.expire()
+	t.ts = append(t.ts, ts)
+	if len(t.ts) > MaxTombstones {
+		t.ts = t.ts[len(t.ts)-MaxTombstones:]
+	}
+}
+
+// TakeInverse finds, removes and returns the most recent tombstone of the
+// deletion that is undone by a change in uri, which replaced the text replaced
+// by the text inserted at start.
+func (t *Tombstones) TakeInverse(uri lsp.URI, start lsp.Position, replaced, inserted string) (Tombstone, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.expire()
+	for i := len(t.ts) - 1; i >= 0; i-- {
+		ts := t.ts[i]
+		if ts.URI == uri && ts.Start == start && ts.Deleted == inserted && ts.Inserted == replaced {
+			t.ts = append(t.ts[:i], t.ts[i+1:]...)
+			return ts, true
+		}
+	}
+	return Tombstone{}, false
+}
+
+// TakeMoved finds, removes and returns the most recent tombstone whose block
+// of deleted lines reappears in lines, the lines touched by an insertion into
+// any document, starting at line first.  Also returns the carried annotations
+// placed on their lines at the new location.
+func (t *Tombstones) TakeMoved(lines []string, first uint32) (Tombstone, []AnnLoc, bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.expire()
+	for i := len(t.ts) - 1; i >= 0; i-- {
+		ts := t.ts[i]
+		if len(ts.Carried) == 0 {
+			continue
+		}
+		at, ok := FindBlock(lines, ts.Block)
+		if !ok {
+			continue
+		}
+		t.ts = append(t.ts[:i], t.ts[i+1:]...)
+		locs := make([]AnnLoc, 0, len(ts.Carried))
+		for _, l := range ts.Carried {
+			l.Line += first + uint32(at)
+			locs = append(locs, l)
+		}
+		return ts, locs, true
+	}
+	return Tombstone{}, nil, false
+}
+
+// FindBlock returns the index of the first occurrence of the consecutive lines
+// block in lines.  Blocks of only blank lines are never found, since they
+// could be anywhere.
+func FindBlock(lines, block []string) (int, bool) {
+	blank := true
+	for _, b := range block {
+		blank = blank && IsBlank(b)
+	}
+	if blank {
+		return 0, false
+	}
+outer:
+	for i := 0; i+len(block) <= len(lines); i++ {
+		for j, b := range block {
+			if lines[i+j] != b {
+				continue outer
+			}
+		}
+		return i, true
+	}
+	return 0, false
+}
+
+// CarriedBlock returns the lines of the range lr whose whole content is
+// deleted by a change in lr, given their text lines before the change, and
+// the annotations locs on them with lines relative to the first such line.
+func CarriedBlock(lr LineRange, lines []string, locs []AnnLoc) ([]string, []AnnLoc) {
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	first, last := lr.Start, lr.End
+	if !RemovesFirstLine(lr, lines[0]) {
+		first++
+	}
+	if end := lines[len(lines)-1]; last > lr.Start && lr.EndCol < uint32(len(utf16.Encode([]rune(end)))) {
+		last--
+	}
+	if first > last || int(last-lr.Start) >= len(lines) {
+		return nil, nil
+	}
+	var carried []AnnLoc
+	for _, l := range locs {
+		if first <= l.Line && l.Line <= last {
+			l.Line -= first
+			carried = append(carried, l)
+		}
+	}
+	return lines[first-lr.Start : last-lr.Start+1], carried
+}
+
+// Shift updates the tombstones of uri for a change at line that moved the
+// lines below it by delta.
+func (t *Tombstones) Shift(uri lsp.URI, line uint32, delta int32) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	for i := range t.ts {
+		ts := &t.ts[i]
+		if ts.URI != uri || ts.Start.Line <= line {
+			continue
+		}
+		ts.Start.Line = uint32(int32(ts.Start.Line) + delta)
+		for j := range ts.Locs {
+			ts.Locs[j].Line = uint32(int32(ts.Locs[j].Line) + delta)
+		}
+	}
+}
+
+// expire forgets the tombstones older than TombstoneTTL.
+func (t *Tombstones) expire() {
+	cutoff := t.now().Add(-TombstoneTTL)
+	i := 0
+	for i < len(t.ts) && t.ts[i].Time.Before(cutoff) {
+		i++
+	}
+	t.ts = t.ts[i:]
+}
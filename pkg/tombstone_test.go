@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/filmil/private-code-comments/tc"
+	lsp "go.lsp.dev/protocol"
+)
+
+func TestTombstones(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1000, 0)
+	ts := NewTombstones()
+	ts.now = func() time.Time { return now }
+
+	at := func(l uint32) lsp.Position { return lsp.Position{Line: l} }
+	ts.Add(Tombstone{URI: "file:///a", Start: at(1), Deleted: "one\n", Locs: []AnnLoc{{Id: 1, Line: 1}}})
+	ts.Add(Tombstone{URI: "file:///a", Start: at(5), Deleted: "five\n", Locs: []AnnLoc{{Id: 2, Line: 5}}})
+
+	if _, ok := ts.TakeInverse("file:///b", at(1), "", "one\n"); ok {
+		t.Errorf("matched a tombstone of another file")
+	}
+	if _, ok := ts.TakeInverse("file:///a", at(1), "", "two\n"); ok {
+		t.Errorf("matched a tombstone with other text")
+	}
+
+	// A line inserted at the top moves the tombstones below it.
+	ts.Shift("file:///a", 0, 1)
+	got, ok := ts.TakeInverse("file:///a", at(6), "", "five\n")
+	if !ok {
+		t.Fatalf("shifted tombstone not found")
+	}
+	if want := []AnnLoc{{Id: 2, Line: 6}}; !reflect.DeepEqual(got.Locs, want) {
+		t.Errorf("want: %+v, got: %+v", want, got.Locs)
+	}
+	if _, ok := ts.TakeInverse("file:///a", at(6), "", "five\n"); ok {
+		t.Errorf("tombstone taken twice")
+	}
+
+	now = now.Add(TombstoneTTL + time.Second)
+	if _, ok := ts.TakeInverse("file:///a", at(2), "", "one\n"); ok {
+		t.Errorf("expired tombstone matched")
+	}
+}
+
+func TestRestoreAnnLocs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	db := NewDB()
+	defer db.Close()
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 10, "a"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 11, "b"))
+	TMust1(t, InsertAnn(ctx, db, "ws", "path", 12, "c"))
+
+	locs := tc.Must(GetAnnLocs(ctx, db, "ws", "path", 10, 11))
+
+	// Delete line 10, dropping its note.
+	tx := tc.Must(db.Begin())
+	TMust1(t, TxBulkRemoveAnn(ctx, tx, DeletePolicyDrop, "ws", "path", LineRange{Start: 10, End: 11}, -1))
+	TMust1(t, tx.Commit())
+
+	// And insert it back.
+	TMust1(t, BulkMoveAnn(ctx, db, "ws", "path", 10, 1))
+	TMust1(t, RestoreAnnLocs(ctx, db, "ws", "path", locs))
+
+	want := []Ann{{10, "a"}, {11, "b"}, {12, "c"}}
+	if anns := tc.Must(GetAnns(ctx, db, "ws", "path")); !reflect.DeepEqual(anns, want) {
+		t.Errorf("\n\twant: %+v\n\tgot : %+v", want, anns)
+	}
+	if got := tc.Must(GetAnnLocs(ctx, db, "ws", "path", 10, 11)); !reflect.DeepEqual(got, locs) {
+		t.Errorf("IDs not restored:\n\twant: %+v\n\tgot : %+v", locs, got)
+	}
+}
+
+func TestCarriedBlock(t *testing.T) {
+	t.Parallel()
+	before := []string{"}", "func f() {", "\treturn", "}", "", "func g() {"}
+	locs := []AnnLoc{{Id: 1, Line: 10}, {Id: 2, Line: 11}, {Id: 3, Line: 15}}
+	tests := []struct {
+		name    string
+		lr      LineRange
+		block   []string
+		carried []AnnLoc
+	}{
+		{
+			name:    "whole lines",
+			lr:      LineRange{Start: 11, End: 15},
+			block:   []string{"func f() {", "\treturn", "}", ""},
+			carried: []AnnLoc{{Id: 2, Line: 0}},
+		},
+		{
+			name:    "from the end of the line before",
+			lr:      LineRange{Start: 10, StartCol: 1, End: 14},
+			block:   []string{"func f() {", "\treturn", "}", ""},
+			carried: []AnnLoc{{Id: 2, Line: 0}},
+		},
+		{
+			name:    "into the last line",
+			lr:      LineRange{Start: 10, End: 15, EndCol: 4},
+			block:   []string{"}", "func f() {", "\treturn", "}", ""},
+			carried: []AnnLoc{{Id: 1, Line: 0}, {Id: 2, Line: 1}},
+		},
+	}
+	for _, test := range tests {
+		lines := before[test.lr.Start-10 : test.lr.End-10+1]
+		block, carried := CarriedBlock(test.lr, lines, locs)
+		if !reflect.DeepEqual(block, test.block) || !reflect.DeepEqual(carried, test.carried) {
+			t.Errorf("%v:\n\twant: %q %+v\n\tgot : %q %+v", test.name, test.block, test.carried, block, carried)
+		}
+	}
+}
+
+func TestTakeMoved(t *testing.T) {
+	t.Parallel()
+	ts := NewTombstones()
+	ts.Add(Tombstone{
+		URI:     "file:///a",
+		Block:   []string{"func f() {", "}"},
+		Carried: []AnnLoc{{Id: 1, Line: 1, Content: "note"}},
+	})
+	ts.Add(Tombstone{
+		URI:     "file:///a",
+		Block:   []string{"", ""},
+		Carried: []AnnLoc{{Id: 2, Line: 0}},
+	})
+
+	if _, _, ok := ts.TakeMoved([]string{"func f() {", "\treturn", "}"}, 0); ok {
+		t.Errorf("matched a block with other lines")
+	}
+	got, locs, ok := ts.TakeMoved([]string{"", "", "func f() {", "}", ""}, 20)
+	if !ok {
+		t.Fatalf("moved block not found")
+	}
+	if got.URI != "file:///a" {
+		t.Errorf("unexpected tombstone: %+v", got)
+	}
+	if want := []AnnLoc{{Id: 1, Line: 23, Content: "note"}}; !reflect.DeepEqual(locs, want) {
+		t.Errorf("want: %+v, got: %+v", want, locs)
+	}
+	if _, _, ok := ts.TakeMoved([]string{"", "", "func f() {", "}", ""}, 20); ok {
+		t.Errorf("tombstone taken twice")
+	}
+}
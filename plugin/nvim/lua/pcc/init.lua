@@ -33,6 +33,25 @@ end
 local client_name = 'pcc'
 local method_get = '$/pcc/get' -- file, line -> text or ""
 local method_set = '$/pcc/set' -- file, line, text -> (nothing)
+local method_orphans = '$/pcc/orphans' -- file -> orphans
+local method_reattach = '$/pcc/reattach' -- file, id, new_line -> (nothing)
+local method_anchor = '$/pcc/anchor' -- file, line, anchor -> anchor
+local method_get_by_id = '$/pcc/getById' -- id -> note
+local method_update_by_id = '$/pcc/updateById' -- id, content -> note
+local method_delete_by_id = '$/pcc/deleteById' -- id -> (nothing)
+local method_thread_get = '$/pcc/thread/get' -- file, line -> entries
+local method_thread_append = '$/pcc/thread/append' -- file, line, content -> id
+local method_thread_edit = '$/pcc/thread/edit' -- file, id, content -> (nothing)
+local method_thread_delete = '$/pcc/thread/delete' -- file, id -> (nothing)
+local method_list = '$/pcc/list' -- filter -> notes
+local method_search = '$/pcc/search' -- query, workspace or file -> results
+local method_tags = '$/pcc/tags' -- workspace -> tags
+local method_history = '$/pcc/history' -- file, id -> revisions
+local method_as_of = '$/pcc/asOf' -- file, time -> notes
+local method_trash = '$/pcc/trash' -- file or workspace -> notes
+local method_trash_restore = '$/pcc/trash/restore' -- id -> note
+local method_gc = '$/pcc/gc' -- (nothing) -> removed
+local method_workspace_notes = '$/pcc/workspaceNotes' -- file or workspace -> entries
 
 -- Returns the current buffer information.
 local function get_current_buf_info()
@@ -228,9 +247,34 @@ local default_opts = {
     -- diagnostics.
     log_verbosity = 0,
 
+    -- What happens to the notes on deleted lines: "merge", "drop", "next" or
+    -- "orphan". A workspace's pcc.config.json can override this.
+    delete_policy = os.getenv("PCC_DELETE_POLICY") or "merge",
+
+    -- If set, the notes of each workspace are kept in a database of their
+    -- own, in this directory, instead of in `db`. A workspace's
+    -- pcc.config.json can put its database elsewhere.
+    shard_dir = os.getenv("PCC_SHARD_DIR") or "",
+
+    -- If set, snapshots of the databases are made in this directory while
+    -- pcc runs, every hour, and the newest 24 of each database are kept.
+    backup_dir = os.getenv("PCC_BACKUP_DIR") or "",
+
     autostart = true,
 }
 
+---Returns the flags of the store, and its backups, of the pcc binary.
+local function store_args()
+    local args = {}
+    if M.config.shard_dir ~= "" then
+        vim.list_extend(args, { "--store=sharded", "--shard_dir=" .. M.config.shard_dir })
+    end
+    if M.config.backup_dir ~= "" then
+        table.insert(args, "--backup_dir=" .. M.config.backup_dir)
+    end
+    return args
+end
+
 ---Configures the pcc client side, without using lsp-config.
 function M.setup_client(opts)
     M.config = vim.tbl_deep_extend('force', default_opts, opts or {})
@@ -246,12 +290,13 @@ function M.setup_client(opts)
                     return
                 end
                 vim.lsp.start({
-                    cmd = {
+                    cmd = vim.list_extend({
                         M.config.pcc_binary,
                         "--log_dir=" .. M.config.log_dir,
                         "--v=" .. string.format("%d", M.config.log_verbosity),
                         "--db=" .. M.config.db,
-                    },
+                        "--delete_policy=" .. M.config.delete_policy,
+                    }, store_args()),
                     root_dir = vim.fs.dirname(
                         vim.fs.find(M.config.root_patterns,
                             { upward = true })[1]),
@@ -343,6 +388,319 @@ function M.delete()
 
 end
 
+-- Lists the orphaned notes of the current buffer in the quickfix list. Each
+-- entry shows the ID of the note, for `reattach`, and the line the note was
+-- last attached to.
+function M.orphans()
+    local buf_info = get_current_buf_info()
+    local client = find_client(buf_info.parent_buf)
+    if not client then
+        error(string.format("no pcc client for buf=%d", buf_info.parent_buf))
+        return
+    end
+    local r = client.request_sync(method_orphans, {
+        file = string.format("file://%s", buf_info.parent_buf_path),
+    }, 5000, buf_info.parent_buf)
+    if not r or r.err or not r.result then
+        error(string.format("could not get orphans: %s", vim.inspect(r)))
+        return
+    end
+    local items = {}
+    for _, o in ipairs(r.result.orphans) do
+        table.insert(items, {
+            bufnr = buf_info.parent_buf,
+            lnum = 1,
+            text = string.format("#%d (was line %d) %s",
+                o.id, o.line + 1, table.concat(o.content, " ")),
+        })
+    end
+    vim.fn.setqflist(items, 'r')
+    return r.result.orphans
+end
+
+-- Reattaches the orphaned note with the ID `id` to the current line of the
+-- current buffer.  If `id` is nil, the note is picked from the orphaned notes
+-- of the buffer.
+function M.reattach(id)
+    local buf_info = get_current_buf_info()
+    local client = find_client(buf_info.parent_buf)
+    if not client then
+        error(string.format("no pcc client for buf=%d", buf_info.parent_buf))
+        return
+    end
+    local function request(orphan_id)
+        return client.request(method_reattach, {
+            file = string.format("file://%s", buf_info.parent_buf_path),
+            id = orphan_id,
+            new_line = buf_info.cursor_line,
+        }, nil, buf_info.parent_buf)
+    end
+    if id ~= nil then
+        return request(id)
+    end
+    local orphans = M.orphans()
+    if not orphans or #orphans == 0 then
+        vim.notify("pcc: no orphaned notes", vim.log.levels.INFO)
+        return
+    end
+    vim.ui.select(orphans, {
+        prompt = "Reattach to this line:",
+        format_item = function(o)
+            return string.format("(was line %d) %s", o.line + 1, table.concat(o.content, " "))
+        end,
+    }, function(o)
+        if o then
+            request(o.id)
+        end
+    end)
+end
+
+-- Anchors the note at the current line to a Go declaration, so that the note
+-- follows the declaration when code is moved around.  `anchor` is a qualified
+-- name such as "pkg.(*Server).Shutdown"; if nil, the declaration enclosing the
+-- current line is used.  An empty string removes the anchor.
+function M.anchor(anchor)
+    local buf_info = get_current_buf_info()
+    local client = find_client(buf_info.parent_buf)
+    if not client then
+        error(string.format("no pcc client for buf=%d", buf_info.parent_buf))
+        return
+    end
+    local r = client.request_sync(method_anchor, {
+        file = string.format("file://%s", buf_info.parent_buf_path),
+        line = buf_info.cursor_line,
+        anchor = anchor or "auto",
+    }, 5000, buf_info.parent_buf)
+    if not r or r.err or not r.result then
+        error(string.format("could not anchor: %s", vim.inspect(r)))
+        return
+    end
+    return r.result.anchor
+end
+
+-- Sends a request about the current buffer, and waits for its result.
+local function thread_request(method, params)
+    local buf_info = get_current_buf_info()
+    local client = find_client(buf_info.parent_buf)
+    if not client then
+        error(string.format("no pcc client for buf=%d", buf_info.parent_buf))
+        return
+    end
+    params.file = string.format("file://%s", buf_info.parent_buf_path)
+    if params.id == nil then
+        params.line = buf_info.cursor_line
+    end
+    local r = client.request_sync(method, params, 5000, buf_info.parent_buf)
+    if not r or r.err or not r.result then
+        error(string.format("%s failed: %s", method, vim.inspect(r)))
+        return
+    end
+    return r.result
+end
+
+-- Returns the thread of notes at the current line: a list of entries with
+-- `id`, `content` (a list of lines) and `created`.
+function M.thread()
+    return thread_request(method_thread_get, {}).entries
+end
+
+-- Appends a note to the thread at the current line.  `content` is a list of
+-- lines.  `kind` is optional: one of "note", "question", "todo", "warning" or
+-- "bug".  Returns the ID of the new note.
+function M.append(content, kind)
+    return thread_request(method_thread_append, { content = content, kind = kind }).id
+end
+
+-- Replaces the content of the note with the given ID in the current buffer.
+function M.edit_entry(id, content)
+    thread_request(method_thread_edit, { id = id, content = content })
+end
+
+-- Deletes the note with the given ID in the current buffer.
+function M.delete_entry(id)
+    thread_request(method_thread_delete, { id = id })
+end
+
+-- Returns the note with the given ID, wherever it is now: a table with `id`,
+-- `content`, `file`, `line` and the metadata of the note.
+function M.get_by_id(id)
+    return thread_request(method_get_by_id, { id = id }).note
+end
+
+-- Replaces the content of the note with the given ID, wherever it is now.
+-- `kind` is optional, as in `M.append`.  Returns the updated note.
+function M.update_by_id(id, content, kind)
+    return thread_request(method_update_by_id, { id = id, content = content, kind = kind }).note
+end
+
+-- Deletes the note with the given ID, wherever it is now.
+function M.delete_by_id(id)
+    thread_request(method_delete_by_id, { id = id })
+end
+
+-- Returns the revisions of the note with the given ID in the current buffer,
+-- oldest first.  Each has `id`, `content`, `revised` and `revised_by`.
+function M.history(id)
+    return thread_request(method_history, { id = id }).revisions
+end
+
+-- Returns the notes of the current buffer as they were at `time`, an RFC 3339
+-- timestamp such as "2024-01-31T12:00:00Z".
+function M.as_of(time)
+    return thread_request(method_as_of, { id = 0, time = time }).notes
+end
+
+-- Lists the deleted notes of the current buffer in the quickfix list, and
+-- returns them.  Each note has its `id`, for `restore`.
+function M.trash()
+    local notes = thread_request(method_trash, { id = 0 }).notes
+    local buf_info = get_current_buf_info()
+    local items = {}
+    for _, n in ipairs(notes) do
+        table.insert(items, {
+            bufnr = buf_info.parent_buf,
+            lnum = n.line + 1,
+            text = string.format("[id %d, deleted %s] %s", n.id, n.deleted,
+                table.concat(n.content, " ")),
+        })
+    end
+    vim.fn.setqflist(items, 'r')
+    return notes
+end
+
+-- Restores the deleted note with the given ID from the trash, to the line it
+-- was deleted from.
+function M.restore(id)
+    return thread_request(method_trash_restore, { id = id }).note
+end
+
+-- Lists the notes matching `filter` in the quickfix list, and returns them.
+-- `filter` is a table with the optional keys `file`, `workspace`, `author`,
+-- `tag`, `created_since`, `created_until`, `updated_since`, `updated_until` (RFC 3339
+-- times), `sort_by` ("location", "created", "updated" or "author") and `desc`.
+function M.list(filter)
+    local buf_info = get_current_buf_info()
+    local client = find_client(buf_info.parent_buf)
+    if not client then
+        error(string.format("no pcc client for buf=%d", buf_info.parent_buf))
+        return
+    end
+    local r = client.request_sync(method_list, filter or {}, 5000, buf_info.parent_buf)
+    if not r or r.err or not r.result then
+        error(string.format("could not list: %s", vim.inspect(r)))
+        return
+    end
+    local items = {}
+    for _, n in ipairs(r.result.notes) do
+        local item = {
+            lnum = n.line + 1,
+            text = string.format("[%s %s] %s", n.author or "", n.updated,
+                table.concat(n.content, " ")),
+        }
+        if n.file and n.file ~= "" then
+            item.filename = vim.uri_to_fname(n.file)
+        else
+            item.filename = n.workspace .. n.path
+        end
+        table.insert(items, item)
+    end
+    vim.fn.setqflist(items, 'r')
+    return r.result.notes
+end
+
+-- Searches the notes for the words of `query`, lists the matches in the
+-- quickfix list, best first, and returns them.  Each word matches the start
+-- of a word, ignoring case.  `opts` is a table with the optional keys
+-- `workspace`, `file` and `limit`.  Each result is a note, with a `snippet`
+-- of its content and the `matches` and `snippet_matches`, as `line`, `start`
+-- and `end` byte offsets.
+function M.search(query, opts)
+    local buf_info = get_current_buf_info()
+    local client = find_client(buf_info.parent_buf)
+    if not client then
+        error(string.format("no pcc client for buf=%d", buf_info.parent_buf))
+        return
+    end
+    local params = vim.tbl_extend('force', opts or {}, { query = query })
+    local r = client.request_sync(method_search, params, 5000, buf_info.parent_buf)
+    if not r or r.err or not r.result then
+        error(string.format("could not search: %s", vim.inspect(r)))
+        return
+    end
+    local items = {}
+    for _, n in ipairs(r.result.results) do
+        local item = {
+            lnum = n.line + 1,
+            text = n.snippet,
+        }
+        if n.file and n.file ~= "" then
+            item.filename = vim.uri_to_fname(n.file)
+        else
+            item.filename = n.workspace .. n.path
+        end
+        table.insert(items, item)
+    end
+    vim.fn.setqflist(items, 'r')
+    return r.result.results
+end
+
+-- Returns the note about the whole current file, as a list of lines.
+function M.file_note()
+    return thread_request(method_get, { scope = "file" }).content
+end
+
+-- Sets the note about the whole current file to `content`, a list of lines.
+-- An empty list deletes the note.
+function M.set_file_note(content)
+    thread_request(method_set, { scope = "file", content = content })
+end
+
+-- Returns the notes about the whole workspace of the current file: a list of
+-- entries as in `M.thread()`.
+function M.workspace_notes()
+    return thread_request(method_workspace_notes, {}).entries
+end
+
+-- Sets the note about the whole workspace of the current file to `content`, a
+-- list of lines.  An empty list deletes the note.
+function M.set_workspace_note(content)
+    thread_request(method_set, { scope = "workspace", content = content })
+end
+
+-- Returns the hashtags used in notes, as a list of `{ tag = ..., count = ... }`.
+-- If `workspace` is set, only the tags of that workspace are returned.
+function M.tags(workspace)
+    local buf_info = get_current_buf_info()
+    local client = find_client(buf_info.parent_buf)
+    if not client then
+        error(string.format("no pcc client for buf=%d", buf_info.parent_buf))
+        return
+    end
+    local r = client.request_sync(method_tags, { workspace = workspace }, 5000, buf_info.parent_buf)
+    if not r or r.err or not r.result then
+        error(string.format("could not get tags: %s", vim.inspect(r)))
+        return
+    end
+    return r.result.tags
+end
+
+-- Deletes the stored note text that no note refers to anymore.  Returns the
+-- number of deleted texts.
+function M.gc()
+    local buf_info = get_current_buf_info()
+    local client = find_client(buf_info.parent_buf)
+    if not client then
+        error(string.format("no pcc client for buf=%d", buf_info.parent_buf))
+        return
+    end
+    local r = client.request_sync(method_gc, {}, 5000, buf_info.parent_buf)
+    if not r or r.err or not r.result then
+        error(string.format("could not collect garbage: %s", vim.inspect(r)))
+        return
+    end
+    return r.result.removed
+end
+
 ---Returns the handler table for the custom methods. These are unused, but
 ---must be defined so that we can issue these calls to the server.
 function M.handlers()
@@ -353,6 +711,25 @@ function M.handlers()
     return {
         [method_get] = function() end,
         [method_set] = function() end,
+        [method_orphans] = function() end,
+        [method_reattach] = function() end,
+        [method_anchor] = function() end,
+        [method_get_by_id] = function() end,
+        [method_update_by_id] = function() end,
+        [method_delete_by_id] = function() end,
+        [method_thread_get] = function() end,
+        [method_thread_append] = function() end,
+        [method_thread_edit] = function() end,
+        [method_thread_delete] = function() end,
+        [method_list] = function() end,
+        [method_search] = function() end,
+        [method_tags] = function() end,
+        [method_history] = function() end,
+        [method_as_of] = function() end,
+        [method_trash] = function() end,
+        [method_trash_restore] = function() end,
+        [method_workspace_notes] = function() end,
+        [method_gc] = function() end,
     }
 end
 
@@ -367,12 +744,13 @@ function M.setup_server_with_lsp_config(opts, client_opts)
     local cfg = vim.tbl_deep_extend('force',
         {
             name = "pcc",
-            cmd = {
+            cmd = vim.list_extend({
                 M.config.pcc_binary,
                 '--log_dir=' .. M.config.log_dir,
                 '--v=' .. M.config.log_verbosity,
                 '--db=' .. M.config.db,
-            },
+                '--delete_policy=' .. M.config.delete_policy,
+            }, store_args()),
             root_dir = lspconfig.util.root_pattern(M.config.root_patterns),
             filetypes = M.config.filetypes,
             handlers = M.handlers(),